@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// API versions of the generated webhook configuration. v1beta1 is only served
+// by API servers before 1.22.
+const (
+	apiVersionV1      = "v1"
+	apiVersionV1beta1 = "v1beta1"
+)
+
+// webhookConfig returns a MutatingWebhookConfiguration or
+// ValidatingWebhookConfiguration of the v1 API as YAML of apiVersion, v1 or
+// v1beta1. The configuration is decoded strictly into the API types, so a
+// misspelled field or a webhook missing the sideEffects or
+// admissionReviewVersions the v1 API requires is an error.
+func webhookConfig(input []byte, apiVersion string) ([]byte, error) {
+	if apiVersion != apiVersionV1 && apiVersion != apiVersionV1beta1 {
+		return nil, fmt.Errorf("invalid webhook config api version %q, must be %s or %s", apiVersion, apiVersionV1, apiVersionV1beta1)
+	}
+	var typeMeta metav1.TypeMeta
+	if err := yaml.Unmarshal(input, &typeMeta); err != nil {
+		return nil, fmt.Errorf("error decoding the webhook config: %v", err)
+	}
+	if typeMeta.APIVersion != admissionregistrationv1.SchemeGroupVersion.String() {
+		return nil, fmt.Errorf("invalid webhook config apiVersion %q, must be %s", typeMeta.APIVersion, admissionregistrationv1.SchemeGroupVersion)
+	}
+
+	var config, betaConfig interface{}
+	switch typeMeta.Kind {
+	case "MutatingWebhookConfiguration":
+		mutating := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		if err := yaml.UnmarshalStrict(input, mutating); err != nil {
+			return nil, fmt.Errorf("error decoding the webhook config: %v", err)
+		}
+		if len(mutating.Webhooks) == 0 {
+			return nil, fmt.Errorf("webhook config %s has no webhooks", mutating.Name)
+		}
+		for _, webhook := range mutating.Webhooks {
+			if err := validateWebhook(webhook.Name, webhook.SideEffects, webhook.AdmissionReviewVersions); err != nil {
+				return nil, err
+			}
+		}
+		config, betaConfig = mutating, &admissionregistrationv1beta1.MutatingWebhookConfiguration{}
+	case "ValidatingWebhookConfiguration":
+		validating := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		if err := yaml.UnmarshalStrict(input, validating); err != nil {
+			return nil, fmt.Errorf("error decoding the webhook config: %v", err)
+		}
+		if len(validating.Webhooks) == 0 {
+			return nil, fmt.Errorf("webhook config %s has no webhooks", validating.Name)
+		}
+		for _, webhook := range validating.Webhooks {
+			if err := validateWebhook(webhook.Name, webhook.SideEffects, webhook.AdmissionReviewVersions); err != nil {
+				return nil, err
+			}
+		}
+		config, betaConfig = validating, &admissionregistrationv1beta1.ValidatingWebhookConfiguration{}
+	default:
+		return nil, fmt.Errorf("invalid webhook config kind %q, must be MutatingWebhookConfiguration or ValidatingWebhookConfiguration", typeMeta.Kind)
+	}
+	if apiVersion == apiVersionV1 {
+		return yaml.Marshal(config)
+	}
+
+	// The webhooks of v1beta1 have the fields of v1, so the configuration is
+	// converted through JSON, failing on a field v1beta1 doesn't have
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(betaConfig); err != nil {
+		return nil, fmt.Errorf("error converting the webhook config to %s: %v", admissionregistrationv1beta1.SchemeGroupVersion, err)
+	}
+	switch beta := betaConfig.(type) {
+	case *admissionregistrationv1beta1.MutatingWebhookConfiguration:
+		beta.APIVersion = admissionregistrationv1beta1.SchemeGroupVersion.String()
+	case *admissionregistrationv1beta1.ValidatingWebhookConfiguration:
+		beta.APIVersion = admissionregistrationv1beta1.SchemeGroupVersion.String()
+	}
+	return yaml.Marshal(betaConfig)
+}
+
+// validateWebhook returns an error if a webhook is missing a field the v1 API
+// requires
+func validateWebhook(name string, sideEffects *admissionregistrationv1.SideEffectClass, admissionReviewVersions []string) error {
+	if sideEffects == nil || (*sideEffects != admissionregistrationv1.SideEffectClassNone && *sideEffects != admissionregistrationv1.SideEffectClassNoneOnDryRun) {
+		return fmt.Errorf("webhook %s requires sideEffects None or NoneOnDryRun", name)
+	}
+	if len(admissionReviewVersions) == 0 {
+		return fmt.Errorf("webhook %s requires admissionReviewVersions", name)
+	}
+	return nil
+}
+
+func main() {
+	apiVersion := flag.String("api-version", apiVersionV1, "The API version of the generated webhook config, v1 or v1beta1 for API servers before 1.22")
+	flag.Parse()
+
+	input, err := io.ReadAll(os.Stdin)
+	if err == nil {
+		input, err = webhookConfig(input, *apiVersion)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	os.Stdout.Write(input)
+}
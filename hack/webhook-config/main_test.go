@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// renderTemplate returns a webhook configuration template of deploy with the
+// variables of hack/webhook-patch-ca-bundle.sh set
+func renderTemplate(t *testing.T, name string) []byte {
+	t.Helper()
+	return renderTemplateWith(t, name, nil)
+}
+
+// renderTemplateWith renders a template like renderTemplate, with overrides
+// of the variables
+func renderTemplateWith(t *testing.T, name string, overrides map[string]string) []byte {
+	t.Helper()
+	template, err := os.ReadFile(filepath.Join("..", "..", "deploy", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{
+		"CA_BUNDLE":               "Y2EK",
+		"MUTATE_PATH":             "/mutate",
+		"FAILURE_POLICY":          "Ignore",
+		"REINVOCATION_POLICY":     "IfNeeded",
+		"WEBHOOK_TIMEOUT_SECONDS": "10",
+		"NAMESPACE_SELECTOR":      `{"matchExpressions":[{"key":"kubernetes.io/metadata.name","operator":"NotIn","values":["kube-system"]}]}`,
+		"OBJECT_SELECTOR":         "{}",
+	}
+	for key, value := range overrides {
+		values[key] = value
+	}
+	return []byte(os.Expand(string(template), func(key string) string { return values[key] }))
+}
+
+func TestWebhookConfigGolden(t *testing.T) {
+	for _, template := range []string{"mutatingwebhook.yaml", "validatingwebhook.yaml"} {
+		for _, apiVersion := range []string{apiVersionV1, apiVersionV1beta1} {
+			golden := filepath.Join("testdata", strings.TrimSuffix(template, ".yaml")+"-"+apiVersion+".yaml")
+			t.Run(golden, func(t *testing.T) {
+				output, err := webhookConfig(renderTemplate(t, template), apiVersion)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *update {
+					if err := os.WriteFile(golden, output, 0644); err != nil {
+						t.Fatalf("Error writing golden file: %v", err)
+					}
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("Error reading golden file: %v", err)
+				}
+				if string(output) != string(want) {
+					t.Errorf("Expected\n%s\ngot\n%s", want, output)
+				}
+
+				// The output is regenerated unchanged from the API types
+				if apiVersion == apiVersionV1 {
+					regenerated, err := webhookConfig(output, apiVersion)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(regenerated) != string(output) {
+						t.Errorf("Expected the config to round-trip, got\n%s", regenerated)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWebhookConfigFields(t *testing.T) {
+	output, err := webhookConfig(renderTemplateWith(t, "mutatingwebhook.yaml", map[string]string{
+		"MUTATE_PATH":             "/mutate/v2",
+		"FAILURE_POLICY":          "Fail",
+		"REINVOCATION_POLICY":     "Never",
+		"WEBHOOK_TIMEOUT_SECONDS": "30",
+		"OBJECT_SELECTOR":         `{"matchLabels":{"irsa":"true"}}`,
+	}), apiVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config admissionregistrationv1.MutatingWebhookConfiguration
+	if err := yaml.UnmarshalStrict(output, &config); err != nil {
+		t.Fatalf("Can't unmarshal %s: %v", output, err)
+	}
+
+	path := "/mutate/v2"
+	failurePolicy := admissionregistrationv1.Fail
+	reinvocationPolicy := admissionregistrationv1.NeverReinvocationPolicy
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	timeout := int32(30)
+	expected := admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "MutatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook", Namespace: "default"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: "pod-identity-webhook.amazonaws.com",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: "default",
+					Name:      "pod-identity-webhook",
+					Path:      &path,
+				},
+				CABundle: []byte("ca\n"),
+			},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"pods"},
+				},
+			}},
+			FailurePolicy: &failurePolicy,
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      "kubernetes.io/metadata.name",
+					Operator: metav1.LabelSelectorOpNotIn,
+					Values:   []string{"kube-system"},
+				}},
+			},
+			ObjectSelector:          &metav1.LabelSelector{MatchLabels: map[string]string{"irsa": "true"}},
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeout,
+			AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			ReinvocationPolicy:      &reinvocationPolicy,
+		}},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected config\n%+v\ngot\n%+v", expected, config)
+	}
+}
+
+func TestWebhookConfigV1beta1(t *testing.T) {
+	output, err := webhookConfig(renderTemplate(t, "mutatingwebhook.yaml"), apiVersionV1beta1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config admissionregistrationv1beta1.MutatingWebhookConfiguration
+	if err := yaml.UnmarshalStrict(output, &config); err != nil {
+		t.Fatalf("Can't unmarshal %s: %v", output, err)
+	}
+	webhook := config.Webhooks[0]
+	if config.APIVersion != "admissionregistration.k8s.io/v1beta1" || webhook.SideEffects == nil || *webhook.SideEffects != admissionregistrationv1beta1.SideEffectClassNone {
+		t.Errorf("Expected a v1beta1 config with sideEffects None, got %s", output)
+	}
+	if string(webhook.ClientConfig.CABundle) != "ca\n" || webhook.ClientConfig.Service == nil || *webhook.ClientConfig.Service.Path != "/mutate" {
+		t.Errorf("Expected the clientConfig of the template, got %+v", webhook.ClientConfig)
+	}
+}
+
+func TestWebhookConfigInvalid(t *testing.T) {
+	valid := string(renderTemplate(t, "mutatingwebhook.yaml"))
+	cases := []struct {
+		caseName   string
+		config     string
+		apiVersion string
+		err        string
+	}{
+		{"APIVersion", valid, "v2", "invalid webhook config api version"},
+		{"BetaTemplate", strings.Replace(valid, "admissionregistration.k8s.io/v1", "admissionregistration.k8s.io/v1beta1", 1), apiVersionV1, "must be admissionregistration.k8s.io/v1"},
+		{"Kind", strings.Replace(valid, "MutatingWebhookConfiguration", "ConfigMap", 1), apiVersionV1, "invalid webhook config kind"},
+		{"UnknownField", strings.Replace(valid, "sideEffects:", "sideEffect:", 1), apiVersionV1, "unknown field"},
+		{"WithoutSideEffects", strings.Replace(valid, "  sideEffects: None\n", "", 1), apiVersionV1, "requires sideEffects"},
+		{"SideEffectsUnknown", strings.Replace(valid, "sideEffects: None", "sideEffects: Unknown", 1), apiVersionV1beta1, "requires sideEffects"},
+		{"WithoutReviewVersions", strings.Replace(valid, `  admissionReviewVersions: ["v1", "v1beta1"]`+"\n", "", 1), apiVersionV1, "requires admissionReviewVersions"},
+		{"WithoutWebhooks", "apiVersion: admissionregistration.k8s.io/v1\nkind: MutatingWebhookConfiguration\n", apiVersionV1, "has no webhooks"},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			_, err := webhookConfig([]byte(c.config), c.apiVersion)
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("Expected an error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
@@ -7,13 +7,114 @@ set -o errexit
 set -o nounset
 set -o pipefail
 
-secret_name=$(kubectl get sa default -o jsonpath='{.secrets[0].name}')
+# The mutate path of the webhook configuration, /mutate or /mutate/v2
+export MUTATE_PATH=${MUTATE_PATH:-/mutate}
+export FAILURE_POLICY=${FAILURE_POLICY:-Ignore}
+export REINVOCATION_POLICY=${REINVOCATION_POLICY:-IfNeeded}
+export WEBHOOK_TIMEOUT_SECONDS=${WEBHOOK_TIMEOUT_SECONDS:-10}
+# Label selectors of the namespaces and pods the API server sends to the
+# webhook, empty selectors match everything
+WEBHOOK_NAMESPACE_SELECTOR=${WEBHOOK_NAMESPACE_SELECTOR:-}
+WEBHOOK_OBJECT_SELECTOR=${WEBHOOK_OBJECT_SELECTOR:-}
+# The CA bundle file written by the webhook with --patch-webhook-ca out of
+# cluster, the CA of the default Service Account token otherwise
+CA_BUNDLE_FILE=${CA_BUNDLE_FILE:-}
+# The https URL the API server calls the webhook at out of cluster, eg. an
+# address of --self-signed-hosts, the Service otherwise. The path of each
+# webhook is appended to it.
+WEBHOOK_URL=${WEBHOOK_URL:-}
+# The API version of the generated configuration, v1beta1 for API servers
+# before 1.22
+WEBHOOK_CONFIG_API_VERSION=${WEBHOOK_CONFIG_API_VERSION:-v1}
 
+while [[ $# -gt 0 ]]; do
+    case "$1" in
+        --mutate-path) MUTATE_PATH="$2"; shift 2 ;;
+        --failure-policy|--webhook-failure-policy) FAILURE_POLICY="$2"; shift 2 ;;
+        --reinvocation-policy) REINVOCATION_POLICY="$2"; shift 2 ;;
+        --webhook-timeout-seconds) WEBHOOK_TIMEOUT_SECONDS="$2"; shift 2 ;;
+        --webhook-namespace-selector) WEBHOOK_NAMESPACE_SELECTOR="$2"; shift 2 ;;
+        --webhook-object-selector) WEBHOOK_OBJECT_SELECTOR="$2"; shift 2 ;;
+        --ca-bundle-file) CA_BUNDLE_FILE="$2"; shift 2 ;;
+        --webhook-url) WEBHOOK_URL="$2"; shift 2 ;;
+        --webhook-config-api-version) WEBHOOK_CONFIG_API_VERSION="$2"; shift 2 ;;
+        *) echo "Unknown flag $1" >&2; exit 1 ;;
+    esac
+done
 
-export CA_BUNDLE=$(kubectl get secret/$secret_name -o jsonpath='{.data.ca\.crt}' | tr -d '\n')
+case "${WEBHOOK_CONFIG_API_VERSION}" in
+    v1|v1beta1) ;;
+    *) echo "Invalid webhook config API version ${WEBHOOK_CONFIG_API_VERSION}, must be v1 or v1beta1" >&2; exit 1 ;;
+esac
+case "${FAILURE_POLICY}" in
+    Ignore|Fail) ;;
+    *) echo "Invalid failure policy ${FAILURE_POLICY}, must be Ignore or Fail" >&2; exit 1 ;;
+esac
+case "${REINVOCATION_POLICY}" in
+    IfNeeded|Never) ;;
+    *) echo "Invalid reinvocation policy ${REINVOCATION_POLICY}, must be IfNeeded or Never" >&2; exit 1 ;;
+esac
+# The API server accepts timeouts between 1 and 30 seconds
+if ! [[ "${WEBHOOK_TIMEOUT_SECONDS}" =~ ^[0-9]+$ ]] || [ "${WEBHOOK_TIMEOUT_SECONDS}" -lt 1 ] || [ "${WEBHOOK_TIMEOUT_SECONDS}" -gt 30 ]; then
+    echo "Invalid webhook timeout ${WEBHOOK_TIMEOUT_SECONDS}, must be between 1 and 30 seconds" >&2
+    exit 1
+fi
+
+# The API server requires https URLs without a query or fragment
+if [ -n "${WEBHOOK_URL}" ] && ! [[ "${WEBHOOK_URL}" =~ ^https://[^/?#]+(/[^?#]*)?$ ]]; then
+    echo "Invalid webhook URL ${WEBHOOK_URL}, must be an https URL without a query" >&2
+    exit 1
+fi
+WEBHOOK_URL=${WEBHOOK_URL%/}
+
+# The selectors are converted to single line JSON, which is valid YAML
+NAMESPACE_SELECTOR=$(cd $(dirname $0)/.. && go run ./hack/webhook-selector --selector "${WEBHOOK_NAMESPACE_SELECTOR}")
+OBJECT_SELECTOR=$(cd $(dirname $0)/.. && go run ./hack/webhook-selector --selector "${WEBHOOK_OBJECT_SELECTOR}")
+export NAMESPACE_SELECTOR OBJECT_SELECTOR
 
-if command -v envsubst >/dev/null 2>&1; then
-    envsubst
+if [ -n "${CA_BUNDLE_FILE}" ]; then
+    export CA_BUNDLE=$(base64 < "${CA_BUNDLE_FILE}" | tr -d '\n')
 else
-    sed -e "s|\${CA_BUNDLE}|${CA_BUNDLE}|g"
+    secret_name=$(kubectl get sa default -o jsonpath='{.secrets[0].name}')
+    export CA_BUNDLE=$(kubectl get secret/$secret_name -o jsonpath='{.data.ca\.crt}' | tr -d '\n')
 fi
+
+render() {
+    if command -v envsubst >/dev/null 2>&1; then
+        envsubst
+    else
+        sed -e "s|\${CA_BUNDLE}|${CA_BUNDLE}|g" \
+            -e "s|\${MUTATE_PATH}|${MUTATE_PATH}|g" \
+            -e "s|\${FAILURE_POLICY}|${FAILURE_POLICY}|g" \
+            -e "s|\${REINVOCATION_POLICY}|${REINVOCATION_POLICY}|g" \
+            -e "s|\${WEBHOOK_TIMEOUT_SECONDS}|${WEBHOOK_TIMEOUT_SECONDS}|g" \
+            -e "s|\${NAMESPACE_SELECTOR}|${NAMESPACE_SELECTOR}|g" \
+            -e "s|\${OBJECT_SELECTOR}|${OBJECT_SELECTOR}|g"
+    fi
+}
+
+# With a webhook URL, the service block of the clientConfig is replaced by
+# the URL and the path of the service, eg. the mutate path of the mutating
+# webhook and /validate of the validating webhook
+generate() {
+    if [ -n "${WEBHOOK_URL}" ]; then
+        render | awk -v url="${WEBHOOK_URL}" '
+            function flush() {
+                if (skip) { printf "%*surl: \"%s%s\"\n", indent, "", url, path; skip = 0 }
+            }
+            skip && match($0, /^ */) && RLENGTH > indent {
+                if ($0 ~ /^ *path:/) { path = $0; sub(/^ *path: */, "", path); gsub(/"/, "", path) }
+                next
+            }
+            { flush() }
+            /^ *service:$/ { indent = index($0, "s") - 1; skip = 1; path = ""; next }
+            { print }
+            END { flush() }'
+    else
+        render
+    fi
+}
+
+# The configuration is decoded into the API types, failing on invalid
+# fields, and written in the API version
+generate | (cd $(dirname $0)/.. && go run ./hack/webhook-config --api-version "${WEBHOOK_CONFIG_API_VERSION}")
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// selectorJSON returns the label selector syntax of selector, eg.
+// "tier notin (system),!skip", as a metav1.LabelSelector on a single JSON
+// line, which is valid YAML in a webhook configuration. An empty selector
+// returns {}, which matches everything.
+func selectorJSON(selector string) (string, error) {
+	labelSelector, err := metav1.ParseToLabelSelector(selector)
+	if err != nil {
+		return "", fmt.Errorf("invalid label selector %q: %v", selector, err)
+	}
+	output, err := json.Marshal(labelSelector)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+func main() {
+	selector := flag.String("selector", "", "The label selector, eg. kubernetes.io/metadata.name notin (kube-system)")
+	flag.Parse()
+
+	output, err := selectorJSON(*selector)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(output)
+}
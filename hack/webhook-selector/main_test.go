@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestSelectorJSON(t *testing.T) {
+	cases := []struct {
+		caseName    string
+		selector    string
+		expected    string
+		expectedErr bool
+	}{
+		{"Empty", "", "", false},
+		{"Equality", "app=web", "app=web", false},
+		{"NotIn", "kubernetes.io/metadata.name notin (kube-system,kube-public)", "kubernetes.io/metadata.name notin (kube-public,kube-system)", false},
+		{"DoesNotExist", "!irsa.example.com/skip", "!irsa.example.com/skip", false},
+		{"Combined", "tier in (web),!irsa.example.com/skip", "!irsa.example.com/skip,tier in (web)", false},
+		{"Invalid", "tier in web", "", true},
+		{"InvalidKey", "-tier=web", "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			output, err := selectorJSON(c.selector)
+			if (err != nil) != c.expectedErr {
+				t.Fatalf("Expected error %v, got %v", c.expectedErr, err)
+			}
+			if c.expectedErr {
+				return
+			}
+
+			// The selectors are embedded in the YAML of a webhook
+			// configuration
+			config := "webhooks:\n- name: pod-identity-webhook.amazonaws.com\n" +
+				"  namespaceSelector: " + output + "\n" +
+				"  objectSelector: " + output + "\n"
+			var webhookConfig admissionregistrationv1.MutatingWebhookConfiguration
+			if err := yaml.UnmarshalStrict([]byte(config), &webhookConfig); err != nil {
+				t.Fatalf("Can't unmarshal %q: %v", config, err)
+			}
+			webhook := webhookConfig.Webhooks[0]
+			for name, labelSelector := range map[string]*metav1.LabelSelector{
+				"namespaceSelector": webhook.NamespaceSelector,
+				"objectSelector":    webhook.ObjectSelector,
+			} {
+				selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+				if err != nil {
+					t.Fatalf("Can't convert the %s: %v", name, err)
+				}
+				if selector.String() != c.expected {
+					t.Errorf("Expected %s %q, got %q", name, c.expected, selector.String())
+				}
+			}
+		})
+	}
+}
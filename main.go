@@ -16,13 +16,12 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
+	"context"
 	goflag "flag"
 	"fmt"
 	"net/http"
 	"os"
+	"text/template"
 	"time"
 
 	"github.com/aws/amazon-eks-pod-identity-webhook/pkg/cache"
@@ -30,7 +29,9 @@ import (
 	"github.com/aws/amazon-eks-pod-identity-webhook/pkg/handler"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	flag "github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 )
@@ -39,7 +40,9 @@ var webhookVersion = "v0.1.0"
 
 func main() {
 	port := flag.Int("port", 443, "Port to listen on")
-	metricsPort := flag.Int("metrics-port", 9999, "Port to listen on for metrics and healthz (http)")
+	evictDeletedNamespaces := flag.Bool("evict-deleted-namespaces", true, "Watch namespaces and evict the cached Service Accounts and metric series of deleted namespaces")
+	metricsNamespaceLabels := flag.Bool("metrics-namespace-labels", true, "Export the number of cached Service Accounts of each namespace, disable it in clusters with many namespaces")
+	metricsPort := flag.Int("metrics-port", 9999, "Port to listen on for metrics, healthz, and readyz (http)")
 
 	// TODO Group in help text in-cluster/out-of-cluster/business logic flags
 	// out-of-cluster kubeconfig / TLS options
@@ -49,20 +52,93 @@ func main() {
 	apiURL := flag.String("kube-api", "", "(out-of-cluster) The url to the API server")
 	tlsKeyFile := flag.String("tls-key", "/etc/webhook/certs/tls.key", "(out-of-cluster) TLS key file path")
 	tlsCertFile := flag.String("tls-cert", "/etc/webhook/certs/tls.cert", "(out-of-cluster) TLS certificate file path")
+	certSource := flag.String("cert-source", "", "Where the serving certificate comes from: csr requests it with a CSR and stores it in tls-secret, files reads tls-cert-file and tls-key-file, secret reads tls-secret managed by another system, selfsigned generates one. Defaults to files with tls-cert-file, csr in-cluster, and the tls-cert and tls-key files out-of-cluster")
+	servingCertFile := flag.String("tls-cert-file", "", "A TLS certificate file served instead of a certificate requested with a CSR or read from tls-cert, eg. provisioned by cert-manager. It is reloaded when it changes, requires tls-key-file")
+	servingKeyFile := flag.String("tls-key-file", "", "The TLS key file of tls-cert-file, reloaded when it changes")
+	tlsKeyType := flag.String("tls-key-type", cert.DefaultKeyType, "The type of the keys generated for the csr and selfsigned certificate sources, one of rsa-2048, rsa-4096, or ecdsa-p256")
+	tlsMinVersion := flag.String("tls-min-version", cert.DefaultTLSMinVersion, "The minimum TLS version of the webhook server, one of 1.0, 1.1, 1.2, or 1.3")
+	tlsCipherSuites := flag.StringSlice("tls-cipher-suites", nil, "The IANA names of the cipher suites of the webhook server for TLS 1.2 and earlier, eg. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Defaults to the suites of Go")
+	selfSignedHosts := flag.StringSlice("self-signed-hosts", nil, "The DNS names and IPs of the certificate of the selfsigned certificate source, eg. the address the API server reaches the webhook at out-of-cluster. The common name is the first DNS name. Defaults to the DNS names of service-name")
 
 	// in-cluster TLS options
 	inCluster := flag.Bool("in-cluster", true, "Use in-cluster authentication and certificate request API")
 	serviceName := flag.String("service-name", "pod-identity-webhook", "(in-cluster) The service name fronting this webhook")
 	namespaceName := flag.String("namespace", "eks", "(in-cluster) The namespace name this webhook and the tls secret resides in")
 	tlsSecret := flag.String("tls-secret", "pod-identity-webhook", "(in-cluster) The secret name for storing the TLS serving cert")
+	csrSignerName := flag.String("csr-signer-name", cert.DefaultSignerName, "(in-cluster) The signer name of the CSRs of the serving certificate, approved by the signer of the cluster")
+	csrDNSNames := flag.StringSlice("csr-dns-names", nil, "(in-cluster) The DNS SANs of the CSRs of the serving certificate. Defaults to service-name, service-name.namespace, and the .svc and .svc.cluster.local names of the Service, an empty value requests none")
+	csrIPSANs := flag.StringSlice("csr-ip-sans", nil, "(in-cluster) The IP SANs of the CSRs of the serving certificate, eg. the cluster IP of the Service")
+	rotateBefore := flag.Duration("rotate-before", 0, "(in-cluster) Renew the serving certificate requested with a CSR this long before it expires, eg. 720h. 0 renews it at 70-90% of its lifetime")
+	leaderElect := flag.Bool("leader-elect", false, "(in-cluster) Elect a leader among the replicas with the csr certificate source, only the leader creates CSRs and updates tls-secret, the other replicas serve tls-secret")
+	leaderElectLeaseName := flag.String("leader-elect-lease-name", cert.DefaultLeaseName, "(in-cluster) The name of the Lease of leader-elect in namespace")
+	webhookConfigName := flag.String("webhook-config-name", "pod-identity-webhook", "(in-cluster) The name of the MutatingWebhookConfiguration calling this webhook")
+	webhookFailurePolicy := flag.String("webhook-failure-policy", handler.FailurePolicyIgnore, "(in-cluster) The failurePolicy the MutatingWebhookConfiguration is expected to have, one of Ignore or Fail. A different live policy is logged at startup. Mutation requests failing with an internal error are admitted unchanged with Ignore and denied with Fail")
+	patchWebhookCA := flag.Bool("patch-webhook-ca", false, "Keep the caBundle of the webhooks of webhook-config-name set to the CA of the serving certificate, applied when either changes. Out-of-cluster, the CA is written to webhook-ca-bundle-file and webhook-config-file instead")
+	webhookCABundleFile := flag.String("webhook-ca-bundle-file", "", "(out-of-cluster) The file patch-webhook-ca writes the CA of the serving certificate to, eg. for hack/webhook-patch-ca-bundle.sh --ca-bundle-file")
+	webhookConfigFile := flag.String("webhook-config-file", "", "(out-of-cluster) The webhook configuration generated by hack/webhook-patch-ca-bundle.sh that patch-webhook-ca regenerates with the CA of the serving certificate when it changes")
 
 	// annotation/volume configurations
-	annotationPrefix := flag.String("annotation-prefix", "eks.amazonaws.com", "The Service Account annotation to look for")
+	annotationPrefixes := flag.StringSlice("annotation-prefix", []string{"eks.amazonaws.com"}, "The Service Account annotation to look for. Later prefixes of a comma-separated list are deprecated, and only honored for Service Accounts without a role annotated with an earlier prefix, eg. while migrating annotations")
+	cacheResyncPeriod := flag.Duration("cache-resync-period", cache.DefaultResyncPeriod, "How often the informers of the caches resync, 0 disables resyncs")
+	watchBackoffMax := flag.Duration("watch-backoff-max", cache.DefaultWatchBackoffMax, "The maximum wait before an informer relists after watch errors, eg. while the API server is upgraded")
+	cachePrewarm := flag.Bool("cache-prewarm", false, "List the Service Accounts page by page before starting the informer, so the cache is populated and ready sooner in large clusters")
+	cachePrewarmPageSize := flag.Int64("cache-prewarm-page-size", cache.DefaultPrewarmPageSize, "The number of Service Accounts listed per page by cache-prewarm")
+	cacheSyncTimeout := flag.Duration("cache-sync-timeout", 30*time.Second, "How long to wait at startup for the Service Account cache to sync before serving, Service Accounts that aren't cached yet are fetched from the API server")
+	lenientBooleanAnnotations := flag.Bool("lenient-boolean-annotations", false, "Accept yes, no, on, and off values of boolean annotations, besides true and false")
 	audience := flag.String("token-audience", "sts.amazonaws.com", "The default audience for tokens. Can be overridden by annotation")
 	mountPath := flag.String("token-mount-path", "/var/run/secrets/eks.amazonaws.com/serviceaccount", "The path to mount tokens")
+	windowsMountPath := flag.String("windows-token-mount-path", "", "The path windows pods mount tokens at, eg. C:\\var\\run\\secrets\\eks.amazonaws.com\\serviceaccount. Defaults to the token-mount-path on the C: drive")
 	tokenExpiration := flag.Int64("token-expiration", 86400, "The token expiration")
+	minTokenExpiration := flag.Int64("min-token-expiration", 600, "The minimum token expiration, token expirations are clamped to this value")
+	maxTokenExpiration := flag.Int64("max-token-expiration", 86400, "The maximum token expiration, token expirations are clamped to this value")
+	allowPodOverride := flag.Bool("allow-pod-annotation-override", false, "Allow the role-arn annotation on a pod to override the role of its Service Account")
+	enableNamespaceDefaults := flag.Bool("enable-namespace-defaults", false, "Use the default-role-arn and default-audience annotations of a namespace for Service Accounts without a role or audience")
+	enableNamespaceRoleAllowlist := flag.Bool("enable-namespace-role-allowlist", false, "Only inject roles matching the allowed-role-arns annotation of a namespace into its pods")
+	denyOnDeletedSA := flag.Bool("deny-on-deleted-sa", false, "Deny pods whose Service Account doesn't exist, eg. because it was deleted along with its role, instead of admitting them without injection")
+	denyOnPolicyViolation := flag.Bool("deny-on-policy-violation", false, "Deny pods whose role is not allowed by their namespace instead of admitting them without injection")
+	maxRequestBytes := flag.Int64("max-request-bytes", handler.DefaultMaxRequestBytes, "The size limit of admission request bodies, larger requests are rejected")
+	saLookupTimeout := flag.Duration("sa-lookup-timeout", cache.DefaultLookupTimeout, "The deadline of API server lookups of Service Accounts missing the cache. 0 disables the deadline")
+	saNotFoundRetryDelay := flag.Duration("sa-not-found-retry-delay", 0, "If set, how long to wait before looking up a Service Account that wasn't found once more, for pods created along with their Service Account")
+	fallbackQPS := flag.Float32("fallback-qps", cache.DefaultFallbackQPS, "The rate of API server lookups of Service Accounts missing the cache, lookups over the rate fail per sa-lookup-failure-policy instead of queueing. 0 disables the limit")
+	fallbackBurst := flag.Int("fallback-burst", cache.DefaultFallbackBurst, "The burst of API server lookups of Service Accounts missing the cache allowed over fallback-qps")
+	saNegativeCacheTTL := flag.Duration("sa-negative-cache-ttl", cache.DefaultNegativeCacheTTL, "How long Service Accounts fetched from the API server without annotations are cached, so their pods don't look them up again. 0 disables the negative cache")
+	saMappingFile := flag.String("sa-mapping-file", "", "A YAML or JSON file mapping namespace/name Service Account keys to a roleARN, audience, tokenExpiration, and regionalSTSEndpoints, reloaded when it changes, eg. for out-of-cluster development")
+	saMappingFileMode := flag.String("sa-mapping-file-mode", cache.MappingFileModeFallback, "Whether the sa-mapping-file settings of a Service Account override its annotations or are only used for Service Accounts that don't exist, one of override or fallback")
+	internalTimeout := flag.Duration("internal-timeout", handler.DefaultInternalTimeout, "The deadline of admission requests, including their Service Account lookups. Set it below the timeoutSeconds of the webhook, 0 disables the deadline")
+	saLookupFailurePolicy := flag.String("sa-lookup-failure-policy", handler.SALookupFailurePolicyAllow, "What to do with pods whose Service Account can't be looked up: allow them without injection, retry the lookup, or deny them, one of allow, retry, or deny")
+	validationMode := flag.String("validation-mode", handler.ValidationModeDeny, "Whether the /validate endpoint denies Service Accounts with invalid annotations or admits them with warnings, one of deny or warn")
+	mutateEphemeralContainers := flag.Bool("mutate-ephemeral-containers", false, "Inject ephemeral containers added to pods through the pods/ephemeralcontainers subresource, eg. by kubectl debug")
+	defaultsConfigMap := flag.String("defaults-configmap", "", "A namespace/name ConfigMap overriding the token-audience, token-expiration, token-mount-path, and regional STS defaults at runtime")
+	watchedConfigMap := flag.String("watched-configmap", "", "A namespace/name ConfigMap mapping Service Accounts to roles, used for Service Accounts without a role annotation")
+	stsEndpoint := flag.String("sts-endpoint-url", "", "If set, AWS_ENDPOINT_URL_STS will be set to this value in mutated containers. Can be overridden by annotation")
+	allowInsecureSTSEndpoint := flag.Bool("allow-insecure-sts-endpoint", false, "Allow http STS endpoint URLs")
+	excludePodSelector := flag.String("exclude-pod-selector", "", "A label selector of pods that are never mutated, eg. irsa.example.com/inject=false")
+	saLabelSelector := flag.String("sa-label-selector", "", "If set, only cache the Service Accounts matching this label selector, other Service Accounts are fetched from the API server for each pod")
+	watchNamespaces := flag.StringSlice("watch-namespaces", nil, "If set, only cache the Service Accounts of these namespaces, Service Accounts of other namespaces are fetched from the API server for each pod")
+	skipOwnerKinds := flag.StringSlice("skip-owner-kinds", nil, "Owner kinds, eg. DaemonSet,Job, whose pods are never mutated")
+	skipNamespaces := flag.StringSlice("skip-namespaces", []string{"kube-system", "kube-public"}, "Namespaces, or glob patterns like kube-*, whose pods are never mutated")
+	allowedPartitions := flag.StringSlice("allowed-partitions", handler.DefaultPartitions, "The AWS partitions role ARNs are accepted in")
+	roleARNTemplate := flag.String("role-arn-template", "", "A Go template building role ARNs from role names, eg. arn:aws:iam::{{.AccountID}}:role/{{.Namespace}}-{{.ServiceAccount}}")
+	accountID := flag.String("account-id", "", "The AWS account ID role ARN templates are rendered with")
+	containerCredentialsURI := flag.String("container-credentials-full-uri", handler.DefaultContainerCredentialsURI, "The credentials agent URI injected into pods of Service Accounts with the credential-mode: container annotation. Empty disables container credentials")
+	containerCredentialsAudience := flag.String("container-credentials-audience", handler.DefaultContainerCredentialsAudience, "The token audience of pods using container credentials")
+	tokenVolumeName := flag.String("token-volume-name", "aws-iam-token", "The name of the injected token volume, suffixed with -irsa if the pod has a different volume with the name")
+	tokenFileMode := flag.String("token-file-mode", "", "If set, the octal file mode of the token, eg. 0400. Can be overridden by annotation")
+	defaultFSGroup := flag.Int64("default-fs-group", -1, "If non-negative, the fsGroup set on mutated pods without one so non-root containers can read the token")
+	regionalSTS := flag.Bool("sts-regional-endpoint", false, "Whether to inject AWS_STS_REGIONAL_ENDPOINTS=regional into mutated containers by default. Can be overridden by annotation")
+	disableIMDSFallback := flag.Bool("disable-imds-fallback", false, "Whether to inject AWS_EC2_METADATA_DISABLED=true into mutated containers so SDKs don't fall back to the node role. Can be overridden by annotation")
+	annotatePods := flag.Bool("annotate-pods", false, "Annotate mutated pods with the injected-role-arn and injected-audience annotations")
+	respectAutomountDisabled := flag.Bool("respect-automount-disabled", false, "Don't inject a token into pods with automountServiceAccountToken disabled on the pod or its Service Account, only the role env vars")
+	audienceOnlyInjection := flag.Bool("enable-audience-only-injection", false, "Inject a token, without the AWS env vars, into pods of Service Accounts with an audience annotation but no role")
+	tokenEnvName := flag.String("token-env-name", handler.DefaultTokenEnvName, "The env var pointing at the token of audience only injections")
 	region := flag.String("aws-default-region", "", "If set, AWS_DEFAULT_REGION and AWS_REGION will be set to this value in mutated containers")
 
+	// versioned mutate path configurations
+	enableMutateV2 := flag.Bool("enable-mutate-v2", false, "Serve /mutate/v2, which mutates pods with the v2 defaults while /mutate keeps the defaults above")
+	v2RegionalSTS := flag.Bool("v2-sts-regional-endpoint", true, "Whether /mutate/v2 injects AWS_STS_REGIONAL_ENDPOINTS=regional into mutated containers by default. Can be overridden by annotation")
+	v2DisableIMDSFallback := flag.Bool("v2-disable-imds-fallback", false, "Whether /mutate/v2 injects AWS_EC2_METADATA_DISABLED=true into mutated containers. Can be overridden by annotation")
+
+	enableDebugHandlers := flag.Bool("enable-debug-handlers", false, "Serve /debug/cache on the metrics port, listing the cached Service Accounts and their settings without authentication")
 	version := flag.Bool("version", false, "Display the version and exit")
 
 	klog.InitFlags(goflag.CommandLine)
@@ -80,6 +156,139 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(*annotationPrefixes) == 0 {
+		klog.Fatalf("Error validating annotation-prefix: at least one prefix is required")
+	}
+	for _, prefix := range *annotationPrefixes {
+		if prefix == "" {
+			klog.Fatalf("Error validating annotation-prefix: prefixes must not be empty")
+		}
+	}
+	annotationPrefix := (*annotationPrefixes)[0]
+
+	if *stsEndpoint != "" {
+		if err := handler.ValidateSTSEndpointURL(*stsEndpoint, *allowInsecureSTSEndpoint); err != nil {
+			klog.Fatalf("Error validating sts-endpoint-url: %v", err)
+		}
+	}
+
+	if err := handler.ValidateNamespacePatterns(*skipNamespaces); err != nil {
+		klog.Fatalf("Error validating skip-namespaces: %v", err)
+	}
+
+	var podSelector labels.Selector
+	if *excludePodSelector != "" {
+		selector, err := labels.Parse(*excludePodSelector)
+		if err != nil {
+			klog.Fatalf("Error parsing exclude-pod-selector: %v", err)
+		}
+		podSelector = selector
+	}
+
+	if err := handler.ValidateMaxRequestBytes(*maxRequestBytes); err != nil {
+		klog.Fatalf("Error validating max-request-bytes: %v", err)
+	}
+	if err := handler.ValidateSALookupFailurePolicy(*saLookupFailurePolicy); err != nil {
+		klog.Fatalf("Error validating sa-lookup-failure-policy: %v", err)
+	}
+	if err := handler.ValidateInternalTimeout(*internalTimeout); err != nil {
+		klog.Fatalf("Error validating internal-timeout: %v", err)
+	}
+	certConfig := cert.SourceConfig{
+		Source:          *certSource,
+		CertFile:        *servingCertFile,
+		KeyFile:         *servingKeyFile,
+		Namespace:       *namespaceName,
+		SecretName:      *tlsSecret,
+		ServiceName:     *serviceName,
+		SignerName:      *csrSignerName,
+		KeyType:         *tlsKeyType,
+		DNSNames:        *csrDNSNames,
+		IPSANs:          *csrIPSANs,
+		RotateBefore:    *rotateBefore,
+		SelfSignedHosts: *selfSignedHosts,
+		LeaderElect:     *leaderElect,
+		LeaseName:       *leaderElectLeaseName,
+	}
+	if certConfig.Source == "" {
+		switch {
+		case *servingCertFile != "" || *servingKeyFile != "":
+			certConfig.Source = cert.SourceFiles
+		case *inCluster:
+			certConfig.Source = cert.SourceCSR
+		default:
+			certConfig.Source = cert.SourceFiles
+			certConfig.CertFile, certConfig.KeyFile = *tlsCertFile, *tlsKeyFile
+		}
+	}
+	if certConfig.LeaderElect {
+		// The pod name identifies the replica in the Lease
+		identity, err := os.Hostname()
+		if err != nil {
+			klog.Fatalf("Error reading the hostname of the leader-elect identity: %v", err)
+		}
+		certConfig.Identity = identity
+	}
+	if *patchWebhookCA && !*inCluster && *webhookCABundleFile == "" {
+		klog.Fatalf("Error validating patch-webhook-ca: out-of-cluster, it requires webhook-ca-bundle-file")
+	}
+	if err := certConfig.Validate(); err != nil {
+		klog.Fatalf("Error validating cert-source: %v", err)
+	}
+	tlsConfig, err := cert.NewServerTLSConfig(*tlsMinVersion, *tlsCipherSuites)
+	if err != nil {
+		klog.Fatalf("Error validating the TLS flags: %v", err)
+	}
+	if _, err := labels.Parse(*saLabelSelector); err != nil {
+		klog.Fatalf("Error parsing sa-label-selector: %v", err)
+	}
+	if *cachePrewarm && *cachePrewarmPageSize <= 0 {
+		klog.Fatalf("Error validating cache-prewarm-page-size: must be positive, got %d", *cachePrewarmPageSize)
+	}
+	if err := cache.ValidateFallbackRateLimit(*fallbackQPS, *fallbackBurst); err != nil {
+		klog.Fatalf("Error validating fallback-qps: %v", err)
+	}
+	if err := cache.ValidateMappingFileMode(*saMappingFileMode); err != nil {
+		klog.Fatalf("Error validating sa-mapping-file-mode: %v", err)
+	}
+	if err := handler.ValidateValidationMode(*validationMode); err != nil {
+		klog.Fatalf("Error validating validation-mode: %v", err)
+	}
+	if err := handler.ValidateFailurePolicy(*webhookFailurePolicy); err != nil {
+		klog.Fatalf("Error validating webhook-failure-policy: %v", err)
+	}
+
+	if err := handler.ValidateTokenEnvName(*tokenEnvName); err != nil {
+		klog.Fatalf("Error validating token-env-name: %v", err)
+	}
+
+	if err := handler.ValidateTokenVolumeName(*tokenVolumeName); err != nil {
+		klog.Fatalf("Error validating token-volume-name: %v", err)
+	}
+
+	if *windowsMountPath != "" {
+		if err := handler.ValidateWindowsMountPath(*windowsMountPath); err != nil {
+			klog.Fatalf("Error validating windows-token-mount-path: %v", err)
+		}
+	}
+
+	if err := handler.ValidateExpirationBounds(*minTokenExpiration, *maxTokenExpiration); err != nil {
+		klog.Fatalf("Error validating token expiration bounds: %v", err)
+	}
+
+	if err := handler.ValidatePartitions(*allowedPartitions); err != nil {
+		klog.Fatalf("Error validating allowed-partitions: %v", err)
+	}
+
+	var roleTemplate *template.Template
+	if *roleARNTemplate != "" {
+		var err error
+		roleTemplate, err = handler.ParseRoleARNTemplate(*roleARNTemplate)
+		if err != nil {
+			klog.Fatalf("Error parsing role-arn-template: %v", err)
+		}
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags(*apiURL, *kubeconfig)
 	if err != nil {
 		klog.Fatalf("Error creating config: %v", err.Error())
@@ -93,19 +302,144 @@ func main() {
 		klog.Fatalf("Error creating clientset: %v", err.Error())
 	}
 
+	if *inCluster {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if _, err := handler.CheckFailurePolicyDrift(ctx, clientset, *webhookConfigName, *webhookFailurePolicy); err != nil {
+			klog.Warningf("Not checking the webhook failure policy: %v", err)
+		}
+		cancel()
+	}
+
+	informerOpts := []cache.InformerOption{
+		cache.WithResyncPeriod(*cacheResyncPeriod),
+		cache.WithWatchBackoffMax(*watchBackoffMax),
+	}
+	var prewarmPageSize int64
+	if *cachePrewarm {
+		prewarmPageSize = *cachePrewarmPageSize
+	}
 	saCache := cache.New(
 		*audience,
-		*annotationPrefix,
+		annotationPrefix,
 		clientset,
+		cache.WithLenientBooleans(*lenientBooleanAnnotations),
+		cache.WithSecondaryAnnotationPrefixes((*annotationPrefixes)[1:]...),
+		cache.WithLookupTimeout(*saLookupTimeout),
+		cache.WithNotFoundRetry(*saNotFoundRetryDelay),
+		cache.WithNegativeCacheTTL(*saNegativeCacheTTL),
+		cache.WithFallbackRateLimit(*fallbackQPS, *fallbackBurst),
+		cache.WithNamespaces(*watchNamespaces),
+		cache.WithLabelSelector(*saLabelSelector),
+		cache.WithNamespaceMetrics(*metricsNamespaceLabels),
+		cache.WithNamespaceEviction(*evictDeletedNamespaces, handler.DeleteNamespaceMetrics),
+		cache.WithPrewarm(prewarmPageSize),
+		cache.WithInformerOptions(informerOpts...),
 	)
+	if *saMappingFile != "" {
+		saCache, err = cache.NewMappingFileCache(*saMappingFile, *saMappingFileMode, *audience, saCache)
+		if err != nil {
+			klog.Fatalf("Error loading sa-mapping-file: %v", err)
+		}
+	}
 	saCache.Start()
+	syncCtx, cancelSync := context.WithTimeout(context.Background(), *cacheSyncTimeout)
+	if k8scache.WaitForCacheSync(syncCtx.Done(), saCache.HasSynced) {
+		klog.Info("Service account cache synced")
+	} else {
+		klog.Warningf("Service account cache not synced after %s, serving with API server lookups of uncached service accounts", *cacheSyncTimeout)
+	}
+	cancelSync()
+
+	var nsCache cache.NamespaceCache
+	if *enableNamespaceDefaults || *enableNamespaceRoleAllowlist {
+		nsCache = cache.NewNamespaceCache(annotationPrefix, clientset, informerOpts...)
+		nsCache.Start()
+	}
+
+	var cmCache cache.ConfigMapCache
+	if *watchedConfigMap != "" {
+		cmNamespace, cmName, err := k8scache.SplitMetaNamespaceKey(*watchedConfigMap)
+		if err != nil || cmNamespace == "" {
+			klog.Fatalf("Error parsing watched-configmap %q, must be namespace/name", *watchedConfigMap)
+		}
+		cmCache = cache.NewConfigMapCache(cmName, cmNamespace, *audience, clientset, informerOpts...)
+		cmCache.Start()
+	}
+
+	var defaultsCache cache.DefaultsCache
+	if *defaultsConfigMap != "" {
+		cmNamespace, cmName, err := k8scache.SplitMetaNamespaceKey(*defaultsConfigMap)
+		if err != nil || cmNamespace == "" {
+			klog.Fatalf("Error parsing defaults-configmap %q, must be namespace/name", *defaultsConfigMap)
+		}
+		defaultsCache = cache.NewDefaultsCache(cmName, cmNamespace, cache.Defaults{
+			TokenAudience:   *audience,
+			TokenExpiration: *tokenExpiration,
+			MountPath:       *mountPath,
+			RegionalSTS:     *regionalSTS,
+		}, clientset, informerOpts...)
+		defaultsCache.Start()
+	}
+
+	var fileMode *int32
+	if *tokenFileMode != "" {
+		mode, err := handler.ParseFileMode(*tokenFileMode)
+		if err != nil {
+			klog.Fatalf("Error parsing token-file-mode: %v", err)
+		}
+		fileMode = &mode
+	}
+
+	var fsGroup *int64
+	if *defaultFSGroup >= 0 {
+		fsGroup = defaultFSGroup
+	}
 
-	mod := handler.NewModifier(
+	opts := []handler.ModifierOpt{
 		handler.WithExpiration(*tokenExpiration),
+		handler.WithMinExpiration(*minTokenExpiration),
+		handler.WithMaxExpiration(*maxTokenExpiration),
 		handler.WithMountPath(*mountPath),
+		handler.WithWindowsMountPath(*windowsMountPath),
 		handler.WithServiceAccountCache(saCache),
+		handler.WithNamespaceCache(nsCache),
+		handler.WithNamespaceDefaults(*enableNamespaceDefaults),
+		handler.WithDenyOnPolicyViolation(*denyOnPolicyViolation),
+		handler.WithDenyOnDeletedSA(*denyOnDeletedSA),
+		handler.WithValidationMode(*validationMode),
+		handler.WithSALookupFailurePolicy(*saLookupFailurePolicy),
+		handler.WithInternalTimeout(*internalTimeout),
+		handler.WithFailurePolicy(*webhookFailurePolicy),
+		handler.WithMaxRequestBytes(*maxRequestBytes),
+		handler.WithMutateEphemeralContainers(*mutateEphemeralContainers),
+		handler.WithConfigMapCache(cmCache),
+		handler.WithDefaultsCache(defaultsCache),
 		handler.WithRegion(*region),
-	)
+		handler.WithRegionalSTS(*regionalSTS),
+		handler.WithDisableIMDSFallback(*disableIMDSFallback),
+		handler.WithAnnotatePods(*annotatePods),
+		handler.WithSkipNamespaces(*skipNamespaces),
+		handler.WithSkipOwnerKinds(*skipOwnerKinds),
+		handler.WithExcludePodSelector(podSelector),
+		handler.WithTokenAudience(*audience),
+		handler.WithRespectAutomountDisabled(*respectAutomountDisabled),
+		handler.WithAudienceOnlyInjection(*audienceOnlyInjection),
+		handler.WithTokenEnvName(*tokenEnvName),
+		handler.WithDefaultFSGroup(fsGroup),
+		handler.WithTokenFileMode(fileMode),
+		handler.WithTokenVolumeName(*tokenVolumeName),
+		handler.WithContainerCredentialsURI(*containerCredentialsURI),
+		handler.WithContainerCredentialsAudience(*containerCredentialsAudience),
+		handler.WithAnnotationDomain(annotationPrefix),
+		handler.WithPodAnnotationOverride(*allowPodOverride),
+		handler.WithLenientBooleanAnnotations(*lenientBooleanAnnotations),
+		handler.WithSTSEndpoint(*stsEndpoint),
+		handler.WithInsecureSTSEndpoint(*allowInsecureSTSEndpoint),
+		handler.WithAllowedPartitions(*allowedPartitions),
+		handler.WithRoleARNTemplate(roleTemplate),
+		handler.WithAccountID(*accountID),
+	}
+	mod := handler.NewModifier(opts...)
 
 	addr := fmt.Sprintf(":%d", *port)
 	metricsAddr := fmt.Sprintf(":%d", *metricsPort)
@@ -117,60 +451,74 @@ func main() {
 		handler.Logging(),
 	)
 	mux.Handle("/mutate", baseHandler)
+	if *enableMutateV2 {
+		// The v2 options are applied last, overriding the shared ones
+		v2 := handler.NewModifier(append(opts[:len(opts):len(opts)],
+			handler.WithRegionalSTS(*v2RegionalSTS),
+			handler.WithDisableIMDSFallback(*v2DisableIMDSFallback),
+		)...)
+		mux.Handle("/mutate/v2", handler.Apply(
+			http.HandlerFunc(v2.Handle),
+			handler.InstrumentRoute(),
+			handler.Logging(),
+		))
+	}
+	mux.Handle("/validate", handler.Apply(
+		http.HandlerFunc(mod.HandleValidate),
+		handler.InstrumentRoute(),
+		handler.Logging(),
+	))
 
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
 	metricsMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "ok")
 	})
+	readiness := handler.NewReadiness()
+	readiness.AddCheck("service-account-cache", func() error {
+		if !saCache.HasSynced() {
+			return fmt.Errorf("not synced")
+		}
+		return nil
+	})
+	metricsMux.Handle("/readyz", readiness)
+	if *enableDebugHandlers {
+		metricsMux.HandleFunc("/debug/cache", mod.HandleDebugCache)
+	}
 
+	certManager, err := cert.NewManager(certConfig, clientset)
+	if err != nil {
+		klog.Fatalf("failed to initialize %s certificate manager: %v", certConfig.Source, err)
+	}
+	certManager.Start()
+	defer certManager.Stop()
 
-	tlsConfig := &tls.Config{}
-
-	if *inCluster {
-		csr := &x509.CertificateRequest{
-			Subject: pkix.Name{CommonName: fmt.Sprintf("%s.%s.svc", *serviceName, *namespaceName)},
-			/*
-				// TODO: EKS Signer only allows SANS for ec2-approved domains, once this is fixed
-				// add additional domains and IPs
-				DNSNames: []string{
-					fmt.Sprintf("%s", *serviceName),
-					fmt.Sprintf("%s.%s", *serviceName, *namespaceName),
-					fmt.Sprintf("%s.%s.svc", *serviceName, *namespaceName),
-					fmt.Sprintf("%s.%s.svc.cluster.local", *serviceName, *namespaceName),
-				},
-				// TODO: SANIPs for service IP, but not pod IP
-				//IPAddresses: nil,
-			*/
-		}
-
-		certManager, err := cert.NewServerCertificateManager(
-			clientset,
-			*namespaceName,
-			*tlsSecret,
-			csr,
-		)
+	if *patchWebhookCA {
+		clusterCA, err := cert.ClusterCA(config)
 		if err != nil {
-			klog.Fatalf("failed to initialize certificate manager: %v", err)
+			klog.Fatalf("Error patching the webhook CA: %v", err)
 		}
-		certManager.Start()
-		defer certManager.Stop()
-
-		tlsConfig.GetCertificate = func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			certificate := certManager.Current()
-			if certificate == nil {
-				return nil, fmt.Errorf("no serving certificate available for the webhook, is the CSR approved?")
-			}
-			return certificate, nil
+		var writer cert.CABundleWriter
+		var trigger <-chan struct{}
+		if *inCluster {
+			patcher := cert.NewWebhookCABundlePatcher(clientset, *webhookConfigName)
+			writer, trigger = patcher, patcher.Watch(context.Background())
+		} else {
+			writer = cert.NewFileCABundleWriter(*webhookCABundleFile, *webhookConfigFile)
 		}
-	} else {
-		certificate, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
-		if err != nil {
-			klog.Fatalf("failed to load TLS cert and key: %v", err)
-		}
-		tlsConfig.Certificates = []tls.Certificate{certificate}
+		go cert.RunCABundleSync(context.Background(), certManager, clusterCA, writer, trigger)
 	}
 
+	readiness.AddCheck("serving-certificate", func() error {
+		if certManager.Current() == nil {
+			return fmt.Errorf("no serving certificate available, is the CSR approved?")
+		}
+		return nil
+	})
+	servingCertificate := cert.NewServingCertificate(certManager)
+	go servingCertificate.Run(context.Background())
+	tlsConfig.GetCertificate = servingCertificate.GetCertificate
+
 	klog.Info("Creating server")
 	server := &http.Server{
 		Addr:      addr,
@@ -180,8 +528,8 @@ func main() {
 	handler.ShutdownOnTerm(server, time.Duration(10)*time.Second)
 
 	metricsServer := &http.Server{
-		Addr:      metricsAddr,
-		Handler:   metricsMux,
+		Addr:    metricsAddr,
+		Handler: metricsMux,
 	}
 
 	go func() {
@@ -191,7 +539,7 @@ func main() {
 		}
 	}()
 
-	klog.Infof("Listening on %s for metrics and healthz", metricsAddr)
+	klog.Infof("Listening on %s for metrics, healthz, and readyz", metricsAddr)
 	if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
 		klog.Fatalf("Error listening: %q", err)
 	}
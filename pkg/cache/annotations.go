@@ -0,0 +1,46 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"strings"
+)
+
+// AnnotationValue returns the value of an annotation with surrounding
+// whitespace trimmed, and whether the annotation is set. Every annotation the
+// webhook reads goes through it, so a value pasted with a stray space or
+// newline means the same as the bare value.
+func AnnotationValue(annotations map[string]string, key string) (string, bool) {
+	value, ok := annotations[key]
+	return strings.TrimSpace(value), ok
+}
+
+// ParseBool parses a boolean annotation value. Surrounding whitespace and case
+// are ignored, and with lenient yes, no, on, and off are accepted as well. ok
+// is false if the value is not a boolean.
+func ParseBool(value string, lenient bool) (parsed, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	case "yes", "on":
+		return lenient, lenient
+	case "no", "off":
+		return false, lenient
+	}
+	return false, false
+}
@@ -0,0 +1,50 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// apiLookup fetches service accounts from the API server for each lookup
+type apiLookup struct {
+	parser *serviceAccountCache
+}
+
+// NewAPILookup returns a lookup fetching service accounts from the API server
+// for each lookup, without an informer or a cache, eg. for programs admitting
+// few pods. The lookup timeout and fallback rate limit options apply to each
+// lookup, the options of the informers and the cache are ignored.
+func NewAPILookup(defaultAudience, prefix string, clientset kubernetes.Interface, opts ...Option) ServiceAccountLookup {
+	parser := &serviceAccountCache{
+		defaultAudience:  defaultAudience,
+		annotationPrefix: prefix,
+		clientset:        clientset,
+		lookupTimeout:    DefaultLookupTimeout,
+	}
+	for _, opt := range opts {
+		opt(parser)
+	}
+	// Lookups aren't cached, not even the negative ones
+	parser.negativeTTL = 0
+	return &apiLookup{parser: parser}
+}
+
+func (l *apiLookup) Lookup(ctx context.Context, name, namespace string) (*CacheResponse, error) {
+	return l.parser.fetch(ctx, name, namespace)
+}
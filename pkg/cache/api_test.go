@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAPILookup(t *testing.T) {
+	annotated := &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "annotated",
+			Namespace:   "default",
+			Annotations: map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader"},
+		},
+	}
+	unannotated := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "default"}}
+	clientset := fake.NewSimpleClientset(annotated, unannotated)
+	lookup := NewAPILookup("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithNegativeCacheTTL(DefaultNegativeCacheTTL))
+
+	cases := []struct {
+		name     string
+		expected *CacheResponse
+	}{
+		{"annotated", &CacheResponse{RoleARN: "arn:aws:iam::111122223333:role/s3-reader", Audience: "sts.amazonaws.com", DefaultAudience: true}},
+		{"plain", &CacheResponse{Audience: "sts.amazonaws.com", DefaultAudience: true}},
+		{"missing", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clientset.ClearActions()
+			// Lookups aren't cached, each one gets the service account
+			for i := 0; i < 2; i++ {
+				resp, err := lookup.Lookup(context.Background(), c.name, "default")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (resp == nil) != (c.expected == nil) || resp != nil && (resp.RoleARN != c.expected.RoleARN || resp.Audience != c.expected.Audience) {
+					t.Errorf("Expected %+v, got %+v", c.expected, resp)
+				}
+			}
+			if gets := len(clientset.Actions()); gets != 2 {
+				t.Errorf("Expected 2 API server gets, got %d", gets)
+			}
+		})
+	}
+}
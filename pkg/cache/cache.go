@@ -16,44 +16,290 @@
 package cache
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/labels"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/klog"
 )
 
+var (
+	invalidAnnotationCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "invalid_annotation_total",
+			Help: "Counter of service account annotations with invalid values, broken out for each annotation.",
+		},
+		[]string{"annotation"},
+	)
+	cacheHitCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sa_cache_hits_total",
+			Help: "Counter of service account lookups served from the cache.",
+		},
+	)
+	cacheMissCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sa_cache_misses_total",
+			Help: "Counter of service account lookups missing the cache.",
+		},
+	)
+	apiFallbackCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sa_api_fallback_total",
+			Help: "Counter of API server lookups of service accounts missing the cache, broken out for the result: found, not-found, error, or throttled.",
+		},
+		[]string{"result"},
+	)
+	lookupDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "sa_lookup_duration_seconds",
+			Help:    "Latency of service account lookups, from the cache or the API server.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		},
+	)
+	cacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sa_cache_entries",
+			Help: "Number of cached service accounts.",
+		},
+	)
+	cacheEntriesByNamespace = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sa_cache_entries_by_namespace",
+			Help: "Number of cached service accounts, broken out for each namespace.",
+		},
+		[]string{"namespace"},
+	)
+	invalidDefaultCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "invalid_default_total",
+			Help: "Counter of ignored defaults configmap values, broken out for each key.",
+		},
+		[]string{"key"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(invalidAnnotationCounter)
+	prometheus.MustRegister(invalidDefaultCounter)
+	prometheus.MustRegister(cacheHitCounter)
+	prometheus.MustRegister(cacheMissCounter)
+	prometheus.MustRegister(apiFallbackCounter)
+	prometheus.MustRegister(lookupDuration)
+	prometheus.MustRegister(cacheEntries)
+	prometheus.MustRegister(cacheEntriesByNamespace)
+}
+
+// errFallbackThrottled is the error of API server lookups rejected by the
+// fallback rate limiter
+var errFallbackThrottled = errors.New("API server lookups are throttled")
+
 type CacheResponse struct {
-	RoleARN  string
+	RoleARN string
+	// RoleName is the annotated role name, used to build the role ARN from a
+	// template
+	RoleName string
 	Audience string
+	// DefaultAudience is true if Audience is the default audience because the
+	// audience is not annotated
+	DefaultAudience bool
+	// UseRegionalSTS is the annotated regional STS setting, or nil if the
+	// annotation is unset or invalid
+	UseRegionalSTS *bool
+	// TokenExpiration is the annotated token expiration in seconds, or 0 if
+	// the annotation is unset or invalid
+	TokenExpiration int64
+	// MountPath is the annotated token mount path, or empty if the annotation
+	// is unset or invalid
+	MountPath string
+	// STSEndpoint is the annotated STS endpoint URL
+	STSEndpoint string
+	// TokenFileName is the annotated token file name, or empty if the
+	// annotation is unset or invalid
+	TokenFileName string
+	// TokenFileMode is the annotated token file mode
+	TokenFileMode *int32
+	// DisableIMDSFallback is the annotated disable-imds-fallback setting, or
+	// nil if the annotation is unset or invalid
+	DisableIMDSFallback *bool
+	// ExtraMountPath is the annotated additional token mount path, or empty
+	// if the annotation is unset or invalid
+	ExtraMountPath string
+	// ChainedRoleARN is the annotated role assumed with the credentials of
+	// RoleARN
+	ChainedRoleARN string
+	// AutomountServiceAccountToken is the automountServiceAccountToken field
+	// of the service account
+	AutomountServiceAccountToken *bool
+	// ContainerCredentials is true if the credential-mode annotation selects
+	// container credentials instead of web identity
+	ContainerCredentials bool
+	// DefaultFSGroup is the annotated fsGroup defaulted for pods without one,
+	// or nil if the annotation is unset or invalid
+	DefaultFSGroup *int64
+	// ForceEnvOverride replaces AWS env vars already defined by containers
+	ForceEnvOverride bool
+	// InvalidAnnotations describes the annotations ignored because their
+	// values are invalid
+	InvalidAnnotations []string
+	// DeprecatedAnnotationPrefix is the secondary annotation prefix the
+	// settings were read from, or empty if they were read from the
+	// annotation prefix
+	DeprecatedAnnotationPrefix string
+}
+
+// ServiceAccountLookup looks up the parsed settings of service accounts
+type ServiceAccountLookup interface {
+	// Lookup returns the parsed settings of a service account. It returns nil
+	// without an error if the service account doesn't exist.
+	Lookup(ctx context.Context, name, namespace string) (*CacheResponse, error)
 }
 
 type ServiceAccountCache interface {
 	Start()
-	Get(name, namespace string) (role, aud string)
+	// Get returns a copy of the parsed settings of a service account, or nil if
+	// the service account is not cached
+	Get(name, namespace string) *CacheResponse
+	// ServiceAccountLookup returns the settings of a service account like Get,
+	// and fetches service accounts that are not cached yet from the API
+	// server
+	ServiceAccountLookup
+	// HasSynced returns true once the initial list of service accounts is
+	// cached
+	HasSynced() bool
+	// NamespaceSynced returns true once the service accounts of a namespace
+	// are cached, before HasSynced while the cache is prewarmed
+	NamespaceSynced(namespace string) bool
+	// List returns copies of the cached service accounts of a namespace, or
+	// of all namespaces if namespace is empty, sorted by namespace and name
+	List(namespace string) []CachedServiceAccount
+	// AddListener registers a listener of the changes of the cached settings
+	AddListener(listener func(SAEvent))
+}
+
+// CachedServiceAccount is the parsed settings of a cached service account
+type CachedServiceAccount struct {
+	Namespace string
+	Name      string
+	Settings  *CacheResponse
+}
+
+// listEntries returns copies of the entries of a namespace/name keyed cache in
+// a namespace, or in all namespaces if namespace is empty, sorted by namespace
+// and name
+func listEntries(entries map[string]*CacheResponse, namespace string) []CachedServiceAccount {
+	var list []CachedServiceAccount
+	for key, resp := range entries {
+		ns, name, _ := strings.Cut(key, "/")
+		if namespace != "" && ns != namespace {
+			continue
+		}
+		respCopy := *resp
+		list = append(list, CachedServiceAccount{Namespace: ns, Name: name, Settings: &respCopy})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Namespace != list[j].Namespace {
+			return list[i].Namespace < list[j].Namespace
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
 }
 
 type serviceAccountCache struct {
-	mu               sync.RWMutex // guards cache
-	cache            map[string]*CacheResponse
-	store            cache.Store
-	controller       cache.Controller
+	mu    sync.RWMutex // guards cache, namespaceEntries, and prewarmedNamespaces
+	cache map[string]*CacheResponse
+	// namespaceEntries is the number of cached service accounts of each
+	// namespace
+	namespaceEntries map[string]int
+	// namespaceMetrics exports the number of cached service accounts of each
+	// namespace
+	namespaceMetrics bool
+	// controllers are the informers of the watched namespaces, or of all
+	// namespaces
+	controllers []cache.Controller
+	// informers are the service account informers among the controllers
+	informers        []cache.SharedIndexInformer
 	clientset        kubernetes.Interface
 	annotationPrefix string
-	defaultAudience  string
+	// secondaryPrefixes are the deprecated annotation prefixes honored after
+	// annotationPrefix, eg. while annotations are migrated to it
+	secondaryPrefixes []string
+	defaultAudience   string
+	// lenientBooleans accepts yes, no, on, and off values of boolean
+	// annotations
+	lenientBooleans bool
+	// lookupTimeout is the deadline of API server lookups of uncached
+	// service accounts, 0 for none
+	lookupTimeout time.Duration
+	// notFoundRetryDelay is the wait before looking up a service account that
+	// wasn't found again, 0 to not retry
+	notFoundRetryDelay time.Duration
+	// fallbackLimiter limits the API server lookups of uncached service
+	// accounts, nil for no limit
+	fallbackLimiter flowcontrol.PassiveRateLimiter
+	// namespaces are the namespaces whose service accounts are cached, all
+	// namespaces if empty
+	namespaces map[string]struct{}
+	// labelSelector restricts the cached service accounts, all service
+	// accounts if empty
+	labelSelector  string
+	informerConfig informerConfig
+	// prewarmPageSize is the page size of the list prewarming the cache
+	// before the informers start, 0 to not prewarm it
+	prewarmPageSize int64
+	// prewarmed is set once the prewarm cached all service accounts
+	prewarmed atomic.Bool
+	// prewarmedNamespaces are the namespaces whose service accounts are all
+	// cached by the prewarm
+	prewarmedNamespaces map[string]struct{}
+	// evictNamespaces evicts the service accounts of deleted namespaces
+	evictNamespaces bool
+	// onNamespaceEvict are called with the name of each evicted namespace
+	onNamespaceEvict []func(namespace string)
+
+	// negativeTTL is how long service accounts fetched from the API server
+	// without annotations are cached, 0 to not cache them
+	negativeTTL time.Duration
+	negativeMu  sync.Mutex // guards negative
+	negative    map[string]negativeEntry
+
+	listenersMu sync.RWMutex // guards listeners
+	// listeners are the event queues of the listeners
+	listeners []chan SAEvent
 }
 
-func (c *serviceAccountCache) Get(name, namespace string) (role, aud string) {
+func (c *serviceAccountCache) Get(name, namespace string) *CacheResponse {
 	klog.V(5).Infof("Fetching sa %s/%s from cache", namespace, name)
 	resp := c.get(name, namespace)
 	if resp == nil {
-		return "", ""
+		return nil
 	}
-	return resp.RoleARN, resp.Audience
+	respCopy := *resp
+	return &respCopy
+}
+
+func (c *serviceAccountCache) List(namespace string) []CachedServiceAccount {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return listEntries(c.cache, namespace)
 }
 
 func (c *serviceAccountCache) get(name, namespace string) *CacheResponse {
@@ -66,88 +312,619 @@ func (c *serviceAccountCache) get(name, namespace string) *CacheResponse {
 	return resp
 }
 
+func (c *serviceAccountCache) Lookup(ctx context.Context, name, namespace string) (*CacheResponse, error) {
+	defer func(start time.Time) {
+		lookupDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+	if c.watched(namespace) {
+		if resp := c.Get(name, namespace); resp != nil {
+			cacheHitCounter.Inc()
+			return resp, nil
+		}
+		cacheMissCounter.Inc()
+	}
+	if resp := c.getNegative(name, namespace); resp != nil {
+		negativeCacheHitCounter.Inc()
+		return resp, nil
+	}
+	if c.clientset == nil {
+		return nil, nil
+	}
+	resp, err := c.fetch(ctx, name, namespace)
+	if err == nil && resp == nil && c.notFoundRetryDelay > 0 {
+		// The Service Account may be created along with the pod, eg. by the
+		// same apply, and not be visible yet. Wait for it once.
+		klog.V(4).Infof("Service account %s/%s not found, retrying in %s", namespace, name, c.notFoundRetryDelay)
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("error fetching sa %s/%s: %v", namespace, name, ctx.Err())
+		case <-time.After(c.notFoundRetryDelay):
+			if resp = c.Get(name, namespace); resp == nil {
+				resp, err = c.fetch(ctx, name, namespace)
+			}
+		}
+	}
+	switch {
+	case errors.Is(err, errFallbackThrottled):
+		apiFallbackCounter.WithLabelValues("throttled").Inc()
+	case err != nil:
+		apiFallbackCounter.WithLabelValues("error").Inc()
+	case resp == nil:
+		apiFallbackCounter.WithLabelValues("not-found").Inc()
+	default:
+		apiFallbackCounter.WithLabelValues("found").Inc()
+	}
+	return resp, err
+}
+
+// fetch gets a service account from the API server within the lookup
+// timeout, it returns nil without an error if the service account doesn't
+// exist. Lookups rejected by the fallback rate limiter fail right away
+// instead of queueing, when the informer lags and every admission misses the
+// cache.
+func (c *serviceAccountCache) fetch(ctx context.Context, name, namespace string) (*CacheResponse, error) {
+	if c.fallbackLimiter != nil && !c.fallbackLimiter.TryAccept() {
+		klog.V(4).Infof("Not fetching uncached sa %s/%s from the API server, lookups are throttled", namespace, name)
+		return nil, fmt.Errorf("error fetching sa %s/%s: %w", namespace, name, errFallbackThrottled)
+	}
+	if c.lookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.lookupTimeout)
+		defer cancel()
+	}
+	klog.V(5).Infof("Fetching uncached sa %s/%s from the API server", namespace, name)
+	sa, err := c.clientset.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching sa %s/%s: %v", namespace, name, err)
+	}
+	resp := c.parse(sa)
+	c.setNegative(sa, resp)
+	return resp, nil
+}
+
 func (c *serviceAccountCache) pop(name, namespace string) {
 	klog.V(5).Infof("Removing sa %s/%s from cache", namespace, name)
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.cache, namespace+"/"+name)
+	old := c.remove(name, namespace)
+	c.notify(name, namespace, old, nil)
+	c.mu.Unlock()
+	c.invalidateNegative(name, namespace)
 }
 
-func (c *serviceAccountCache) addSA(sa *v1.ServiceAccount) {
-	arn, ok := sa.Annotations[c.annotationPrefix+"/role-arn"]
-	resp := &CacheResponse{}
+// remove removes a cached service account and returns its settings, or nil if
+// it isn't cached, c.mu must be held
+func (c *serviceAccountCache) remove(name, namespace string) *CacheResponse {
+	old, ok := c.cache[namespace+"/"+name]
 	if ok {
+		delete(c.cache, namespace+"/"+name)
+		c.countEntry(namespace, -1)
+	}
+	return old
+}
+
+// invalidAnnotation logs, counts, and records an ignored annotation with an
+// invalid value, the setting keeps its default. The reason is appended to the
+// message if set. Service accounts are parsed when the informer adds, updates,
+// or resyncs them, so each invalid annotation is logged once per resync
+// instead of for every pod.
+func (c *saParser) invalidAnnotation(resp *CacheResponse, sa *v1.ServiceAccount, annotation, value, reason string) {
+	message := fmt.Sprintf("invalid %s/%s value %q", c.prefix, annotation, value)
+	if reason != "" {
+		message += ", " + reason
+	}
+	klog.Warningf("Ignoring %s on sa %s/%s", message, sa.Namespace, sa.Name)
+	invalidAnnotationCounter.WithLabelValues(annotation).Inc()
+	resp.InvalidAnnotations = append(resp.InvalidAnnotations, message)
+}
+
+// ParseServiceAccount reads the annotations of a service account with the
+// annotation prefix, using defaultAudience if the audience is not annotated
+func ParseServiceAccount(sa *v1.ServiceAccount, prefix, defaultAudience string, opts ...Option) *CacheResponse {
+	parser := &serviceAccountCache{
+		defaultAudience:  defaultAudience,
+		annotationPrefix: prefix,
+	}
+	for _, opt := range opts {
+		opt(parser)
+	}
+	return parser.parse(sa)
+}
+
+// annotation returns the trimmed value of an annotation of sa with the
+// annotation prefix of the parser
+func (c *saParser) annotation(sa *v1.ServiceAccount, name string) (string, bool) {
+	return AnnotationValue(sa.Annotations, c.prefix+"/"+name)
+}
+
+// boolAnnotation parses a boolean annotation of sa. Invalid values are
+// recorded and nil is returned, as for a missing annotation.
+func (c *saParser) boolAnnotation(resp *CacheResponse, sa *v1.ServiceAccount, name string) *bool {
+	value, ok := c.annotation(sa, name)
+	if !ok {
+		return nil
+	}
+	parsed, ok := ParseBool(value, c.lenientBooleans)
+	if !ok {
+		reason := "must be true or false"
+		if c.lenientBooleans {
+			reason = "must be true, false, yes, no, on, or off"
+		}
+		c.invalidAnnotation(resp, sa, name, value, reason)
+		return nil
+	}
+	return &parsed
+}
+
+// parseAnnotations reads the annotations of a service account with the
+// annotation prefix of the parser into a CacheResponse
+func (c *saParser) parseAnnotations(sa *v1.ServiceAccount) *CacheResponse {
+	resp := &CacheResponse{}
+	if sa.AutomountServiceAccountToken != nil {
+		automount := *sa.AutomountServiceAccountToken
+		resp.AutomountServiceAccountToken = &automount
+	}
+	if arn, ok := c.annotation(sa, "role-arn"); ok {
 		resp.RoleARN = arn
-		if audience, ok := sa.Annotations[c.annotationPrefix+"/audience"]; ok {
-			resp.Audience = audience
+	}
+	if name, ok := c.annotation(sa, "role-name"); ok {
+		resp.RoleName = name
+	}
+	// The audience is resolved even without a role so that pod level role
+	// overrides still use the service account's audience
+	if audience, ok := c.annotation(sa, "audience"); ok {
+		resp.Audience = audience
+	} else {
+		resp.Audience = c.defaultAudience
+		resp.DefaultAudience = true
+	}
+	resp.UseRegionalSTS = c.boolAnnotation(resp, sa, "sts-regional-endpoints")
+	if expiration, ok := c.annotation(sa, "token-expiration"); ok {
+		if value, err := strconv.ParseInt(expiration, 10, 64); err != nil || value <= 0 {
+			reason := "must be a positive number of seconds"
+			if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+				reason = "out of range"
+			}
+			c.invalidAnnotation(resp, sa, "token-expiration", expiration, reason)
+		} else {
+			resp.TokenExpiration = value
+		}
+	}
+	if mountPath, ok := c.annotation(sa, "token-mount-path"); ok {
+		if !path.IsAbs(mountPath) || strings.Contains(mountPath, "..") {
+			c.invalidAnnotation(resp, sa, "token-mount-path", mountPath, "must be an absolute path")
 		} else {
-			resp.Audience = c.defaultAudience
+			resp.MountPath = path.Clean(mountPath)
 		}
 	}
+	if mountPath, ok := c.annotation(sa, "extra-token-mount-path"); ok {
+		if !path.IsAbs(mountPath) || strings.Contains(mountPath, "..") {
+			c.invalidAnnotation(resp, sa, "extra-token-mount-path", mountPath, "must be an absolute path")
+		} else {
+			resp.ExtraMountPath = path.Clean(mountPath)
+		}
+	}
+	if fsGroup, ok := c.annotation(sa, "default-fs-group"); ok {
+		if value, err := strconv.ParseInt(fsGroup, 10, 64); err != nil || value < 0 {
+			c.invalidAnnotation(resp, sa, "default-fs-group", fsGroup, "must be a non-negative integer")
+		} else {
+			resp.DefaultFSGroup = &value
+		}
+	}
+	if name, ok := c.annotation(sa, "token-file-name"); ok {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			c.invalidAnnotation(resp, sa, "token-file-name", name, "must be a file name")
+		} else {
+			resp.TokenFileName = name
+		}
+	}
+	if mode, ok := c.annotation(sa, "token-file-mode"); ok {
+		if value, err := strconv.ParseInt(mode, 8, 32); err != nil || value < 0 || value > 0777 {
+			c.invalidAnnotation(resp, sa, "token-file-mode", mode, "must be an octal mode")
+		} else {
+			fileMode := int32(value)
+			resp.TokenFileMode = &fileMode
+		}
+	}
+	resp.DisableIMDSFallback = c.boolAnnotation(resp, sa, "disable-imds-fallback")
+	if arn, ok := c.annotation(sa, "chained-role-arn"); ok {
+		resp.ChainedRoleARN = arn
+	}
+	if mode, ok := c.annotation(sa, "credential-mode"); ok {
+		switch strings.ToLower(mode) {
+		case "container":
+			resp.ContainerCredentials = true
+		case "irsa":
+		default:
+			c.invalidAnnotation(resp, sa, "credential-mode", mode, "must be container or irsa")
+		}
+	}
+	if endpoint, ok := c.annotation(sa, "sts-endpoint-url"); ok {
+		resp.STSEndpoint = endpoint
+	}
+	if force := c.boolAnnotation(resp, sa, "force-env-override"); force != nil {
+		resp.ForceEnvOverride = *force
+	}
+	return resp
+}
+
+func (c *serviceAccountCache) addSA(sa *v1.ServiceAccount) {
+	resp := c.parse(sa)
 	klog.V(5).Infof("Adding sa %s/%s to cache", sa.Name, sa.Namespace)
 	c.set(sa.Name, sa.Namespace, resp)
 }
 
+// set caches the settings of a service account, and notifies the listeners
+// once they are cached. Events are queued while c.mu is held, so they are
+// queued in the order the cache is updated.
 func (c *serviceAccountCache) set(name, namespace string, resp *CacheResponse) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	old, ok := c.cache[namespace+"/"+name]
 	c.cache[namespace+"/"+name] = resp
+	if !ok {
+		c.countEntry(namespace, 1)
+	}
+	c.notify(name, namespace, old, resp)
+	c.mu.Unlock()
+	c.invalidateNegative(name, namespace)
+}
+
+// countEntry updates the entry gauges after adding or removing a cached
+// service account of namespace, c.mu must be held. The series of namespaces
+// without cached service accounts are deleted.
+func (c *serviceAccountCache) countEntry(namespace string, delta int) {
+	cacheEntries.Set(float64(len(c.cache)))
+	if !c.namespaceMetrics {
+		return
+	}
+	if c.namespaceEntries == nil {
+		c.namespaceEntries = map[string]int{}
+	}
+	c.namespaceEntries[namespace] += delta
+	if count := c.namespaceEntries[namespace]; count > 0 {
+		cacheEntriesByNamespace.WithLabelValues(namespace).Set(float64(count))
+		return
+	}
+	delete(c.namespaceEntries, namespace)
+	cacheEntriesByNamespace.DeleteLabelValues(namespace)
+}
+
+// DefaultLookupTimeout is the default deadline of API server lookups of
+// service accounts missing the cache
+const DefaultLookupTimeout = 500 * time.Millisecond
+
+// Default rate limit of API server lookups of service accounts missing the
+// cache
+const (
+	DefaultFallbackQPS   = 10
+	DefaultFallbackBurst = 20
+)
+
+// ValidateFallbackRateLimit returns an error if qps is negative, or if lookups
+// are limited with a burst below 1
+func ValidateFallbackRateLimit(qps float32, burst int) error {
+	if qps < 0 {
+		return fmt.Errorf("invalid fallback qps %v, must not be negative", qps)
+	}
+	if qps > 0 && burst < 1 {
+		return fmt.Errorf("invalid fallback burst %d, must be at least 1", burst)
+	}
+	return nil
+}
+
+// Option configures a Service Account cache
+type Option func(*serviceAccountCache)
+
+// WithLenientBooleans accepts yes, no, on, and off values of boolean
+// annotations
+func WithLenientBooleans(lenient bool) Option {
+	return func(c *serviceAccountCache) { c.lenientBooleans = lenient }
+}
+
+// WithLookupTimeout sets the deadline of API server lookups of service
+// accounts missing the cache, 0 for none
+func WithLookupTimeout(timeout time.Duration) Option {
+	return func(c *serviceAccountCache) { c.lookupTimeout = timeout }
+}
+
+// WithNotFoundRetry looks up service accounts that aren't found once more
+// after delay, 0 to not retry
+func WithNotFoundRetry(delay time.Duration) Option {
+	return func(c *serviceAccountCache) { c.notFoundRetryDelay = delay }
+}
+
+// WithFallbackRateLimit limits the API server lookups of service accounts
+// missing the cache to qps, with bursts of burst lookups. Lookups over the
+// limit fail. A qps of 0 disables the limit.
+func WithFallbackRateLimit(qps float32, burst int) Option {
+	return func(c *serviceAccountCache) {
+		c.fallbackLimiter = nil
+		if qps > 0 {
+			c.fallbackLimiter = flowcontrol.NewTokenBucketPassiveRateLimiter(qps, burst)
+		}
+	}
+}
+
+// WithNegativeCacheTTL caches service accounts fetched from the API server
+// without annotations for ttl, 0 to not cache them. Informer updates of a
+// service account drop it from the negative cache.
+func WithNegativeCacheTTL(ttl time.Duration) Option {
+	return func(c *serviceAccountCache) { c.negativeTTL = ttl }
+}
+
+// WithNamespaces only caches the service accounts of namespaces, with an
+// informer per namespace. Service accounts of other namespaces are fetched
+// from the API server.
+func WithNamespaces(namespaces []string) Option {
+	return func(c *serviceAccountCache) {
+		c.namespaces = map[string]struct{}{}
+		for _, namespace := range namespaces {
+			c.namespaces[namespace] = struct{}{}
+		}
+	}
+}
+
+// WithSecondaryAnnotationPrefixes honors the annotations of service accounts
+// with deprecated prefixes as well, eg. while annotations are migrated to the
+// annotation prefix. The settings of a service account are read from the
+// first prefix with a role, in order.
+func WithSecondaryAnnotationPrefixes(prefixes ...string) Option {
+	return func(c *serviceAccountCache) { c.secondaryPrefixes = prefixes }
+}
+
+// WithNamespaceMetrics exports the number of cached service accounts of each
+// namespace, disable it in clusters with many namespaces
+func WithNamespaceMetrics(enabled bool) Option {
+	return func(c *serviceAccountCache) { c.namespaceMetrics = enabled }
+}
+
+// WithNamespaceEviction watches namespaces and evicts the service accounts of
+// deleted namespaces, along with their negative cache entries and metric
+// series, eg. in clusters whose CI creates and deletes namespaces. onEvict
+// are called with the name of each evicted namespace, eg. to delete the
+// metric series of other packages.
+func WithNamespaceEviction(enabled bool, onEvict ...func(namespace string)) Option {
+	return func(c *serviceAccountCache) {
+		c.evictNamespaces = enabled
+		c.onNamespaceEvict = onEvict
+	}
 }
 
-func New(defaultAudience, prefix string, clientset kubernetes.Interface) ServiceAccountCache {
+// WithLabelSelector only caches the service accounts matching a label
+// selector. Service accounts that don't match are fetched from the API server.
+func WithLabelSelector(selector string) Option {
+	return func(c *serviceAccountCache) { c.labelSelector = selector }
+}
+
+// WithPrewarm lists the service accounts page by page before the informers
+// start, with pageSize service accounts per page, so the cache is populated
+// incrementally while the informers of large clusters sync. The cache is
+// synced once the prewarm completes. A pageSize of 0 disables the prewarm.
+func WithPrewarm(pageSize int64) Option {
+	return func(c *serviceAccountCache) { c.prewarmPageSize = pageSize }
+}
+
+// WithInformerOptions configures the service account informers
+func WithInformerOptions(opts ...InformerOption) Option {
+	return func(c *serviceAccountCache) {
+		for _, opt := range opts {
+			opt(&c.informerConfig)
+		}
+	}
+}
+
+func New(defaultAudience, prefix string, clientset kubernetes.Interface, opts ...Option) ServiceAccountCache {
 	c := &serviceAccountCache{
 		cache:            map[string]*CacheResponse{},
 		defaultAudience:  defaultAudience,
 		annotationPrefix: prefix,
+		clientset:        clientset,
+		namespaceMetrics: true,
+		lookupTimeout:    DefaultLookupTimeout,
+		negativeTTL:      DefaultNegativeCacheTTL,
+		fallbackLimiter:  flowcontrol.NewTokenBucketPassiveRateLimiter(DefaultFallbackQPS, DefaultFallbackBurst),
+		informerConfig:   newInformerConfig(nil),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
 
-	saListWatcher := cache.NewListWatchFromClient(
-		clientset.CoreV1().RESTClient(),
-		"serviceaccounts",
-		v1.NamespaceAll,
-		fields.Everything(),
-	)
+	for _, namespace := range c.informerNamespaces() {
+		informer := newInformer("serviceaccounts", newServiceAccountListWatch(namespace, c.labelSelector, clientset), &v1.ServiceAccount{}, c.eventHandler(), c.informerConfig)
+		if err := informer.SetTransform(c.stripServiceAccount); err != nil {
+			klog.Fatalf("Error setting service account informer transform: %v", err)
+		}
+		c.informers = append(c.informers, informer)
+		c.controllers = append(c.controllers, informer)
+	}
+	if c.evictNamespaces {
+		c.controllers = append(c.controllers, c.newNamespaceEvictionInformer(clientset))
+	}
+	return c
+}
 
-	c.store, c.controller = cache.NewInformer(
-		saListWatcher,
-		&v1.ServiceAccount{},
-		time.Second*60,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				sa := obj.(*v1.ServiceAccount)
-				c.addSA(sa)
-			},
-			DeleteFunc: func(obj interface{}) {
-				sa := obj.(*v1.ServiceAccount)
+// eventHandler returns the handler of the service account informers. Deleted
+// service accounts are removed right away, including the tombstones of
+// deletions missed while the watch was down, so pods aren't mutated with the
+// settings of a deleted service account.
+func (c *serviceAccountCache) eventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			sa := obj.(*v1.ServiceAccount)
+			c.addSA(sa)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if sa, ok := obj.(*v1.ServiceAccount); ok {
 				c.pop(sa.Name, sa.Namespace)
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				sa := newObj.(*v1.ServiceAccount)
-				c.addSA(sa)
-			},
+			}
 		},
-	)
-	return c
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			sa := newObj.(*v1.ServiceAccount)
+			c.addSA(sa)
+		},
+	}
 }
 
-func (c *serviceAccountCache) start() {
-	// Populate the cache
-	err := cache.ListAll(c.store, labels.Everything(), func(obj interface{}) {
-		sa := obj.(*v1.ServiceAccount)
-		c.addSA(sa)
-	})
-	if err != nil {
-		klog.Errorf("Error fetching service accounts: %v", err.Error())
-		return
+// stripServiceAccount is the transform of the service account informers. It
+// drops the fields that aren't parsed before the informer stores service
+// accounts, eg. managed fields, secrets, and annotations without an
+// annotation prefix, like the last applied configuration.
+func (c *serviceAccountCache) stripServiceAccount(obj interface{}) (interface{}, error) {
+	sa, ok := obj.(*v1.ServiceAccount)
+	if !ok {
+		return obj, nil
+	}
+	stripped := &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            sa.Name,
+			Namespace:       sa.Namespace,
+			UID:             sa.UID,
+			ResourceVersion: sa.ResourceVersion,
+		},
+		AutomountServiceAccountToken: sa.AutomountServiceAccountToken,
+	}
+	for key, value := range sa.Annotations {
+		if c.prefixed(key) {
+			if stripped.Annotations == nil {
+				stripped.Annotations = map[string]string{}
+			}
+			stripped.Annotations[key] = value
+		}
+	}
+	return stripped, nil
+}
+
+// informerNamespaces returns the sorted watched namespaces, or all namespaces
+func (c *serviceAccountCache) informerNamespaces() []string {
+	if len(c.namespaces) == 0 {
+		return []string{v1.NamespaceAll}
+	}
+	var namespaces []string
+	for namespace := range c.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// newServiceAccountListWatch returns a ListWatch for the service accounts of a
+// namespace, or of all namespaces, matching a label selector. The typed client
+// rather than the REST client lists and watches, so the informer runs against
+// fake clientsets as well.
+func newServiceAccountListWatch(namespace, labelSelector string, clientset kubernetes.Interface) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = labelSelector
+			return clientset.CoreV1().ServiceAccounts(namespace).List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = labelSelector
+			return clientset.CoreV1().ServiceAccounts(namespace).Watch(context.TODO(), options)
+		},
+	}
+}
+
+// run prewarms the cache, then runs the informers until ctx is done. The
+// prewarm, then the initial list of the informer populate the cache through
+// the add handler.
+func (c *serviceAccountCache) run(ctx context.Context) {
+	c.runPrewarm(ctx)
+	c.runInformers(ctx.Done())
+	<-ctx.Done()
+}
+
+// runInformers runs the informers until stop is closed. Once the service
+// account informers synced, the prewarmed service accounts they didn't list
+// are removed: they were deleted before the informers listed, so the
+// informers send no delete event for them.
+func (c *serviceAccountCache) runInformers(stop <-chan struct{}) {
+	for _, controller := range c.controllers {
+		go controller.Run(stop)
+	}
+	synced := make([]cache.InformerSynced, 0, len(c.informers))
+	for _, informer := range c.informers {
+		synced = append(synced, informer.HasSynced)
+	}
+	go func() {
+		if cache.WaitForCacheSync(stop, synced...) {
+			c.dropUnlisted()
+		}
+	}()
+}
+
+// dropUnlisted removes the cached service accounts missing from the stores of
+// the service account informers. The stores are updated before the handlers
+// run, so a service account the informers add meanwhile is in a store by the
+// time it is cached.
+func (c *serviceAccountCache) dropUnlisted() {
+	var dropped []string
+	c.mu.Lock()
+	for key := range c.cache {
+		if c.listed(key) {
+			continue
+		}
+		namespace, name, _ := strings.Cut(key, "/")
+		klog.V(4).Infof("Removing sa %s/%s from cache, it was deleted after the prewarm", namespace, name)
+		c.notify(name, namespace, c.remove(name, namespace), nil)
+		dropped = append(dropped, key)
 	}
+	c.mu.Unlock()
+	for _, key := range dropped {
+		namespace, name, _ := strings.Cut(key, "/")
+		c.invalidateNegative(name, namespace)
+	}
+}
 
-	stop := make(chan struct{})
-	defer close(stop)
-	go c.controller.Run(stop)
-	// Wait forever
-	select {}
+// listed returns true if a service account informer stores a namespace/name
+// key
+func (c *serviceAccountCache) listed(key string) bool {
+	for _, informer := range c.informers {
+		if _, ok, _ := informer.GetStore().GetByKey(key); ok {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *serviceAccountCache) Start() {
-	go c.start()
+	go c.run(context.Background())
+}
+
+func (c *serviceAccountCache) HasSynced() bool {
+	if c.prewarmed.Load() {
+		return true
+	}
+	for _, controller := range c.controllers {
+		if !controller.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *serviceAccountCache) NamespaceSynced(namespace string) bool {
+	if !c.watched(namespace) {
+		return false
+	}
+	if c.HasSynced() {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.prewarmedNamespaces[namespace]
+	return ok
+}
+
+// watched returns true if the service accounts of a namespace are cached
+func (c *serviceAccountCache) watched(namespace string) bool {
+	if len(c.namespaces) == 0 {
+		return true
+	}
+	_, ok := c.namespaces[namespace]
+	return ok
 }
@@ -1,9 +1,25 @@
 package cache
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	goruntime "runtime"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+	clocktesting "k8s.io/utils/clock/testing"
 )
 
 func TestSaCache(t *testing.T) {
@@ -19,20 +35,1180 @@ func TestSaCache(t *testing.T) {
 		annotationPrefix: "eks.amazonaws.com",
 	}
 
-	role, aud := cache.Get("default", "default")
+	resp := cache.Get("default", "default")
 
-	if role != "" || aud != "" {
-		t.Errorf("Expected role and aud to be empty, got %s, %s", role, aud)
+	if resp != nil {
+		t.Errorf("Expected no response, got %+v", resp)
 	}
 
 	cache.addSA(testSA)
 
-	role, aud = cache.Get("default", "default")
-	if role != roleArn {
-		t.Errorf("Expected role to be %s, got %s", roleArn, role)
+	resp = cache.Get("default", "default")
+	if resp.RoleARN != roleArn {
+		t.Errorf("Expected role to be %s, got %s", roleArn, resp.RoleARN)
 	}
-	if aud != "sts.amazonaws.com" {
-		t.Errorf("Expected aud to be sts.amzonaws.com, got %s", aud)
+	if resp.Audience != "sts.amazonaws.com" {
+		t.Errorf("Expected aud to be sts.amzonaws.com, got %s", resp.Audience)
 	}
 
 }
+
+func TestSaCacheInformer(t *testing.T) {
+	ctx := context.Background()
+	newSA := func(name, role string) *v1.ServiceAccount {
+		return &v1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Annotations: map[string]string{"eks.amazonaws.com/role-arn": role},
+			},
+		}
+	}
+	// waitFor polls the cache until the role of a service account is as
+	// expected, an empty role expects the service account not to be cached
+	waitFor := func(c ServiceAccountCache, name, role string) {
+		t.Helper()
+		var resp *CacheResponse
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			resp = c.Get(name, "default")
+			if (role == "" && resp == nil) || (resp != nil && resp.RoleARN == role) {
+				return
+			}
+		}
+		t.Fatalf("Expected sa %s role %q, got %+v", name, role, resp)
+	}
+
+	clientset := fake.NewSimpleClientset(newSA("listed", "arn:aws:iam::111122223333:role/listed"))
+	c := New("sts.amazonaws.com", "eks.amazonaws.com", clientset)
+	if c.HasSynced() {
+		t.Fatal("Expected cache not to be synced before it is started")
+	}
+	c.Start()
+	for deadline := time.Now().Add(5 * time.Second); !c.HasSynced(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected cache to sync")
+		}
+	}
+	if resp := c.Get("listed", "default"); resp == nil || resp.RoleARN != "arn:aws:iam::111122223333:role/listed" {
+		t.Fatalf("Expected listed sa to be cached once synced, got %+v", resp)
+	}
+
+	added := newSA("added", "arn:aws:iam::111122223333:role/added")
+	if _, err := clientset.CoreV1().ServiceAccounts("default").Create(ctx, added, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(c, "added", "arn:aws:iam::111122223333:role/added")
+
+	updated := newSA("added", "arn:aws:iam::111122223333:role/updated")
+	if _, err := clientset.CoreV1().ServiceAccounts("default").Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(c, "added", "arn:aws:iam::111122223333:role/updated")
+
+	if err := clientset.CoreV1().ServiceAccounts("default").Delete(ctx, "added", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(c, "added", "")
+	waitFor(c, "listed", "arn:aws:iam::111122223333:role/listed")
+}
+
+func TestSaCacheWatchNamespaces(t *testing.T) {
+	var accounts []runtime.Object
+	for _, namespace := range []string{"irsa", "other"} {
+		accounts = append(accounts, &v1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "default",
+				Namespace:   namespace,
+				Annotations: map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/" + namespace},
+			},
+		})
+	}
+	clientset := fake.NewSimpleClientset(accounts...)
+	c := New("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithNamespaces([]string{"irsa"}))
+	c.Start()
+	for deadline := time.Now().Add(5 * time.Second); !c.HasSynced(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected cache to sync")
+		}
+	}
+
+	if resp := c.Get("default", "irsa"); resp == nil || resp.RoleARN != "arn:aws:iam::111122223333:role/irsa" {
+		t.Errorf("Expected sa of watched namespace to be cached, got %+v", resp)
+	}
+	if resp := c.Get("default", "other"); resp != nil {
+		t.Errorf("Expected sa of other namespace not to be cached, got %+v", resp)
+	}
+
+	misses := testutil.ToFloat64(cacheMissCounter)
+	found := testutil.ToFloat64(apiFallbackCounter.WithLabelValues("found"))
+	resp, err := c.Lookup(context.Background(), "default", "other")
+	if err != nil || resp == nil || resp.RoleARN != "arn:aws:iam::111122223333:role/other" {
+		t.Fatalf("Expected sa of other namespace to be fetched from the API server, got %+v, %v", resp, err)
+	}
+	if got := testutil.ToFloat64(cacheMissCounter) - misses; got != 0 {
+		t.Errorf("Expected lookups of unwatched namespaces not to count as cache misses, got %v", got)
+	}
+	if got := testutil.ToFloat64(apiFallbackCounter.WithLabelValues("found")) - found; got != 1 {
+		t.Errorf("Expected 1 found API fallback, got %v", got)
+	}
+}
+
+func TestSaCacheLabelSelector(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "selected", Namespace: "default", Labels: map[string]string{"irsa": "true"}}},
+		&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}},
+	)
+	c := New("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithLabelSelector("irsa=true"))
+	c.Start()
+	for deadline := time.Now().Add(5 * time.Second); !c.HasSynced(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected cache to sync")
+		}
+	}
+	if resp := c.Get("selected", "default"); resp == nil {
+		t.Error("Expected the selected sa to be cached")
+	}
+	if resp := c.Get("other", "default"); resp != nil {
+		t.Errorf("Expected the sa not matching the selector not to be cached, got %+v", resp)
+	}
+}
+
+func TestSaCacheEntryGauges(t *testing.T) {
+	for _, namespaceMetrics := range []bool{true, false} {
+		t.Run(fmt.Sprintf("NamespaceMetrics=%t", namespaceMetrics), func(t *testing.T) {
+			cacheEntriesByNamespace.Reset()
+			clientset := fake.NewSimpleClientset(
+				&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "one", Namespace: "gauge-a"}},
+			)
+			c := New("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithNamespaceMetrics(namespaceMetrics))
+			c.Start()
+			for deadline := time.Now().Add(5 * time.Second); !c.HasSynced(); time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("Expected cache to sync")
+				}
+			}
+
+			expect := func(entries int, byNamespace map[string]int) {
+				t.Helper()
+				if !namespaceMetrics {
+					byNamespace = nil
+				}
+				// The informer handlers run asynchronously
+				var got float64
+				for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+					if got = testutil.ToFloat64(cacheEntries); got == float64(entries) && len(c.List("")) == entries {
+						break
+					}
+				}
+				if got != float64(entries) {
+					t.Fatalf("Expected %d cache entries, got %v", entries, got)
+				}
+				if got := seriesCount(cacheEntriesByNamespace); got != len(byNamespace) {
+					t.Errorf("Expected %d namespace series, got %d", len(byNamespace), got)
+				}
+				for namespace, expected := range byNamespace {
+					if got := testutil.ToFloat64(cacheEntriesByNamespace.WithLabelValues(namespace)); got != float64(expected) {
+						t.Errorf("Expected %d cache entries in namespace %s, got %v", expected, namespace, got)
+					}
+				}
+			}
+			expect(1, map[string]int{"gauge-a": 1})
+
+			for _, sa := range []*v1.ServiceAccount{
+				{ObjectMeta: metav1.ObjectMeta{Name: "two", Namespace: "gauge-a"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "one", Namespace: "gauge-b"}},
+			} {
+				if _, err := clientset.CoreV1().ServiceAccounts(sa.Namespace).Create(context.Background(), sa, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expect(3, map[string]int{"gauge-a": 2, "gauge-b": 1})
+
+			if err := clientset.CoreV1().ServiceAccounts("gauge-b").Delete(context.Background(), "one", metav1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			expect(2, map[string]int{"gauge-a": 2})
+		})
+	}
+}
+
+func TestSaCacheDelete(t *testing.T) {
+	sa := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name:        "deleted",
+		Namespace:   "default",
+		Annotations: map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/deleted"},
+	}}
+	cases := []struct {
+		caseName string
+		deleted  interface{}
+	}{
+		{"Deleted", sa},
+		{"Tombstone", cache.DeletedFinalStateUnknown{Key: "default/deleted", Obj: sa}},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := New("sts.amazonaws.com", "eks.amazonaws.com", fake.NewSimpleClientset()).(*serviceAccountCache)
+			handler := saCache.eventHandler()
+			handler.OnAdd(sa.DeepCopy(), true)
+			if resp := saCache.Get("deleted", "default"); resp == nil {
+				t.Fatal("Expected the sa to be cached")
+			}
+			handler.OnDelete(c.deleted)
+			if resp := saCache.Get("deleted", "default"); resp != nil {
+				t.Errorf("Expected the deleted sa to be removed, got %+v", resp)
+			}
+			resp, err := saCache.Lookup(context.Background(), "deleted", "default")
+			if err != nil || resp != nil {
+				t.Errorf("Expected the deleted sa not to be found, got %+v, %v", resp, err)
+			}
+		})
+	}
+}
+
+// BenchmarkSaCacheMemory reports the heap used by the cache of 20000 service
+// accounts in 1000 namespaces, with all namespaces or 50 of them watched
+func BenchmarkSaCacheMemory(b *testing.B) {
+	const namespaceCount, accountsPerNamespace = 1000, 20
+	var accounts []runtime.Object
+	for i := 0; i < namespaceCount; i++ {
+		for j := 0; j < accountsPerNamespace; j++ {
+			accounts = append(accounts, &v1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        fmt.Sprintf("sa-%d", j),
+					Namespace:   fmt.Sprintf("ns-%d", i),
+					Annotations: map[string]string{"eks.amazonaws.com/role-arn": fmt.Sprintf("arn:aws:iam::111122223333:role/ns-%d-sa-%d", i, j)},
+				},
+			})
+		}
+	}
+	var watched []string
+	for i := 0; i < 50; i++ {
+		watched = append(watched, fmt.Sprintf("ns-%d", i))
+	}
+
+	cases := []struct {
+		caseName string
+		opts     []Option
+	}{
+		{"AllNamespaces", nil},
+		{"WatchNamespaces", []Option{WithNamespaces(watched)}},
+	}
+	for _, c := range cases {
+		b.Run(c.caseName, func(b *testing.B) {
+			clientset := fake.NewSimpleClientset(accounts...)
+			var heap uint64
+			for i := 0; i < b.N; i++ {
+				var before, after goruntime.MemStats
+				goruntime.GC()
+				goruntime.ReadMemStats(&before)
+				saCache := New("sts.amazonaws.com", "eks.amazonaws.com", clientset, c.opts...).(*serviceAccountCache)
+				ctx, cancel := context.WithCancel(context.Background())
+				go saCache.run(ctx)
+				for !saCache.HasSynced() {
+					time.Sleep(time.Millisecond)
+				}
+				goruntime.GC()
+				goruntime.ReadMemStats(&after)
+				if after.HeapAlloc > before.HeapAlloc {
+					heap += after.HeapAlloc - before.HeapAlloc
+				}
+				goruntime.KeepAlive(saCache)
+				// The informers of each iteration are stopped, so they
+				// don't count towards the next
+				cancel()
+			}
+			b.ReportMetric(float64(heap)/float64(b.N), "heap-bytes/op")
+		})
+	}
+}
+
+// fatServiceAccount returns a service account with the fields a cluster
+// typically adds, which the cache doesn't parse
+func fatServiceAccount(namespace, name string) *v1.ServiceAccount {
+	automount := false
+	return &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			UID:             types.UID(namespace + "-" + name),
+			ResourceVersion: "12345",
+			Labels:          map[string]string{"app.kubernetes.io/managed-by": "Helm", "app.kubernetes.io/name": name},
+			Annotations: map[string]string{
+				"eks.amazonaws.com/role-arn":               "arn:aws:iam::111122223333:role/" + name,
+				"eks.amazonaws.com/token-expiration":       "3600",
+				"eks.amazonaws.com/sts-regional-endpoints": "true",
+				"meta.helm.sh/release-name":                name,
+				"kubectl.kubernetes.io/last-applied-configuration": fmt.Sprintf(
+					`{"apiVersion":"v1","kind":"ServiceAccount","metadata":{"annotations":{"eks.amazonaws.com/role-arn":"arn:aws:iam::111122223333:role/%s"},"name":"%s","namespace":"%s"}}`,
+					name, name, namespace),
+			},
+			ManagedFields: []metav1.ManagedFieldsEntry{{
+				Manager:    "kubectl-client-side-apply",
+				Operation:  metav1.ManagedFieldsOperationUpdate,
+				APIVersion: "v1",
+				FieldsType: "FieldsV1",
+				FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{".":{},"f:eks.amazonaws.com/role-arn":{},"f:kubectl.kubernetes.io/last-applied-configuration":{}}}}`)},
+			}},
+		},
+		Secrets:                      []v1.ObjectReference{{Name: name + "-token-abcde"}},
+		ImagePullSecrets:             []v1.LocalObjectReference{{Name: "registry"}},
+		AutomountServiceAccountToken: &automount,
+	}
+}
+
+func TestSaCacheStripsServiceAccounts(t *testing.T) {
+	sa := fatServiceAccount("default", "s3-reader")
+	expected := ParseServiceAccount(sa, "eks.amazonaws.com", "sts.amazonaws.com")
+
+	c := New("sts.amazonaws.com", "eks.amazonaws.com", fake.NewSimpleClientset(sa.DeepCopy()))
+	c.Start()
+	for deadline := time.Now().Add(5 * time.Second); !c.HasSynced(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected cache to sync")
+		}
+	}
+	if resp := c.Get("s3-reader", "default"); !reflect.DeepEqual(resp, expected) {
+		t.Errorf("Expected the settings of the full service account %+v, got %+v", expected, resp)
+	}
+
+	obj, err := c.(*serviceAccountCache).stripServiceAccount(sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := obj.(*v1.ServiceAccount)
+	if len(stripped.ManagedFields) != 0 || len(stripped.Secrets) != 0 || len(stripped.ImagePullSecrets) != 0 || len(stripped.Labels) != 0 {
+		t.Errorf("Expected unparsed fields to be stripped, got %+v", stripped)
+	}
+	if len(stripped.Annotations) != 3 {
+		t.Errorf("Expected only the 3 prefixed annotations to be kept, got %v", stripped.Annotations)
+	}
+	if stripped.UID != sa.UID || stripped.Name != sa.Name || stripped.Namespace != sa.Namespace {
+		t.Errorf("Expected the identity of the service account to be kept, got %+v", stripped.ObjectMeta)
+	}
+	if resp := ParseServiceAccount(stripped, "eks.amazonaws.com", "sts.amazonaws.com"); !reflect.DeepEqual(resp, expected) {
+		t.Errorf("Expected the stripped service account to parse to %+v, got %+v", expected, resp)
+	}
+}
+
+// BenchmarkSaCacheStoreEntry reports the heap used per service account stored
+// by the informer, with full and stripped service accounts
+func BenchmarkSaCacheStoreEntry(b *testing.B) {
+	const count = 10000
+	c := &serviceAccountCache{annotationPrefix: "eks.amazonaws.com"}
+	cases := []struct {
+		caseName  string
+		transform func(interface{}) (interface{}, error)
+	}{
+		{"Full", func(obj interface{}) (interface{}, error) { return obj, nil }},
+		{"Stripped", c.stripServiceAccount},
+	}
+	for _, tc := range cases {
+		b.Run(tc.caseName, func(b *testing.B) {
+			var heap uint64
+			for i := 0; i < b.N; i++ {
+				var before, after goruntime.MemStats
+				goruntime.GC()
+				goruntime.ReadMemStats(&before)
+				store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+				for j := 0; j < count; j++ {
+					obj, _ := tc.transform(fatServiceAccount("default", fmt.Sprintf("sa-%d", j)))
+					if err := store.Add(obj); err != nil {
+						b.Fatal(err)
+					}
+				}
+				goruntime.GC()
+				goruntime.ReadMemStats(&after)
+				if after.HeapAlloc > before.HeapAlloc {
+					heap += after.HeapAlloc - before.HeapAlloc
+				}
+				goruntime.KeepAlive(store)
+			}
+			b.ReportMetric(float64(heap)/float64(b.N*count), "heap-bytes/entry")
+		})
+	}
+}
+
+func TestSaCacheAudienceWithoutRole(t *testing.T) {
+	testSA := &v1.ServiceAccount{}
+	testSA.Name = "default"
+	testSA.Namespace = "default"
+	testSA.Annotations = map[string]string{"eks.amazonaws.com/audience": "custom"}
+
+	cache := &serviceAccountCache{
+		cache:            map[string]*CacheResponse{},
+		defaultAudience:  "sts.amazonaws.com",
+		annotationPrefix: "eks.amazonaws.com",
+	}
+	cache.addSA(testSA)
+
+	resp := cache.Get("default", "default")
+	if resp.RoleARN != "" {
+		t.Errorf("Expected role to be empty, got %s", resp.RoleARN)
+	}
+	if resp.Audience != "custom" {
+		t.Errorf("Expected aud to be custom, got %s", resp.Audience)
+	}
+}
+
+func TestSaCacheRegionalSTS(t *testing.T) {
+	cases := []struct {
+		caseName string
+		value    *string
+		expected *bool
+	}{
+		{"True", stringPtr("true"), boolPtr(true)},
+		{"TrueUpperCase", stringPtr("TRUE"), boolPtr(true)},
+		{"False", stringPtr("false"), boolPtr(false)},
+		{"Missing", nil, nil},
+		{"Garbage", stringPtr("yes please"), nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testSA := &v1.ServiceAccount{}
+			testSA.Name = "default"
+			testSA.Namespace = "default"
+			testSA.Annotations = map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader"}
+			if c.value != nil {
+				testSA.Annotations["eks.amazonaws.com/sts-regional-endpoints"] = *c.value
+			}
+
+			cache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				defaultAudience:  "sts.amazonaws.com",
+				annotationPrefix: "eks.amazonaws.com",
+			}
+			cache.addSA(testSA)
+
+			resp := cache.Get("default", "default")
+			if (resp.UseRegionalSTS == nil) != (c.expected == nil) ||
+				(c.expected != nil && *resp.UseRegionalSTS != *c.expected) {
+				t.Errorf("Expected UseRegionalSTS to be %v, got %v", c.expected, resp.UseRegionalSTS)
+			}
+		})
+	}
+}
+
+func TestSaCacheTokenExpiration(t *testing.T) {
+	cases := []struct {
+		caseName string
+		value    *string
+		expected int64
+		invalid  string
+	}{
+		{"Valid", stringPtr("43200"), 43200, ""},
+		{"Missing", nil, 0, ""},
+		{"NotAnInteger", stringPtr("1h"), 0, `invalid eks.amazonaws.com/token-expiration value "1h", must be a positive number of seconds`},
+		{"Negative", stringPtr("-3600"), 0, `invalid eks.amazonaws.com/token-expiration value "-3600", must be a positive number of seconds`},
+		{"Overflow", stringPtr("99999999999999999999"), 0, `invalid eks.amazonaws.com/token-expiration value "99999999999999999999", out of range`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testSA := &v1.ServiceAccount{}
+			testSA.Name = "default"
+			testSA.Namespace = "default"
+			testSA.Annotations = map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader"}
+			if c.value != nil {
+				testSA.Annotations["eks.amazonaws.com/token-expiration"] = *c.value
+			}
+
+			cache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				defaultAudience:  "sts.amazonaws.com",
+				annotationPrefix: "eks.amazonaws.com",
+			}
+			before := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues("token-expiration"))
+			cache.addSA(testSA)
+			after := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues("token-expiration"))
+
+			resp := cache.Get("default", "default")
+			if resp.TokenExpiration != c.expected {
+				t.Errorf("Expected TokenExpiration to be %d, got %d", c.expected, resp.TokenExpiration)
+			}
+			if c.invalid != "" && after != before+1 {
+				t.Errorf("Expected invalid annotation counter to increase, got %v -> %v", before, after)
+			}
+			if c.invalid == "" && after != before {
+				t.Errorf("Expected invalid annotation counter to be unchanged, got %v -> %v", before, after)
+			}
+			var invalid []string
+			if c.invalid != "" {
+				invalid = []string{c.invalid}
+			}
+			if !reflect.DeepEqual(resp.InvalidAnnotations, invalid) {
+				t.Errorf("Expected InvalidAnnotations %q, got %q", invalid, resp.InvalidAnnotations)
+			}
+		})
+	}
+}
+
+func TestSaCacheMountPath(t *testing.T) {
+	cases := []struct {
+		caseName string
+		value    string
+		expected string
+	}{
+		{"Absolute", "/var/run/secrets/aws", "/var/run/secrets/aws"},
+		{"TrailingSlash", "/var/run/secrets/aws/", "/var/run/secrets/aws"},
+		{"Relative", "var/run/secrets/aws", ""},
+		{"ParentDirectory", "/var/run/../secrets", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testSA := &v1.ServiceAccount{}
+			testSA.Name = "default"
+			testSA.Namespace = "default"
+			testSA.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn":         "arn:aws:iam::111122223333:role/s3-reader",
+				"eks.amazonaws.com/token-mount-path": c.value,
+			}
+
+			cache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				defaultAudience:  "sts.amazonaws.com",
+				annotationPrefix: "eks.amazonaws.com",
+			}
+			cache.addSA(testSA)
+
+			resp := cache.Get("default", "default")
+			if resp.MountPath != c.expected {
+				t.Errorf("Expected MountPath to be %q, got %q", c.expected, resp.MountPath)
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestSaCacheForceEnvOverride(t *testing.T) {
+	cases := []struct {
+		caseName string
+		value    *string
+		expected bool
+	}{
+		{"True", stringPtr("True"), true},
+		{"False", stringPtr("false"), false},
+		{"Missing", nil, false},
+		{"Garbage", stringPtr("always"), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testSA := &v1.ServiceAccount{}
+			testSA.Name = "default"
+			testSA.Namespace = "default"
+			testSA.Annotations = map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader"}
+			if c.value != nil {
+				testSA.Annotations["eks.amazonaws.com/force-env-override"] = *c.value
+			}
+
+			cache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				defaultAudience:  "sts.amazonaws.com",
+				annotationPrefix: "eks.amazonaws.com",
+			}
+			cache.addSA(testSA)
+
+			resp := cache.Get("default", "default")
+			if resp.ForceEnvOverride != c.expected {
+				t.Errorf("Expected ForceEnvOverride to be %t, got %t", c.expected, resp.ForceEnvOverride)
+			}
+		})
+	}
+}
+
+func TestSaCacheTokenFileName(t *testing.T) {
+	cases := []struct {
+		caseName string
+		value    *string
+		expected string
+		invalid  bool
+	}{
+		{"Valid", stringPtr("oidc-token"), "oidc-token", false},
+		{"Missing", nil, "", false},
+		{"Empty", stringPtr(""), "", true},
+		{"Path", stringPtr("dir/token"), "", true},
+		{"WindowsPath", stringPtr(`dir\token`), "", true},
+		{"Parent", stringPtr(".."), "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testSA := &v1.ServiceAccount{}
+			testSA.Name = "default"
+			testSA.Namespace = "default"
+			testSA.Annotations = map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader"}
+			if c.value != nil {
+				testSA.Annotations["eks.amazonaws.com/token-file-name"] = *c.value
+			}
+
+			cache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				defaultAudience:  "sts.amazonaws.com",
+				annotationPrefix: "eks.amazonaws.com",
+			}
+			before := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues("token-file-name"))
+			cache.addSA(testSA)
+			after := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues("token-file-name"))
+
+			resp := cache.Get("default", "default")
+			if resp.TokenFileName != c.expected {
+				t.Errorf("Expected TokenFileName to be %q, got %q", c.expected, resp.TokenFileName)
+			}
+			if c.invalid && after != before+1 {
+				t.Errorf("Expected invalid annotation counter to increase, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestSaCacheTokenFileMode(t *testing.T) {
+	cases := []struct {
+		caseName string
+		value    *string
+		expected int32
+		invalid  bool
+	}{
+		{"OwnerRead", stringPtr("0400"), 256, false},
+		{"GroupRead", stringPtr("0640"), 416, false},
+		{"Missing", nil, -1, false},
+		{"Decimal", stringPtr("0900"), -1, true},
+		{"TooLarge", stringPtr("01777"), -1, true},
+		{"Symbolic", stringPtr("rw-r-----"), -1, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testSA := &v1.ServiceAccount{}
+			testSA.Name = "default"
+			testSA.Namespace = "default"
+			testSA.Annotations = map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader"}
+			if c.value != nil {
+				testSA.Annotations["eks.amazonaws.com/token-file-mode"] = *c.value
+			}
+
+			cache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				defaultAudience:  "sts.amazonaws.com",
+				annotationPrefix: "eks.amazonaws.com",
+			}
+			before := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues("token-file-mode"))
+			cache.addSA(testSA)
+			after := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues("token-file-mode"))
+
+			resp := cache.Get("default", "default")
+			if c.expected < 0 && resp.TokenFileMode != nil {
+				t.Errorf("Expected TokenFileMode to be unset, got %d", *resp.TokenFileMode)
+			}
+			if c.expected >= 0 && (resp.TokenFileMode == nil || *resp.TokenFileMode != c.expected) {
+				t.Errorf("Expected TokenFileMode to be %d, got %v", c.expected, resp.TokenFileMode)
+			}
+			if c.invalid && after != before+1 {
+				t.Errorf("Expected invalid annotation counter to increase, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestSaCacheCredentialMode(t *testing.T) {
+	cases := []struct {
+		caseName string
+		value    *string
+		expected bool
+		invalid  bool
+	}{
+		{"Container", stringPtr("container"), true, false},
+		{"ContainerUpperCase", stringPtr("CONTAINER"), true, false},
+		{"IRSA", stringPtr("irsa"), false, false},
+		{"Missing", nil, false, false},
+		{"Garbage", stringPtr("agent"), false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testSA := &v1.ServiceAccount{}
+			testSA.Name = "default"
+			testSA.Namespace = "default"
+			testSA.Annotations = map[string]string{}
+			if c.value != nil {
+				testSA.Annotations["eks.amazonaws.com/credential-mode"] = *c.value
+			}
+
+			cache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				defaultAudience:  "sts.amazonaws.com",
+				annotationPrefix: "eks.amazonaws.com",
+			}
+			before := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues("credential-mode"))
+			cache.addSA(testSA)
+			after := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues("credential-mode"))
+
+			resp := cache.Get("default", "default")
+			if resp.ContainerCredentials != c.expected {
+				t.Errorf("Expected ContainerCredentials to be %t, got %t", c.expected, resp.ContainerCredentials)
+			}
+			if c.invalid && after != before+1 {
+				t.Errorf("Expected invalid annotation counter to increase, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestSaCacheLookup(t *testing.T) {
+	uncached := &v1.ServiceAccount{}
+	uncached.Name = "uncached"
+	uncached.Namespace = "default"
+	uncached.Annotations = map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-writer"}
+
+	cases := []struct {
+		caseName    string
+		name        string
+		lookupErr   error
+		expected    string
+		expectedErr bool
+		// fallback is the result of the API server lookup, empty for cache
+		// hits
+		fallback string
+	}{
+		{"Cached", "default", nil, "arn:aws:iam::111122223333:role/s3-reader", false, ""},
+		{"CachedWithAPIError", "default", errors.New("connection refused"), "arn:aws:iam::111122223333:role/s3-reader", false, ""},
+		{"Uncached", "uncached", nil, "arn:aws:iam::111122223333:role/s3-writer", false, "found"},
+		{"NotFound", "missing", nil, "", false, "not-found"},
+		{"APIError", "uncached", errors.New("connection refused"), "", true, "error"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(uncached)
+			if c.lookupErr != nil {
+				clientset.PrependReactor("get", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, c.lookupErr
+				})
+			}
+			cache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				defaultAudience:  "sts.amazonaws.com",
+				annotationPrefix: "eks.amazonaws.com",
+				clientset:        clientset,
+			}
+			cache.set("default", "default", &CacheResponse{RoleARN: "arn:aws:iam::111122223333:role/s3-reader"})
+
+			hits := testutil.ToFloat64(cacheHitCounter)
+			misses := testutil.ToFloat64(cacheMissCounter)
+			fallbacks := map[string]float64{}
+			for _, result := range []string{"found", "not-found", "error"} {
+				fallbacks[result] = testutil.ToFloat64(apiFallbackCounter.WithLabelValues(result))
+			}
+
+			resp, err := cache.Lookup(context.Background(), c.name, "default")
+			if (err != nil) != c.expectedErr {
+				t.Fatalf("Expected error %v, got %v", c.expectedErr, err)
+			}
+			role := ""
+			if resp != nil {
+				role = resp.RoleARN
+			}
+			if role != c.expected {
+				t.Errorf("Expected role %q, got %q", c.expected, role)
+			}
+
+			expectedHits, expectedMisses := 1.0, 0.0
+			if c.fallback != "" {
+				expectedHits, expectedMisses = 0, 1
+			}
+			if got := testutil.ToFloat64(cacheHitCounter) - hits; got != expectedHits {
+				t.Errorf("Expected %v cache hits, got %v", expectedHits, got)
+			}
+			if got := testutil.ToFloat64(cacheMissCounter) - misses; got != expectedMisses {
+				t.Errorf("Expected %v cache misses, got %v", expectedMisses, got)
+			}
+			for result, before := range fallbacks {
+				expected := 0.0
+				if result == c.fallback {
+					expected = 1
+				}
+				if got := testutil.ToFloat64(apiFallbackCounter.WithLabelValues(result)) - before; got != expected {
+					t.Errorf("Expected %v %s API fallbacks, got %v", expected, result, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSaCacheLookupFallback(t *testing.T) {
+	raced := &v1.ServiceAccount{}
+	raced.Name = "raced"
+	raced.Namespace = "default"
+	raced.Annotations = map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/raced"}
+
+	cases := []struct {
+		caseName string
+		// apiDelay is how long the service account is missing from the API
+		// server, -1 if it is never created
+		apiDelay time.Duration
+		// informerDelay is how long the informer takes to add the service
+		// account, -1 if it doesn't
+		informerDelay time.Duration
+		retryDelay    time.Duration
+		expected      string
+		outcome       string
+	}{
+		{"InAPI", 0, -1, 0, "arn:aws:iam::111122223333:role/raced", "found"},
+		{"NotFound", -1, -1, 0, "", "not-found"},
+		{"NotFoundRetryDisabled", 20 * time.Millisecond, -1, 0, "", "not-found"},
+		{"FoundInAPIOnRetry", 20 * time.Millisecond, -1, 100 * time.Millisecond, "arn:aws:iam::111122223333:role/raced", "found"},
+		{"CachedByInformerOnRetry", -1, 20 * time.Millisecond, 100 * time.Millisecond, "arn:aws:iam::111122223333:role/raced", "found"},
+		{"NotFoundOnRetry", -1, -1, 20 * time.Millisecond, "", "not-found"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			created := time.Now().Add(c.apiDelay)
+			clientset.PrependReactor("get", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if c.apiDelay < 0 || time.Now().Before(created) {
+					return true, nil, apierrors.NewNotFound(v1.Resource("serviceaccounts"), "raced")
+				}
+				return true, raced.DeepCopy(), nil
+			})
+			cache := &serviceAccountCache{
+				cache:              map[string]*CacheResponse{},
+				defaultAudience:    "sts.amazonaws.com",
+				annotationPrefix:   "eks.amazonaws.com",
+				clientset:          clientset,
+				lookupTimeout:      DefaultLookupTimeout,
+				notFoundRetryDelay: c.retryDelay,
+			}
+			if c.informerDelay >= 0 {
+				informed := time.AfterFunc(c.informerDelay, func() { cache.addSA(raced.DeepCopy()) })
+				defer informed.Stop()
+			}
+
+			misses := testutil.ToFloat64(cacheMissCounter)
+			outcomes := testutil.ToFloat64(apiFallbackCounter.WithLabelValues(c.outcome))
+			resp, err := cache.Lookup(context.Background(), "raced", "default")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			role := ""
+			if resp != nil {
+				role = resp.RoleARN
+			}
+			if role != c.expected {
+				t.Errorf("Expected role %q, got %q", c.expected, role)
+			}
+			if got := testutil.ToFloat64(cacheMissCounter) - misses; got != 1 {
+				t.Errorf("Expected 1 cache miss, got %v", got)
+			}
+			if got := testutil.ToFloat64(apiFallbackCounter.WithLabelValues(c.outcome)) - outcomes; got != 1 {
+				t.Errorf("Expected 1 %s lookup, got %v", c.outcome, got)
+			}
+		})
+	}
+}
+
+func TestSaCacheLookupRetryCanceled(t *testing.T) {
+	cache := &serviceAccountCache{
+		cache:              map[string]*CacheResponse{},
+		clientset:          fake.NewSimpleClientset(),
+		notFoundRetryDelay: time.Minute,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	resp, err := cache.Lookup(ctx, "missing", "default")
+	if err == nil || resp != nil {
+		t.Errorf("Expected the canceled retry to fail, got %+v, %v", resp, err)
+	}
+}
+
+func TestSaCacheLookupThrottled(t *testing.T) {
+	sa := &v1.ServiceAccount{}
+	sa.Name = "uncached"
+	sa.Namespace = "default"
+	sa.Annotations = map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-writer"}
+	clientset := fake.NewSimpleClientset(sa)
+	fakeClock := clocktesting.NewFakePassiveClock(time.Now())
+	cache := &serviceAccountCache{
+		cache:            map[string]*CacheResponse{},
+		annotationPrefix: "eks.amazonaws.com",
+		clientset:        clientset,
+		fallbackLimiter:  flowcontrol.NewTokenBucketPassiveRateLimiterWithClock(1, 2, fakeClock),
+	}
+
+	lookup := func(expectThrottled bool) {
+		t.Helper()
+		throttled := testutil.ToFloat64(apiFallbackCounter.WithLabelValues("throttled"))
+		resp, err := cache.Lookup(context.Background(), "uncached", "default")
+		if expectThrottled {
+			if !errors.Is(err, errFallbackThrottled) || resp != nil {
+				t.Errorf("Expected the lookup to be throttled, got %+v, %v", resp, err)
+			}
+			if got := testutil.ToFloat64(apiFallbackCounter.WithLabelValues("throttled")) - throttled; got != 1 {
+				t.Errorf("Expected 1 throttled API fallback, got %v", got)
+			}
+			return
+		}
+		if err != nil || resp == nil || resp.RoleARN != "arn:aws:iam::111122223333:role/s3-writer" {
+			t.Errorf("Expected the sa to be fetched, got %+v, %v", resp, err)
+		}
+	}
+
+	// The burst is allowed, then lookups fail until a token is refilled
+	lookup(false)
+	lookup(false)
+	lookup(true)
+	fakeClock.SetTime(fakeClock.Now().Add(500 * time.Millisecond))
+	lookup(true)
+	fakeClock.SetTime(fakeClock.Now().Add(500 * time.Millisecond))
+	lookup(false)
+	lookup(true)
+	if got := len(clientset.Actions()); got != 3 {
+		t.Errorf("Expected 3 API server lookups, got %d", got)
+	}
+}
+
+func TestValidateFallbackRateLimit(t *testing.T) {
+	cases := []struct {
+		qps     float32
+		burst   int
+		invalid bool
+	}{
+		{10, 20, false},
+		{0, 0, false},
+		{0.5, 1, false},
+		{-1, 20, true},
+		{10, 0, true},
+	}
+	for _, c := range cases {
+		if err := ValidateFallbackRateLimit(c.qps, c.burst); (err != nil) != c.invalid {
+			t.Errorf("Expected qps %v and burst %d invalid %t, got %v", c.qps, c.burst, c.invalid, err)
+		}
+	}
+}
+
+func TestSaCacheInvalidAnnotations(t *testing.T) {
+	cases := []struct {
+		annotation string
+		value      string
+		reason     string
+	}{
+		{"sts-regional-endpoints", "yes please", "must be true or false"},
+		{"token-expiration", "1h", "must be a positive number of seconds"},
+		{"token-mount-path", "relative/path", "must be an absolute path"},
+		{"extra-token-mount-path", "/var/run/../secrets", "must be an absolute path"},
+		{"default-fs-group", "-1", "must be a non-negative integer"},
+		{"token-file-name", "dir/token", "must be a file name"},
+		{"token-file-mode", "0999", "must be an octal mode"},
+		{"disable-imds-fallback", "maybe", "must be true or false"},
+		{"credential-mode", "pod-identity", "must be container or irsa"},
+		{"force-env-override", "always", "must be true or false"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.annotation, func(t *testing.T) {
+			testSA := &v1.ServiceAccount{}
+			testSA.Name = "default"
+			testSA.Namespace = "default"
+			testSA.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn":        "arn:aws:iam::111122223333:role/s3-reader",
+				"eks.amazonaws.com/" + c.annotation: c.value,
+			}
+
+			cache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				defaultAudience:  "sts.amazonaws.com",
+				annotationPrefix: "eks.amazonaws.com",
+			}
+			before := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues(c.annotation))
+			cache.addSA(testSA)
+			after := testutil.ToFloat64(invalidAnnotationCounter.WithLabelValues(c.annotation))
+
+			if after != before+1 {
+				t.Errorf("Expected invalid annotation counter to increase, got %v -> %v", before, after)
+			}
+			resp := cache.Get("default", "default")
+			invalid := []string{fmt.Sprintf("invalid eks.amazonaws.com/%s value %q, %s", c.annotation, c.value, c.reason)}
+			if !reflect.DeepEqual(resp.InvalidAnnotations, invalid) {
+				t.Errorf("Expected InvalidAnnotations %q, got %q", invalid, resp.InvalidAnnotations)
+			}
+			// Invalid values fall back to the defaults of a service account
+			// with the role only
+			want := &CacheResponse{
+				RoleARN:            "arn:aws:iam::111122223333:role/s3-reader",
+				Audience:           "sts.amazonaws.com",
+				DefaultAudience:    true,
+				InvalidAnnotations: invalid,
+			}
+			if !reflect.DeepEqual(resp, want) {
+				t.Errorf("Expected defaults %+v, got %+v", want, resp)
+			}
+		})
+	}
+}
+
+func TestSaCacheSecondaryAnnotationPrefix(t *testing.T) {
+	cases := []struct {
+		caseName           string
+		annotations        map[string]string
+		expectedRole       string
+		expectedAudience   string
+		expectedPrefix     string
+		expectedDeprecated string
+	}{
+		{
+			"Primary",
+			map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/primary"},
+			"arn:aws:iam::111122223333:role/primary", "sts.amazonaws.com", "eks.amazonaws.com", "",
+		},
+		{
+			"SecondaryOnly",
+			map[string]string{"irsa.mycorp.io/role-arn": "arn:aws:iam::111122223333:role/secondary", "irsa.mycorp.io/audience": "custom"},
+			"arn:aws:iam::111122223333:role/secondary", "custom", "irsa.mycorp.io", "irsa.mycorp.io",
+		},
+		{
+			"Conflicting",
+			map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/primary",
+				"irsa.mycorp.io/role-arn":    "arn:aws:iam::111122223333:role/secondary",
+				"irsa.mycorp.io/audience":    "custom",
+			},
+			"arn:aws:iam::111122223333:role/primary", "sts.amazonaws.com", "eks.amazonaws.com", "",
+		},
+		{
+			"RoleWithSecondary",
+			map[string]string{"eks.amazonaws.com/audience": "custom", "irsa.mycorp.io/role-arn": "arn:aws:iam::111122223333:role/secondary"},
+			"arn:aws:iam::111122223333:role/secondary", "sts.amazonaws.com", "irsa.mycorp.io", "irsa.mycorp.io",
+		},
+		{
+			"AudienceOnlySecondary",
+			map[string]string{"irsa.mycorp.io/audience": "custom"},
+			"", "custom", "irsa.mycorp.io", "irsa.mycorp.io",
+		},
+		{"Unannotated", nil, "", "sts.amazonaws.com", "", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			sa := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "default", Annotations: c.annotations}}
+			saCache := New("sts.amazonaws.com", "eks.amazonaws.com", fake.NewSimpleClientset(), WithSecondaryAnnotationPrefixes("irsa.mycorp.io")).(*serviceAccountCache)
+
+			// All prefixed annotations are kept by the informer transform
+			stripped, err := saCache.stripServiceAccount(sa)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stripped.(*v1.ServiceAccount).Annotations; len(got) != len(c.annotations) {
+				t.Errorf("Expected annotations %v to be kept, got %v", c.annotations, got)
+			}
+
+			matches := map[string]float64{}
+			for _, prefix := range []string{"eks.amazonaws.com", "irsa.mycorp.io"} {
+				matches[prefix] = testutil.ToFloat64(annotationPrefixCounter.WithLabelValues(prefix))
+			}
+			resp := saCache.parse(stripped.(*v1.ServiceAccount))
+			if resp.RoleARN != c.expectedRole || resp.Audience != c.expectedAudience {
+				t.Errorf("Expected role %q and audience %q, got %q and %q", c.expectedRole, c.expectedAudience, resp.RoleARN, resp.Audience)
+			}
+			if resp.DeprecatedAnnotationPrefix != c.expectedDeprecated {
+				t.Errorf("Expected deprecated prefix %q, got %q", c.expectedDeprecated, resp.DeprecatedAnnotationPrefix)
+			}
+			for prefix, before := range matches {
+				expected := before
+				if prefix == c.expectedPrefix {
+					expected++
+				}
+				if got := testutil.ToFloat64(annotationPrefixCounter.WithLabelValues(prefix)); got != expected {
+					t.Errorf("Expected %v matches of prefix %s, got %v", expected, prefix, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBool(t *testing.T) {
+	cases := []struct {
+		value          string
+		lenient        bool
+		expectedParsed bool
+		expectedOK     bool
+	}{
+		{"true", false, true, true},
+		{"false", false, false, true},
+		{"True", false, true, true},
+		{"FALSE", false, false, true},
+		{" true", false, true, true},
+		{"false\n", false, false, true},
+		{"\tTrue ", false, true, true},
+		{"yes", false, false, false},
+		{"no", false, false, false},
+		{"on", false, false, false},
+		{"off", false, false, false},
+		{"yes", true, true, true},
+		{" No ", true, false, true},
+		{"ON", true, true, true},
+		{"off", true, false, true},
+		{"", true, false, false},
+		{"1", true, false, false},
+		{"t", true, false, false},
+		{"y", true, false, false},
+		{"tru e", true, false, false},
+		{"yes please", true, false, false},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%q/lenient=%v", c.value, c.lenient), func(t *testing.T) {
+			parsed, ok := ParseBool(c.value, c.lenient)
+			if parsed != c.expectedParsed || ok != c.expectedOK {
+				t.Errorf("Expected %v, %v, got %v, %v", c.expectedParsed, c.expectedOK, parsed, ok)
+			}
+		})
+	}
+}
+
+func TestSaCacheTrimmedAnnotations(t *testing.T) {
+	testSA := &v1.ServiceAccount{}
+	testSA.Name = "default"
+	testSA.Namespace = "default"
+	testSA.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn":               " arn:aws:iam::111122223333:role/s3-reader\n",
+		"eks.amazonaws.com/sts-regional-endpoints": " True",
+		"eks.amazonaws.com/token-expiration":       "3600 ",
+		"eks.amazonaws.com/token-mount-path":       " /var/run/secrets/token",
+		"eks.amazonaws.com/disable-imds-fallback":  "yes",
+		"eks.amazonaws.com/force-env-override":     "On",
+	}
+
+	for _, lenient := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lenient=%v", lenient), func(t *testing.T) {
+			resp := ParseServiceAccount(testSA, "eks.amazonaws.com", "sts.amazonaws.com", WithLenientBooleans(lenient))
+			if resp.RoleARN != "arn:aws:iam::111122223333:role/s3-reader" {
+				t.Errorf("Expected a trimmed role ARN, got %q", resp.RoleARN)
+			}
+			if resp.UseRegionalSTS == nil || !*resp.UseRegionalSTS {
+				t.Errorf("Expected regional STS, got %v", resp.UseRegionalSTS)
+			}
+			if resp.TokenExpiration != 3600 || resp.MountPath != "/var/run/secrets/token" {
+				t.Errorf("Expected expiration 3600 and mount path /var/run/secrets/token, got %d and %q", resp.TokenExpiration, resp.MountPath)
+			}
+			disabled := resp.DisableIMDSFallback != nil && *resp.DisableIMDSFallback
+			if disabled != lenient || resp.ForceEnvOverride != lenient {
+				t.Errorf("Expected yes and On to be %v, got disable-imds-fallback %v and force-env-override %v", lenient, resp.DisableIMDSFallback, resp.ForceEnvOverride)
+			}
+			invalid := 2
+			if lenient {
+				invalid = 0
+			}
+			if len(resp.InvalidAnnotations) != invalid {
+				t.Errorf("Expected %d invalid annotations, got %q", invalid, resp.InvalidAnnotations)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+var (
+	configMapLoadErrorCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "configmap_load_errors_total",
+			Help: "Counter of ignored malformed versions of the role mapping configmap.",
+		},
+	)
+	configMapVersionGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "configmap_active_resource_version",
+			Help: "The resourceVersion of the active role mapping configmap, with the number of mappings as value.",
+		},
+		[]string{"namespace", "name", "resource_version"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(configMapLoadErrorCounter)
+	prometheus.MustRegister(configMapVersionGauge)
+}
+
+// ConfigMapCache is a cache of service account settings read from a ConfigMap.
+// It is used as a fallback for service accounts without a role annotation.
+type ConfigMapCache interface {
+	Start()
+	// Get returns a copy of the mapped settings of a service account, or nil if
+	// the service account is not mapped
+	Get(name, namespace string) *CacheResponse
+	// List returns copies of the mapped settings of the service accounts of
+	// a namespace, or of all namespaces if namespace is empty, sorted by
+	// namespace and name
+	List(namespace string) []CachedServiceAccount
+}
+
+// configMapEntry is a single service account mapping in the ConfigMap
+type configMapEntry struct {
+	RoleARN              string `json:"roleARN"`
+	Audience             string `json:"audience"`
+	RegionalSTSEndpoints *bool  `json:"regionalSTSEndpoints"`
+}
+
+// configMapMapping is the parsed mappings of a version of the ConfigMap. It is
+// not modified once loaded, new versions replace it.
+type configMapMapping struct {
+	entries map[string]*CacheResponse
+	// resourceVersion is the resourceVersion of the ConfigMap, empty if no
+	// ConfigMap is loaded
+	resourceVersion string
+}
+
+type configMapCache struct {
+	mapping         atomic.Pointer[configMapMapping]
+	controller      cache.Controller
+	name            string
+	namespace       string
+	defaultAudience string
+}
+
+func (c *configMapCache) Get(name, namespace string) *CacheResponse {
+	klog.V(5).Infof("Fetching sa %s/%s from configmap cache", namespace, name)
+	mapping := c.mapping.Load()
+	if mapping == nil {
+		return nil
+	}
+	resp, ok := mapping.entries[namespace+"/"+name]
+	if !ok {
+		return nil
+	}
+	respCopy := *resp
+	return &respCopy
+}
+
+func (c *configMapCache) List(namespace string) []CachedServiceAccount {
+	mapping := c.mapping.Load()
+	if mapping == nil {
+		return nil
+	}
+	return listEntries(mapping.entries, namespace)
+}
+
+// parse reads the service account mappings of a ConfigMap. ConfigMap keys can't
+// contain a '/', so each data value is a JSON object mapping
+// "namespace/serviceaccount" keys to settings. A malformed value or entry fails
+// the whole ConfigMap, so a typo can't drop the roles of other service
+// accounts.
+func (c *configMapCache) parse(cm *v1.ConfigMap) (map[string]*CacheResponse, error) {
+	mapping := map[string]*CacheResponse{}
+	for key, value := range cm.Data {
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(value), &entries); err != nil {
+			return nil, fmt.Errorf("invalid key %s: %v", key, err)
+		}
+		for sa, raw := range entries {
+			if namespace, name, err := cache.SplitMetaNamespaceKey(sa); err != nil || namespace == "" || name == "" {
+				return nil, fmt.Errorf("invalid entry %s of key %s: must be namespace/serviceaccount", sa, key)
+			}
+			var entry configMapEntry
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return nil, fmt.Errorf("invalid entry %s of key %s: %v", sa, key, err)
+			}
+			if !strings.HasPrefix(entry.RoleARN, "arn:") {
+				return nil, fmt.Errorf("invalid entry %s of key %s: roleARN %q is not an ARN", sa, key, entry.RoleARN)
+			}
+			if _, ok := mapping[sa]; ok {
+				return nil, fmt.Errorf("invalid entry %s of key %s: mapped by another key", sa, key)
+			}
+			resp := &CacheResponse{
+				RoleARN:        entry.RoleARN,
+				Audience:       entry.Audience,
+				UseRegionalSTS: entry.RegionalSTSEndpoints,
+			}
+			if resp.Audience == "" {
+				resp.Audience = c.defaultAudience
+				resp.DefaultAudience = true
+			}
+			mapping[sa] = resp
+		}
+	}
+	return mapping, nil
+}
+
+// update replaces all mappings with the mappings of the ConfigMap. A malformed
+// ConfigMap is logged and counted, and the last loaded mappings are kept.
+func (c *configMapCache) update(cm *v1.ConfigMap) {
+	klog.V(5).Infof("Loading configmap %s/%s", cm.Namespace, cm.Name)
+	entries, err := c.parse(cm)
+	if err != nil {
+		klog.Errorf("Ignoring configmap %s/%s at resourceVersion %s, keeping the mappings of resourceVersion %q: %v",
+			cm.Namespace, cm.Name, cm.ResourceVersion, c.resourceVersion(), err)
+		configMapLoadErrorCounter.Inc()
+		return
+	}
+	c.swap(&configMapMapping{entries: entries, resourceVersion: cm.ResourceVersion})
+}
+
+func (c *configMapCache) clear() {
+	klog.V(5).Infof("Removing configmap %s/%s mappings", c.namespace, c.name)
+	c.swap(&configMapMapping{entries: map[string]*CacheResponse{}})
+}
+
+// swap replaces the active mappings and updates the active resourceVersion
+// gauge
+func (c *configMapCache) swap(mapping *configMapMapping) {
+	c.mapping.Store(mapping)
+	configMapVersionGauge.Reset()
+	if mapping.resourceVersion != "" {
+		configMapVersionGauge.WithLabelValues(c.namespace, c.name, mapping.resourceVersion).Set(float64(len(mapping.entries)))
+	}
+}
+
+// resourceVersion returns the resourceVersion of the active mappings
+func (c *configMapCache) resourceVersion() string {
+	if mapping := c.mapping.Load(); mapping != nil {
+		return mapping.resourceVersion
+	}
+	return ""
+}
+
+// NewConfigMapCache returns a ConfigMapCache backed by an informer watching
+// the named ConfigMap
+func NewConfigMapCache(name, namespace, defaultAudience string, clientset kubernetes.Interface, opts ...InformerOption) ConfigMapCache {
+	c := &configMapCache{
+		name:            name,
+		namespace:       namespace,
+		defaultAudience: defaultAudience,
+	}
+
+	c.controller = newInformer(
+		"configmaps",
+		newConfigMapListWatch(name, namespace, clientset),
+		&v1.ConfigMap{},
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				cm := obj.(*v1.ConfigMap)
+				if cm.Name == c.name {
+					c.update(cm)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				cm, ok := obj.(*v1.ConfigMap)
+				if !ok || cm.Name == c.name {
+					c.clear()
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				cm := newObj.(*v1.ConfigMap)
+				if cm.Name == c.name {
+					c.update(cm)
+				}
+			},
+		},
+		newInformerConfig(opts),
+	)
+	return c
+}
+
+func (c *configMapCache) Start() {
+	go c.controller.Run(make(chan struct{}))
+}
+
+// newConfigMapListWatch returns a ListWatch for a single named ConfigMap
+func newConfigMapListWatch(name, namespace string, clientset kubernetes.Interface) *cache.ListWatch {
+	selector := fields.OneTermEqualSelector("metadata.name", name).String()
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().ConfigMaps(namespace).List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().ConfigMaps(namespace).Watch(context.TODO(), options)
+		},
+	}
+}
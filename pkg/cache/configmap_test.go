@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapCacheParse(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook", Namespace: "eks", ResourceVersion: "1"},
+		Data: map[string]string{
+			"config": `{
+				"default/s3-reader": {"roleARN": "arn:aws:iam::111122223333:role/s3-reader", "regionalSTSEndpoints": true},
+				"default/custom": {"roleARN": "arn:aws:iam::111122223333:role/custom", "audience": "custom"}
+			}`,
+			"other": `{"other/default": {"roleARN": "arn:aws:iam::111122223333:role/other"}}`,
+		},
+	}
+	c := &configMapCache{
+		name:            "pod-identity-webhook",
+		namespace:       "eks",
+		defaultAudience: "sts.amazonaws.com",
+	}
+	c.update(cm)
+
+	resp := c.Get("s3-reader", "default")
+	if resp == nil {
+		t.Fatalf("Expected a response for default/s3-reader")
+	}
+	if resp.RoleARN != "arn:aws:iam::111122223333:role/s3-reader" {
+		t.Errorf("Unexpected role %s", resp.RoleARN)
+	}
+	if resp.Audience != "sts.amazonaws.com" {
+		t.Errorf("Expected default audience, got %s", resp.Audience)
+	}
+	if resp.UseRegionalSTS == nil || !*resp.UseRegionalSTS {
+		t.Errorf("Expected UseRegionalSTS to be true")
+	}
+	if resp := c.Get("custom", "default"); resp == nil || resp.Audience != "custom" {
+		t.Errorf("Expected audience custom for default/custom, got %+v", resp)
+	}
+	if resp := c.Get("default", "other"); resp == nil || resp.RoleARN != "arn:aws:iam::111122223333:role/other" {
+		t.Errorf("Expected role of key other for other/default, got %+v", resp)
+	}
+	if got := testutil.ToFloat64(configMapVersionGauge.WithLabelValues("eks", "pod-identity-webhook", "1")); got != 3 {
+		t.Errorf("Expected 3 mappings at the active resourceVersion, got %v", got)
+	}
+}
+
+// seriesCount returns the number of series of a collector
+func seriesCount(collector prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 100)
+	collector.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestConfigMapCacheMalformed(t *testing.T) {
+	cases := []struct {
+		caseName string
+		data     map[string]string
+	}{
+		{"InvalidJSON", map[string]string{"garbage": `{"default/garbage": `}},
+		{"InvalidEntry", map[string]string{"config": `{"default/malformed": {"roleARN": 1234}}`}},
+		{"MissingRole", map[string]string{"config": `{"default/no-role": {"audience": "custom"}}`}},
+		{"InvalidRole", map[string]string{"config": `{"default/name": {"roleARN": "s3-reader"}}`}},
+		{"InvalidKey", map[string]string{"config": `{"default": {"roleARN": "arn:aws:iam::111122223333:role/s3-reader"}}`}},
+		{"DuplicateKey", map[string]string{
+			"a": `{"default/default": {"roleARN": "arn:aws:iam::111122223333:role/a"}}`,
+			"b": `{"default/default": {"roleARN": "arn:aws:iam::111122223333:role/b"}}`,
+		}},
+		{"MalformedWithValidEntries", map[string]string{
+			"config":  `{"default/default": {"roleARN": "arn:aws:iam::111122223333:role/s3-writer"}}`,
+			"garbage": `{"default/garbage": `,
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.caseName, func(t *testing.T) {
+			c := &configMapCache{
+				name:            "pod-identity-webhook",
+				namespace:       "eks",
+				defaultAudience: "sts.amazonaws.com",
+			}
+			c.update(&v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook", Namespace: "eks", ResourceVersion: "1"},
+				Data:       map[string]string{"config": `{"default/default": {"roleARN": "arn:aws:iam::111122223333:role/s3-reader"}}`},
+			})
+
+			before := testutil.ToFloat64(configMapLoadErrorCounter)
+			c.update(&v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook", Namespace: "eks", ResourceVersion: "2"},
+				Data:       tc.data,
+			})
+			if got := testutil.ToFloat64(configMapLoadErrorCounter) - before; got != 1 {
+				t.Errorf("Expected 1 load error, got %v", got)
+			}
+			if resp := c.Get("default", "default"); resp == nil || resp.RoleARN != "arn:aws:iam::111122223333:role/s3-reader" {
+				t.Errorf("Expected the last good mapping to be kept, got %+v", resp)
+			}
+			if count := seriesCount(configMapVersionGauge); count != 1 {
+				t.Errorf("Expected 1 active resourceVersion, got %d", count)
+			}
+			if got := testutil.ToFloat64(configMapVersionGauge.WithLabelValues("eks", "pod-identity-webhook", "1")); got != 1 {
+				t.Errorf("Expected resourceVersion 1 to stay active, got %v", got)
+			}
+		})
+	}
+}
+
+func TestConfigMapCacheReload(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook", Namespace: "eks"},
+		Data: map[string]string{
+			"config": `{"default/default": {"roleARN": "arn:aws:iam::111122223333:role/s3-reader"}}`,
+		},
+	}
+	clientset := fake.NewSimpleClientset(cm)
+	c := NewConfigMapCache("pod-identity-webhook", "eks", "sts.amazonaws.com", clientset)
+	c.Start()
+
+	waitForRole := func(expected string) {
+		t.Helper()
+		var role string
+		for i := 0; i < 50; i++ {
+			role = ""
+			if resp := c.Get("default", "default"); resp != nil {
+				role = resp.RoleARN
+			}
+			if role == expected {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("Expected role %q, got %q", expected, role)
+	}
+	waitForRole("arn:aws:iam::111122223333:role/s3-reader")
+
+	cm = cm.DeepCopy()
+	cm.Data["config"] = `{"default/default": {"roleARN": "arn:aws:iam::111122223333:role/s3-writer"}}`
+	if _, err := clientset.CoreV1().ConfigMaps("eks").Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Error updating configmap: %v", err)
+	}
+	waitForRole("arn:aws:iam::111122223333:role/s3-writer")
+
+	errors := testutil.ToFloat64(configMapLoadErrorCounter)
+	cm = cm.DeepCopy()
+	cm.Data["config"] = `{"default/default": {"roleARN": `
+	if _, err := clientset.CoreV1().ConfigMaps("eks").Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Error updating configmap: %v", err)
+	}
+	for i := 0; i < 50 && testutil.ToFloat64(configMapLoadErrorCounter) == errors; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if testutil.ToFloat64(configMapLoadErrorCounter) == errors {
+		t.Fatal("Expected the malformed configmap to be counted")
+	}
+	waitForRole("arn:aws:iam::111122223333:role/s3-writer")
+
+	if err := clientset.CoreV1().ConfigMaps("eks").Delete(context.TODO(), cm.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Error deleting configmap: %v", err)
+	}
+	waitForRole("")
+}
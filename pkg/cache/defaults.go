@@ -0,0 +1,162 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// Defaults holds the global default settings of the webhook
+type Defaults struct {
+	TokenAudience   string
+	TokenExpiration int64
+	MountPath       string
+	RegionalSTS     bool
+}
+
+// DefaultsCache holds global defaults that can be changed at runtime
+type DefaultsCache interface {
+	Start()
+	// Get returns the current defaults
+	Get() Defaults
+}
+
+type defaultsCache struct {
+	mu         sync.RWMutex // guards current
+	current    Defaults
+	flags      Defaults
+	controller cache.Controller
+	name       string
+	namespace  string
+}
+
+func (c *defaultsCache) Get() Defaults {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current
+}
+
+// parse reads the defaults of a ConfigMap. Keys missing from the ConfigMap use
+// the flag defaults, keys with invalid values keep their previous value.
+func (c *defaultsCache) parse(cm *v1.ConfigMap, previous Defaults) Defaults {
+	defaults := c.flags
+	invalid := func(key, value string) {
+		klog.Warningf("Ignoring invalid %s value %q in configmap %s/%s, keeping the previous value", key, value, cm.Namespace, cm.Name)
+		invalidDefaultCounter.WithLabelValues(key).Inc()
+	}
+	if value, ok := cm.Data["tokenAudience"]; ok {
+		if value = strings.TrimSpace(value); value == "" {
+			invalid("tokenAudience", value)
+			defaults.TokenAudience = previous.TokenAudience
+		} else {
+			defaults.TokenAudience = value
+		}
+	}
+	if value, ok := cm.Data["tokenExpiration"]; ok {
+		if expiration, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err != nil || expiration <= 0 {
+			invalid("tokenExpiration", value)
+			defaults.TokenExpiration = previous.TokenExpiration
+		} else {
+			defaults.TokenExpiration = expiration
+		}
+	}
+	if value, ok := cm.Data["mountPath"]; ok {
+		if mountPath := strings.TrimSpace(value); !path.IsAbs(mountPath) || strings.Contains(mountPath, "..") {
+			invalid("mountPath", value)
+			defaults.MountPath = previous.MountPath
+		} else {
+			defaults.MountPath = path.Clean(mountPath)
+		}
+	}
+	if value, ok := cm.Data["regionalSTS"]; ok {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "true":
+			defaults.RegionalSTS = true
+		case "false":
+			defaults.RegionalSTS = false
+		default:
+			invalid("regionalSTS", value)
+			defaults.RegionalSTS = previous.RegionalSTS
+		}
+	}
+	return defaults
+}
+
+func (c *defaultsCache) update(cm *v1.ConfigMap) {
+	klog.V(5).Infof("Loading defaults from configmap %s/%s", cm.Namespace, cm.Name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = c.parse(cm, c.current)
+}
+
+func (c *defaultsCache) reset() {
+	klog.V(5).Infof("Configmap %s/%s removed, using flag defaults", c.namespace, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = c.flags
+}
+
+// NewDefaultsCache returns a DefaultsCache backed by an informer watching the
+// named ConfigMap. The flag defaults are used until the ConfigMap is loaded and
+// for keys missing from the ConfigMap.
+func NewDefaultsCache(name, namespace string, flags Defaults, clientset kubernetes.Interface, opts ...InformerOption) DefaultsCache {
+	c := &defaultsCache{
+		current:   flags,
+		flags:     flags,
+		name:      name,
+		namespace: namespace,
+	}
+
+	c.controller = newInformer(
+		"configmaps",
+		newConfigMapListWatch(name, namespace, clientset),
+		&v1.ConfigMap{},
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				cm := obj.(*v1.ConfigMap)
+				if cm.Name == c.name {
+					c.update(cm)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				cm, ok := obj.(*v1.ConfigMap)
+				if !ok || cm.Name == c.name {
+					c.reset()
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				cm := newObj.(*v1.ConfigMap)
+				if cm.Name == c.name {
+					c.update(cm)
+				}
+			},
+		},
+		newInformerConfig(opts),
+	)
+	return c
+}
+
+func (c *defaultsCache) Start() {
+	go c.controller.Run(make(chan struct{}))
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var flagDefaults = Defaults{
+	TokenAudience:   "sts.amazonaws.com",
+	TokenExpiration: 86400,
+	MountPath:       "/var/run/secrets/eks.amazonaws.com/serviceaccount",
+}
+
+func TestDefaultsCacheParse(t *testing.T) {
+	c := &defaultsCache{current: flagDefaults, flags: flagDefaults}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook-defaults", Namespace: "eks"},
+		Data: map[string]string{
+			"tokenAudience":   "custom",
+			"tokenExpiration": "3600",
+			"mountPath":       "/var/run/secrets/custom/",
+			"regionalSTS":     "True",
+		},
+	}
+	c.update(cm)
+	expected := Defaults{
+		TokenAudience:   "custom",
+		TokenExpiration: 3600,
+		MountPath:       "/var/run/secrets/custom",
+		RegionalSTS:     true,
+	}
+	if got := c.Get(); got != expected {
+		t.Errorf("Expected defaults %+v, got %+v", expected, got)
+	}
+
+	// Invalid values keep the previous value, valid values still apply
+	cm = cm.DeepCopy()
+	cm.Data = map[string]string{
+		"tokenAudience":   " ",
+		"tokenExpiration": "1h",
+		"mountPath":       "relative/path",
+		"regionalSTS":     "yes",
+	}
+	c.update(cm)
+	if got := c.Get(); got != expected {
+		t.Errorf("Expected invalid values to keep defaults %+v, got %+v", expected, got)
+	}
+
+	cm.Data = map[string]string{"tokenExpiration": "-1", "tokenAudience": "other"}
+	c.update(cm)
+	expected = flagDefaults
+	expected.TokenAudience = "other"
+	expected.TokenExpiration = 3600
+	if got := c.Get(); got != expected {
+		t.Errorf("Expected missing keys to use flag defaults %+v, got %+v", expected, got)
+	}
+
+	c.reset()
+	if got := c.Get(); got != flagDefaults {
+		t.Errorf("Expected flag defaults after reset, got %+v", got)
+	}
+}
+
+func TestDefaultsCacheReload(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook-defaults", Namespace: "eks"},
+		Data:       map[string]string{"tokenAudience": "custom"},
+	}
+	clientset := fake.NewSimpleClientset(cm)
+	c := NewDefaultsCache("pod-identity-webhook-defaults", "eks", flagDefaults, clientset)
+	c.Start()
+
+	waitForAudience := func(expected string) {
+		t.Helper()
+		var audience string
+		for i := 0; i < 50; i++ {
+			if audience = c.Get().TokenAudience; audience == expected {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("Expected audience %q, got %q", expected, audience)
+	}
+	waitForAudience("custom")
+
+	cm = cm.DeepCopy()
+	cm.Data["tokenAudience"] = "updated"
+	if _, err := clientset.CoreV1().ConfigMaps("eks").Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Error updating configmap: %v", err)
+	}
+	waitForAudience("updated")
+
+	if err := clientset.CoreV1().ConfigMaps("eks").Delete(context.TODO(), cm.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Error deleting configmap: %v", err)
+	}
+	waitForAudience("sts.amazonaws.com")
+}
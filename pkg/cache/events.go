@@ -0,0 +1,128 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+)
+
+// listenerQueueSize is the number of events queued for a listener, events are
+// dropped while its queue is full
+const listenerQueueSize = 1000
+
+var droppedEventCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "sa_listener_events_dropped_total",
+		Help: "Counter of service account events dropped because the queue of a listener was full.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(droppedEventCounter)
+}
+
+// SAEventType is the type of a service account event
+type SAEventType string
+
+const (
+	// SAEventAdd is sent when a service account is cached
+	SAEventAdd SAEventType = "add"
+	// SAEventUpdate is sent when the settings of a cached service account
+	// change. Resyncs and changes that don't change the settings, eg. to
+	// other annotations, send no event.
+	SAEventUpdate SAEventType = "update"
+	// SAEventDelete is sent when a service account is removed from the cache
+	SAEventDelete SAEventType = "delete"
+)
+
+// SAEvent is a change of the cached settings of a service account
+type SAEvent struct {
+	Type      SAEventType
+	Namespace string
+	Name      string
+	// Old is the previous settings, nil for add events
+	Old *CacheResponse
+	// New is the current settings, nil for delete events
+	New *CacheResponse
+}
+
+// AddListener registers a listener of the changes of the cache. Each listener
+// is called from its own goroutine, one event at a time, in the order the
+// cache was updated. An event is sent after the cache is updated, so the
+// cache returns the new settings, or newer ones, by the time the listener is
+// called. Events are queued up to 1000 per listener, events are dropped and
+// counted while the queue is full.
+func (c *serviceAccountCache) AddListener(listener func(SAEvent)) {
+	queue := make(chan SAEvent, listenerQueueSize)
+	go func() {
+		for evt := range queue {
+			listener(evt)
+		}
+	}()
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	c.listeners = append(c.listeners, queue)
+}
+
+// newSAEvent returns the event of a change from old to new settings, and false
+// if the settings didn't change
+func newSAEvent(name, namespace string, old, new *CacheResponse) (SAEvent, bool) {
+	evt := SAEvent{Namespace: namespace, Name: name, Old: copyResponse(old), New: copyResponse(new)}
+	switch {
+	case old == nil && new == nil:
+		return evt, false
+	case old == nil:
+		evt.Type = SAEventAdd
+	case new == nil:
+		evt.Type = SAEventDelete
+	case reflect.DeepEqual(old, new):
+		return evt, false
+	default:
+		evt.Type = SAEventUpdate
+	}
+	return evt, true
+}
+
+// notify queues the event of a change from old to new settings for the
+// listeners, if the settings changed, c.mu must be held
+func (c *serviceAccountCache) notify(name, namespace string, old, new *CacheResponse) {
+	evt, changed := newSAEvent(name, namespace, old, new)
+	if !changed {
+		return
+	}
+	c.listenersMu.RLock()
+	defer c.listenersMu.RUnlock()
+	for _, queue := range c.listeners {
+		select {
+		case queue <- evt:
+		default:
+			klog.Warningf("Dropping %s event of sa %s/%s, the listener queue is full", evt.Type, namespace, name)
+			droppedEventCounter.Inc()
+		}
+	}
+}
+
+// copyResponse returns a copy of settings, or nil
+func copyResponse(resp *CacheResponse) *CacheResponse {
+	if resp == nil {
+		return nil
+	}
+	respCopy := *resp
+	return &respCopy
+}
@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordedEvent is an event with the settings the cache returned when the
+// listener was called
+type recordedEvent struct {
+	evt    SAEvent
+	cached *CacheResponse
+}
+
+func TestSaCacheListener(t *testing.T) {
+	c := &serviceAccountCache{
+		cache:            map[string]*CacheResponse{},
+		defaultAudience:  "sts.amazonaws.com",
+		annotationPrefix: "eks.amazonaws.com",
+	}
+	events := make(chan recordedEvent, 10)
+	c.AddListener(func(evt SAEvent) {
+		events <- recordedEvent{evt: evt, cached: c.Get(evt.Name, evt.Namespace)}
+	})
+	next := func() recordedEvent {
+		t.Helper()
+		select {
+		case recorded := <-events:
+			return recorded
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected an event")
+		}
+		return recordedEvent{}
+	}
+	newSA := func(role string, labels map[string]string) *v1.ServiceAccount {
+		return &v1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "default",
+				Namespace:   "default",
+				Labels:      labels,
+				Annotations: map[string]string{"eks.amazonaws.com/role-arn": role},
+			},
+		}
+	}
+
+	c.addSA(newSA("arn:aws:iam::111122223333:role/s3-reader", nil))
+	added := next()
+	if added.evt.Type != SAEventAdd || added.evt.Old != nil || added.evt.New.RoleARN != "arn:aws:iam::111122223333:role/s3-reader" {
+		t.Errorf("Unexpected add event %+v", added.evt)
+	}
+	if added.cached == nil || added.cached.RoleARN != "arn:aws:iam::111122223333:role/s3-reader" {
+		t.Errorf("Expected the added sa to be cached when the listener is called, got %+v", added.cached)
+	}
+
+	// Changes that don't change the settings send no event
+	c.addSA(newSA("arn:aws:iam::111122223333:role/s3-reader", map[string]string{"team": "storage"}))
+
+	c.addSA(newSA("arn:aws:iam::111122223333:role/s3-writer", nil))
+	updated := next()
+	if updated.evt.Type != SAEventUpdate || updated.evt.Old.RoleARN != "arn:aws:iam::111122223333:role/s3-reader" ||
+		updated.evt.New.RoleARN != "arn:aws:iam::111122223333:role/s3-writer" {
+		t.Errorf("Unexpected update event %+v", updated.evt)
+	}
+	if updated.cached == nil || updated.cached.RoleARN != "arn:aws:iam::111122223333:role/s3-writer" {
+		t.Errorf("Expected the updated sa to be cached when the listener is called, got %+v", updated.cached)
+	}
+
+	c.pop("default", "default")
+	deleted := next()
+	if deleted.evt.Type != SAEventDelete || deleted.evt.New != nil || deleted.evt.Old.RoleARN != "arn:aws:iam::111122223333:role/s3-writer" {
+		t.Errorf("Unexpected delete event %+v", deleted.evt)
+	}
+	if deleted.cached != nil {
+		t.Errorf("Expected the deleted sa not to be cached when the listener is called, got %+v", deleted.cached)
+	}
+
+	// Deleting an uncached service account sends no event
+	c.pop("default", "default")
+	select {
+	case recorded := <-events:
+		t.Errorf("Unexpected event %+v", recorded.evt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSaCacheListenerQueueFull(t *testing.T) {
+	c := &serviceAccountCache{cache: map[string]*CacheResponse{}}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c.AddListener(func(evt SAEvent) {
+		if evt.Name == "first" {
+			close(started)
+			<-release
+		}
+	})
+	defer close(release)
+
+	c.set("first", "default", &CacheResponse{RoleARN: "arn:aws:iam::111122223333:role/first"})
+	<-started
+	before := testutil.ToFloat64(droppedEventCounter)
+	for i := 0; i < listenerQueueSize+10; i++ {
+		c.set("other", "default", &CacheResponse{RoleARN: "arn:aws:iam::111122223333:role/other", TokenExpiration: int64(i + 1)})
+	}
+	if got := testutil.ToFloat64(droppedEventCounter) - before; got != 10 {
+		t.Errorf("Expected 10 dropped events, got %v", got)
+	}
+}
+
+func TestSaCacheListenerOrder(t *testing.T) {
+	c := &serviceAccountCache{cache: map[string]*CacheResponse{}}
+	events := make(chan SAEvent, listenerQueueSize)
+	c.AddListener(func(evt SAEvent) { events <- evt })
+
+	// Concurrent writers of a service account queue the events in the order
+	// they updated the cache, so each event starts from the settings of the
+	// previous one
+	const writers, writes = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if i%10 == 9 {
+					c.pop("default", "default")
+					continue
+				}
+				c.set("default", "default", &CacheResponse{TokenExpiration: int64(w*writes + i + 1)})
+			}
+		}(w)
+	}
+	wg.Wait()
+	// A final update to know once the listener got all events
+	c.set("default", "default", &CacheResponse{TokenExpiration: -1})
+
+	var previous *CacheResponse
+	for {
+		var evt SAEvent
+		select {
+		case evt = <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected an event")
+		}
+		if !reflect.DeepEqual(evt.Old, previous) {
+			t.Fatalf("Expected %s event to start from %+v, got %+v", evt.Type, previous, evt.Old)
+		}
+		previous = evt.New
+		if previous != nil && previous.TokenExpiration == -1 {
+			break
+		}
+	}
+}
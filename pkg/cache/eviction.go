@@ -0,0 +1,125 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+var namespaceEvictionCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "sa_cache_namespaces_evicted_total",
+		Help: "Counter of deleted namespaces whose service accounts were evicted from the cache.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(namespaceEvictionCounter)
+}
+
+// newNamespaceEvictionInformer returns an informer evicting the service
+// accounts of namespaces once they are deleted. The namespace controller
+// deletes the service accounts of a namespace before the namespace, so the
+// eviction catches the deletions the service account informers missed, and
+// the negative cache entries and metric series they don't cover.
+func (c *serviceAccountCache) newNamespaceEvictionInformer(clientset kubernetes.Interface) cache.Controller {
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return clientset.CoreV1().Namespaces().List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return clientset.CoreV1().Namespaces().Watch(context.TODO(), options)
+		},
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if ns, ok := obj.(*v1.Namespace); ok {
+				c.evictNamespace(ns.Name)
+			}
+		},
+	}
+	informer := newInformer("namespaces", lw, &v1.Namespace{}, handler, c.informerConfig)
+	if err := informer.SetTransform(stripNamespace); err != nil {
+		klog.Fatalf("Error setting namespace informer transform: %v", err)
+	}
+	return informer
+}
+
+// stripNamespace is the transform of the namespace eviction informer, only the
+// names of namespaces are used
+func stripNamespace(obj interface{}) (interface{}, error) {
+	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		return obj, nil
+	}
+	return &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            ns.Name,
+			UID:             ns.UID,
+			ResourceVersion: ns.ResourceVersion,
+		},
+	}, nil
+}
+
+// evictNamespace removes the cached and negative cached service accounts of a
+// deleted namespace and its metric series, then calls the eviction hooks.
+// Listeners get a delete event for each evicted service account.
+func (c *serviceAccountCache) evictNamespace(namespace string) {
+	prefix := namespace + "/"
+	evicted := map[string]*CacheResponse{}
+	c.mu.Lock()
+	for key, resp := range c.cache {
+		if strings.HasPrefix(key, prefix) {
+			evicted[strings.TrimPrefix(key, prefix)] = resp
+			delete(c.cache, key)
+		}
+	}
+	cacheEntries.Set(float64(len(c.cache)))
+	delete(c.namespaceEntries, namespace)
+	cacheEntriesByNamespace.DeleteLabelValues(namespace)
+	for name, resp := range evicted {
+		c.notify(name, namespace, resp, nil)
+	}
+	c.mu.Unlock()
+
+	c.negativeMu.Lock()
+	for key := range c.negative {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.negative, key)
+		}
+	}
+	negativeCacheSize.Set(float64(len(c.negative)))
+	c.negativeMu.Unlock()
+
+	klog.V(4).Infof("Evicted %d service accounts of deleted namespace %s", len(evicted), namespace)
+	for _, onEvict := range c.onNamespaceEvict {
+		onEvict(namespace)
+	}
+	namespaceEvictionCounter.Inc()
+}
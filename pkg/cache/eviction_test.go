@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSaCacheNamespaceEviction(t *testing.T) {
+	cacheEntriesByNamespace.Reset()
+	annotations := map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/ci"}
+	clientset := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ci-1234"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kept"}},
+		&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "ci-1234", Annotations: annotations}},
+		&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "builder", Namespace: "ci-1234", Annotations: annotations}},
+		&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "kept"}},
+	)
+	var mu sync.Mutex
+	var evicted []string
+	saCache := New("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithNamespaceEviction(true, func(namespace string) {
+		mu.Lock()
+		defer mu.Unlock()
+		evicted = append(evicted, namespace)
+	}))
+	c := saCache.(*serviceAccountCache)
+	events := make(chan SAEvent, 10)
+	c.AddListener(func(evt SAEvent) { events <- evt })
+	c.Start()
+	for deadline := time.Now().Add(5 * time.Second); !c.HasSynced() || len(c.List("")) != 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected cache to sync")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		<-events
+	}
+	c.negativeTTL = time.Minute
+	c.setNegative(&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "uncached", Namespace: "ci-1234"}}, &CacheResponse{})
+
+	evictions := testutil.ToFloat64(namespaceEvictionCounter)
+	// The fake clientset doesn't delete the service accounts of the namespace
+	if err := clientset.CoreV1().Namespaces().Delete(context.Background(), "ci-1234", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(namespaceEvictionCounter) == evictions; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the namespace to be evicted")
+		}
+	}
+
+	if got := c.List("ci-1234"); len(got) != 0 {
+		t.Errorf("Expected the service accounts of the namespace to be evicted, got %+v", got)
+	}
+	if got := c.List("kept"); len(got) != 1 {
+		t.Errorf("Expected the service accounts of other namespaces to be kept, got %+v", got)
+	}
+	if resp := c.getNegative("uncached", "ci-1234"); resp != nil {
+		t.Errorf("Expected the negative cache entry to be evicted, got %+v", resp)
+	}
+	if got := testutil.ToFloat64(cacheEntries); got != 1 {
+		t.Errorf("Expected 1 cache entry, got %v", got)
+	}
+	if got := seriesCount(cacheEntriesByNamespace); got != 1 {
+		t.Errorf("Expected only the series of namespace kept, got %d series", got)
+	}
+	c.mu.RLock()
+	if _, ok := c.namespaceEntries["ci-1234"]; ok {
+		t.Error("Expected the entry count of the namespace to be deleted")
+	}
+	c.mu.RUnlock()
+	mu.Lock()
+	if len(evicted) != 1 || evicted[0] != "ci-1234" {
+		t.Errorf("Expected the eviction hook to be called for ci-1234, got %v", evicted)
+	}
+	mu.Unlock()
+	for i := 0; i < 2; i++ {
+		select {
+		case evt := <-events:
+			if evt.Type != SAEventDelete || evt.Namespace != "ci-1234" {
+				t.Errorf("Expected a delete event of namespace ci-1234, got %+v", evt)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a delete event for each evicted service account")
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package cache
 
 import (
+	"context"
 	"k8s.io/api/core/v1"
 	"sync"
 )
 
 // FakeServiceAccountCache is a goroutine safe cache for testing
 type FakeServiceAccountCache struct {
-	mu    sync.RWMutex // guards cache
+	mu    sync.RWMutex // guards cache and unsynced
 	cache map[string]*CacheResponse
+	// unsynced is true until SetSynced(true) is called on a cache that was
+	// set unsynced
+	unsynced  bool
+	listeners []func(SAEvent)
 }
 
 func NewFakeServiceAccountCache(accounts ...*v1.ServiceAccount) *FakeServiceAccountCache {
@@ -16,13 +21,7 @@ func NewFakeServiceAccountCache(accounts ...*v1.ServiceAccount) *FakeServiceAcco
 		cache: map[string]*CacheResponse{},
 	}
 	for _, sa := range accounts {
-		arn, _ := sa.Annotations["eks.amazonaws.com/role-arn"]
-		audience, ok := sa.Annotations["eks.amazonaws.com/audience"]
-		if !ok {
-			audience = "sts.amazonaws.com"
-		}
-
-		c.Add(sa.Name, sa.Namespace, arn, audience)
+		c.AddResponse(sa.Name, sa.Namespace, ParseServiceAccount(sa, "eks.amazonaws.com", "sts.amazonaws.com"))
 	}
 	return c
 }
@@ -32,30 +31,220 @@ var _ ServiceAccountCache = &FakeServiceAccountCache{}
 // Start does nothing
 func (f *FakeServiceAccountCache) Start() {}
 
+// HasSynced returns true unless the cache was set unsynced
+func (f *FakeServiceAccountCache) HasSynced() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return !f.unsynced
+}
+
+// NamespaceSynced returns true unless the cache was set unsynced
+func (f *FakeServiceAccountCache) NamespaceSynced(namespace string) bool {
+	return f.HasSynced()
+}
+
+// SetSynced sets whether the cache reports it has synced
+func (f *FakeServiceAccountCache) SetSynced(synced bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unsynced = !synced
+}
+
 // Get gets a service account from the cache
-func (f *FakeServiceAccountCache) Get(name, namespace string) (role, aud string) {
+func (f *FakeServiceAccountCache) Get(name, namespace string) *CacheResponse {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 	resp, ok := f.cache[namespace+"/"+name]
 	if !ok {
-		return "", ""
+		return nil
 	}
-	return resp.RoleARN, resp.Audience
+	respCopy := *resp
+	return &respCopy
+}
+
+// List lists the service accounts of the cache
+func (f *FakeServiceAccountCache) List(namespace string) []CachedServiceAccount {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return listEntries(f.cache, namespace)
+}
+
+// Lookup gets a service account from the cache
+func (f *FakeServiceAccountCache) Lookup(ctx context.Context, name, namespace string) (*CacheResponse, error) {
+	return f.Get(name, namespace), nil
 }
 
 // Add adds a cache entry
 func (f *FakeServiceAccountCache) Add(name, namespace, role, aud string) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	f.cache[namespace+"/"+name] = &CacheResponse{
+	f.AddResponse(name, namespace, &CacheResponse{
 		RoleARN:  role,
 		Audience: aud,
+	})
+}
+
+// AddResponse adds a cache entry with all settings
+func (f *FakeServiceAccountCache) AddResponse(name, namespace string, resp *CacheResponse) {
+	f.mu.Lock()
+	old := f.cache[namespace+"/"+name]
+	f.cache[namespace+"/"+name] = resp
+	f.mu.Unlock()
+	f.notify(name, namespace, old, resp)
+}
+
+// AddListener registers a listener, it is called synchronously by Add,
+// AddResponse, and Pop
+func (f *FakeServiceAccountCache) AddListener(listener func(SAEvent)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listeners = append(f.listeners, listener)
+}
+
+func (f *FakeServiceAccountCache) notify(name, namespace string, old, new *CacheResponse) {
+	f.mu.RLock()
+	listeners := f.listeners
+	f.mu.RUnlock()
+	evt, changed := newSAEvent(name, namespace, old, new)
+	if !changed {
+		return
+	}
+	for _, listener := range listeners {
+		listener(evt)
 	}
 }
 
 // Pop deletes a cache entry
 func (f *FakeServiceAccountCache) Pop(name, namespace string) {
 	f.mu.Lock()
-	defer f.mu.Unlock()
+	old := f.cache[namespace+"/"+name]
 	delete(f.cache, namespace+"/"+name)
+	f.mu.Unlock()
+	f.notify(name, namespace, old, nil)
+}
+
+// FakeNamespaceCache is a goroutine safe namespace cache for testing
+type FakeNamespaceCache struct {
+	mu    sync.RWMutex // guards cache
+	cache map[string]*NamespaceResponse
+}
+
+func NewFakeNamespaceCache(namespaces ...*v1.Namespace) *FakeNamespaceCache {
+	c := &FakeNamespaceCache{
+		cache: map[string]*NamespaceResponse{},
+	}
+	parser := &namespaceCache{
+		annotationPrefix: "eks.amazonaws.com",
+	}
+	for _, ns := range namespaces {
+		c.Add(ns.Name, parser.parse(ns))
+	}
+	return c
+}
+
+var _ NamespaceCache = &FakeNamespaceCache{}
+
+// Start does nothing
+func (f *FakeNamespaceCache) Start() {}
+
+// Get gets a namespace from the cache
+func (f *FakeNamespaceCache) Get(name string) *NamespaceResponse {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	resp, ok := f.cache[name]
+	if !ok {
+		return nil
+	}
+	respCopy := *resp
+	respCopy.AllowedRoleARNs = copyPatterns(resp.AllowedRoleARNs)
+	return &respCopy
+}
+
+// Add adds a cache entry
+func (f *FakeNamespaceCache) Add(name string, resp *NamespaceResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cache[name] = resp
+}
+
+// FakeConfigMapCache is a goroutine safe configmap cache for testing
+type FakeConfigMapCache struct {
+	mu    sync.RWMutex // guards cache
+	cache map[string]*CacheResponse
+}
+
+func NewFakeConfigMapCache(configMaps ...*v1.ConfigMap) *FakeConfigMapCache {
+	c := &FakeConfigMapCache{
+		cache: map[string]*CacheResponse{},
+	}
+	parser := &configMapCache{
+		defaultAudience: "sts.amazonaws.com",
+	}
+	for _, cm := range configMaps {
+		// Malformed ConfigMaps map nothing, like the first version loaded by
+		// the informer
+		entries, _ := parser.parse(cm)
+		for key, resp := range entries {
+			c.cache[key] = resp
+		}
+	}
+	return c
+}
+
+var _ ConfigMapCache = &FakeConfigMapCache{}
+
+// Start does nothing
+func (f *FakeConfigMapCache) Start() {}
+
+// Get gets a service account mapping from the cache
+func (f *FakeConfigMapCache) Get(name, namespace string) *CacheResponse {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	resp, ok := f.cache[namespace+"/"+name]
+	if !ok {
+		return nil
+	}
+	respCopy := *resp
+	return &respCopy
+}
+
+// List lists the mappings of the cache
+func (f *FakeConfigMapCache) List(namespace string) []CachedServiceAccount {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return listEntries(f.cache, namespace)
+}
+
+// Add adds a cache entry
+func (f *FakeConfigMapCache) Add(name, namespace string, resp *CacheResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cache[namespace+"/"+name] = resp
+}
+
+// FakeDefaultsCache is a goroutine safe defaults cache for testing
+type FakeDefaultsCache struct {
+	mu       sync.RWMutex // guards defaults
+	defaults Defaults
+}
+
+func NewFakeDefaultsCache(defaults Defaults) *FakeDefaultsCache {
+	return &FakeDefaultsCache{defaults: defaults}
+}
+
+var _ DefaultsCache = &FakeDefaultsCache{}
+
+// Start does nothing
+func (f *FakeDefaultsCache) Start() {}
+
+// Get gets the current defaults
+func (f *FakeDefaultsCache) Get() Defaults {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.defaults
+}
+
+// Set sets the current defaults
+func (f *FakeDefaultsCache) Set(defaults Defaults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.defaults = defaults
 }
@@ -0,0 +1,233 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+const (
+	// DefaultResyncPeriod is the default resync period of the informers
+	DefaultResyncPeriod = 60 * time.Second
+	// DefaultWatchBackoffMax is the default maximum wait before relisting
+	// after watch errors
+	DefaultWatchBackoffMax = 30 * time.Second
+	// watchBackoffBase is the wait before relisting after the first watch
+	// error, doubled for each consecutive error
+	watchBackoffBase = time.Second
+	// watchErrorLogInterval is the minimum interval between logged watch
+	// errors of an informer, errors in between are counted in the next log
+	watchErrorLogInterval = time.Minute
+)
+
+var (
+	watchErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "watch_errors_total",
+			Help: "Counter of informer list and watch errors, broken out for each resource.",
+		},
+		[]string{"resource"},
+	)
+	lastSyncTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "informer_last_sync_timestamp_seconds",
+			Help: "Unix time of the last complete list of an informer, broken out for each resource.",
+		},
+		[]string{"resource"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(watchErrorCounter)
+	prometheus.MustRegister(lastSyncTimestamp)
+}
+
+type informerConfig struct {
+	resyncPeriod    time.Duration
+	watchBackoffMax time.Duration
+}
+
+// InformerOption configures the informers of a cache
+type InformerOption func(*informerConfig)
+
+// WithResyncPeriod sets the resync period of the informers, at least a
+// second, 0 disables resyncs
+func WithResyncPeriod(period time.Duration) InformerOption {
+	return func(c *informerConfig) { c.resyncPeriod = period }
+}
+
+// WithWatchBackoffMax sets the maximum wait before relisting after watch
+// errors
+func WithWatchBackoffMax(max time.Duration) InformerOption {
+	return func(c *informerConfig) { c.watchBackoffMax = max }
+}
+
+func newInformerConfig(opts []InformerOption) informerConfig {
+	c := informerConfig{
+		resyncPeriod:    DefaultResyncPeriod,
+		watchBackoffMax: DefaultWatchBackoffMax,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// newInformer returns an informer of resource. Watch errors are counted,
+// logged at most once per interval, and back off relisting.
+func newInformer(resource string, lw cache.ListerWatcher, objType runtime.Object, handler cache.ResourceEventHandler, config informerConfig) cache.SharedIndexInformer {
+	errs := newWatchErrors(resource, config.watchBackoffMax)
+	backoffLW := &backoffListWatch{ListerWatcher: lw, errs: errs}
+	informer := &backoffInformer{
+		SharedIndexInformer: cache.NewSharedIndexInformer(backoffLW, objType, config.resyncPeriod, cache.Indexers{}),
+		lw:                  backoffLW,
+	}
+	if _, err := informer.AddEventHandler(handler); err != nil {
+		klog.Fatalf("Error adding %s informer handler: %v", resource, err)
+	}
+	if err := informer.SetWatchErrorHandler(errs.handle); err != nil {
+		klog.Fatalf("Error setting %s informer watch error handler: %v", resource, err)
+	}
+	return informer
+}
+
+// watchErrors tracks the consecutive watch errors of an informer
+type watchErrors struct {
+	resource   string
+	backoffMax time.Duration
+	logf       func(format string, args ...interface{})
+	now        func() time.Time
+
+	mu         sync.Mutex // guards the fields below
+	failures   int
+	lastError  time.Time
+	lastLogged time.Time
+	suppressed int
+}
+
+func newWatchErrors(resource string, backoffMax time.Duration) *watchErrors {
+	return &watchErrors{
+		resource:   resource,
+		backoffMax: backoffMax,
+		logf:       klog.Warningf,
+		now:        time.Now,
+	}
+}
+
+// handle is the watch error handler of the informer. An error more than
+// twice the maximum backoff after the previous one starts a new series of
+// consecutive errors.
+func (w *watchErrors) handle(_ *cache.Reflector, err error) {
+	watchErrorCounter.WithLabelValues(w.resource).Inc()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	if now.Sub(w.lastError) > 2*w.backoffMax {
+		w.failures = 0
+	}
+	w.failures++
+	w.lastError = now
+	if now.Sub(w.lastLogged) < watchErrorLogInterval {
+		w.suppressed++
+		return
+	}
+	if w.suppressed > 0 {
+		w.logf("Error watching %s, %d more errors since the last: %v", w.resource, w.suppressed, err)
+	} else {
+		w.logf("Error watching %s: %v", w.resource, err)
+	}
+	w.lastLogged = now
+	w.suppressed = 0
+}
+
+// reset starts a new series of consecutive errors
+func (w *watchErrors) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failures = 0
+}
+
+// delay returns the wait before relisting, doubling from the base wait for
+// each consecutive error up to the maximum, with up to half of it jittered
+func (w *watchErrors) delay() time.Duration {
+	w.mu.Lock()
+	failures := w.failures
+	w.mu.Unlock()
+	if failures == 0 || w.backoffMax <= 0 {
+		return 0
+	}
+	delay := w.backoffMax
+	if failures < 32 && watchBackoffBase<<(failures-1) < delay {
+		delay = watchBackoffBase << (failures - 1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// backoffInformer is an informer whose list backoff stops waiting once the
+// informer is stopped
+type backoffInformer struct {
+	cache.SharedIndexInformer
+	lw *backoffListWatch
+}
+
+func (i *backoffInformer) Run(stop <-chan struct{}) {
+	i.lw.stop = stop
+	i.SharedIndexInformer.Run(stop)
+}
+
+// backoffListWatch waits for the watch error backoff before listing, the
+// informer relists after each watch error. Only the first page of a list
+// waits, and a successful list resets the backoff. The time of the last page
+// of successful lists is recorded as the last sync.
+type backoffListWatch struct {
+	cache.ListerWatcher
+	errs *watchErrors
+	// stop stops the wait before listing, nil to never stop it
+	stop <-chan struct{}
+}
+
+func (lw *backoffListWatch) List(options metav1.ListOptions) (runtime.Object, error) {
+	if delay := lw.errs.delay(); delay > 0 && options.Continue == "" {
+		klog.V(4).Infof("Relisting %s in %s", lw.errs.resource, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-lw.stop:
+			timer.Stop()
+			return nil, fmt.Errorf("stopped before relisting %s", lw.errs.resource)
+		case <-timer.C:
+		}
+	}
+	list, err := lw.ListerWatcher.List(options)
+	if err != nil {
+		return list, err
+	}
+	if listMeta, metaErr := meta.ListAccessor(list); metaErr == nil && listMeta.GetContinue() == "" {
+		lw.errs.reset()
+		lastSyncTimestamp.WithLabelValues(lw.errs.resource).Set(float64(lw.errs.now().Unix()))
+	}
+	return list, nil
+}
@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestInformerResyncPeriod(t *testing.T) {
+	cases := []struct {
+		caseName string
+		period   time.Duration
+		resyncs  bool
+	}{
+		{"Resync", time.Second, true},
+		{"Disabled", 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(&v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook", Namespace: "eks"},
+			})
+			var updates int32
+			informer := newInformer(
+				"configmaps",
+				newConfigMapListWatch("pod-identity-webhook", "eks", clientset),
+				&v1.ConfigMap{},
+				cache.ResourceEventHandlerFuncs{
+					UpdateFunc: func(oldObj, newObj interface{}) { atomic.AddInt32(&updates, 1) },
+				},
+				newInformerConfig([]InformerOption{WithResyncPeriod(c.period)}),
+			)
+			stop := make(chan struct{})
+			defer close(stop)
+			go informer.Run(stop)
+			if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+				t.Fatal("Expected informer to sync")
+			}
+
+			time.Sleep(2500 * time.Millisecond)
+			got := atomic.LoadInt32(&updates)
+			if c.resyncs && got < 2 {
+				t.Errorf("Expected at least 2 resyncs, got %d", got)
+			}
+			if !c.resyncs && got != 0 {
+				t.Errorf("Expected no resyncs, got %d", got)
+			}
+		})
+	}
+}
+
+func TestWatchErrorsLogging(t *testing.T) {
+	var logs []string
+	now := time.Unix(0, 0)
+	w := newWatchErrors("test-logging", 30*time.Second)
+	w.logf = func(format string, args ...interface{}) { logs = append(logs, fmt.Sprintf(format, args...)) }
+	w.now = func() time.Time { return now }
+
+	before := testutil.ToFloat64(watchErrorCounter.WithLabelValues("test-logging"))
+	for i := 0; i < 100; i++ {
+		w.handle(nil, errors.New("connection refused"))
+		now = now.Add(100 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(watchErrorCounter.WithLabelValues("test-logging")) - before; got != 100 {
+		t.Errorf("Expected 100 watch errors to be counted, got %v", got)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("Expected 1 log within the log interval, got %d: %v", len(logs), logs)
+	}
+
+	now = now.Add(watchErrorLogInterval)
+	w.handle(nil, errors.New("connection refused"))
+	if len(logs) != 2 || !strings.Contains(logs[1], "99 more errors") {
+		t.Errorf("Expected a log with the suppressed errors, got %v", logs)
+	}
+}
+
+func TestWatchErrorsBackoff(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := newWatchErrors("test-backoff", 10*time.Second)
+	w.logf = func(string, ...interface{}) {}
+	w.now = func() time.Time { return now }
+
+	if delay := w.delay(); delay != 0 {
+		t.Errorf("Expected no delay without errors, got %s", delay)
+	}
+	for i, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		w.handle(nil, errors.New("connection refused"))
+		now = now.Add(time.Second)
+		delay := w.delay()
+		if delay < max/2 || delay > max {
+			t.Errorf("Expected delay after %d errors between %s and %s, got %s", i+1, max/2, max, delay)
+		}
+	}
+
+	// An error after the watch ran for a while starts over
+	now = now.Add(time.Minute)
+	w.handle(nil, errors.New("connection refused"))
+	if delay := w.delay(); delay > time.Second {
+		t.Errorf("Expected backoff to reset, got %s", delay)
+	}
+}
+
+func TestBackoffListWatchPages(t *testing.T) {
+	errs := newWatchErrors("test-pages", time.Hour)
+	errs.logf = func(string, ...interface{}) {}
+	var page *v1.ServiceAccountList
+	stop := make(chan struct{})
+	lw := &backoffListWatch{
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return page, nil
+			},
+		},
+		errs: errs,
+		stop: stop,
+	}
+	for i := 0; i < 5; i++ {
+		errs.handle(nil, errors.New("connection refused"))
+	}
+
+	// The following pages of a list don't wait for the backoff
+	page = &v1.ServiceAccountList{ListMeta: metav1.ListMeta{Continue: "last"}}
+	if _, err := lw.List(metav1.ListOptions{Continue: "next"}); err != nil {
+		t.Fatal(err)
+	}
+	if delay := errs.delay(); delay == 0 {
+		t.Error("Expected a partial list not to reset the backoff")
+	}
+
+	// The first page waits until the informer is stopped
+	listed := make(chan error)
+	go func() {
+		_, err := lw.List(metav1.ListOptions{})
+		listed <- err
+	}()
+	close(stop)
+	select {
+	case err := <-listed:
+		if err == nil {
+			t.Error("Expected an error once stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the backoff to stop with the informer")
+	}
+
+	// The last page of a list resets the backoff
+	page = &v1.ServiceAccountList{}
+	if _, err := lw.List(metav1.ListOptions{Continue: "last"}); err != nil {
+		t.Fatal(err)
+	}
+	if delay := errs.delay(); delay != 0 {
+		t.Errorf("Expected a successful list to reset the backoff, got %s", delay)
+	}
+}
+
+func TestInformerLastSyncTimestamp(t *testing.T) {
+	errs := newWatchErrors("test-last-sync", time.Second)
+	errs.now = func() time.Time { return time.Unix(1700000000, 0) }
+	var page *v1.ServiceAccountList
+	var listErr error
+	lw := &backoffListWatch{
+		ListerWatcher: &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return page, listErr
+			},
+		},
+		errs: errs,
+	}
+	lastSync := func() float64 {
+		return testutil.ToFloat64(lastSyncTimestamp.WithLabelValues("test-last-sync"))
+	}
+
+	page = &v1.ServiceAccountList{ListMeta: metav1.ListMeta{Continue: "next"}}
+	if _, err := lw.List(metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastSync(); got != 0 {
+		t.Errorf("Expected a partial list not to be a sync, got %v", got)
+	}
+
+	page, listErr = nil, errors.New("connection refused")
+	if _, err := lw.List(metav1.ListOptions{}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if got := lastSync(); got != 0 {
+		t.Errorf("Expected a failed list not to be a sync, got %v", got)
+	}
+
+	page, listErr = &v1.ServiceAccountList{}, nil
+	if _, err := lw.List(metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastSync(); got != 1700000000 {
+		t.Errorf("Expected the last sync timestamp to be set, got %v", got)
+	}
+}
@@ -0,0 +1,300 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// MappingFileModeOverride uses the mapping file settings of a service
+	// account instead of its annotations
+	MappingFileModeOverride = "override"
+	// MappingFileModeFallback uses the mapping file settings of service
+	// accounts that don't exist
+	MappingFileModeFallback = "fallback"
+)
+
+var mappingFileLoadErrorCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "sa_mapping_file_load_errors_total",
+		Help: "Counter of ignored malformed versions of the service account mapping file.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(mappingFileLoadErrorCounter)
+}
+
+// ValidateMappingFileMode returns an error if mode is not a mapping file mode
+func ValidateMappingFileMode(mode string) error {
+	switch mode {
+	case MappingFileModeOverride, MappingFileModeFallback:
+		return nil
+	}
+	return fmt.Errorf("invalid mapping file mode %q, must be %s or %s", mode, MappingFileModeOverride, MappingFileModeFallback)
+}
+
+// mappingFileEntry is the settings of a service account in the mapping file
+type mappingFileEntry struct {
+	RoleARN              string `json:"roleARN"`
+	Audience             string `json:"audience"`
+	TokenExpiration      int64  `json:"tokenExpiration"`
+	RegionalSTSEndpoints *bool  `json:"regionalSTSEndpoints"`
+}
+
+// mappingFileCache is a ServiceAccountCache reading the settings of service
+// accounts from a YAML or JSON file mapping "namespace/serviceaccount" keys to
+// settings, before or after another cache. The file is reloaded when it
+// changes, a malformed version is logged and counted, and the previous
+// mappings are kept.
+type mappingFileCache struct {
+	base            ServiceAccountCache
+	path            string
+	mode            string
+	defaultAudience string
+	mapping         atomic.Pointer[map[string]*CacheResponse]
+	watcher         *fsnotify.Watcher
+}
+
+var _ ServiceAccountCache = &mappingFileCache{}
+
+// NewMappingFileCache returns a ServiceAccountCache using the service account
+// mappings of a file with mode, override or fallback, and base for the
+// service accounts that aren't mapped. A nil base only serves the mappings of
+// the file, eg. to run the webhook without an API server. It returns an error
+// if the file can't be loaded or watched.
+func NewMappingFileCache(path, mode, defaultAudience string, base ServiceAccountCache) (ServiceAccountCache, error) {
+	if err := ValidateMappingFileMode(mode); err != nil {
+		return nil, err
+	}
+	if base == nil {
+		base = emptyCache{}
+	}
+	c := &mappingFileCache{
+		base:            base,
+		path:            path,
+		mode:            mode,
+		defaultAudience: defaultAudience,
+	}
+	mapping, err := c.load()
+	if err != nil {
+		return nil, fmt.Errorf("error loading sa mapping file %s: %v", path, err)
+	}
+	c.mapping.Store(&mapping)
+
+	// The directory is watched, files are often replaced rather than
+	// written, eg. by editors or ConfigMap volumes
+	c.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error watching sa mapping file %s: %v", path, err)
+	}
+	if err := c.watcher.Add(filepath.Dir(path)); err != nil {
+		c.watcher.Close()
+		return nil, fmt.Errorf("error watching sa mapping file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// load reads and validates the mappings of the file
+func (c *mappingFileCache) load() (map[string]*CacheResponse, error) {
+	content, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]mappingFileEntry
+	if err := yaml.UnmarshalStrict(content, &entries); err != nil {
+		return nil, err
+	}
+	mapping := map[string]*CacheResponse{}
+	for key, entry := range entries {
+		namespace, name, ok := strings.Cut(key, "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid key %s: must be namespace/serviceaccount", key)
+		}
+		if entry.RoleARN != "" && !strings.HasPrefix(entry.RoleARN, "arn:") {
+			return nil, fmt.Errorf("invalid entry %s: roleARN %q is not an ARN", key, entry.RoleARN)
+		}
+		if entry.TokenExpiration < 0 {
+			return nil, fmt.Errorf("invalid entry %s: tokenExpiration must not be negative", key)
+		}
+		resp := &CacheResponse{
+			RoleARN:         entry.RoleARN,
+			Audience:        entry.Audience,
+			TokenExpiration: entry.TokenExpiration,
+			UseRegionalSTS:  entry.RegionalSTSEndpoints,
+		}
+		if resp.Audience == "" {
+			resp.Audience = c.defaultAudience
+			resp.DefaultAudience = true
+		}
+		mapping[key] = resp
+	}
+	return mapping, nil
+}
+
+// reload replaces the mappings with the mappings of the file, unless it is
+// malformed
+func (c *mappingFileCache) reload() {
+	mapping, err := c.load()
+	if err != nil {
+		klog.Errorf("Ignoring sa mapping file %s, keeping the previous mappings: %v", c.path, err)
+		mappingFileLoadErrorCounter.Inc()
+		return
+	}
+	klog.V(4).Infof("Loaded %d mappings from sa mapping file %s", len(mapping), c.path)
+	c.mapping.Store(&mapping)
+}
+
+func (c *mappingFileCache) watch() {
+	for {
+		select {
+		case evt, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			if evt.Has(fsnotify.Chmod) {
+				continue
+			}
+			// Any change of the directory may replace the file, eg. the
+			// ..data symlink of a ConfigMap volume
+			if _, err := os.Stat(c.path); err == nil {
+				c.reload()
+			}
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			klog.Errorf("Error watching sa mapping file %s: %v", c.path, err)
+		}
+	}
+}
+
+// get returns a copy of the mapped settings of a service account, or nil
+func (c *mappingFileCache) get(name, namespace string) *CacheResponse {
+	return copyResponse((*c.mapping.Load())[namespace+"/"+name])
+}
+
+func (c *mappingFileCache) Start() {
+	c.base.Start()
+	go c.watch()
+}
+
+func (c *mappingFileCache) Get(name, namespace string) *CacheResponse {
+	if c.mode == MappingFileModeOverride {
+		if resp := c.get(name, namespace); resp != nil {
+			return resp
+		}
+		return c.base.Get(name, namespace)
+	}
+	if resp := c.base.Get(name, namespace); resp != nil {
+		return resp
+	}
+	return c.get(name, namespace)
+}
+
+// Lookup returns the mapped settings of a service account before looking it
+// up with the override mode. With the fallback mode, the mapped settings are
+// returned if the service account doesn't exist or the lookup fails.
+func (c *mappingFileCache) Lookup(ctx context.Context, name, namespace string) (*CacheResponse, error) {
+	if c.mode == MappingFileModeOverride {
+		if resp := c.get(name, namespace); resp != nil {
+			return resp, nil
+		}
+		return c.base.Lookup(ctx, name, namespace)
+	}
+	resp, err := c.base.Lookup(ctx, name, namespace)
+	if resp != nil {
+		return resp, err
+	}
+	if mapped := c.get(name, namespace); mapped != nil {
+		if err != nil {
+			klog.V(4).Infof("Using sa mapping file settings of sa %s/%s: %v", namespace, name, err)
+		}
+		return mapped, nil
+	}
+	return nil, err
+}
+
+func (c *mappingFileCache) HasSynced() bool {
+	return c.base.HasSynced()
+}
+
+func (c *mappingFileCache) NamespaceSynced(namespace string) bool {
+	return c.base.NamespaceSynced(namespace)
+}
+
+// List lists the service accounts of the base cache and the mapping file, the
+// mappings replace cached service accounts with the override mode
+func (c *mappingFileCache) List(namespace string) []CachedServiceAccount {
+	entries := map[string]*CacheResponse{}
+	mapped := *c.mapping.Load()
+	for key, resp := range mapped {
+		entries[key] = resp
+	}
+	for _, sa := range c.base.List(namespace) {
+		key := sa.Namespace + "/" + sa.Name
+		if _, ok := mapped[key]; ok && c.mode == MappingFileModeOverride {
+			continue
+		}
+		entries[key] = sa.Settings
+	}
+	return listEntries(entries, namespace)
+}
+
+// AddListener registers a listener of the base cache, changes of the mapping
+// file send no events
+func (c *mappingFileCache) AddListener(listener func(SAEvent)) {
+	c.base.AddListener(listener)
+}
+
+// emptyCache is the base of mapping file caches without another cache, no
+// service account exists
+type emptyCache struct{}
+
+func (emptyCache) Start() {}
+
+func (emptyCache) Get(name, namespace string) *CacheResponse {
+	return nil
+}
+
+func (emptyCache) Lookup(ctx context.Context, name, namespace string) (*CacheResponse, error) {
+	return nil, nil
+}
+
+func (emptyCache) HasSynced() bool {
+	return true
+}
+
+func (emptyCache) NamespaceSynced(namespace string) bool {
+	return true
+}
+
+func (emptyCache) List(namespace string) []CachedServiceAccount {
+	return nil
+}
+
+func (emptyCache) AddListener(listener func(SAEvent)) {}
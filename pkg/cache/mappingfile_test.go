@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testMappingFile = `
+default/annotated:
+  roleARN: arn:aws:iam::111122223333:role/file-annotated
+default/mapped:
+  roleARN: arn:aws:iam::111122223333:role/file-mapped
+  audience: custom
+  tokenExpiration: 3600
+`
+
+// erroringServiceAccountCache fails the lookups of uncached service accounts
+type erroringServiceAccountCache struct {
+	*FakeServiceAccountCache
+}
+
+func (e erroringServiceAccountCache) Lookup(ctx context.Context, name, namespace string) (*CacheResponse, error) {
+	if resp := e.Get(name, namespace); resp != nil {
+		return resp, nil
+	}
+	return nil, errors.New("connection refused")
+}
+
+func writeMappingFile(t *testing.T, path, content string) {
+	t.Helper()
+	// Replace the file like editors and ConfigMap volumes do
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMappingFileCacheModes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.yaml")
+	writeMappingFile(t, path, testMappingFile)
+
+	cases := []struct {
+		caseName   string
+		mode       string
+		name       string
+		apiError   bool
+		expected   string
+		expectErr  bool
+		expiration int64
+	}{
+		{"OverrideAnnotated", MappingFileModeOverride, "annotated", false, "arn:aws:iam::111122223333:role/file-annotated", false, 0},
+		{"OverrideMapped", MappingFileModeOverride, "mapped", false, "arn:aws:iam::111122223333:role/file-mapped", false, 3600},
+		{"OverrideNotMapped", MappingFileModeOverride, "cached", false, "arn:aws:iam::111122223333:role/cached", false, 0},
+		{"FallbackAnnotated", MappingFileModeFallback, "annotated", false, "arn:aws:iam::111122223333:role/annotated", false, 0},
+		{"FallbackMapped", MappingFileModeFallback, "mapped", false, "arn:aws:iam::111122223333:role/file-mapped", false, 3600},
+		{"FallbackMappedAPIError", MappingFileModeFallback, "mapped", true, "arn:aws:iam::111122223333:role/file-mapped", false, 3600},
+		{"FallbackNotMappedAPIError", MappingFileModeFallback, "missing", true, "", true, 0},
+		{"FallbackMissing", MappingFileModeFallback, "missing", false, "", false, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			fakeCache := NewFakeServiceAccountCache()
+			fakeCache.Add("annotated", "default", "arn:aws:iam::111122223333:role/annotated", "sts.amazonaws.com")
+			fakeCache.Add("cached", "default", "arn:aws:iam::111122223333:role/cached", "sts.amazonaws.com")
+			var base ServiceAccountCache = fakeCache
+			if c.apiError {
+				base = erroringServiceAccountCache{fakeCache}
+			}
+			saCache, err := NewMappingFileCache(path, c.mode, "sts.amazonaws.com", base)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := saCache.Lookup(context.Background(), c.name, "default")
+			if (err != nil) != c.expectErr {
+				t.Fatalf("Expected error %t, got %v", c.expectErr, err)
+			}
+			role, expiration := "", int64(0)
+			if resp != nil {
+				role, expiration = resp.RoleARN, resp.TokenExpiration
+			}
+			if role != c.expected || expiration != c.expiration {
+				t.Errorf("Expected role %q and expiration %d, got %q and %d", c.expected, c.expiration, role, expiration)
+			}
+			if !c.apiError {
+				getRole := ""
+				if resp := saCache.Get(c.name, "default"); resp != nil {
+					getRole = resp.RoleARN
+				}
+				if getRole != c.expected {
+					t.Errorf("Expected Get role %q, got %q", c.expected, getRole)
+				}
+			}
+		})
+	}
+}
+
+func TestMappingFileCacheDefaultAudience(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	writeMappingFile(t, path, `{"default/mapped": {"roleARN": "arn:aws:iam::111122223333:role/file-mapped"}}`)
+	saCache, err := NewMappingFileCache(path, MappingFileModeOverride, "sts.amazonaws.com", NewFakeServiceAccountCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := saCache.Get("mapped", "default"); resp == nil || resp.Audience != "sts.amazonaws.com" || !resp.DefaultAudience {
+		t.Errorf("Expected the default audience, got %+v", resp)
+	}
+}
+
+func TestMappingFileCacheWithoutBase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	writeMappingFile(t, path, `{"default/mapped": {"roleARN": "arn:aws:iam::111122223333:role/file-mapped"}}`)
+	saCache, err := NewMappingFileCache(path, MappingFileModeFallback, "sts.amazonaws.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saCache.HasSynced() {
+		t.Error("Expected the cache to be synced")
+	}
+	if resp, err := saCache.Lookup(context.Background(), "mapped", "default"); err != nil || resp == nil || resp.RoleARN != "arn:aws:iam::111122223333:role/file-mapped" {
+		t.Errorf("Expected the file mapping, got %+v, %v", resp, err)
+	}
+	if resp, err := saCache.Lookup(context.Background(), "unmapped", "default"); err != nil || resp != nil {
+		t.Errorf("Expected no service account, got %+v, %v", resp, err)
+	}
+}
+
+func TestMappingFileCacheInvalid(t *testing.T) {
+	cases := []struct {
+		caseName string
+		content  string
+	}{
+		{"InvalidYAML", "default/mapped: [\n"},
+		{"InvalidKey", "mapped:\n  roleARN: arn:aws:iam::111122223333:role/mapped\n"},
+		{"InvalidRole", "default/mapped:\n  roleARN: mapped\n"},
+		{"NegativeExpiration", "default/mapped:\n  roleARN: arn:aws:iam::111122223333:role/mapped\n  tokenExpiration: -1\n"},
+		{"UnknownField", "default/mapped:\n  role: arn:aws:iam::111122223333:role/mapped\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mapping.yaml")
+			writeMappingFile(t, path, c.content)
+			if _, err := NewMappingFileCache(path, MappingFileModeOverride, "sts.amazonaws.com", NewFakeServiceAccountCache()); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+
+	if _, err := NewMappingFileCache(filepath.Join(t.TempDir(), "missing.yaml"), MappingFileModeOverride, "sts.amazonaws.com", NewFakeServiceAccountCache()); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestMappingFileCacheReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.yaml")
+	writeMappingFile(t, path, testMappingFile)
+	saCache, err := NewMappingFileCache(path, MappingFileModeOverride, "sts.amazonaws.com", NewFakeServiceAccountCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saCache.Start()
+
+	waitForRole := func(expected string) {
+		t.Helper()
+		var role string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			role = ""
+			if resp := saCache.Get("mapped", "default"); resp != nil {
+				role = resp.RoleARN
+			}
+			if role == expected {
+				return
+			}
+		}
+		t.Fatalf("Expected role %q, got %q", expected, role)
+	}
+	waitForRole("arn:aws:iam::111122223333:role/file-mapped")
+
+	writeMappingFile(t, path, "default/mapped:\n  roleARN: arn:aws:iam::111122223333:role/reloaded\n")
+	waitForRole("arn:aws:iam::111122223333:role/reloaded")
+
+	errors := testutil.ToFloat64(mappingFileLoadErrorCounter)
+	writeMappingFile(t, path, "default/mapped: [\n")
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(mappingFileLoadErrorCounter) == errors; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the malformed file to be counted")
+		}
+	}
+	waitForRole("arn:aws:iam::111122223333:role/reloaded")
+
+	writeMappingFile(t, path, "{}\n")
+	waitForRole("")
+}
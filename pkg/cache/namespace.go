@@ -0,0 +1,152 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"strings"
+	"sync"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// NamespaceResponse holds the parsed namespace level defaults
+type NamespaceResponse struct {
+	DefaultRoleARN  string
+	DefaultAudience string
+	// AllowedRoleARNs are the glob patterns of the role ARNs pods in the
+	// namespace may use, or nil if any role is allowed
+	AllowedRoleARNs []string
+}
+
+// NamespaceCache is a cache of namespace level defaults
+type NamespaceCache interface {
+	Start()
+	// Get returns a copy of the parsed defaults of a namespace, or nil if the
+	// namespace is not cached
+	Get(name string) *NamespaceResponse
+}
+
+type namespaceCache struct {
+	mu               sync.RWMutex // guards cache
+	cache            map[string]*NamespaceResponse
+	controller       cache.Controller
+	annotationPrefix string
+}
+
+func (c *namespaceCache) Get(name string) *NamespaceResponse {
+	klog.V(5).Infof("Fetching namespace %s from cache", name)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resp, ok := c.cache[name]
+	if !ok {
+		return nil
+	}
+	respCopy := *resp
+	respCopy.AllowedRoleARNs = copyPatterns(resp.AllowedRoleARNs)
+	return &respCopy
+}
+
+// copyPatterns copies patterns, keeping nil and empty patterns distinct
+func copyPatterns(patterns []string) []string {
+	if patterns == nil {
+		return nil
+	}
+	return append([]string{}, patterns...)
+}
+
+// parse reads the annotations of a namespace into a NamespaceResponse
+func (c *namespaceCache) parse(ns *v1.Namespace) *NamespaceResponse {
+	resp := &NamespaceResponse{}
+	if arn, ok := AnnotationValue(ns.Annotations, c.annotationPrefix+"/default-role-arn"); ok {
+		resp.DefaultRoleARN = arn
+	}
+	if audience, ok := AnnotationValue(ns.Annotations, c.annotationPrefix+"/default-audience"); ok {
+		resp.DefaultAudience = strings.TrimSpace(audience)
+	}
+	// An annotation without patterns allows no roles
+	if patterns, ok := AnnotationValue(ns.Annotations, c.annotationPrefix+"/allowed-role-arns"); ok {
+		resp.AllowedRoleARNs = []string{}
+		for _, pattern := range strings.Split(patterns, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				resp.AllowedRoleARNs = append(resp.AllowedRoleARNs, pattern)
+			}
+		}
+	}
+	return resp
+}
+
+func (c *namespaceCache) addNamespace(ns *v1.Namespace) {
+	klog.V(5).Infof("Adding namespace %s to cache", ns.Name)
+	resp := c.parse(ns)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache[ns.Name] = resp
+}
+
+func (c *namespaceCache) pop(name string) {
+	klog.V(5).Infof("Removing namespace %s from cache", name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.cache, name)
+}
+
+// NewNamespaceCache returns a NamespaceCache backed by a namespace informer
+func NewNamespaceCache(prefix string, clientset kubernetes.Interface, opts ...InformerOption) NamespaceCache {
+	c := &namespaceCache{
+		cache:            map[string]*NamespaceResponse{},
+		annotationPrefix: prefix,
+	}
+
+	nsListWatcher := cache.NewListWatchFromClient(
+		clientset.CoreV1().RESTClient(),
+		"namespaces",
+		v1.NamespaceAll,
+		fields.Everything(),
+	)
+
+	c.controller = newInformer(
+		"namespaces",
+		nsListWatcher,
+		&v1.Namespace{},
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				ns := obj.(*v1.Namespace)
+				c.addNamespace(ns)
+			},
+			DeleteFunc: func(obj interface{}) {
+				ns, ok := obj.(*v1.Namespace)
+				if !ok {
+					return
+				}
+				c.pop(ns.Name)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				ns := newObj.(*v1.Namespace)
+				c.addNamespace(ns)
+			},
+		},
+		newInformerConfig(opts),
+	)
+	return c
+}
+
+func (c *namespaceCache) Start() {
+	go c.controller.Run(make(chan struct{}))
+}
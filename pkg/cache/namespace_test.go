@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestNamespaceCache(t *testing.T) {
+	testNamespace := &v1.Namespace{}
+	testNamespace.Name = "default"
+	roleArn := "arn:aws:iam::111122223333:role/namespace-default"
+	testNamespace.Annotations = map[string]string{
+		"eks.amazonaws.com/default-role-arn":  roleArn,
+		"eks.amazonaws.com/default-audience":  " custom ",
+		"eks.amazonaws.com/allowed-role-arns": "arn:aws:iam::111122223333:role/team-a/*, arn:aws:iam::111122223333:role/shared,",
+	}
+
+	cache := &namespaceCache{
+		cache:            map[string]*NamespaceResponse{},
+		annotationPrefix: "eks.amazonaws.com",
+	}
+
+	if resp := cache.Get("default"); resp != nil {
+		t.Errorf("Expected no response, got %+v", resp)
+	}
+
+	cache.addNamespace(testNamespace)
+
+	resp := cache.Get("default")
+	if resp.DefaultRoleARN != roleArn {
+		t.Errorf("Expected default role to be %s, got %s", roleArn, resp.DefaultRoleARN)
+	}
+	if resp.DefaultAudience != "custom" {
+		t.Errorf("Expected default audience to be custom, got %s", resp.DefaultAudience)
+	}
+	wantPatterns := []string{"arn:aws:iam::111122223333:role/team-a/*", "arn:aws:iam::111122223333:role/shared"}
+	if !reflect.DeepEqual(resp.AllowedRoleARNs, wantPatterns) {
+		t.Errorf("Expected allowed role ARNs %v, got %v", wantPatterns, resp.AllowedRoleARNs)
+	}
+
+	testNamespace.Annotations = map[string]string{"eks.amazonaws.com/allowed-role-arns": " "}
+	cache.addNamespace(testNamespace)
+	if resp := cache.Get("default"); resp.AllowedRoleARNs == nil || len(resp.AllowedRoleARNs) != 0 {
+		t.Errorf("Expected an empty annotation to allow no roles, got %#v", resp.AllowedRoleARNs)
+	}
+	testNamespace.Annotations = nil
+	cache.addNamespace(testNamespace)
+	if resp := cache.Get("default"); resp.AllowedRoleARNs != nil {
+		t.Errorf("Expected no annotation to allow any role, got %#v", resp.AllowedRoleARNs)
+	}
+
+	cache.pop("default")
+	if resp := cache.Get("default"); resp != nil {
+		t.Errorf("Expected no response after pop, got %+v", resp)
+	}
+}
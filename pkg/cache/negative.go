@@ -0,0 +1,126 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// DefaultNegativeCacheTTL is the default time service accounts fetched from
+// the API server without annotations are cached
+const DefaultNegativeCacheTTL = 30 * time.Second
+
+var (
+	negativeCacheHitCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sa_negative_cache_hits_total",
+			Help: "Counter of service account lookups served from the cache of service accounts without annotations.",
+		},
+	)
+	negativeCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sa_negative_cache_entries",
+			Help: "Number of service accounts without annotations cached after an API server lookup.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(negativeCacheHitCounter)
+	prometheus.MustRegister(negativeCacheSize)
+}
+
+// negativeEntry is a service account without annotations, cached until it
+// expires
+type negativeEntry struct {
+	resp    *CacheResponse
+	expires time.Time
+}
+
+// hasAnnotations returns true if sa has an annotation with an annotation
+// prefix
+func (c *serviceAccountCache) hasAnnotations(sa *v1.ServiceAccount) bool {
+	for key := range sa.Annotations {
+		if c.prefixed(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// getNegative returns a copy of the settings of a service account cached
+// without annotations, or nil if it isn't cached or expired
+func (c *serviceAccountCache) getNegative(name, namespace string) *CacheResponse {
+	if c.negativeTTL <= 0 {
+		return nil
+	}
+	key := namespace + "/" + name
+	c.negativeMu.Lock()
+	defer c.negativeMu.Unlock()
+	entry, ok := c.negative[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.negative, key)
+		negativeCacheSize.Set(float64(len(c.negative)))
+		return nil
+	}
+	respCopy := *entry.resp
+	return &respCopy
+}
+
+// setNegative caches the settings of a service account fetched from the API
+// server if it has no annotations, so lookups of its pods don't call the API
+// server again until the TTL expires. Expired entries are evicted.
+func (c *serviceAccountCache) setNegative(sa *v1.ServiceAccount, resp *CacheResponse) {
+	if c.negativeTTL <= 0 || c.hasAnnotations(sa) {
+		return
+	}
+	now := time.Now()
+	c.negativeMu.Lock()
+	defer c.negativeMu.Unlock()
+	if c.negative == nil {
+		c.negative = map[string]negativeEntry{}
+	}
+	for key, entry := range c.negative {
+		if now.After(entry.expires) {
+			delete(c.negative, key)
+		}
+	}
+	klog.V(5).Infof("Caching sa %s/%s without annotations for %s", sa.Namespace, sa.Name, c.negativeTTL)
+	respCopy := *resp
+	c.negative[sa.Namespace+"/"+sa.Name] = negativeEntry{resp: &respCopy, expires: now.Add(c.negativeTTL)}
+	negativeCacheSize.Set(float64(len(c.negative)))
+}
+
+// invalidateNegative drops a service account from the negative cache, eg.
+// when the informer shows annotations were added to it
+func (c *serviceAccountCache) invalidateNegative(name, namespace string) {
+	key := namespace + "/" + name
+	c.negativeMu.Lock()
+	defer c.negativeMu.Unlock()
+	if _, ok := c.negative[key]; !ok {
+		return
+	}
+	klog.V(5).Infof("Removing sa %s/%s from the negative cache", namespace, name)
+	delete(c.negative, key)
+	negativeCacheSize.Set(float64(len(c.negative)))
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSaCacheNegativeLookup(t *testing.T) {
+	unannotated := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "default"}}
+	clientset := fake.NewSimpleClientset(unannotated)
+	c := &serviceAccountCache{
+		cache:            map[string]*CacheResponse{},
+		defaultAudience:  "sts.amazonaws.com",
+		annotationPrefix: "eks.amazonaws.com",
+		clientset:        clientset,
+		negativeTTL:      time.Minute,
+	}
+	gets := func() int {
+		n := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "get" {
+				n++
+			}
+		}
+		return n
+	}
+
+	hits := testutil.ToFloat64(negativeCacheHitCounter)
+	for i := 0; i < 3; i++ {
+		resp, err := c.Lookup(context.Background(), "plain", "default")
+		if err != nil || resp == nil || resp.RoleARN != "" || resp.Audience != "sts.amazonaws.com" {
+			t.Fatalf("Expected the sa without a role, got %+v, %v", resp, err)
+		}
+	}
+	if got := gets(); got != 1 {
+		t.Errorf("Expected 1 API server lookup, got %d", got)
+	}
+	if got := testutil.ToFloat64(negativeCacheHitCounter) - hits; got != 2 {
+		t.Errorf("Expected 2 negative cache hits, got %v", got)
+	}
+	if got := testutil.ToFloat64(negativeCacheSize); got != 1 {
+		t.Errorf("Expected 1 negative cache entry, got %v", got)
+	}
+
+	// The informer shows a role annotation was added
+	annotated := unannotated.DeepCopy()
+	annotated.Annotations = map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/plain"}
+	c.addSA(annotated)
+	if got := testutil.ToFloat64(negativeCacheSize); got != 0 {
+		t.Errorf("Expected the negative cache entry to be invalidated, got %v entries", got)
+	}
+	c.pop("plain", "default")
+	if _, err := clientset.CoreV1().ServiceAccounts("default").Update(context.Background(), annotated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Lookup(context.Background(), "plain", "default")
+	if err != nil || resp == nil || resp.RoleARN != "arn:aws:iam::111122223333:role/plain" {
+		t.Fatalf("Expected the annotated sa to be fetched, got %+v, %v", resp, err)
+	}
+	if got := gets(); got != 2 {
+		t.Errorf("Expected 2 API server lookups, got %d", got)
+	}
+	if got := testutil.ToFloat64(negativeCacheSize); got != 0 {
+		t.Errorf("Expected the annotated sa not to be negatively cached, got %v entries", got)
+	}
+}
+
+func TestSaCacheNegativeExpiration(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "default"}})
+	cases := []struct {
+		caseName string
+		ttl      time.Duration
+		expected int
+	}{
+		{"Cached", time.Minute, 1},
+		{"Expired", time.Millisecond, 2},
+		{"Disabled", 0, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			clientset.ClearActions()
+			saCache := &serviceAccountCache{
+				cache:            map[string]*CacheResponse{},
+				annotationPrefix: "eks.amazonaws.com",
+				clientset:        clientset,
+				negativeTTL:      c.ttl,
+			}
+			for i := 0; i < 2; i++ {
+				if resp, err := saCache.Lookup(context.Background(), "plain", "default"); err != nil || resp == nil {
+					t.Fatalf("Expected the sa, got %+v, %v", resp, err)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if got := len(clientset.Actions()); got != c.expected {
+				t.Errorf("Expected %d API server lookups, got %d", c.expected, got)
+			}
+		})
+	}
+}
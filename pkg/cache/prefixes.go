@@ -0,0 +1,99 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+var annotationPrefixCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "sa_annotation_prefix_matches_total",
+		Help: "Counter of parsed service accounts with annotations, broken out for the annotation prefix their settings were read from.",
+	},
+	[]string{"prefix"},
+)
+
+func init() {
+	prometheus.MustRegister(annotationPrefixCounter)
+}
+
+// saParser parses the annotations of a service account with one of the
+// annotation prefixes of the cache
+type saParser struct {
+	*serviceAccountCache
+	prefix string
+}
+
+// prefixes returns the annotation prefix followed by the secondary prefixes
+func (c *serviceAccountCache) prefixes() []string {
+	return append([]string{c.annotationPrefix}, c.secondaryPrefixes...)
+}
+
+// prefixed returns true if an annotation key has one of the annotation
+// prefixes
+func (c *serviceAccountCache) prefixed(key string) bool {
+	for _, prefix := range c.prefixes() {
+		if strings.HasPrefix(key, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPrefix returns the prefix the annotations of sa are read from: the
+// first prefix with a role-arn or role-name annotation, or else the first
+// prefix with any annotation, or else the annotation prefix. ok is false if sa
+// has no annotation with any prefix.
+func (c *serviceAccountCache) matchPrefix(sa *v1.ServiceAccount) (prefix string, ok bool) {
+	prefixes := c.prefixes()
+	for _, prefix := range prefixes {
+		for _, name := range []string{"role-arn", "role-name"} {
+			if _, ok := sa.Annotations[prefix+"/"+name]; ok {
+				return prefix, true
+			}
+		}
+	}
+	for _, prefix := range prefixes {
+		for key := range sa.Annotations {
+			if strings.HasPrefix(key, prefix+"/") {
+				return prefix, true
+			}
+		}
+	}
+	return c.annotationPrefix, false
+}
+
+// parse reads the annotations of a service account into a CacheResponse, with
+// the prefix matched by matchPrefix. Service accounts read from a secondary
+// prefix are logged as deprecated.
+func (c *serviceAccountCache) parse(sa *v1.ServiceAccount) *CacheResponse {
+	prefix, ok := c.matchPrefix(sa)
+	resp := (&saParser{serviceAccountCache: c, prefix: prefix}).parseAnnotations(sa)
+	if !ok {
+		return resp
+	}
+	annotationPrefixCounter.WithLabelValues(prefix).Inc()
+	if prefix != c.annotationPrefix {
+		klog.Warningf("Sa %s/%s uses the deprecated annotation prefix %s, annotate it with %s instead", sa.Namespace, sa.Name, prefix, c.annotationPrefix)
+		resp.DeprecatedAnnotationPrefix = prefix
+	}
+	return resp
+}
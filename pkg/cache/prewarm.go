@@ -0,0 +1,118 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// DefaultPrewarmPageSize is the default number of service accounts listed per
+// page by the cache prewarm
+const DefaultPrewarmPageSize = 500
+
+var (
+	prewarmServiceAccounts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sa_cache_prewarm_service_accounts",
+			Help: "Number of service accounts loaded by the cache prewarm.",
+		},
+	)
+	prewarmNamespaces = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sa_cache_prewarm_namespaces_completed",
+			Help: "Number of namespaces whose service accounts are all loaded by the cache prewarm.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(prewarmServiceAccounts)
+	prometheus.MustRegister(prewarmNamespaces)
+}
+
+// runPrewarm prewarms the cache if it is enabled, the cache is synced once the
+// prewarm completes, and each namespace once the prewarm completes it. If it
+// fails, the cache is synced by the informers.
+func (c *serviceAccountCache) runPrewarm(ctx context.Context) {
+	if c.prewarmPageSize <= 0 || c.clientset == nil {
+		return
+	}
+	if err := c.prewarm(ctx); err != nil {
+		klog.Warningf("Error prewarming the service account cache, waiting for the informers to sync: %v", err)
+		return
+	}
+	c.prewarmed.Store(true)
+}
+
+// prewarm lists the service accounts of the watched namespaces, or of all
+// namespaces, page by page before the informers start, caching each page as
+// it is listed. Lists are sorted by namespace, so a namespace is completed
+// once the list moves past it.
+func (c *serviceAccountCache) prewarm(ctx context.Context) error {
+	loaded, completed := 0, 0
+	prewarmServiceAccounts.Set(0)
+	prewarmNamespaces.Set(0)
+	complete := func(namespace string) {
+		completed++
+		prewarmNamespaces.Set(float64(completed))
+		c.mu.Lock()
+		if c.prewarmedNamespaces == nil {
+			c.prewarmedNamespaces = map[string]struct{}{}
+		}
+		c.prewarmedNamespaces[namespace] = struct{}{}
+		c.mu.Unlock()
+		klog.V(4).Infof("Prewarmed the service accounts of namespace %s", namespace)
+	}
+
+	for _, namespace := range c.informerNamespaces() {
+		options := metav1.ListOptions{Limit: c.prewarmPageSize, LabelSelector: c.labelSelector}
+		current := ""
+		for {
+			list, err := c.clientset.CoreV1().ServiceAccounts(namespace).List(ctx, options)
+			if err != nil {
+				return fmt.Errorf("error listing service accounts: %v", err)
+			}
+			for i := range list.Items {
+				sa := &list.Items[i]
+				if current != "" && sa.Namespace != current {
+					complete(current)
+				}
+				current = sa.Namespace
+				c.addSA(sa)
+				loaded++
+			}
+			prewarmServiceAccounts.Set(float64(loaded))
+			klog.Infof("Prewarmed %d service accounts, %d namespaces completed", loaded, completed)
+			if options.Continue = list.Continue; options.Continue == "" {
+				break
+			}
+		}
+		if namespace != v1.NamespaceAll {
+			current = namespace
+		}
+		if current != "" {
+			complete(current)
+		}
+	}
+	klog.Infof("Prewarmed the service account cache with %d service accounts in %d namespaces", loaded, completed)
+	return nil
+}
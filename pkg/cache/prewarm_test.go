@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func prewarmServiceAccount(namespace, name string) v1.ServiceAccount {
+	return v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      map[string]string{"irsa": "true"},
+			Annotations: map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/" + namespace + "-" + name},
+		},
+	}
+}
+
+// pageProgress is the state of the prewarm when a page is listed
+type pageProgress struct {
+	cached, loaded, completed int
+}
+
+func TestSaCachePrewarm(t *testing.T) {
+	// The fake clientset ignores limit and continue, so the reactor serves
+	// the pages in order
+	pages := [][]v1.ServiceAccount{
+		{prewarmServiceAccount("a", "one"), prewarmServiceAccount("a", "two")},
+		{prewarmServiceAccount("b", "one"), prewarmServiceAccount("c", "one")},
+		{prewarmServiceAccount("c", "two")},
+	}
+	clientset := fake.NewSimpleClientset()
+	var c *serviceAccountCache
+	var progress []pageProgress
+	clientset.PrependReactor("list", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if selector := action.(k8stesting.ListAction).GetListRestrictions().Labels.String(); selector != "irsa=true" {
+			t.Errorf("Expected label selector irsa=true, got %q", selector)
+		}
+		page := len(progress)
+		progress = append(progress, pageProgress{
+			cached:    len(c.List("")),
+			loaded:    int(testutil.ToFloat64(prewarmServiceAccounts)),
+			completed: int(testutil.ToFloat64(prewarmNamespaces)),
+		})
+		list := &v1.ServiceAccountList{Items: pages[page]}
+		if page < len(pages)-1 {
+			list.Continue = "next"
+		}
+		return true, list, nil
+	})
+	c = New("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithLabelSelector("irsa=true"), WithPrewarm(2)).(*serviceAccountCache)
+
+	if c.HasSynced() {
+		t.Fatal("Expected cache not to be synced before the prewarm")
+	}
+	c.runPrewarm(context.Background())
+	if !c.HasSynced() {
+		t.Error("Expected cache to be synced by the prewarm")
+	}
+
+	// Each page is cached as it is listed, a namespace is completed once the
+	// list moves past it
+	expected := []pageProgress{{0, 0, 0}, {2, 2, 0}, {4, 4, 2}}
+	if len(progress) != len(expected) {
+		t.Fatalf("Expected %d pages, got %d", len(expected), len(progress))
+	}
+	for i := range expected {
+		if progress[i] != expected[i] {
+			t.Errorf("Expected progress %+v before page %d, got %+v", expected[i], i, progress[i])
+		}
+	}
+	if got := testutil.ToFloat64(prewarmServiceAccounts); got != 5 {
+		t.Errorf("Expected 5 prewarmed service accounts, got %v", got)
+	}
+	if got := testutil.ToFloat64(prewarmNamespaces); got != 3 {
+		t.Errorf("Expected 3 prewarmed namespaces, got %v", got)
+	}
+	if resp := c.Get("two", "c"); resp == nil || resp.RoleARN != "arn:aws:iam::111122223333:role/c-two" {
+		t.Errorf("Expected the prewarmed sa, got %+v", resp)
+	}
+}
+
+func TestSaCachePrewarmNamespaces(t *testing.T) {
+	one := prewarmServiceAccount("a", "one")
+	clientset := fake.NewSimpleClientset(&one, &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "other"}})
+	c := New("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithNamespaces([]string{"empty", "a"}), WithPrewarm(DefaultPrewarmPageSize)).(*serviceAccountCache)
+	c.runPrewarm(context.Background())
+
+	var listed []string
+	for _, action := range clientset.Actions() {
+		listed = append(listed, action.GetNamespace())
+	}
+	if len(listed) != 2 || listed[0] != "a" || listed[1] != "empty" {
+		t.Errorf("Expected the watched namespaces to be listed, got %v", listed)
+	}
+	if got := testutil.ToFloat64(prewarmNamespaces); got != 2 {
+		t.Errorf("Expected 2 prewarmed namespaces, got %v", got)
+	}
+	if list := c.List(""); len(list) != 1 || list[0].Name != "one" {
+		t.Errorf("Expected the service account of the watched namespace, got %+v", list)
+	}
+}
+
+func TestSaCachePrewarmError(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("list", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("the provided continue parameter is too old")
+	})
+	c := New("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithPrewarm(DefaultPrewarmPageSize)).(*serviceAccountCache)
+	c.runPrewarm(context.Background())
+	if c.HasSynced() {
+		t.Error("Expected a failed prewarm to wait for the informers to sync")
+	}
+}
+
+func TestSaCachePrewarmNamespaceSynced(t *testing.T) {
+	// The list fails after the first page, which completes namespace a
+	clientset := fake.NewSimpleClientset()
+	pages := 0
+	clientset.PrependReactor("list", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if pages++; pages > 1 {
+			return true, nil, errors.New("the provided continue parameter is too old")
+		}
+		return true, &v1.ServiceAccountList{
+			ListMeta: metav1.ListMeta{Continue: "next"},
+			Items:    []v1.ServiceAccount{prewarmServiceAccount("a", "one"), prewarmServiceAccount("b", "one")},
+		}, nil
+	})
+	c := New("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithNamespaces([]string{"a", "b"}), WithPrewarm(2)).(*serviceAccountCache)
+	c.runPrewarm(context.Background())
+
+	if c.HasSynced() {
+		t.Error("Expected a failed prewarm not to sync the cache")
+	}
+	if !c.NamespaceSynced("a") {
+		t.Error("Expected the completed namespace to be synced")
+	}
+	if c.NamespaceSynced("b") {
+		t.Error("Expected the namespace of the failed page not to be synced")
+	}
+	if c.NamespaceSynced("other") {
+		t.Error("Expected a namespace that isn't watched not to be synced")
+	}
+}
+
+func TestSaCachePrewarmDeleted(t *testing.T) {
+	kept, gone := prewarmServiceAccount("a", "kept"), prewarmServiceAccount("a", "gone")
+	clientset := fake.NewSimpleClientset(&kept, &gone)
+	c := New("sts.amazonaws.com", "eks.amazonaws.com", clientset, WithPrewarm(DefaultPrewarmPageSize)).(*serviceAccountCache)
+	c.runPrewarm(context.Background())
+	if c.Get("gone", "a") == nil {
+		t.Fatal("Expected the prewarm to cache the sa")
+	}
+
+	// The service account is deleted before the informers list, so they send
+	// no delete event for it
+	if err := clientset.CoreV1().ServiceAccounts("a").Delete(context.Background(), "gone", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Error deleting sa: %v", err)
+	}
+	var events []SAEvent
+	var eventsMu sync.Mutex
+	c.AddListener(func(evt SAEvent) {
+		eventsMu.Lock()
+		defer eventsMu.Unlock()
+		events = append(events, evt)
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	c.runInformers(stop)
+
+	for deadline := time.Now().Add(5 * time.Second); c.Get("gone", "a") != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the deleted sa to be removed once the informers synced")
+		}
+	}
+	if c.Get("kept", "a") == nil {
+		t.Error("Expected the listed sa to stay cached")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		eventsMu.Lock()
+		count := len(events)
+		eventsMu.Unlock()
+		if count > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a delete event")
+		}
+	}
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if len(events) != 1 || events[0].Type != SAEventDelete || events[0].Name != "gone" {
+		t.Errorf("Expected a single delete event of the removed sa, got %+v", events)
+	}
+}
@@ -0,0 +1,340 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	admissionregistrationv1ac "k8s.io/client-go/applyconfigurations/admissionregistration/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/certificate"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// CABundleFieldManager is the field manager of the caBundles applied to the
+// webhook configuration
+const CABundleFieldManager = "pod-identity-webhook-ca-bundle"
+
+// caBundleCheckPeriod is how often the CA bundle of the serving certificate
+// is checked for changes
+const caBundleCheckPeriod = 30 * time.Second
+
+var (
+	caBundleUpdateCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: "certificate_manager",
+			Name:      "ca_bundle_updates_total",
+			Help:      "Counter of updates of the CA bundle of the webhook configuration, or of the CA bundle file out of cluster.",
+		},
+	)
+	caBundleUpdateErrorCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: "certificate_manager",
+			Name:      "ca_bundle_update_errors_total",
+			Help:      "Counter of updates of the CA bundle of the webhook configuration, or of the CA bundle file out of cluster, that failed and are retried.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(caBundleUpdateCounter)
+	prometheus.MustRegister(caBundleUpdateErrorCounter)
+}
+
+// ClusterCA returns the PEM encoded CA of the API server of config, which
+// signs the certificates of the csr source
+func ClusterCA(config *rest.Config) ([]byte, error) {
+	if len(config.CAData) != 0 {
+		return config.CAData, nil
+	}
+	if config.CAFile == "" {
+		return nil, nil
+	}
+	ca, err := os.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cluster CA: %v", err)
+	}
+	return ca, nil
+}
+
+// CABundle returns the PEM encoded CAs the API server verifies cert with: the
+// certificates of its chain after the leaf, the leaf if it is self-signed, or
+// clusterCA otherwise
+func CABundle(cert *tls.Certificate, clusterCA []byte) []byte {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	if len(cert.Certificate) > 1 {
+		var bundle []byte
+		for _, der := range cert.Certificate[1:] {
+			bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+		}
+		return bundle
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return clusterCA
+		}
+		leaf = parsed
+	}
+	// A self-signed leaf is trusted as is, it doesn't need to be a CA
+	if bytes.Equal(leaf.RawIssuer, leaf.RawSubject) && leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	}
+	return clusterCA
+}
+
+// CABundleWriter writes the CA bundle of the serving certificate where the
+// API server reads it
+type CABundleWriter interface {
+	// WriteCABundle writes bundle, it returns true if it changed
+	WriteCABundle(ctx context.Context, bundle []byte) (bool, error)
+}
+
+// RunCABundleSync writes the CA bundle of the certificate of manager with
+// writer when it changes, and on each trigger, until ctx is done. Failed
+// writes are retried.
+func RunCABundleSync(ctx context.Context, manager certificate.Manager, clusterCA []byte, writer CABundleWriter, trigger <-chan struct{}) {
+	update := func() {
+		bundle := CABundle(manager.Current(), clusterCA)
+		if len(bundle) == 0 {
+			klog.V(4).Info("No CA bundle of the serving certificate to write yet")
+			return
+		}
+		updated, err := writer.WriteCABundle(ctx, bundle)
+		if err != nil {
+			klog.Errorf("Error writing the CA bundle of the serving certificate, retrying: %v", err)
+			caBundleUpdateErrorCounter.Inc()
+			return
+		}
+		if updated {
+			caBundleUpdateCounter.Inc()
+		}
+	}
+	ticker := time.NewTicker(caBundleCheckPeriod)
+	defer ticker.Stop()
+	for {
+		update()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-trigger:
+		}
+	}
+}
+
+// WebhookCABundlePatcher applies the CA bundle to the webhooks of a
+// MutatingWebhookConfiguration with server-side apply, owning only their
+// caBundle fields
+type WebhookCABundlePatcher struct {
+	clientset clientset.Interface
+	name      string
+}
+
+// NewWebhookCABundlePatcher returns a patcher of the named
+// MutatingWebhookConfiguration
+func NewWebhookCABundlePatcher(kubeClient clientset.Interface, name string) *WebhookCABundlePatcher {
+	return &WebhookCABundlePatcher{clientset: kubeClient, name: name}
+}
+
+// WriteCABundle applies bundle to the webhooks of the configuration whose
+// caBundle differs. The caBundles are forced, they are usually set by the
+// manifest the configuration was created from.
+func (p *WebhookCABundlePatcher) WriteCABundle(ctx context.Context, bundle []byte) (bool, error) {
+	config, err := p.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, p.name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("error fetching mutating webhook configuration %s: %v", p.name, err)
+	}
+	stale := false
+	apply := admissionregistrationv1ac.MutatingWebhookConfiguration(p.name)
+	for _, webhook := range config.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, bundle) {
+			stale = true
+		}
+		apply.WithWebhooks(admissionregistrationv1ac.MutatingWebhook().
+			WithName(webhook.Name).
+			WithClientConfig(admissionregistrationv1ac.WebhookClientConfig().WithCABundle(bundle...)))
+	}
+	if !stale {
+		return false, nil
+	}
+	if _, err := p.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Apply(ctx, apply,
+		metav1.ApplyOptions{FieldManager: CABundleFieldManager, Force: true}); err != nil {
+		return false, fmt.Errorf("error applying the CA bundle of mutating webhook configuration %s: %v", p.name, err)
+	}
+	klog.Infof("Applied the CA bundle of the serving certificate to the %d webhooks of mutating webhook configuration %s", len(config.Webhooks), p.name)
+	return true, nil
+}
+
+// Watch returns a channel receiving a value when the configuration changes,
+// eg. when it is applied again with the caBundle of its manifest, until ctx is
+// done
+func (p *WebhookCABundlePatcher) Watch(ctx context.Context) <-chan struct{} {
+	selector := fields.OneTermEqualSelector("metadata.name", p.name).String()
+	client := p.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return client.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return client.Watch(ctx, options)
+		},
+	}
+	changed := make(chan struct{}, 1)
+	notify := func(obj interface{}) {
+		if config, ok := obj.(*admissionregistrationv1.MutatingWebhookConfiguration); !ok || config.Name != p.name {
+			return
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	informer := cache.NewSharedIndexInformer(lw, &admissionregistrationv1.MutatingWebhookConfiguration{}, 0, cache.Indexers{})
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, newObj interface{}) { notify(newObj) },
+	}); err != nil {
+		klog.Fatalf("Error adding mutatingwebhookconfigurations informer handler: %v", err)
+	}
+	go informer.Run(ctx.Done())
+	return changed
+}
+
+// FileCABundleWriter writes the CA bundle to a file, and sets it as the
+// caBundle of the webhook configuration generated out of cluster
+type FileCABundleWriter struct {
+	path string
+	// configPath is the generated webhook configuration, empty for none
+	configPath string
+}
+
+// NewFileCABundleWriter returns a writer of the CA bundle file path, and of
+// the caBundles of the webhook configuration file configPath unless it is
+// empty
+func NewFileCABundleWriter(path, configPath string) *FileCABundleWriter {
+	return &FileCABundleWriter{path: path, configPath: configPath}
+}
+
+// WriteCABundle replaces the file with bundle if it differs, then regenerates
+// the webhook configuration with it if its caBundles differ
+func (w *FileCABundleWriter) WriteCABundle(_ context.Context, bundle []byte) (bool, error) {
+	updated, err := replaceFile(w.path, bundle)
+	if err != nil {
+		return false, fmt.Errorf("error writing CA bundle file %s: %v", w.path, err)
+	}
+	if updated {
+		klog.Infof("Wrote the CA bundle of the serving certificate to %s", w.path)
+	}
+	if w.configPath == "" {
+		return updated, nil
+	}
+	config, err := os.ReadFile(w.configPath)
+	if err != nil {
+		return false, fmt.Errorf("error reading webhook configuration %s: %v", w.configPath, err)
+	}
+	config, err = setConfigCABundle(config, bundle)
+	if err != nil {
+		return false, fmt.Errorf("error regenerating webhook configuration %s: %v", w.configPath, err)
+	}
+	configUpdated, err := replaceFile(w.configPath, config)
+	if err != nil {
+		return false, fmt.Errorf("error writing webhook configuration %s: %v", w.configPath, err)
+	}
+	if configUpdated {
+		klog.Infof("Regenerated webhook configuration %s with the CA bundle of the serving certificate", w.configPath)
+	}
+	return updated || configUpdated, nil
+}
+
+// setConfigCABundle returns a webhook configuration with the caBundle of each
+// of its webhooks set to bundle. The configuration is decoded without its API
+// types, so that mutating and validating configurations of any API version
+// keep their other fields.
+func setConfigCABundle(config, bundle []byte) ([]byte, error) {
+	var object map[string]interface{}
+	if err := yaml.Unmarshal(config, &object); err != nil {
+		return nil, err
+	}
+	webhooks, _ := object["webhooks"].([]interface{})
+	if len(webhooks) == 0 {
+		return nil, fmt.Errorf("no webhooks")
+	}
+	for i, webhook := range webhooks {
+		fields, ok := webhook.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid webhook %d", i)
+		}
+		clientConfig, ok := fields["clientConfig"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("webhook %d has no clientConfig", i)
+		}
+		clientConfig["caBundle"] = base64.StdEncoding.EncodeToString(bundle)
+	}
+	return yaml.Marshal(object)
+}
+
+// replaceFile replaces the file path with data if it differs, through a
+// temporary file so it is never read partially written
+func replaceFile(path string, data []byte) (bool, error) {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	// The files hold no secrets, only certificates and webhook configurations
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
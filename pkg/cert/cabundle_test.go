@@ -0,0 +1,357 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCABundle(t *testing.T) {
+	caKey, caKeyPEM, err := generateKey(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM := selfSign(t, caKey, "test-ca")
+	caCert, err := x509.ParseCertificate(pemBytes(t, caPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned, err := tls.X509KeyPair(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A leaf signed by the CA, with and without the CA in its chain
+	leafKey, _, err := generateKey(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: caCert.SerialNumber,
+		NotBefore:    caCert.NotBefore,
+		NotAfter:     caCert.NotAfter,
+	}, caCert, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &tls.Certificate{Certificate: [][]byte{leafDER}}
+	chain := &tls.Certificate{Certificate: [][]byte{leafDER, caCert.Raw}}
+	clusterCA := []byte("cluster CA")
+
+	cases := []struct {
+		caseName string
+		cert     *tls.Certificate
+		expected []byte
+	}{
+		{"None", nil, nil},
+		{"SelfSigned", &selfSigned, caPEM},
+		{"Chain", chain, caPEM},
+		{"SignedByCluster", leaf, clusterCA},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			if got := CABundle(c.cert, clusterCA); !bytes.Equal(got, c.expected) {
+				t.Errorf("Expected CA bundle %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+// newFakeWebhookConfig returns a fake clientset with a mutating webhook
+// configuration of two webhooks. Applied caBundles are set on the tracked
+// configuration, and the applied patches are sent to patches.
+func newFakeWebhookConfig(t *testing.T, caBundle []byte) (*fakeclientset.Clientset, chan []byte) {
+	t.Helper()
+	failurePolicy := admissionregistrationv1.Ignore
+	webhook := func(name string) admissionregistrationv1.MutatingWebhook {
+		return admissionregistrationv1.MutatingWebhook{
+			Name:          name,
+			FailurePolicy: &failurePolicy,
+			ClientConfig:  admissionregistrationv1.WebhookClientConfig{CABundle: caBundle},
+		}
+	}
+	fake := fakeclientset.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{webhook("pod-identity-webhook.amazonaws.com"), webhook("pod-identity-webhook-v2.amazonaws.com")},
+	})
+	patches := make(chan []byte, 10)
+	resource := admissionregistrationv1.SchemeGroupVersion.WithResource("mutatingwebhookconfigurations")
+	fake.PrependReactor("patch", "mutatingwebhookconfigurations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			t.Errorf("Expected a server-side apply patch, got %s", patch.GetPatchType())
+		}
+		var applied admissionregistrationv1.MutatingWebhookConfiguration
+		if err := json.Unmarshal(patch.GetPatch(), &applied); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := fake.Tracker().Get(resource, "", patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		config := obj.(*admissionregistrationv1.MutatingWebhookConfiguration).DeepCopy()
+		for _, a := range applied.Webhooks {
+			for i := range config.Webhooks {
+				if config.Webhooks[i].Name == a.Name {
+					config.Webhooks[i].ClientConfig.CABundle = a.ClientConfig.CABundle
+				}
+			}
+		}
+		if err := fake.Tracker().Update(resource, config, ""); err != nil {
+			return true, nil, err
+		}
+		patches <- patch.GetPatch()
+		return true, config, nil
+	})
+	return fake, patches
+}
+
+func TestWebhookCABundlePatcher(t *testing.T) {
+	fake, patches := newFakeWebhookConfig(t, []byte("stale"))
+	patcher := NewWebhookCABundlePatcher(fake, "pod-identity-webhook")
+	ctx := context.Background()
+	bundle := []byte("-----BEGIN CERTIFICATE-----\n")
+
+	updated, err := patcher.WriteCABundle(ctx, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated {
+		t.Error("Expected the stale CA bundles to be updated")
+	}
+	// The patch only holds the caBundles, the other fields of the webhooks
+	// are owned by the manifest of the configuration
+	var patch map[string]interface{}
+	if err := json.Unmarshal(<-patches, &patch); err != nil {
+		t.Fatal(err)
+	}
+	encoded := []interface{}{}
+	for _, name := range []string{"pod-identity-webhook.amazonaws.com", "pod-identity-webhook-v2.amazonaws.com"} {
+		encoded = append(encoded, map[string]interface{}{
+			"name":         name,
+			"clientConfig": map[string]interface{}{"caBundle": "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCg=="},
+		})
+	}
+	expected := map[string]interface{}{
+		"kind":       "MutatingWebhookConfiguration",
+		"apiVersion": "admissionregistration.k8s.io/v1",
+		"metadata":   map[string]interface{}{"name": "pod-identity-webhook"},
+		"webhooks":   encoded,
+	}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("Expected patch %v, got %v", expected, patch)
+	}
+
+	// Up to date CA bundles aren't patched again
+	updated, err = patcher.WriteCABundle(ctx, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated || len(patches) != 0 {
+		t.Error("Expected up to date CA bundles not to be patched")
+	}
+
+	if _, err := NewWebhookCABundlePatcher(fake, "other").WriteCABundle(ctx, bundle); err == nil {
+		t.Error("Expected an error for a missing webhook configuration")
+	}
+}
+
+func TestRunCABundleSync(t *testing.T) {
+	manager, err := newSelfSignedCertManager("pod-identity-webhook", "eks", nil, DefaultKeyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := CABundle(manager.Current(), nil)
+	fake, patches := newFakeWebhookConfig(t, nil)
+	patcher := NewWebhookCABundlePatcher(fake, "pod-identity-webhook")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := testutil.ToFloat64(caBundleUpdateCounter)
+	go RunCABundleSync(ctx, manager, nil, patcher, patcher.Watch(ctx))
+
+	expectPatch := func() {
+		t.Helper()
+		select {
+		case <-patches:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Expected the CA bundle to be patched")
+		}
+	}
+	expectPatch()
+
+	// The configuration applied again with its manifest is patched when the
+	// watch sees it
+	configs := fake.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	config, err := configs.Get(ctx, "pod-identity-webhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Webhooks[0].ClientConfig.CABundle = []byte("${CA_BUNDLE}")
+	if _, err := configs.Update(ctx, config, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectPatch()
+
+	config, err = configs.Get(ctx, "pod-identity-webhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, webhook := range config.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, bundle) {
+			t.Errorf("Expected webhook %s to have the CA bundle of the serving certificate, got %q", webhook.Name, webhook.ClientConfig.CABundle)
+		}
+	}
+	if got := testutil.ToFloat64(caBundleUpdateCounter) - updates; got != 2 {
+		t.Errorf("Expected 2 CA bundle updates, got %v", got)
+	}
+}
+
+func TestFileCABundleWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca-bundle.crt")
+	writer := NewFileCABundleWriter(path, "")
+	ctx := context.Background()
+	for _, c := range []struct {
+		bundle  string
+		updated bool
+	}{
+		{"first", true},
+		{"first", false},
+		{"second", true},
+	} {
+		updated, err := writer.WriteCABundle(ctx, []byte(c.bundle))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated != c.updated {
+			t.Errorf("Expected bundle %s updated %t, got %t", c.bundle, c.updated, updated)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != c.bundle {
+			t.Errorf("Expected bundle %s, got %s", c.bundle, content)
+		}
+	}
+	// No temporary file is left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the bundle file, got %d files", len(entries))
+	}
+}
+
+func TestFileCABundleWriterConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "mutatingwebhook.yaml")
+	config := `apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: pod-identity-webhook
+webhooks:
+- admissionReviewVersions:
+  - v1
+  clientConfig:
+    caBundle: b2xkCg==
+    url: https://10.0.0.10:8443/mutate
+  name: pod-identity-webhook.amazonaws.com
+  sideEffects: None
+- clientConfig:
+    service:
+      name: pod-identity-webhook
+      namespace: default
+  name: other.amazonaws.com
+`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writer := NewFileCABundleWriter(filepath.Join(dir, "ca-bundle.crt"), configPath)
+	ctx := context.Background()
+
+	updated, err := writer.WriteCABundle(ctx, []byte("new\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated {
+		t.Error("Expected the CA bundle to be updated")
+	}
+	regenerated, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The caBundles are replaced, the other fields are kept
+	expected := `apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: pod-identity-webhook
+webhooks:
+- admissionReviewVersions:
+  - v1
+  clientConfig:
+    caBundle: bmV3Cg==
+    url: https://10.0.0.10:8443/mutate
+  name: pod-identity-webhook.amazonaws.com
+  sideEffects: None
+- clientConfig:
+    caBundle: bmV3Cg==
+    service:
+      name: pod-identity-webhook
+      namespace: default
+  name: other.amazonaws.com
+`
+	if string(regenerated) != expected {
+		t.Errorf("Expected config\n%s\ngot\n%s", expected, regenerated)
+	}
+
+	// Unchanged files aren't written again, a configuration generated again
+	// from its template is
+	if updated, err := writer.WriteCABundle(ctx, []byte("new\n")); err != nil || updated {
+		t.Errorf("Expected no update of an unchanged bundle, got %t, %v", updated, err)
+	}
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := writer.WriteCABundle(ctx, []byte("new\n")); err != nil || !updated {
+		t.Errorf("Expected a stale config to be regenerated, got %t, %v", updated, err)
+	}
+
+	if err := os.WriteFile(configPath, []byte("kind: MutatingWebhookConfiguration\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteCABundle(ctx, []byte("new\n")); err == nil {
+		t.Error("Expected an error for a config without webhooks")
+	}
+}
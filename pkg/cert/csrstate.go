@@ -0,0 +1,189 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	certificates "k8s.io/api/certificates/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	certificatesclient "k8s.io/client-go/kubernetes/typed/certificates/v1"
+	"k8s.io/klog"
+)
+
+// States of the CSR of the serving certificate
+const (
+	csrStatePending  = "pending"
+	csrStateApproved = "approved"
+	csrStateDenied   = "denied"
+	csrStateFailed   = "failed"
+)
+
+var (
+	csrStateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "certificate_manager",
+			Name:      "csr_state",
+			Help:      "State of the last CSR of the serving certificate, 1 for its state: pending, approved, denied, or failed, 0 for the others.",
+		},
+		[]string{"state"},
+	)
+	csrRejectionCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "certificate_manager",
+			Name:      "csr_rejections_total",
+			Help:      "Counter of CSRs of the serving certificate denied or failed by the signer, by state and the reason of the signer.",
+		},
+		[]string{"state", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(csrStateGauge)
+	prometheus.MustRegister(csrRejectionCounter)
+}
+
+// lastRejection is the last denied or failed CSR, so a CSR read again by the
+// certificate manager is only logged and counted once
+var lastRejection struct {
+	sync.Mutex
+	key string
+}
+
+// recordCSRState sets the CSR state gauge to the state of csr
+func recordCSRState(csr *certificates.CertificateSigningRequest) {
+	state := csrStatePending
+	var rejection certificates.CertificateSigningRequestCondition
+	for _, condition := range csr.Status.Conditions {
+		switch condition.Type {
+		case certificates.CertificateDenied:
+			state, rejection = csrStateDenied, condition
+		case certificates.CertificateFailed:
+			state, rejection = csrStateFailed, condition
+		case certificates.CertificateApproved:
+			if state == csrStatePending {
+				state = csrStateApproved
+			}
+		}
+	}
+	klog.V(4).Infof("CSR %s of the serving certificate is %s", csr.Name, state)
+	if state == csrStateDenied || state == csrStateFailed {
+		recordCSRRejection(csr, state, rejection)
+	}
+	for _, s := range []string{csrStatePending, csrStateApproved, csrStateDenied, csrStateFailed} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		csrStateGauge.WithLabelValues(s).Set(value)
+	}
+}
+
+// recordCSRRejection logs and counts a denied or failed CSR with the reason of
+// the signer, eg. a signer rejecting the SANs of the request
+func recordCSRRejection(csr *certificates.CertificateSigningRequest, state string, condition certificates.CertificateSigningRequestCondition) {
+	key := string(csr.UID) + "/" + csr.Name + "/" + state
+	lastRejection.Lock()
+	defer lastRejection.Unlock()
+	if lastRejection.key == key {
+		return
+	}
+	lastRejection.key = key
+	reason := condition.Reason
+	if reason == "" {
+		reason = "unknown"
+	}
+	klog.Warningf("CSR %s of the serving certificate is %s by signer %s, recreating it: %s: %s",
+		csr.Name, state, csr.Spec.SignerName, reason, condition.Message)
+	csrRejectionCounter.WithLabelValues(state, reason).Inc()
+}
+
+// csrStateClientset is a clientset recording the state of the CSRs created,
+// read, and watched by the certificate manager. If keys is set, the CSRs are
+// created with its keys.
+type csrStateClientset struct {
+	clientset.Interface
+	keys *csrKeys
+}
+
+func (c *csrStateClientset) CertificatesV1() certificatesclient.CertificatesV1Interface {
+	return &csrStateCertificates{c.Interface.CertificatesV1(), c.keys}
+}
+
+type csrStateCertificates struct {
+	certificatesclient.CertificatesV1Interface
+	keys *csrKeys
+}
+
+func (c *csrStateCertificates) CertificateSigningRequests() certificatesclient.CertificateSigningRequestInterface {
+	return &csrStateRequests{c.CertificatesV1Interface.CertificateSigningRequests(), c.keys}
+}
+
+type csrStateRequests struct {
+	certificatesclient.CertificateSigningRequestInterface
+	keys *csrKeys
+}
+
+func (c *csrStateRequests) Create(ctx context.Context, csr *certificates.CertificateSigningRequest, opts metav1.CreateOptions) (*certificates.CertificateSigningRequest, error) {
+	if c.keys != nil {
+		csr = csr.DeepCopy()
+		if err := c.keys.replace(csr); err != nil {
+			return nil, err
+		}
+	}
+	created, err := c.CertificateSigningRequestInterface.Create(ctx, csr, opts)
+	if err == nil {
+		recordCSRState(created)
+	}
+	return created, err
+}
+
+func (c *csrStateRequests) Get(ctx context.Context, name string, opts metav1.GetOptions) (*certificates.CertificateSigningRequest, error) {
+	csr, err := c.CertificateSigningRequestInterface.Get(ctx, name, opts)
+	if err == nil {
+		recordCSRState(csr)
+	}
+	return csr, err
+}
+
+// List records the states of the listed CSRs, the certificate manager lists
+// its CSR by name
+func (c *csrStateRequests) List(ctx context.Context, opts metav1.ListOptions) (*certificates.CertificateSigningRequestList, error) {
+	list, err := c.CertificateSigningRequestInterface.List(ctx, opts)
+	if err == nil {
+		for i := range list.Items {
+			recordCSRState(&list.Items[i])
+		}
+	}
+	return list, err
+}
+
+func (c *csrStateRequests) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := c.CertificateSigningRequestInterface.Watch(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return watch.Filter(w, func(evt watch.Event) (watch.Event, bool) {
+		if csr, ok := evt.Object.(*certificates.CertificateSigningRequest); ok && evt.Type != watch.Deleted {
+			recordCSRState(csr)
+		}
+		return evt, true
+	}), nil
+}
@@ -0,0 +1,95 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	certificates "k8s.io/api/certificates/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+)
+
+// expectCSRState fails unless the CSR state gauge is 1 for state only
+func expectCSRState(t *testing.T, state string) {
+	t.Helper()
+	for _, s := range []string{csrStatePending, csrStateApproved, csrStateDenied, csrStateFailed} {
+		expected := 0.0
+		if s == state {
+			expected = 1
+		}
+		if got := testutil.ToFloat64(csrStateGauge.WithLabelValues(s)); got != expected {
+			t.Errorf("Expected csr_state{state=%q} %v, got %v", s, expected, got)
+		}
+	}
+}
+
+func TestCSRStateClientset(t *testing.T) {
+	fake := fakeclientset.NewSimpleClientset()
+	client := (&csrStateClientset{fake, nil}).CertificatesV1().CertificateSigningRequests()
+	ctx := context.Background()
+
+	csr := &certificates.CertificateSigningRequest{ObjectMeta: metav1.ObjectMeta{Name: "csr-1"}}
+	if _, err := client.Create(ctx, csr, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectCSRState(t, csrStatePending)
+
+	w, err := client.Watch(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	csr.Status.Conditions = []certificates.CertificateSigningRequestCondition{{Type: certificates.CertificateApproved, Status: v1.ConditionTrue}}
+	if _, err := fake.CertificatesV1().CertificateSigningRequests().UpdateStatus(ctx, csr, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.ResultChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a watch event")
+	}
+	expectCSRState(t, csrStateApproved)
+
+	for _, c := range []struct {
+		condition certificates.RequestConditionType
+		state     string
+	}{
+		{certificates.CertificateDenied, csrStateDenied},
+		{certificates.CertificateFailed, csrStateFailed},
+	} {
+		rejections := testutil.ToFloat64(csrRejectionCounter.WithLabelValues(c.state, "SANsRejected"))
+		csr.Status.Conditions = []certificates.CertificateSigningRequestCondition{{Type: c.condition, Status: v1.ConditionTrue, Reason: "SANsRejected"}}
+		if _, err := fake.CertificatesV1().CertificateSigningRequests().UpdateStatus(ctx, csr, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		// The certificate manager watches and reads a CSR more than once, it
+		// is counted once
+		for i := 0; i < 2; i++ {
+			if _, err := client.Get(ctx, "csr-1", metav1.GetOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectCSRState(t, c.state)
+		if got := testutil.ToFloat64(csrRejectionCounter.WithLabelValues(c.state, "SANsRejected")) - rejections; got != 1 {
+			t.Errorf("Expected 1 %s CSR counted, got %v", c.state, got)
+		}
+	}
+}
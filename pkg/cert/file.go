@@ -0,0 +1,151 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/util/certificate"
+	"k8s.io/klog"
+)
+
+var fileReloadErrorCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Subsystem: "certificate_manager",
+		Name:      "file_reload_errors_total",
+		Help:      "Counter of reloads of the TLS certificate and key files that failed, the previous certificate is kept.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(fileReloadErrorCounter)
+}
+
+// Compile time check that fileCertManager implements the certificate.Manager interface
+var _ certificate.Manager = &fileCertManager{}
+
+// fileCertManager serves the certificate of a pair of files, reloaded when the
+// files change
+type fileCertManager struct {
+	certFile string
+	keyFile  string
+	current  atomic.Pointer[tls.Certificate]
+	watcher  *fsnotify.Watcher
+}
+
+// NewFileCertificateManager returns a certificate manager serving the TLS
+// certificate and key of files, eg. provisioned by cert-manager into a secret
+// volume. The files are reloaded when they change, including when the kubelet
+// swaps the symlinks of the volume. A pair that can't be loaded, or whose
+// certificate and key don't match, is logged and the previous certificate is
+// served. It returns an error if the files can't be loaded or watched.
+func NewFileCertificateManager(certFile, keyFile string) (certificate.Manager, error) {
+	m := &fileCertManager{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	cert, err := m.load()
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS cert and key files: %v", err)
+	}
+	m.current.Store(cert)
+
+	// The directories are watched, secret volumes replace the files by
+	// swapping their ..data symlink rather than writing them
+	m.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error watching TLS cert and key files: %v", err)
+	}
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := m.watcher.Add(dir); err != nil {
+			m.watcher.Close()
+			return nil, fmt.Errorf("error watching TLS cert and key files: %v", err)
+		}
+	}
+	return m, nil
+}
+
+func (m *fileCertManager) load() (*tls.Certificate, error) {
+	certBytes, err := os.ReadFile(m.certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := os.ReadFile(m.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return loadX509KeyPairData(certBytes, keyBytes)
+}
+
+// reload replaces the certificate with the certificate of the files, unless
+// they can't be loaded or don't match
+func (m *fileCertManager) reload() {
+	cert, err := m.load()
+	if err != nil {
+		klog.Errorf("Error reloading TLS cert %s and key %s, serving the previous certificate: %v", m.certFile, m.keyFile, err)
+		fileReloadErrorCounter.Inc()
+		return
+	}
+	if previous := m.current.Load(); bytes.Equal(previous.Certificate[0], cert.Certificate[0]) {
+		return
+	}
+	klog.Infof("Reloaded TLS cert %s expiring %s", m.certFile, cert.Leaf.NotAfter)
+	m.current.Store(cert)
+}
+
+func (m *fileCertManager) watch() {
+	for {
+		select {
+		case evt, ok := <-m.watcher.Events:
+			if !ok {
+				return
+			}
+			if evt.Has(fsnotify.Chmod) {
+				continue
+			}
+			m.reload()
+		case err, ok := <-m.watcher.Errors:
+			if !ok {
+				return
+			}
+			klog.Errorf("Error watching TLS cert and key files: %v", err)
+		}
+	}
+}
+
+func (m *fileCertManager) Start() {
+	go m.watch()
+}
+
+func (m *fileCertManager) Stop() {
+	m.watcher.Close()
+}
+
+func (m *fileCertManager) Current() *tls.Certificate {
+	return m.current.Load()
+}
+
+// ServerHealthy returns true, the files are served without an API server
+func (m *fileCertManager) ServerHealthy() bool {
+	return true
+}
@@ -0,0 +1,204 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestKeyPair returns a PEM encoded self-signed certificate for commonName
+// and its key
+func newTestKeyPair(t *testing.T, commonName string) ([]byte, []byte) {
+	t.Helper()
+	return newTestKeyPairValidity(t, commonName, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// newTestKeyPairValidity returns a PEM encoded self-signed certificate for
+// commonName valid from notBefore to notAfter, and its key
+func newTestKeyPairValidity(t *testing.T, commonName string, notBefore, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedCommonName returns the common name of the certificate served by a TLS
+// server using getCertificate
+func servedCommonName(t *testing.T, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: getCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*tls.Conn).Handshake()
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestFileCertificateManagerReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	certOne, keyOne := newTestKeyPair(t, "one")
+	writeFile(t, certFile, certOne)
+	writeFile(t, keyFile, keyOne)
+
+	m, err := NewFileCertificateManager(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Stop()
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return m.Current(), nil }
+	if got := servedCommonName(t, getCertificate); got != "one" {
+		t.Fatalf("Expected certificate one to be served, got %s", got)
+	}
+
+	certTwo, keyTwo := newTestKeyPair(t, "two")
+	writeFile(t, keyFile, keyTwo)
+	writeFile(t, certFile, certTwo)
+	for deadline := time.Now().Add(5 * time.Second); servedCommonName(t, getCertificate) != "two"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected certificate two to be served after the files are rewritten")
+		}
+	}
+
+	// A certificate that doesn't match the key keeps the previous pair
+	reloadErrors := testutil.ToFloat64(fileReloadErrorCounter)
+	certThree, _ := newTestKeyPair(t, "three")
+	writeFile(t, certFile, certThree)
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(fileReloadErrorCounter) == reloadErrors; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the mismatched pair to fail to reload")
+		}
+	}
+	if got := servedCommonName(t, getCertificate); got != "two" {
+		t.Errorf("Expected certificate two to still be served, got %s", got)
+	}
+}
+
+func TestFileCertificateManagerSymlinkSwap(t *testing.T) {
+	// Secret volumes link the files to the ..data symlink of a timestamped
+	// directory, and swap the symlink to update them
+	dir := t.TempDir()
+	writeVersion := func(version, commonName string) {
+		t.Helper()
+		cert, key := newTestKeyPair(t, commonName)
+		if err := os.Mkdir(filepath.Join(dir, version), 0700); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, version, "tls.crt"), cert)
+		writeFile(t, filepath.Join(dir, version, "tls.key"), key)
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..2024_01_01", "one")
+	for _, name := range []string{"tls.crt", "tls.key"} {
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := NewFileCertificateManager(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Stop()
+	if got := m.Current().Leaf.Subject.CommonName; got != "one" {
+		t.Fatalf("Expected certificate one, got %s", got)
+	}
+
+	writeVersion("..2024_01_02", "two")
+	if err := os.RemoveAll(filepath.Join(dir, "..2024_01_01")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); m.Current().Leaf.Subject.CommonName != "two"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected certificate two after the symlink swap")
+		}
+	}
+}
+
+func TestFileCertificateManagerInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	cert, _ := newTestKeyPair(t, "one")
+	_, otherKey := newTestKeyPair(t, "other")
+	writeFile(t, certFile, cert)
+
+	if _, err := NewFileCertificateManager(certFile, keyFile); err == nil {
+		t.Error("Expected an error without a key file")
+	}
+	writeFile(t, keyFile, otherKey)
+	if _, err := NewFileCertificateManager(certFile, keyFile); err == nil {
+		t.Error("Expected an error with a key not matching the certificate")
+	}
+}
@@ -0,0 +1,168 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sync"
+
+	certificates "k8s.io/api/certificates/v1"
+	"k8s.io/client-go/util/certificate"
+	"k8s.io/klog"
+)
+
+// Key types of the serving certificate
+const (
+	KeyTypeRSA2048   = "rsa-2048"
+	KeyTypeRSA4096   = "rsa-4096"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+)
+
+// DefaultKeyType is the key type of the serving certificate, the type of the
+// keys generated by the client-go certificate manager
+const DefaultKeyType = KeyTypeECDSAP256
+
+// ValidateKeyType returns an error if keyType is not a key type
+func ValidateKeyType(keyType string) error {
+	switch keyType {
+	case KeyTypeRSA2048, KeyTypeRSA4096, KeyTypeECDSAP256:
+		return nil
+	}
+	return fmt.Errorf("invalid tls key type %q, must be %s, %s, or %s", keyType, KeyTypeRSA2048, KeyTypeRSA4096, KeyTypeECDSAP256)
+}
+
+// generateKey returns a new private key of keyType and its PEM encoding, PKCS#1
+// for RSA and SEC1 for ECDSA keys
+func generateKey(keyType string) (crypto.Signer, []byte, error) {
+	switch keyType {
+	case KeyTypeRSA2048, KeyTypeRSA4096:
+		bits := 2048
+		if keyType == KeyTypeRSA4096 {
+			bits = 4096
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error generating %s key: %v", keyType, err)
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	case KeyTypeECDSAP256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error generating %s key: %v", keyType, err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error encoding %s key: %v", keyType, err)
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+	return nil, nil, ValidateKeyType(keyType)
+}
+
+// csrKeys replaces the keys of the CSRs of the client-go certificate manager,
+// which only generates ECDSA P-256 keys, with keys of keyType. The request of a
+// CSR is signed again with a new key before the CSR is created, and the key
+// stored with the issued certificate is swapped for it.
+type csrKeys struct {
+	keyType string
+
+	mu sync.Mutex
+	// publicKey and key are the DER public key and the PEM private key of
+	// the last created CSR, the certificate manager waits for one CSR at a
+	// time
+	publicKey []byte
+	key       []byte
+}
+
+// replace signs the request of csr with a new key of keyType
+func (k *csrKeys) replace(csr *certificates.CertificateSigningRequest) error {
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil {
+		return fmt.Errorf("error decoding certificate request")
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("error parsing certificate request: %v", err)
+	}
+	key, keyPEM, err := generateKey(k.keyType)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        req.Subject,
+		DNSNames:       req.DNSNames,
+		IPAddresses:    req.IPAddresses,
+		EmailAddresses: req.EmailAddresses,
+		URIs:           req.URIs,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("error creating %s certificate request: %v", k.keyType, err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return fmt.Errorf("error encoding %s public key: %v", k.keyType, err)
+	}
+	csr.Spec.Request = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.publicKey, k.key = publicKey, keyPEM
+	return nil
+}
+
+// keyOf returns the key of the last created CSR if cert was issued for it, or
+// key otherwise
+func (k *csrKeys) keyOf(cert, key []byte) []byte {
+	block, _ := pem.Decode(cert)
+	if block == nil {
+		return key
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return key
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(parsed.PublicKey)
+	if err != nil {
+		return key
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.key == nil || !bytes.Equal(publicKey, k.publicKey) {
+		return key
+	}
+	klog.V(4).Infof("Storing the %s key of the issued certificate", k.keyType)
+	return k.key
+}
+
+// csrKeyStore is a certificate.Store storing the issued certificates with the
+// keys of their CSRs
+type csrKeyStore struct {
+	certificate.Store
+	keys *csrKeys
+}
+
+func (s *csrKeyStore) Update(cert, key []byte) (*tls.Certificate, error) {
+	return s.Store.Update(cert, s.keys.keyOf(cert, key))
+}
@@ -0,0 +1,185 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+)
+
+// expectKeyType fails if key is not a private key of keyType
+func expectKeyType(t *testing.T, key crypto.PrivateKey, keyType string) {
+	t.Helper()
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if bits := k.N.BitLen(); keyType != KeyTypeRSA2048 && keyType != KeyTypeRSA4096 ||
+			keyType == KeyTypeRSA2048 && bits != 2048 || keyType == KeyTypeRSA4096 && bits != 4096 {
+			t.Errorf("Expected a %s key, got an RSA key of %d bits", keyType, bits)
+		}
+	case *ecdsa.PrivateKey:
+		if keyType != KeyTypeECDSAP256 || k.Curve != elliptic.P256() {
+			t.Errorf("Expected a %s key, got an ECDSA key of curve %s", keyType, k.Curve.Params().Name)
+		}
+	default:
+		t.Errorf("Expected a %s key, got %T", keyType, key)
+	}
+}
+
+// selfSign returns a PEM encoded certificate for commonName signed by key
+func selfSign(t *testing.T, key crypto.Signer, commonName string) []byte {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestGenerateKey(t *testing.T) {
+	for _, keyType := range []string{KeyTypeRSA2048, KeyTypeRSA4096, KeyTypeECDSAP256} {
+		t.Run(keyType, func(t *testing.T) {
+			key, keyPEM, err := generateKey(keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeyType(t, key, keyType)
+			certPEM := selfSign(t, key, keyType)
+			pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The keys are stored PKCS#1 or SEC1 encoded, keys of other
+			// systems may be PKCS#8 encoded
+			encodings := map[string][]byte{
+				"generated": keyPEM,
+				"pkcs8":     pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+			}
+			for name, encoded := range encodings {
+				store := NewSecretCertStore("eks", "pod-identity-webhook", fakeclientset.NewSimpleClientset())
+				if _, err := store.Update(certPEM, encoded); err != nil {
+					t.Fatalf("Expected the %s key to be stored, got %v", name, err)
+				}
+				cert, err := store.Current()
+				if err != nil {
+					t.Fatalf("Expected the %s key to be loaded, got %v", name, err)
+				}
+				expectKeyType(t, cert.PrivateKey, keyType)
+				if got := servedCommonName(t, func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }); got != keyType {
+					t.Errorf("Expected the certificate of the %s key to be served, got %s", name, got)
+				}
+			}
+		})
+	}
+
+	if _, _, err := generateKey("dsa-1024"); err == nil {
+		t.Error("Expected an error for an unknown key type")
+	}
+}
+
+func TestCSRKeys(t *testing.T) {
+	// The certificate manager signs the request with its own key
+	managerKey, managerKeyPEM, err := generateKey(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "pod-identity-webhook.eks.svc"},
+		DNSNames: []string{"pod-identity-webhook.eks.svc"},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, managerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := &certificates.CertificateSigningRequest{
+		Spec: certificates.CertificateSigningRequestSpec{
+			Request: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}),
+		},
+	}
+
+	keys := &csrKeys{keyType: KeyTypeRSA2048}
+	if err := keys.replace(csr); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(csr.Spec.Request)
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.CheckSignature(); err != nil {
+		t.Errorf("Expected a signed request, got %v", err)
+	}
+	if req.Subject.CommonName != template.Subject.CommonName || len(req.DNSNames) != 1 || req.DNSNames[0] != template.DNSNames[0] {
+		t.Errorf("Expected the request of the template, got %s %v", req.Subject.CommonName, req.DNSNames)
+	}
+	if _, ok := req.PublicKey.(*rsa.PublicKey); !ok {
+		t.Fatalf("Expected an RSA request, got %T", req.PublicKey)
+	}
+
+	// The certificate of the request is stored with the replaced key
+	caKey, _, err := generateKey(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(pemBytes(t, selfSign(t, caKey, "test-ca")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := signCSR(t, csr, caCert, caKey.(*ecdsa.PrivateKey), time.Now())
+	key := keys.keyOf(certPEM, managerKeyPEM)
+	cert, err := tls.X509KeyPair(certPEM, key)
+	if err != nil {
+		t.Fatalf("Expected the replaced key of the certificate, got %v", err)
+	}
+	expectKeyType(t, cert.PrivateKey, KeyTypeRSA2048)
+
+	// Other certificates keep their key
+	otherPEM := selfSign(t, managerKey, "other")
+	if _, err := tls.X509KeyPair(otherPEM, keys.keyOf(otherPEM, managerKeyPEM)); err != nil {
+		t.Errorf("Expected the key of another certificate to be kept, got %v", err)
+	}
+}
+
+// pemBytes returns the bytes of the first PEM block of data
+func pemBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("Expected a PEM block")
+	}
+	return block.Bytes
+}
@@ -0,0 +1,197 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/certificate"
+	"k8s.io/klog"
+)
+
+// DefaultLeaseName is the Lease of the leader election of the csr source
+const DefaultLeaseName = "pod-identity-webhook"
+
+// Timing of the leader election, the defaults of the Kubernetes controllers
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+var leaderGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certificate_manager",
+		Name:      "leader",
+		Help:      "1 if the replica of the identity leads the CSR creation and Secret updates of the csr certificate source, 0 if it serves the Secret of the leader.",
+	},
+	[]string{"identity"},
+)
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
+
+// Compile time check that leaderElectedManager implements the
+// certificate.Manager interface
+var _ certificate.Manager = &leaderElectedManager{}
+
+// leaderElectedManager runs the certificate manager of the csr source on the
+// replica holding a Lease only, so replicas don't create CSRs and overwrite
+// the Secret of each other. Every replica serves the certificate of the
+// Secret, the leader serves the certificate of its manager once it is issued.
+type leaderElectedManager struct {
+	lock resourcelock.Interface
+	// newLeaderManager returns the certificate manager of the leader, it is
+	// stopped when the leadership is lost
+	newLeaderManager func() (certificate.Manager, error)
+	follower         *secretCertManager
+
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	leader certificate.Manager
+}
+
+// newLeaderElectedManager returns a manager electing a leader with the
+// leaseName Lease in namespace, identity names the replica in the Lease
+func newLeaderElectedManager(kubeClient clientset.Interface, namespace, secretName, leaseName, identity string, newLeaderManager func() (certificate.Manager, error)) *leaderElectedManager {
+	return &leaderElectedManager{
+		lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: leaseName},
+			Client:     kubeClient.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		newLeaderManager: newLeaderManager,
+		follower:         newSecretWatcher(kubeClient, namespace, secretName),
+		leaseDuration:    leaseDuration,
+		renewDeadline:    renewDeadline,
+		retryPeriod:      retryPeriod,
+	}
+}
+
+// elect campaigns for the Lease until the leadership is lost or ctx is done
+func (m *leaderElectedManager) elect(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            m.lock,
+		LeaseDuration:   m.leaseDuration,
+		RenewDeadline:   m.renewDeadline,
+		RetryPeriod:     m.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            m.lock.Describe(),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) { m.lead(leaderCtx, cancel) },
+			OnStoppedLeading: m.follow,
+			OnNewLeader: func(identity string) {
+				klog.Infof("Replica %s leads the serving certificate renewal with lease %s", identity, m.lock.Describe())
+			},
+		},
+	})
+	if err != nil {
+		klog.Errorf("Error configuring the leader election: %v", err)
+		return
+	}
+	elector.Run(ctx)
+}
+
+// lead starts the certificate manager of the leader, or releases the Lease
+// with release if it can't be created
+func (m *leaderElectedManager) lead(ctx context.Context, release context.CancelFunc) {
+	manager, err := m.newLeaderManager()
+	if err != nil {
+		klog.Errorf("Error creating the certificate manager of the leader, releasing lease %s: %v", m.lock.Describe(), err)
+		release()
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The leadership was lost while the manager was created
+	if ctx.Err() != nil {
+		return
+	}
+	klog.Infof("Leading the serving certificate renewal as %s", m.lock.Identity())
+	manager.Start()
+	m.leader = manager
+	leaderGauge.WithLabelValues(m.lock.Identity()).Set(1)
+}
+
+// follow stops the certificate manager of the leader, once the leadership is
+// lost or given up
+func (m *leaderElectedManager) follow() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.leader != nil {
+		klog.Infof("Stopped leading the serving certificate renewal as %s, serving TLS secret %s/%s",
+			m.lock.Identity(), m.follower.namespace, m.follower.name)
+		m.leader.Stop()
+		m.leader = nil
+	}
+	leaderGauge.WithLabelValues(m.lock.Identity()).Set(0)
+}
+
+func (m *leaderElectedManager) Start() {
+	m.follower.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel, m.done = cancel, make(chan struct{})
+	leaderGauge.WithLabelValues(m.lock.Identity()).Set(0)
+	go func() {
+		defer close(m.done)
+		wait.UntilWithContext(ctx, m.elect, m.retryPeriod)
+	}()
+}
+
+// Stop stops the certificate manager of the leader and releases the Lease, so
+// another replica takes over without waiting for it to expire
+func (m *leaderElectedManager) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+		<-m.done
+	}
+	m.follower.Stop()
+}
+
+func (m *leaderElectedManager) Current() *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.leader != nil {
+		if cert := m.leader.Current(); cert != nil {
+			return cert
+		}
+	}
+	return m.follower.Current()
+}
+
+func (m *leaderElectedManager) ServerHealthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.leader == nil || m.leader.ServerHealthy()
+}
@@ -0,0 +1,148 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/certificate"
+)
+
+// fakeLeaderManager is the certificate manager of a leader, serving a
+// certificate for its identity
+type fakeLeaderManager struct {
+	cert   *tls.Certificate
+	starts atomic.Int32
+	stops  atomic.Int32
+}
+
+func newFakeLeaderManager(t *testing.T, identity string) *fakeLeaderManager {
+	t.Helper()
+	cert, key := newTestKeyPair(t, identity)
+	tlsCert, err := loadX509KeyPairData(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeLeaderManager{cert: tlsCert}
+}
+
+func (m *fakeLeaderManager) Start()                    { m.starts.Add(1) }
+func (m *fakeLeaderManager) Stop()                     { m.stops.Add(1) }
+func (m *fakeLeaderManager) Current() *tls.Certificate { return m.cert }
+func (m *fakeLeaderManager) ServerHealthy() bool       { return true }
+
+// newTestLeaderElectedManager returns a manager of identity electing a leader
+// with a lease of a second, so the test doesn't wait for the defaults
+func newTestLeaderElectedManager(t *testing.T, clientset *fakeclientset.Clientset, identity string) (*leaderElectedManager, *fakeLeaderManager) {
+	t.Helper()
+	leader := newFakeLeaderManager(t, identity)
+	m := newLeaderElectedManager(clientset, "eks", "pod-identity-webhook", DefaultLeaseName, identity,
+		func() (certificate.Manager, error) { return leader, nil })
+	m.leaseDuration, m.renewDeadline, m.retryPeriod = time.Second, 500*time.Millisecond, 100*time.Millisecond
+	return m, leader
+}
+
+// eventually fails the test unless condition becomes true
+func eventually(t *testing.T, message string, condition func() bool) {
+	t.Helper()
+	if err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) { return condition(), nil }); err != nil {
+		t.Fatal(message)
+	}
+}
+
+func TestLeaderElectedManager(t *testing.T) {
+	clientset := fakeclientset.NewSimpleClientset(newTestSecret(t, "", "secret"))
+	servesCommonName := func(m certificate.Manager, commonName string) func() bool {
+		return func() bool { cert := m.Current(); return cert != nil && cert.Leaf.Subject.CommonName == commonName }
+	}
+	leads := func(identity string) func() bool {
+		return func() bool { return testutil.ToFloat64(leaderGauge.WithLabelValues(identity)) == 1 }
+	}
+	// Reactors can't be added while the electors use the clientset, the
+	// renewals of b fail once failRenewals is set
+	var failRenewals atomic.Bool
+	clientset.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if lease := action.(k8stesting.UpdateAction).GetObject().(*coordinationv1.Lease); failRenewals.Load() && *lease.Spec.HolderIdentity == "b" {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+
+	a, leaderA := newTestLeaderElectedManager(t, clientset, "a")
+	a.Start()
+	eventually(t, "Expected a to lead", leads("a"))
+	eventually(t, "Expected a to serve the certificate of its manager", servesCommonName(a, "a"))
+
+	// b follows a and serves the Secret
+	b, leaderB := newTestLeaderElectedManager(t, clientset, "b")
+	b.Start()
+	defer b.Stop()
+	eventually(t, "Expected b to serve the secret", servesCommonName(b, "secret"))
+	time.Sleep(2 * time.Second)
+	if leaderB.starts.Load() != 0 || testutil.ToFloat64(leaderGauge.WithLabelValues("b")) != 0 {
+		t.Fatal("Expected b not to lead while a holds the lease")
+	}
+
+	// a releases the lease when it stops, b takes over
+	a.Stop()
+	if leaderA.starts.Load() != 1 || leaderA.stops.Load() != 1 {
+		t.Errorf("Expected the manager of a to be started and stopped once, got %d starts and %d stops", leaderA.starts.Load(), leaderA.stops.Load())
+	}
+	if testutil.ToFloat64(leaderGauge.WithLabelValues("a")) != 0 {
+		t.Error("Expected a not to lead once stopped")
+	}
+	eventually(t, "Expected b to lead", leads("b"))
+	eventually(t, "Expected b to serve the certificate of its manager", servesCommonName(b, "b"))
+
+	// b can't renew the lease, it stops its manager and serves the Secret
+	failRenewals.Store(true)
+	eventually(t, "Expected b to lose the leadership", func() bool { return !leads("b")() })
+	eventually(t, "Expected the manager of b to be stopped", func() bool { return leaderB.stops.Load() == 1 })
+	eventually(t, "Expected b to serve the secret", servesCommonName(b, "secret"))
+}
+
+func TestLeaderElectedManagerWithoutSecret(t *testing.T) {
+	clientset := fakeclientset.NewSimpleClientset()
+	m, _ := newTestLeaderElectedManager(t, clientset, "a")
+	// The leader can't create the Secret, the lease is released and the
+	// Secret of another leader is served once it is created
+	m.newLeaderManager = func() (certificate.Manager, error) { return nil, errors.New("no signer") }
+	m.Start()
+	defer m.Stop()
+	time.Sleep(500 * time.Millisecond)
+	if m.Current() != nil {
+		t.Fatalf("Expected no certificate without the secret, got %v", m.Current())
+	}
+	if _, err := clientset.CoreV1().Secrets("eks").Create(context.Background(), newTestSecret(t, "", "secret"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "Expected the created secret to be served", func() bool {
+		cert := m.Current()
+		return cert != nil && cert.Leaf.Subject.CommonName == "secret"
+	})
+}
@@ -21,36 +21,69 @@ import (
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
-	certificates "k8s.io/api/certificates/v1beta1"
+	certificates "k8s.io/api/certificates/v1"
 	clientset "k8s.io/client-go/kubernetes"
-	certificatesclient "k8s.io/client-go/kubernetes/typed/certificates/v1beta1"
 	"k8s.io/client-go/util/certificate"
 )
 
-// NewServerCertificateManager returns a certificate manager that stores TLS keys in Kubernetes Secrets
-func NewServerCertificateManager(kubeClient clientset.Interface, namespace, secretName string, csr *x509.CertificateRequest) (certificate.Manager, error) {
-	clientFn := func(_ *tls.Certificate) (certificatesclient.CertificateSigningRequestInterface, error) {
-		return kubeClient.CertificatesV1beta1().CertificateSigningRequests(), nil
+// DefaultSignerName is the EKS signer for serving certificates of in-cluster webhooks
+const DefaultSignerName = "beta.eks.amazonaws.com/app-serving"
+
+var certificateExpiration = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Subsystem: "certificate_manager",
+		Name:      "server_expiration_seconds",
+		Help:      "Gauge of the lifetime of a certificate. The value is the date the certificate will expire in seconds since January 1, 1970 UTC.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(certificateExpiration)
+}
+
+// NewServerCertificateManager returns a certificate manager that stores TLS keys in Kubernetes Secrets,
+// requesting them with CSRs for signerName with keys of keyType. A denied or failed CSR is recreated with
+// backoff, the state of the last CSR is recorded in the csr_state gauge.
+func NewServerCertificateManager(kubeClient clientset.Interface, namespace, secretName, signerName, keyType string, csr *x509.CertificateRequest) (certificate.Manager, error) {
+	return newServerCertificateManager(kubeClient, namespace, secretName, signerName, keyType, csr, false)
+}
+
+// newServerCertificateManager returns a server certificate manager, with renew
+// requesting a new certificate rather than loading the certificate of the
+// Secret
+func newServerCertificateManager(kubeClient clientset.Interface, namespace, secretName, signerName, keyType string, csr *x509.CertificateRequest, renew bool) (certificate.Manager, error) {
+	if err := ValidateKeyType(keyType); err != nil {
+		return nil, err
+	}
+	// The certificate manager generates keys of the default type
+	var keys *csrKeys
+	if keyType != DefaultKeyType {
+		keys = &csrKeys{keyType: keyType}
+	}
+	clientsetFn := func(_ *tls.Certificate) (clientset.Interface, error) {
+		return &csrStateClientset{kubeClient, keys}, nil
 	}
 
-	certificateStore := NewSecretCertStore(
+	var store certificate.Store = NewSecretCertStore(
 		namespace,
 		secretName,
 		kubeClient,
 	)
-
-	var certificateExpiration = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Subsystem: "certificate_manager",
-			Name:      "server_expiration_seconds",
-			Help:      "Gauge of the lifetime of a certificate. The value is the date the certificate will expire in seconds since January 1, 1970 UTC.",
-		},
-	)
-	prometheus.MustRegister(certificateExpiration)
+	if keys != nil {
+		store = &csrKeyStore{Store: store, keys: keys}
+	}
+	if renew {
+		store = &renewalStore{Store: store}
+	}
+	certificateStore := &expirationStore{
+		Store:      store,
+		expiration: certificateExpiration,
+	}
 
 	m, err := certificate.NewManager(&certificate.Config{
-		ClientFn: clientFn,
-		Template: csr,
+		ClientsetFn: clientsetFn,
+		Template:    csr,
+		SignerName:  signerName,
 		Usages: []certificates.KeyUsage{
 			// https://tools.ietf.org/html/rfc5280#section-4.2.1.3
 			//
@@ -65,11 +98,34 @@ func NewServerCertificateManager(kubeClient clientset.Interface, namespace, secr
 			// authenticate itself to a TLS client.
 			certificates.UsageServerAuth,
 		},
-		CertificateStore:      certificateStore,
-		CertificateExpiration: certificateExpiration,
+		CertificateStore:    certificateStore,
+		CertificateRotation: rotationObserver{},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize server certificate manager: %v", err)
 	}
 	return m, nil
 }
+
+// expirationStore is a certificate.Store that records the expiration of the
+// current certificate
+type expirationStore struct {
+	certificate.Store
+	expiration prometheus.Gauge
+}
+
+func (s *expirationStore) Current() (*tls.Certificate, error) {
+	return s.record(s.Store.Current())
+}
+
+func (s *expirationStore) Update(cert, key []byte) (*tls.Certificate, error) {
+	return s.record(s.Store.Update(cert, key))
+}
+
+func (s *expirationStore) record(cert *tls.Certificate, err error) (*tls.Certificate, error) {
+	if err == nil && cert != nil && cert.Leaf != nil {
+		s.expiration.Set(float64(cert.Leaf.NotAfter.Unix()))
+		servingNotAfter.Store(cert.Leaf.NotAfter.Unix())
+	}
+	return cert, err
+}
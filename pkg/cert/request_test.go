@@ -16,14 +16,30 @@
 package cert
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	certificates "k8s.io/api/certificates/v1"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	clientset "k8s.io/client-go/kubernetes"
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/util/certificate"
 )
 
@@ -193,3 +209,194 @@ func TestSecretStore(t *testing.T) {
 		})
 	}
 }
+
+// signCSR returns a PEM encoded certificate for the request of csr, signed by
+// a CA at now and valid for an hour
+func signCSR(t *testing.T, csr *certificates.CertificateSigningRequest, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, now time.Time) []byte {
+	t.Helper()
+	block, _ := pem.Decode(csr.Spec.Request)
+	if block == nil {
+		t.Fatal("Expected a PEM encoded certificate request")
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      req.Subject,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, req.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// fakeSigner is a fake clientset signing the CSRs of a certificate manager
+// with a CA
+type fakeSigner struct {
+	*fakeclientset.Clientset
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	// now is when certificates are issued
+	now func() time.Time
+
+	mu sync.Mutex
+	// signerNames are the signer names of the created CSRs
+	signerNames []string
+	handled     map[string]bool
+}
+
+func newFakeSigner(t *testing.T) *fakeSigner {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSigner{Clientset: fakeclientset.NewSimpleClientset(), caCert: caCert, caKey: caKey, now: time.Now, handled: map[string]bool{}}
+	// The fake clientset doesn't generate names, nor select the listed CSRs
+	// by name like the certificate manager expects
+	s.PrependReactor("create", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		csr := action.(k8stesting.CreateAction).GetObject().(*certificates.CertificateSigningRequest)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.signerNames = append(s.signerNames, csr.Spec.SignerName)
+		csr.Name = fmt.Sprintf("csr-%d", len(s.signerNames))
+		csr.UID = types.UID(csr.Name)
+		return false, nil, nil
+	})
+	csrResource := certificates.SchemeGroupVersion.WithResource("certificatesigningrequests")
+	s.PrependReactor("list", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := s.Tracker().List(csrResource, certificates.SchemeGroupVersion.WithKind("CertificateSigningRequest"), "")
+		if err != nil {
+			return true, nil, err
+		}
+		list := obj.(*certificates.CertificateSigningRequestList)
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Fields
+		selected := &certificates.CertificateSigningRequestList{ListMeta: list.ListMeta}
+		for _, csr := range list.Items {
+			if selector.Matches(fields.Set{"metadata.name": csr.Name}) {
+				selected.Items = append(selected.Items, csr)
+			}
+		}
+		return true, selected, nil
+	})
+	return s
+}
+
+// created returns the signer names of the created CSRs
+func (s *fakeSigner) created() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.signerNames...)
+}
+
+// signUntil denies the first denied CSRs and approves the next ones, until done
+// returns true
+func (s *fakeSigner) signUntil(t *testing.T, denied int, done func() bool) {
+	t.Helper()
+	ctx := context.Background()
+	for deadline := time.Now().Add(20 * time.Second); !done(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a certificate to be issued")
+		}
+		list, err := s.CertificatesV1().CertificateSigningRequests().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range list.Items {
+			csr := &list.Items[i]
+			if s.handled[csr.Name] {
+				continue
+			}
+			s.handled[csr.Name] = true
+			if len(s.handled) <= denied {
+				csr.Status.Conditions = []certificates.CertificateSigningRequestCondition{{Type: certificates.CertificateDenied, Status: v1.ConditionTrue, Reason: "Test"}}
+			} else {
+				csr.Status.Conditions = []certificates.CertificateSigningRequestCondition{{Type: certificates.CertificateApproved, Status: v1.ConditionTrue}}
+				csr.Status.Certificate = signCSR(t, csr, s.caCert, s.caKey, s.now())
+			}
+			if _, err := s.CertificatesV1().CertificateSigningRequests().UpdateStatus(ctx, csr, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestServerCertificateManager(t *testing.T) {
+	const signer = "pki.example.com/webhook-serving"
+	cases := []struct {
+		caseName string
+		keyType  string
+		// denied is the number of CSRs denied before one is approved
+		denied int
+	}{
+		{"DeniedCSR", DefaultKeyType, 1},
+		{"RSA2048", KeyTypeRSA2048, 0},
+		{"RSA4096", KeyTypeRSA4096, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			fake := newFakeSigner(t)
+			csrTemplate := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "pod-identity-webhook.eks.svc"}}
+			m, err := NewServerCertificateManager(fake, "eks", "pod-identity-webhook", signer, c.keyType, csrTemplate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Start()
+			defer m.Stop()
+
+			// The first denied CSRs are recreated, then one is approved
+			fake.signUntil(t, c.denied, func() bool { return m.Current() != nil })
+
+			current := m.Current()
+			if got := current.Leaf.Subject.CommonName; got != "pod-identity-webhook.eks.svc" {
+				t.Errorf("Expected the certificate of the CSR template, got %s", got)
+			}
+			expectKeyType(t, current.PrivateKey, c.keyType)
+			if got := servedCommonName(t, func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return m.Current(), nil }); got != "pod-identity-webhook.eks.svc" {
+				t.Errorf("Expected the certificate of the CSR template to be served, got %s", got)
+			}
+			// The key of the certificate is stored in the Secret
+			stored, err := NewSecretCertStore("eks", "pod-identity-webhook", fake).Current()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectKeyType(t, stored.PrivateKey, c.keyType)
+
+			created := fake.created()
+			if len(created) != c.denied+1 {
+				t.Errorf("Expected %d CSRs, got %d", c.denied+1, len(created))
+			}
+			for _, signerName := range created {
+				if signerName != signer {
+					t.Errorf("Expected CSRs for signer %s, got %s", signer, signerName)
+				}
+			}
+			expectCSRState(t, csrStateApproved)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/tls"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/certificate"
+	"k8s.io/klog"
+)
+
+// rotationCheckPeriod is how often the expiration of the certificate of a
+// rotating manager is checked
+const rotationCheckPeriod = time.Minute
+
+// servingNotAfter is the expiration of the last certificate stored by a CSR
+// certificate manager in seconds since January 1, 1970 UTC
+var servingNotAfter atomic.Int64
+
+var (
+	rotationCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: "certificate",
+			Name:      "rotations_total",
+			Help:      "Counter of rotations of the serving certificate requested with CSRs.",
+		},
+	)
+	expiryGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Subsystem: "certificate",
+			Name:      "expiry_seconds",
+			Help:      "Seconds until the serving certificate requested with CSRs expires, negative once it has expired.",
+		},
+		func() float64 {
+			notAfter := servingNotAfter.Load()
+			if notAfter == 0 {
+				return 0
+			}
+			return float64(notAfter - time.Now().Unix())
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(rotationCounter)
+	prometheus.MustRegister(expiryGauge)
+}
+
+// rotationObserver counts the rotations of the client-go certificate manager,
+// which observes the age of the replaced certificate
+type rotationObserver struct{}
+
+func (rotationObserver) Observe(float64) {
+	rotationCounter.Inc()
+}
+
+// Compile time check that rotatingManager implements the certificate.Manager interface
+var _ certificate.Manager = &rotatingManager{}
+
+// rotatingManager renews the certificate of a certificate manager
+// rotateBefore it expires, earlier than the certificate manager would. A
+// renewal manager requests a certificate with a new key, and replaces the
+// active manager once it is issued. The previous certificate is served until
+// then, the renewal manager retries with backoff.
+type rotatingManager struct {
+	// newManager returns a certificate manager, with renew requesting a new
+	// certificate rather than loading the stored one
+	newManager   func(renew bool) (certificate.Manager, error)
+	rotateBefore time.Duration
+	checkPeriod  time.Duration
+	now          func() time.Time
+	stop         chan struct{}
+
+	mu      sync.Mutex
+	active  certificate.Manager
+	renewal certificate.Manager
+	// deadline is the jittered renewal deadline of deadlineCert
+	deadline     time.Time
+	deadlineCert *tls.Certificate
+}
+
+func newRotatingManager(newManager func(renew bool) (certificate.Manager, error), rotateBefore time.Duration) (*rotatingManager, error) {
+	active, err := newManager(false)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingManager{
+		newManager:   newManager,
+		rotateBefore: rotateBefore,
+		checkPeriod:  rotationCheckPeriod,
+		now:          time.Now,
+		stop:         make(chan struct{}),
+		active:       active,
+	}, nil
+}
+
+// renewalDeadline returns when the renewal of cert starts, rotateBefore its
+// expiration and up to a tenth of rotateBefore earlier, so replicas don't
+// all request certificates at once. Certificates issued for less than twice
+// rotateBefore are renewed halfway through their lifetime, rather than as
+// soon as they are issued.
+func (m *rotatingManager) renewalDeadline(cert *tls.Certificate) time.Time {
+	if m.deadlineCert != cert {
+		jitter := time.Duration(rand.Int63n(int64(m.rotateBefore)/10 + 1))
+		m.deadline = cert.Leaf.NotAfter.Add(-m.rotateBefore - jitter)
+		if halfway := cert.Leaf.NotBefore.Add(cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore) / 2); m.deadline.Before(halfway) {
+			klog.Warningf("Serving certificate expiring %s has a lifetime shorter than twice rotate-before %s, renewing it at %s",
+				cert.Leaf.NotAfter, m.rotateBefore, halfway)
+			m.deadline = halfway
+		}
+		m.deadlineCert = cert
+	}
+	return m.deadline
+}
+
+// check starts a renewal once the certificate of the active manager reaches
+// its renewal deadline, and replaces the active manager with the renewal
+// manager once it has a certificate
+func (m *rotatingManager) check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.renewal != nil {
+		renewed := m.renewal.Current()
+		if renewed == nil {
+			return
+		}
+		klog.Infof("Rotated the serving certificate, the new certificate expires %s", renewed.Leaf.NotAfter)
+		m.active.Stop()
+		m.active, m.renewal = m.renewal, nil
+		rotationCounter.Inc()
+		return
+	}
+
+	cert := m.active.Current()
+	if cert == nil || cert.Leaf == nil {
+		return
+	}
+	if deadline := m.renewalDeadline(cert); m.now().Before(deadline) {
+		return
+	}
+	klog.Infof("Renewing the serving certificate expiring %s, %s before its expiration", cert.Leaf.NotAfter, m.rotateBefore)
+	renewal, err := m.newManager(true)
+	if err != nil {
+		klog.Errorf("Error renewing the serving certificate, retrying: %v", err)
+		return
+	}
+	renewal.Start()
+	m.renewal = renewal
+}
+
+func (m *rotatingManager) Start() {
+	m.mu.Lock()
+	m.active.Start()
+	m.mu.Unlock()
+	go wait.Until(m.check, m.checkPeriod, m.stop)
+}
+
+func (m *rotatingManager) Stop() {
+	close(m.stop)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active.Stop()
+	if m.renewal != nil {
+		m.renewal.Stop()
+	}
+}
+
+func (m *rotatingManager) Current() *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active.Current()
+}
+
+func (m *rotatingManager) ServerHealthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active.ServerHealthy()
+}
+
+// renewalStore is a certificate.Store without a current certificate, so the
+// certificate manager requests a new one. New certificates are stored.
+type renewalStore struct {
+	certificate.Store
+}
+
+func (s *renewalStore) Current() (*tls.Certificate, error) {
+	noKeyErr := certificate.NoCertKeyError("renewing the certificate")
+	return nil, &noKeyErr
+}
@@ -0,0 +1,106 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRenewalDeadline(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &tls.Certificate{Leaf: &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(time.Hour)}}
+
+	m := &rotatingManager{rotateBefore: 10 * time.Minute}
+	deadline := m.renewalDeadline(cert)
+	if earliest, latest := cert.Leaf.NotAfter.Add(-11*time.Minute), cert.Leaf.NotAfter.Add(-10*time.Minute); deadline.Before(earliest) || deadline.After(latest) {
+		t.Errorf("Expected a deadline between %s and %s, got %s", earliest, latest, deadline)
+	}
+	if again := m.renewalDeadline(cert); !again.Equal(deadline) {
+		t.Errorf("Expected the jittered deadline of a certificate to be kept, got %s then %s", deadline, again)
+	}
+
+	// The certificate is renewed halfway through a lifetime shorter than
+	// twice rotateBefore
+	m = &rotatingManager{rotateBefore: 2 * time.Hour}
+	if deadline, halfway := m.renewalDeadline(cert), notBefore.Add(30*time.Minute); !deadline.Equal(halfway) {
+		t.Errorf("Expected deadline %s, got %s", halfway, deadline)
+	}
+}
+
+func TestRotatingManager(t *testing.T) {
+	fake := newFakeSigner(t)
+	config := SourceConfig{Source: SourceCSR, Namespace: "eks", SecretName: "pod-identity-webhook", ServiceName: "pod-identity-webhook",
+		SignerName: DefaultSignerName, KeyType: DefaultKeyType, RotateBefore: 10 * time.Minute}
+	manager, err := NewManager(config, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := manager.(*rotatingManager)
+	var clock atomic.Int64
+	clock.Store(time.Now().UnixNano())
+	// The certificates are issued at the time of the clock
+	m.now = func() time.Time { return time.Unix(0, clock.Load()) }
+	fake.now = m.now
+	m.checkPeriod = 10 * time.Millisecond
+	m.Start()
+	defer m.Stop()
+
+	fake.signUntil(t, 0, func() bool { return m.Current() != nil })
+	first := m.Current()
+	rotations := testutil.ToFloat64(rotationCounter)
+
+	// The certificate issued for an hour isn't renewed yet
+	time.Sleep(100 * time.Millisecond)
+	if created := fake.created(); len(created) != 1 {
+		t.Fatalf("Expected 1 CSR before the renewal deadline, got %d", len(created))
+	}
+
+	// 5 minutes before its expiration, a certificate is requested with a new
+	// key and replaces the current one once it is issued
+	clock.Store(first.Leaf.NotAfter.Add(-5 * time.Minute).UnixNano())
+	fake.signUntil(t, 0, func() bool {
+		return !bytes.Equal(m.Current().Certificate[0], first.Certificate[0])
+	})
+	renewed := m.Current()
+	if created := fake.created(); len(created) != 2 {
+		t.Errorf("Expected 2 CSRs after the renewal, got %d", len(created))
+	}
+	if bytes.Equal(renewed.Leaf.RawSubjectPublicKeyInfo, first.Leaf.RawSubjectPublicKeyInfo) {
+		t.Error("Expected the renewed certificate to have a new key")
+	}
+	if got := testutil.ToFloat64(rotationCounter) - rotations; got != 1 {
+		t.Errorf("Expected 1 rotation, got %v", got)
+	}
+	if got, expected := testutil.ToFloat64(expiryGauge), time.Until(renewed.Leaf.NotAfter).Seconds(); got < expected-5 || got > expected+5 {
+		t.Errorf("Expected the renewed certificate to expire in %vs, got %vs", expected, got)
+	}
+
+	// The renewed certificate is stored in the Secret
+	stored, err := NewSecretCertStore("eks", "pod-identity-webhook", fake).Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.Certificate[0], renewed.Certificate[0]) {
+		t.Error("Expected the renewed certificate to be stored in the secret")
+	}
+}
@@ -0,0 +1,210 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/certificate"
+	"k8s.io/klog"
+)
+
+// secretRetryPeriod is how long the secret source waits before reading the
+// Secret and watching it again once a watch ends
+const secretRetryPeriod = 10 * time.Second
+
+var secretReloadErrorCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Subsystem: "certificate_manager",
+		Name:      "secret_reload_errors_total",
+		Help:      "Counter of reloads of the TLS Secret of the secret source that failed, the previous certificate is kept.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(secretReloadErrorCounter)
+}
+
+// secretCertManager serves the certificate of a Secret provisioned by another
+// system. The Secret is only read and watched, never created or updated, so
+// the webhook only needs get and watch on it.
+type secretCertManager struct {
+	clientset clientset.Interface
+	namespace string
+	name      string
+	// waitForSecret serves no certificate until the Secret is created, eg.
+	// by the leader of the csr source, rather than requiring it
+	waitForSecret bool
+	current       atomic.Pointer[tls.Certificate]
+	stop          chan struct{}
+}
+
+// newSecretCertManager returns a manager serving the certificate of a Secret,
+// an error if the Secret doesn't exist or is malformed
+func newSecretCertManager(kubeClient clientset.Interface, namespace, name string) (certificate.Manager, error) {
+	m := &secretCertManager{clientset: kubeClient, namespace: namespace, name: name, stop: make(chan struct{})}
+	secret, err := m.get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	cert, err := secretCertificate(secret)
+	if err != nil {
+		return nil, err
+	}
+	m.current.Store(cert)
+	return m, nil
+}
+
+// newSecretWatcher returns a manager serving the certificate of a Secret once
+// it is created, so the replicas following the leader of the csr source serve
+// the certificate it stores
+func newSecretWatcher(kubeClient clientset.Interface, namespace, name string) *secretCertManager {
+	return &secretCertManager{clientset: kubeClient, namespace: namespace, name: name, waitForSecret: true, stop: make(chan struct{})}
+}
+
+// get returns the Secret, an error naming it if it doesn't exist unless the
+// manager waits for it
+func (m *secretCertManager) get(ctx context.Context) (*v1.Secret, error) {
+	secret, err := m.clientset.CoreV1().Secrets(m.namespace).Get(ctx, m.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) && m.waitForSecret {
+		return nil, nil
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("TLS secret %s/%s not found, certificate source %s doesn't create it", m.namespace, m.name, SourceSecret)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading TLS secret %s/%s: %v", m.namespace, m.name, err)
+	}
+	return secret, nil
+}
+
+// secretCertificate returns the certificate and key of the tls.crt and
+// tls.key of a kubernetes.io/tls or Opaque Secret
+func secretCertificate(secret *v1.Secret) (*tls.Certificate, error) {
+	switch secret.Type {
+	case v1.SecretTypeTLS, v1.SecretTypeOpaque, "":
+	default:
+		return nil, fmt.Errorf("TLS secret %s/%s has type %s, must be %s or %s",
+			secret.Namespace, secret.Name, secret.Type, v1.SecretTypeTLS, v1.SecretTypeOpaque)
+	}
+	for _, key := range []string{v1.TLSCertKey, v1.TLSPrivateKeyKey} {
+		if len(secret.Data[key]) == 0 {
+			return nil, fmt.Errorf("TLS secret %s/%s has no %s", secret.Namespace, secret.Name, key)
+		}
+	}
+	cert, err := loadX509KeyPairData(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing TLS secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	return cert, nil
+}
+
+// load replaces the certificate with the certificate of the Secret, unless it
+// is malformed
+func (m *secretCertManager) load(secret *v1.Secret) {
+	cert, err := secretCertificate(secret)
+	if err != nil {
+		secretReloadErrorCounter.Inc()
+		klog.Errorf("Error reloading the TLS secret, serving the previous certificate: %v", err)
+		return
+	}
+	if current := m.current.Load(); current != nil && bytes.Equal(current.Leaf.Raw, cert.Leaf.Raw) {
+		return
+	}
+	klog.Infof("Loaded certificate %s expiring %s from TLS secret %s/%s",
+		cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter, m.namespace, m.name)
+	m.current.Store(cert)
+}
+
+// watch reads the Secret, then watches it from its resource version until the
+// watch ends or the manager is stopped. A Secret the manager waits for is
+// watched until it is created.
+func (m *secretCertManager) watch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	secret, err := m.get(ctx)
+	if err != nil {
+		secretReloadErrorCounter.Inc()
+		klog.Errorf("Error reloading the TLS secret, serving the previous certificate: %v", err)
+		return
+	}
+	resourceVersion := ""
+	if secret != nil {
+		m.load(secret)
+		resourceVersion = secret.ResourceVersion
+	} else {
+		klog.V(2).Infof("Waiting for TLS secret %s/%s to be created", m.namespace, m.name)
+	}
+	w, err := m.clientset.CoreV1().Secrets(m.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", m.name).String(),
+		ResourceVersion: resourceVersion,
+	})
+	if err != nil {
+		klog.Errorf("Error watching TLS secret %s/%s: %v", m.namespace, m.name, err)
+		return
+	}
+	defer w.Stop()
+	for event := range w.ResultChan() {
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			if secret, ok := event.Object.(*v1.Secret); ok && secret.Name == m.name {
+				m.load(secret)
+			}
+		case watch.Deleted:
+			klog.Warningf("TLS secret %s/%s was deleted, serving the previous certificate", m.namespace, m.name)
+		case watch.Error:
+			klog.Warningf("Error watching TLS secret %s/%s: %v", m.namespace, m.name, apierrors.FromObject(event.Object))
+			return
+		}
+	}
+}
+
+func (m *secretCertManager) Start() {
+	go wait.Until(m.watch, secretRetryPeriod, m.stop)
+}
+
+func (m *secretCertManager) Stop() {
+	close(m.stop)
+}
+
+func (m *secretCertManager) Current() *tls.Certificate {
+	return m.current.Load()
+}
+
+func (m *secretCertManager) ServerHealthy() bool {
+	return true
+}
@@ -0,0 +1,166 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestSecret returns a TLS secret of a key pair for commonName
+func newTestSecret(t *testing.T, secretType v1.SecretType, commonName string) *v1.Secret {
+	t.Helper()
+	cert, key := newTestKeyPair(t, commonName)
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook", Namespace: "eks"},
+		Type:       secretType,
+		Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+	}
+}
+
+func TestSecretCertificate(t *testing.T) {
+	with := func(secret *v1.Secret, update func(*v1.Secret)) *v1.Secret {
+		update(secret)
+		return secret
+	}
+	_, otherKey := newTestKeyPair(t, "other")
+
+	cases := []struct {
+		caseName string
+		secret   *v1.Secret
+		err      string
+	}{
+		{"TLS", newTestSecret(t, v1.SecretTypeTLS, "secret"), ""},
+		{"Opaque", newTestSecret(t, v1.SecretTypeOpaque, "secret"), ""},
+		{"WithoutType", newTestSecret(t, "", "secret"), ""},
+		{"ServiceAccountToken", newTestSecret(t, v1.SecretTypeServiceAccountToken, "secret"), "has type kubernetes.io/service-account-token"},
+		{"WithoutCert", with(newTestSecret(t, v1.SecretTypeTLS, "secret"), func(s *v1.Secret) { delete(s.Data, v1.TLSCertKey) }), "has no tls.crt"},
+		{"WithoutKey", with(newTestSecret(t, v1.SecretTypeOpaque, "secret"), func(s *v1.Secret) { s.Data[v1.TLSPrivateKeyKey] = nil }), "has no tls.key"},
+		{"MalformedCert", with(newTestSecret(t, v1.SecretTypeTLS, "secret"), func(s *v1.Secret) { s.Data[v1.TLSCertKey] = []byte("not a certificate") }), "error parsing TLS secret eks/pod-identity-webhook"},
+		{"MismatchedKey", with(newTestSecret(t, v1.SecretTypeTLS, "secret"), func(s *v1.Secret) { s.Data[v1.TLSPrivateKeyKey] = otherKey }), "error parsing TLS secret eks/pod-identity-webhook"},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			cert, err := secretCertificate(c.secret)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("Expected an error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.Leaf.Subject.CommonName != "secret" {
+				t.Errorf("Expected certificate secret, got %s", cert.Leaf.Subject.CommonName)
+			}
+		})
+	}
+}
+
+func TestSecretCertManagerMissingSecret(t *testing.T) {
+	clientset := fakeclientset.NewSimpleClientset()
+	_, err := newSecretCertManager(clientset, "eks", "pod-identity-webhook")
+	if err == nil || !strings.Contains(err.Error(), "TLS secret eks/pod-identity-webhook not found") {
+		t.Errorf("Expected an error naming the missing secret, got %v", err)
+	}
+	// The secret is never created
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "get" {
+			t.Errorf("Expected only gets of the secret, got %s", action.GetVerb())
+		}
+	}
+}
+
+func TestSecretCertManagerRotation(t *testing.T) {
+	clientset := fakeclientset.NewSimpleClientset(newTestSecret(t, v1.SecretTypeTLS, "first"))
+	m, err := newSecretCertManager(clientset, "eks", "pod-identity-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Stop()
+	expectCommonName := func(commonName string) {
+		t.Helper()
+		if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			return m.Current().Leaf.Subject.CommonName == commonName, nil
+		}); err != nil {
+			t.Fatalf("Expected certificate %s, got %s", commonName, m.Current().Leaf.Subject.CommonName)
+		}
+	}
+	expectCommonName("first")
+	// Updates are only seen once the watch is started
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "watch" {
+				return true, nil
+			}
+		}
+		return false, nil
+	}); err != nil {
+		t.Fatal("Expected the secret to be watched")
+	}
+
+	secrets := clientset.CoreV1().Secrets("eks")
+	// The external system rotates the secret, and changes it to Opaque
+	if _, err := secrets.Update(context.Background(), newTestSecret(t, v1.SecretTypeOpaque, "second"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectCommonName("second")
+
+	// A malformed secret keeps the previous certificate
+	errors := testutil.ToFloat64(secretReloadErrorCounter)
+	malformed := newTestSecret(t, v1.SecretTypeTLS, "third")
+	malformed.Data[v1.TLSCertKey] = []byte("not a certificate")
+	if _, err := secrets.Update(context.Background(), malformed, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return testutil.ToFloat64(secretReloadErrorCounter) > errors, nil
+	}); err != nil {
+		t.Fatal("Expected the reload error to be counted")
+	}
+	expectCommonName("second")
+
+	if _, err := secrets.Update(context.Background(), newTestSecret(t, v1.SecretTypeTLS, "fourth"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectCommonName("fourth")
+
+	// The secret is only read and watched, the updates are the rotations of
+	// the test
+	updates := 0
+	for _, action := range clientset.Actions() {
+		switch action.GetVerb() {
+		case "get", "watch":
+		case "update":
+			updates++
+		default:
+			t.Errorf("Expected only gets and watches of the secret, got %s", action.GetVerb())
+		}
+	}
+	if updates != 3 {
+		t.Errorf("Expected the 3 updates of the test, got %d", updates)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/certificate"
+	"k8s.io/klog"
+)
+
+// servingCheckPeriod is how often the served certificate is checked for
+// changes between handshakes
+const servingCheckPeriod = 30 * time.Second
+
+var (
+	servingNotAfterGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "webhook_cert_not_after_timestamp_seconds",
+			Help: "Expiration of the certificate served by the webhook in seconds since January 1, 1970 UTC.",
+		},
+	)
+	servingNotBeforeGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "webhook_cert_not_before_timestamp_seconds",
+			Help: "Start of the validity of the certificate served by the webhook in seconds since January 1, 1970 UTC.",
+		},
+	)
+	servingReloadCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "webhook_cert_reloads_total",
+			Help: "Counter of changes of the certificate served by the webhook, eg. renewals or reloads of the certificate source.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(servingNotAfterGauge)
+	prometheus.MustRegister(servingNotBeforeGauge)
+	prometheus.MustRegister(servingReloadCounter)
+}
+
+// ServingCertificate serves the certificate of a manager of any source,
+// recording the validity of the served certificate and counting its changes
+type ServingCertificate struct {
+	manager certificate.Manager
+
+	mu sync.Mutex
+	// served is the DER of the last served certificate
+	served []byte
+}
+
+// NewServingCertificate returns the serving certificate of manager
+func NewServingCertificate(manager certificate.Manager) *ServingCertificate {
+	s := &ServingCertificate{manager: manager}
+	s.current()
+	return s
+}
+
+// current returns the certificate of the manager, recording it if it changed
+func (s *ServingCertificate) current() *tls.Certificate {
+	cert := s.manager.Current()
+	if cert == nil || cert.Leaf == nil {
+		return cert
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bytes.Equal(s.served, cert.Leaf.Raw) {
+		return cert
+	}
+	if s.served != nil {
+		klog.Infof("Serving certificate %s valid from %s to %s", cert.Leaf.Subject.CommonName, cert.Leaf.NotBefore, cert.Leaf.NotAfter)
+		servingReloadCounter.Inc()
+	}
+	s.served = cert.Leaf.Raw
+	servingNotAfterGauge.Set(float64(cert.Leaf.NotAfter.Unix()))
+	servingNotBeforeGauge.Set(float64(cert.Leaf.NotBefore.Unix()))
+	return cert
+}
+
+// GetCertificate returns the certificate of the manager for a handshake, an
+// error if it has none yet
+func (s *ServingCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := s.current()
+	if cert == nil {
+		return nil, fmt.Errorf("no serving certificate available for the webhook, is the CSR approved?")
+	}
+	return cert, nil
+}
+
+// Run records the changes of the certificate every servingCheckPeriod until
+// ctx is done, so the metrics follow the certificate of the manager without
+// handshakes
+func (s *ServingCertificate) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(context.Context) { s.current() }, servingCheckPeriod)
+}
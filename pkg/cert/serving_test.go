@@ -0,0 +1,68 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServingCertificateMetrics(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	now := time.Now().Truncate(time.Second)
+	first, firstKey := newTestKeyPairValidity(t, "first", now.Add(-time.Hour), now.Add(24*time.Hour))
+	writeFile(t, certFile, first)
+	writeFile(t, keyFile, firstKey)
+	m, err := NewManager(SourceConfig{Source: SourceFiles, CertFile: certFile, KeyFile: keyFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Stop()
+	expectValidity := func(notBefore, notAfter time.Time) {
+		t.Helper()
+		if got := testutil.ToFloat64(servingNotBeforeGauge); got != float64(notBefore.Unix()) {
+			t.Errorf("Expected not before %d, got %v", notBefore.Unix(), got)
+		}
+		if got := testutil.ToFloat64(servingNotAfterGauge); got != float64(notAfter.Unix()) {
+			t.Errorf("Expected not after %d, got %v", notAfter.Unix(), got)
+		}
+	}
+
+	reloads := testutil.ToFloat64(servingReloadCounter)
+	s := NewServingCertificate(m)
+	expectValidity(now.Add(-time.Hour), now.Add(24*time.Hour))
+	if got := servedCommonName(t, s.GetCertificate); got != "first" {
+		t.Fatalf("Expected certificate first to be served, got %s", got)
+	}
+	if got := testutil.ToFloat64(servingReloadCounter) - reloads; got != 0 {
+		t.Errorf("Expected no reloads before the certificate changes, got %v", got)
+	}
+
+	// The certificate is renewed, the handshakes serve the new certificate
+	second, secondKey := newTestKeyPairValidity(t, "second", now, now.Add(48*time.Hour))
+	writeFile(t, keyFile, secondKey)
+	writeFile(t, certFile, second)
+	eventually(t, "Expected certificate second to be served", func() bool { return servedCommonName(t, s.GetCertificate) == "second" })
+	expectValidity(now, now.Add(48*time.Hour))
+	if got := testutil.ToFloat64(servingReloadCounter) - reloads; got != 1 {
+		t.Errorf("Expected 1 reload, got %v", got)
+	}
+}
@@ -0,0 +1,343 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/certificate"
+	"k8s.io/klog"
+)
+
+// Sources of the serving certificate
+const (
+	// SourceCSR requests the certificate with a CSR, and stores it in a
+	// Secret
+	SourceCSR = "csr"
+	// SourceFiles reads the certificate and key from files, reloaded when
+	// they change
+	SourceFiles = "files"
+	// SourceSecret reads the certificate and key from a Secret managed by
+	// another system, reloaded when it changes
+	SourceSecret = "secret"
+	// SourceSelfSigned generates a self-signed certificate at startup
+	SourceSelfSigned = "selfsigned"
+)
+
+// selfSignedValidity is the lifetime of self-signed certificates
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// SourceConfig configures the source of the serving certificate
+type SourceConfig struct {
+	// Source is one of csr, files, secret, or selfsigned
+	Source string
+	// CertFile and KeyFile are the files of the files source
+	CertFile string
+	KeyFile  string
+	// Namespace and SecretName are the Secret of the csr and secret
+	// sources
+	Namespace  string
+	SecretName string
+	// ServiceName is the Service fronting the webhook, naming the
+	// certificates of the csr and selfsigned sources in Namespace
+	ServiceName string
+	// SignerName is the signer of the CSRs of the csr source
+	SignerName string
+	// DNSNames and IPSANs are the SANs of the CSRs of the csr source. nil
+	// DNSNames default to the DNS names of the Service, empty DNSNames
+	// request none.
+	DNSNames []string
+	IPSANs   []string
+	// SelfSignedHosts are the DNS names and IPs of the certificate of the
+	// selfsigned source, nil defaults to the DNS names of the Service
+	SelfSignedHosts []string
+	// RotateBefore renews the certificate of the csr source before it
+	// expires, 0 keeps the rotation of the certificate manager at 70-90% of
+	// its lifetime
+	RotateBefore time.Duration
+	// KeyType is the type of the keys generated by the csr and selfsigned
+	// sources
+	KeyType string
+	// LeaderElect elects the replica of the csr source creating the CSRs and
+	// updating the Secret with the LeaseName Lease in Namespace, the other
+	// replicas serve the Secret. Identity names the replica in the Lease.
+	LeaderElect bool
+	LeaseName   string
+	Identity    string
+}
+
+// Validate returns an error if the source is unknown, or if a setting it
+// requires is missing or a setting of another source is set
+func (c SourceConfig) Validate() error {
+	var required []string
+	switch c.Source {
+	case SourceCSR:
+		required = []string{"namespace", "tls-secret", "service-name", "csr-signer-name"}
+	case SourceFiles:
+		required = []string{"tls-cert-file", "tls-key-file"}
+	case SourceSecret:
+		required = []string{"namespace", "tls-secret"}
+	case SourceSelfSigned:
+		if c.SelfSignedHosts == nil {
+			required = []string{"namespace", "service-name"}
+		}
+	default:
+		return fmt.Errorf("invalid certificate source %q, must be %s, %s, %s, or %s",
+			c.Source, SourceCSR, SourceFiles, SourceSecret, SourceSelfSigned)
+	}
+	values := map[string]string{
+		"namespace":       c.Namespace,
+		"tls-secret":      c.SecretName,
+		"service-name":    c.ServiceName,
+		"csr-signer-name": c.SignerName,
+		"tls-cert-file":   c.CertFile,
+		"tls-key-file":    c.KeyFile,
+	}
+	for _, name := range required {
+		if values[name] == "" {
+			return fmt.Errorf("certificate source %s requires %s", c.Source, name)
+		}
+	}
+	// The signer name has a default, the other sources ignore it. The SANs
+	// and rotate-before don't, setting them with another source is an error.
+	if c.Source == SourceCSR {
+		if err := ValidateSignerName(c.SignerName); err != nil {
+			return err
+		}
+		if _, err := csrTemplate(c); err != nil {
+			return err
+		}
+	} else if c.DNSNames != nil || len(c.IPSANs) != 0 {
+		return fmt.Errorf("csr-dns-names and csr-ip-sans require certificate source %s, got %s", SourceCSR, c.Source)
+	} else if c.RotateBefore != 0 {
+		return fmt.Errorf("rotate-before requires certificate source %s, got %s", SourceCSR, c.Source)
+	} else if c.LeaderElect {
+		return fmt.Errorf("leader-elect requires certificate source %s, got %s", SourceCSR, c.Source)
+	}
+	if c.LeaderElect && c.LeaseName == "" {
+		return fmt.Errorf("leader-elect requires leader-elect-lease-name")
+	}
+	if c.LeaderElect && c.Identity == "" {
+		return fmt.Errorf("leader-elect requires the identity of the replica")
+	}
+	if c.RotateBefore < 0 {
+		return fmt.Errorf("invalid rotate-before %s, must not be negative", c.RotateBefore)
+	}
+	if c.Source == SourceSelfSigned {
+		if _, err := selfSignedTemplate(c.ServiceName, c.Namespace, c.SelfSignedHosts); err != nil {
+			return err
+		}
+	} else if c.SelfSignedHosts != nil {
+		return fmt.Errorf("self-signed-hosts requires certificate source %s, got %s", SourceSelfSigned, c.Source)
+	}
+	// The key type has a default, the files and secret sources ignore it
+	if c.Source == SourceCSR || c.Source == SourceSelfSigned {
+		if err := ValidateKeyType(c.KeyType); err != nil {
+			return err
+		}
+	}
+	if c.Source != SourceFiles && (c.CertFile != "" || c.KeyFile != "") {
+		return fmt.Errorf("tls-cert-file and tls-key-file require certificate source %s, got %s", SourceFiles, c.Source)
+	}
+	return nil
+}
+
+// ValidateSignerName returns an error if name is not a signer name, a domain
+// and a path like beta.eks.amazonaws.com/app-serving
+func ValidateSignerName(name string) error {
+	domain, path, ok := strings.Cut(name, "/")
+	if !ok || domain == "" || path == "" || !strings.Contains(domain, ".") {
+		return fmt.Errorf("invalid csr signer name %q, must be a domain and a path like %s", name, DefaultSignerName)
+	}
+	return nil
+}
+
+// NewManager returns the certificate manager of a source. Only the csr and
+// secret sources use kubeClient, the files and selfsigned sources don't call
+// the API server and kubeClient may be nil.
+func NewManager(c SourceConfig, kubeClient clientset.Interface) (certificate.Manager, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	switch c.Source {
+	case SourceCSR:
+		csr, err := csrTemplate(c)
+		if err != nil {
+			return nil, err
+		}
+		newManager := func() (certificate.Manager, error) {
+			if c.RotateBefore == 0 {
+				return NewServerCertificateManager(kubeClient, c.Namespace, c.SecretName, c.SignerName, c.KeyType, csr)
+			}
+			return newRotatingManager(func(renew bool) (certificate.Manager, error) {
+				return newServerCertificateManager(kubeClient, c.Namespace, c.SecretName, c.SignerName, c.KeyType, csr, renew)
+			}, c.RotateBefore)
+		}
+		if !c.LeaderElect {
+			return newManager()
+		}
+		return newLeaderElectedManager(kubeClient, c.Namespace, c.SecretName, c.LeaseName, c.Identity, newManager), nil
+	case SourceFiles:
+		return NewFileCertificateManager(c.CertFile, c.KeyFile)
+	case SourceSecret:
+		return newSecretCertManager(kubeClient, c.Namespace, c.SecretName)
+	default:
+		return newSelfSignedCertManager(c.ServiceName, c.Namespace, c.SelfSignedHosts, c.KeyType)
+	}
+}
+
+// csrTemplate returns the template of the CSRs of the csr source, an error if
+// a SAN is invalid. Clients validate the SANs of the certificate, the common
+// name is kept for signers that require it.
+func csrTemplate(c SourceConfig) (*x509.CertificateRequest, error) {
+	dnsNames := c.DNSNames
+	if dnsNames == nil {
+		dnsNames = serviceDNSNames(c.ServiceName, c.Namespace)
+	}
+	for _, name := range dnsNames {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid csr dns name %q: %s", name, strings.Join(errs, ", "))
+		}
+	}
+	var ips []net.IP
+	for _, san := range c.IPSANs {
+		ip := net.ParseIP(san)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid csr ip san %q", san)
+		}
+		ips = append(ips, ip)
+	}
+	return &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: fmt.Sprintf("%s.%s.svc", c.ServiceName, c.Namespace)},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	}, nil
+}
+
+// serviceDNSNames returns the DNS names of a Service
+func serviceDNSNames(serviceName, namespace string) []string {
+	return []string{
+		serviceName,
+		fmt.Sprintf("%s.%s", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc", serviceName, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", serviceName, namespace),
+	}
+}
+
+// staticCertManager serves a certificate that never changes
+type staticCertManager struct {
+	cert *tls.Certificate
+}
+
+// selfSignedTemplate returns the subject and SANs of the self-signed
+// certificate, the DNS names of the Service unless hosts is set. hosts are
+// DNS names or IPs, the common name is the first DNS name, or the first IP if
+// there are none.
+func selfSignedTemplate(serviceName, namespace string, hosts []string) (*x509.Certificate, error) {
+	if hosts == nil {
+		return &x509.Certificate{
+			Subject:  pkix.Name{CommonName: fmt.Sprintf("%s.%s.svc", serviceName, namespace)},
+			DNSNames: serviceDNSNames(serviceName, namespace),
+		}, nil
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("self-signed-hosts requires a DNS name or an IP")
+	}
+	template := &x509.Certificate{}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(host); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid self-signed host %q, must be a DNS name or an IP: %s", host, strings.Join(errs, ", "))
+		}
+		template.DNSNames = append(template.DNSNames, host)
+	}
+	if len(template.DNSNames) != 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	} else {
+		template.Subject.CommonName = template.IPAddresses[0].String()
+	}
+	return template, nil
+}
+
+// newSelfSignedCertManager returns a manager serving a certificate of the
+// Service of the webhook, or of hosts if set, signed by its own key. The API
+// server must be configured to trust it, so the certificate is logged.
+func newSelfSignedCertManager(serviceName, namespace string, hosts []string, keyType string) (certificate.Manager, error) {
+	template, err := selfSignedTemplate(serviceName, namespace, hosts)
+	if err != nil {
+		return nil, err
+	}
+	key, keyPEM, err := generateKey(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("error generating self-signed key: %v", err)
+	}
+	keyUsage := x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		// RSA keys encipher the keys of TLS RSA key exchanges
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("error generating self-signed certificate serial: %v", err)
+	}
+	now := time.Now()
+	template.SerialNumber = serial
+	template.NotBefore = now.Add(-time.Minute)
+	template.NotAfter = now.Add(selfSignedValidity)
+	template.KeyUsage = keyUsage
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.BasicConstraintsValid = true
+	template.IsCA = true
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("error generating self-signed certificate: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	cert, err := loadX509KeyPairData(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Generated self-signed certificate %s expiring %s, the API server must trust it:\n%s",
+		template.Subject.CommonName, template.NotAfter, certPEM)
+	return &staticCertManager{cert: cert}, nil
+}
+
+func (m *staticCertManager) Start() {}
+
+func (m *staticCertManager) Stop() {}
+
+func (m *staticCertManager) Current() *tls.Certificate {
+	return m.cert
+}
+
+func (m *staticCertManager) ServerHealthy() bool {
+	return true
+}
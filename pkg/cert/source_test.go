@@ -0,0 +1,285 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSourceConfigValidate(t *testing.T) {
+	csr := SourceConfig{Source: SourceCSR, Namespace: "eks", SecretName: "pod-identity-webhook", ServiceName: "pod-identity-webhook", SignerName: DefaultSignerName, KeyType: DefaultKeyType}
+	files := SourceConfig{Source: SourceFiles, CertFile: "tls.crt", KeyFile: "tls.key"}
+	secret := SourceConfig{Source: SourceSecret, Namespace: "eks", SecretName: "pod-identity-webhook"}
+	selfSigned := SourceConfig{Source: SourceSelfSigned, Namespace: "eks", ServiceName: "pod-identity-webhook", KeyType: DefaultKeyType}
+	with := func(c SourceConfig, update func(*SourceConfig)) SourceConfig {
+		update(&c)
+		return c
+	}
+
+	cases := []struct {
+		caseName string
+		config   SourceConfig
+		valid    bool
+	}{
+		{"CSR", csr, true},
+		{"CSRWithoutNamespace", with(csr, func(c *SourceConfig) { c.Namespace = "" }), false},
+		{"CSRWithoutSecret", with(csr, func(c *SourceConfig) { c.SecretName = "" }), false},
+		{"CSRWithoutService", with(csr, func(c *SourceConfig) { c.ServiceName = "" }), false},
+		{"CSRWithoutSignerName", with(csr, func(c *SourceConfig) { c.SignerName = "" }), false},
+		{"CSRWithCustomSignerName", with(csr, func(c *SourceConfig) { c.SignerName = "pki.example.com/webhook-serving" }), true},
+		{"CSRWithInvalidSignerName", with(csr, func(c *SourceConfig) { c.SignerName = "app-serving" }), false},
+		{"CSRWithRSAKey", with(csr, func(c *SourceConfig) { c.KeyType = KeyTypeRSA4096 }), true},
+		{"CSRWithoutKeyType", with(csr, func(c *SourceConfig) { c.KeyType = "" }), false},
+		{"CSRWithInvalidKeyType", with(csr, func(c *SourceConfig) { c.KeyType = "rsa-1024" }), false},
+		{"CSRWithSANs", with(csr, func(c *SourceConfig) {
+			c.DNSNames, c.IPSANs = []string{"webhook.example.com"}, []string{"10.100.0.10", "fd00::10"}
+		}), true},
+		{"CSRWithoutDNSNames", with(csr, func(c *SourceConfig) { c.DNSNames = []string{} }), true},
+		{"CSRWithInvalidDNSName", with(csr, func(c *SourceConfig) { c.DNSNames = []string{"Webhook_Service"} }), false},
+		{"CSRWithInvalidIPSAN", with(csr, func(c *SourceConfig) { c.IPSANs = []string{"10.100.0"} }), false},
+		{"CSRWithRotateBefore", with(csr, func(c *SourceConfig) { c.RotateBefore = 720 * time.Hour }), true},
+		{"CSRWithNegativeRotateBefore", with(csr, func(c *SourceConfig) { c.RotateBefore = -time.Hour }), false},
+		{"CSRWithFiles", with(csr, func(c *SourceConfig) { c.CertFile, c.KeyFile = "tls.crt", "tls.key" }), false},
+		{"CSRWithLeaderElect", with(csr, func(c *SourceConfig) {
+			c.LeaderElect, c.LeaseName, c.Identity = true, DefaultLeaseName, "pod-identity-webhook-0"
+		}), true},
+		{"CSRWithLeaderElectWithoutLease", with(csr, func(c *SourceConfig) { c.LeaderElect, c.Identity = true, "pod-identity-webhook-0" }), false},
+		{"CSRWithLeaderElectWithoutIdentity", with(csr, func(c *SourceConfig) { c.LeaderElect, c.LeaseName = true, DefaultLeaseName }), false},
+		{"Files", files, true},
+		// The files source doesn't need the Secret or its namespace
+		{"FilesWithoutSecret", with(files, func(c *SourceConfig) { c.Namespace, c.SecretName, c.ServiceName = "", "", "" }), true},
+		{"FilesWithoutCert", with(files, func(c *SourceConfig) { c.CertFile = "" }), false},
+		{"FilesWithoutKey", with(files, func(c *SourceConfig) { c.KeyFile = "" }), false},
+		{"Secret", secret, true},
+		{"SecretWithSignerName", with(secret, func(c *SourceConfig) { c.SignerName = DefaultSignerName }), true},
+		{"SecretWithKeyType", with(secret, func(c *SourceConfig) { c.KeyType = "rsa-1024" }), true},
+		{"SecretWithDNSNames", with(secret, func(c *SourceConfig) { c.DNSNames = []string{"webhook.example.com"} }), false},
+		{"SecretWithoutNamespace", with(secret, func(c *SourceConfig) { c.Namespace = "" }), false},
+		{"SecretWithoutSecret", with(secret, func(c *SourceConfig) { c.SecretName = "" }), false},
+		{"SecretWithCertFile", with(secret, func(c *SourceConfig) { c.CertFile = "tls.crt" }), false},
+		{"SecretWithLeaderElect", with(secret, func(c *SourceConfig) {
+			c.LeaderElect, c.LeaseName, c.Identity = true, DefaultLeaseName, "pod-identity-webhook-0"
+		}), false},
+		{"SelfSigned", selfSigned, true},
+		{"SelfSignedWithoutNamespace", with(selfSigned, func(c *SourceConfig) { c.Namespace = "" }), false},
+		{"SelfSignedWithoutService", with(selfSigned, func(c *SourceConfig) { c.ServiceName = "" }), false},
+		{"SelfSignedWithRSAKey", with(selfSigned, func(c *SourceConfig) { c.KeyType = KeyTypeRSA2048 }), true},
+		{"SelfSignedWithInvalidKeyType", with(selfSigned, func(c *SourceConfig) { c.KeyType = "ecdsa-p384" }), false},
+		{"SelfSignedWithIPSANs", with(selfSigned, func(c *SourceConfig) { c.IPSANs = []string{"10.100.0.10"} }), false},
+		{"SelfSignedWithRotateBefore", with(selfSigned, func(c *SourceConfig) { c.RotateBefore = time.Hour }), false},
+		{"SelfSignedWithKeyFile", with(selfSigned, func(c *SourceConfig) { c.KeyFile = "tls.key" }), false},
+		{"SelfSignedWithHosts", with(selfSigned, func(c *SourceConfig) { c.SelfSignedHosts = []string{"localhost", "127.0.0.1", "::1"} }), true},
+		// The hosts replace the DNS names of the Service
+		{"SelfSignedWithHostsWithoutService", with(selfSigned, func(c *SourceConfig) {
+			c.Namespace, c.ServiceName, c.SelfSignedHosts = "", "", []string{"10.0.0.10"}
+		}), true},
+		{"SelfSignedWithoutHosts", with(selfSigned, func(c *SourceConfig) { c.SelfSignedHosts = []string{} }), false},
+		{"SelfSignedWithInvalidHost", with(selfSigned, func(c *SourceConfig) { c.SelfSignedHosts = []string{"https://localhost:8443"} }), false},
+		{"CSRWithSelfSignedHosts", with(csr, func(c *SourceConfig) { c.SelfSignedHosts = []string{"localhost"} }), false},
+		{"Empty", SourceConfig{}, false},
+		{"Unknown", with(csr, func(c *SourceConfig) { c.Source = "acm" }), false},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			err := c.config.Validate()
+			if c.valid && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if !c.valid && err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestNewManagerWithoutAPIServer(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	cert, key := newTestKeyPair(t, "files")
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+
+	cases := []struct {
+		caseName   string
+		config     SourceConfig
+		commonName string
+	}{
+		{"Files", SourceConfig{Source: SourceFiles, CertFile: certFile, KeyFile: keyFile}, "files"},
+		{"SelfSigned", SourceConfig{Source: SourceSelfSigned, Namespace: "eks", ServiceName: "pod-identity-webhook", KeyType: DefaultKeyType}, "pod-identity-webhook.eks.svc"},
+		{"SelfSignedRSA2048", SourceConfig{Source: SourceSelfSigned, Namespace: "eks", ServiceName: "pod-identity-webhook", KeyType: KeyTypeRSA2048}, "pod-identity-webhook.eks.svc"},
+		{"SelfSignedRSA4096", SourceConfig{Source: SourceSelfSigned, Namespace: "eks", ServiceName: "pod-identity-webhook", KeyType: KeyTypeRSA4096}, "pod-identity-webhook.eks.svc"},
+		{"SelfSignedHosts", SourceConfig{Source: SourceSelfSigned, SelfSignedHosts: []string{"127.0.0.1", "webhook.example.com", "localhost"}, KeyType: DefaultKeyType}, "webhook.example.com"},
+		{"SelfSignedIPs", SourceConfig{Source: SourceSelfSigned, SelfSignedHosts: []string{"10.0.0.10", "::1"}, KeyType: DefaultKeyType}, "10.0.0.10"},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			// No clientset, the source must not call the API server
+			m, err := NewManager(c.config, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Start()
+			defer m.Stop()
+			current := m.Current()
+			if current == nil || current.Leaf.Subject.CommonName != c.commonName {
+				t.Fatalf("Expected certificate %s, got %v", c.commonName, current)
+			}
+			if c.config.KeyType != "" {
+				expectKeyType(t, current.PrivateKey, c.config.KeyType)
+			}
+			if got := servedCommonName(t, func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return m.Current(), nil }); got != c.commonName {
+				t.Errorf("Expected certificate %s to be served, got %s", c.commonName, got)
+			}
+		})
+	}
+}
+
+func TestSelfSignedHosts(t *testing.T) {
+	hosts := []string{"localhost", "webhook.example.com", "127.0.0.1", "::1"}
+	m, err := NewManager(SourceConfig{Source: SourceSelfSigned, SelfSignedHosts: hosts, KeyType: DefaultKeyType}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return m.Current(), nil }}
+	// The certificate is its own CA
+	roots := x509.NewCertPool()
+	roots.AddCert(m.Current().Leaf)
+
+	for _, host := range append(hosts, "other.example.com", "10.0.0.10") {
+		t.Run(host, func(t *testing.T) {
+			err := handshake(t, config, &tls.Config{RootCAs: roots, ServerName: host})
+			if valid := host != "other.example.com" && host != "10.0.0.10"; valid && err != nil {
+				t.Errorf("Expected a verified connection to %s, got %v", host, err)
+			} else if !valid && err == nil {
+				t.Errorf("Expected the certificate not to be valid for %s", host)
+			}
+		})
+	}
+}
+
+func TestNewManagerSecret(t *testing.T) {
+	cert, key := newTestKeyPair(t, "secret")
+	clientset := fakeclientset.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook", Namespace: "eks"},
+		Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+	})
+	config := SourceConfig{Source: SourceSecret, Namespace: "eks", SecretName: "pod-identity-webhook"}
+	m, err := NewManager(config, clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current := m.Current(); current == nil || current.Leaf.Subject.CommonName != "secret" {
+		t.Errorf("Expected the certificate of the secret, got %v", current)
+	}
+	// The secret is only read, never created or updated
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "get" {
+			t.Errorf("Expected only gets of the secret, got %s", action.GetVerb())
+		}
+	}
+
+	if _, err := NewManager(config, fakeclientset.NewSimpleClientset()); err == nil {
+		t.Error("Expected an error without the secret")
+	}
+}
+
+func TestNewManagerCSRSANs(t *testing.T) {
+	config := SourceConfig{Source: SourceCSR, Namespace: "eks", SecretName: "pod-identity-webhook", ServiceName: "pod-identity-webhook",
+		SignerName: DefaultSignerName, KeyType: DefaultKeyType}
+	with := func(update func(*SourceConfig)) SourceConfig {
+		c := config
+		update(&c)
+		return c
+	}
+
+	cases := []struct {
+		caseName    string
+		config      SourceConfig
+		dnsNames    []string
+		ipAddresses []string
+	}{
+		{"Default", config, serviceDNSNames("pod-identity-webhook", "eks"), nil},
+		{"Custom", with(func(c *SourceConfig) {
+			c.DNSNames, c.IPSANs = []string{"webhook.example.com"}, []string{"10.100.0.10", "fd00::10"}
+		}), []string{"webhook.example.com"}, []string{"10.100.0.10", "fd00::10"}},
+		{"NoDNSNames", with(func(c *SourceConfig) { c.DNSNames = []string{} }), nil, nil},
+		{"RSA", with(func(c *SourceConfig) {
+			c.KeyType, c.IPSANs = KeyTypeRSA2048, []string{"10.100.0.10"}
+		}), serviceDNSNames("pod-identity-webhook", "eks"), []string{"10.100.0.10"}},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			fake := fakeclientset.NewSimpleClientset()
+			requests := make(chan []byte, 1)
+			fake.PrependReactor("create", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				csr := action.(k8stesting.CreateAction).GetObject().(*certificates.CertificateSigningRequest)
+				select {
+				case requests <- csr.Spec.Request:
+				default:
+				}
+				return true, nil, fmt.Errorf("not signing in tests")
+			})
+			m, err := NewManager(c.config, fake)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Start()
+			defer m.Stop()
+
+			var request []byte
+			select {
+			case request = <-requests:
+			case <-time.After(10 * time.Second):
+				t.Fatal("Expected a CSR")
+			}
+			block, _ := pem.Decode(request)
+			if block == nil {
+				t.Fatal("Expected a PEM encoded certificate request")
+			}
+			req, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Subject.CommonName != "pod-identity-webhook.eks.svc" {
+				t.Errorf("Expected common name pod-identity-webhook.eks.svc, got %s", req.Subject.CommonName)
+			}
+			if !reflect.DeepEqual(req.DNSNames, c.dnsNames) {
+				t.Errorf("Expected DNS SANs %v, got %v", c.dnsNames, req.DNSNames)
+			}
+			var ips []string
+			for _, ip := range req.IPAddresses {
+				ips = append(ips, ip.String())
+			}
+			if !reflect.DeepEqual(ips, c.ipAddresses) {
+				t.Errorf("Expected IP SANs %v, got %v", c.ipAddresses, ips)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultTLSMinVersion is the minimum TLS version of the webhook server
+const DefaultTLSMinVersion = "1.2"
+
+// tlsVersions are the TLS versions the webhook server can be limited to
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewServerTLSConfig returns the TLS config of the webhook server, accepting
+// TLS minVersion or later and, if set, the cipher suites of their IANA names.
+// Only the suites of CipherSuites are accepted, the suites of TLS 1.3 are
+// accepted but can't be configured.
+func NewServerTLSConfig(minVersion string, cipherSuites []string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls min version %q, must be 1.0, 1.1, 1.2, or 1.3", minVersion)
+	}
+	config := &tls.Config{MinVersion: version}
+	if len(cipherSuites) == 0 {
+		return config, nil
+	}
+	ids := map[string]uint16{}
+	var names []string
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+		names = append(names, suite.Name)
+	}
+	sort.Strings(names)
+	for _, name := range cipherSuites {
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls cipher suite %q, must be one of %s", name, strings.Join(names, ", "))
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
@@ -0,0 +1,128 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package cert
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestNewServerTLSConfig(t *testing.T) {
+	cases := []struct {
+		caseName     string
+		minVersion   string
+		cipherSuites []string
+		expected     uint16
+		suites       []uint16
+		err          string
+	}{
+		{"Default", DefaultTLSMinVersion, nil, tls.VersionTLS12, nil, ""},
+		{"TLS13", "1.3", nil, tls.VersionTLS13, nil, ""},
+		{"TLS10", "1.0", nil, tls.VersionTLS10, nil, ""},
+		{"InvalidVersion", "TLSv1.2", nil, 0, nil, "invalid tls min version"},
+		{"CipherSuites", "1.2", []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, tls.VersionTLS12,
+			[]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, ""},
+		// The error lists the valid suites
+		{"UnknownCipherSuite", "1.2", []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM"}, 0, nil, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		{"InsecureCipherSuite", "1.2", []string{"TLS_RSA_WITH_RC4_128_SHA"}, 0, nil, "invalid tls cipher suite"},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			config, err := NewServerTLSConfig(c.minVersion, c.cipherSuites)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("Expected an error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.MinVersion != c.expected {
+				t.Errorf("Expected min version %x, got %x", c.expected, config.MinVersion)
+			}
+			if len(config.CipherSuites) != len(c.suites) {
+				t.Fatalf("Expected cipher suites %v, got %v", c.suites, config.CipherSuites)
+			}
+			for i := range c.suites {
+				if config.CipherSuites[i] != c.suites[i] {
+					t.Errorf("Expected cipher suites %v, got %v", c.suites, config.CipherSuites)
+				}
+			}
+		})
+	}
+}
+
+// handshake returns the error of a TLS handshake of a client with a server
+// using config
+func handshake(t *testing.T, config *tls.Config, client *tls.Config) error {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*tls.Conn).Handshake()
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestServerTLSConfigHandshake(t *testing.T) {
+	manager, err := newSelfSignedCertManager("pod-identity-webhook", "eks", nil, DefaultKeyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewServerTLSConfig(DefaultTLSMinVersion, []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return manager.Current(), nil }
+
+	cases := []struct {
+		caseName string
+		client   *tls.Config
+		ok       bool
+	}{
+		{"TLS13", &tls.Config{InsecureSkipVerify: true}, true},
+		{"TLS12", &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}, true},
+		{"TLS11", &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}, false},
+		{"TLS10", &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS10}, false},
+		{"DisallowedCipherSuite", &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			err := handshake(t, config, c.client)
+			if c.ok && err != nil {
+				t.Errorf("Expected a handshake, got %v", err)
+			}
+			if !c.ok && err == nil {
+				t.Error("Expected the handshake to fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// DefaultPartitions are the AWS partitions role ARNs are accepted in by default
+var DefaultPartitions = []string{"aws", "aws-cn", "aws-us-gov"}
+
+// ValidatePartitions returns an error if any of partitions is not a known AWS
+// partition
+func ValidatePartitions(partitions []string) error {
+	for _, partition := range partitions {
+		if !isKnownPartition(partition) {
+			return fmt.Errorf("unknown partition %q, must be one of %s", partition, strings.Join(DefaultPartitions, ", "))
+		}
+	}
+	return nil
+}
+
+func isKnownPartition(partition string) bool {
+	for _, known := range DefaultPartitions {
+		if partition == known {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRoleARN returns an error if arn is not an IAM role ARN in one of the
+// allowed partitions, eg. arn:aws:iam::111122223333:role/s3-reader
+func validateRoleARN(arn string, allowedPartitions []string) error {
+	// arn:partition:service:region:account-id:resource
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return fmt.Errorf("malformed ARN %q", arn)
+	}
+	partition, service, region, account, resource := parts[1], parts[2], parts[3], parts[4], parts[5]
+	allowed := false
+	for _, p := range allowedPartitions {
+		allowed = allowed || p == partition
+	}
+	if !allowed {
+		return fmt.Errorf("partition %q of ARN %q is not allowed", partition, arn)
+	}
+	if service != "iam" {
+		return fmt.Errorf("service of ARN %q must be iam", arn)
+	}
+	if region != "" {
+		return fmt.Errorf("ARN %q must not have a region", arn)
+	}
+	if !isAccountID(account) {
+		return fmt.Errorf("ARN %q has an invalid account ID %q", arn, account)
+	}
+	if !strings.HasPrefix(resource, "role/") || strings.HasSuffix(resource, "/") {
+		return fmt.Errorf("ARN %q is not a role", arn)
+	}
+	return nil
+}
+
+// isAccountID returns true if id is a 12 digit AWS account ID
+func isAccountID(id string) bool {
+	if len(id) != 12 {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// roleARNTemplateData is the data a role ARN template is rendered with
+type roleARNTemplateData struct {
+	AccountID      string
+	Namespace      string
+	ServiceAccount string
+	RoleName       string
+}
+
+// ParseRoleARNTemplate parses a role ARN template, eg.
+// arn:aws:iam::{{.AccountID}}:role/{{.Namespace}}-{{.ServiceAccount}}. The
+// template can use the AccountID, Namespace, ServiceAccount, and RoleName
+// fields.
+func ParseRoleARNTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("role-arn").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// Catch references to unknown fields at startup rather than admission
+	if err := tmpl.Execute(&bytes.Buffer{}, roleARNTemplateData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// roleARNAllowed returns true if roleARN matches any of the glob patterns. A *
+// matches any characters, including the / of role paths, and a ? matches a
+// single character.
+func roleARNAllowed(roleARN string, patterns []string) bool {
+	for _, pattern := range patterns {
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.Replace(expr, `\*`, ".*", -1)
+		expr = strings.Replace(expr, `\?`, ".", -1)
+		if regexp.MustCompile("^" + expr + "$").MatchString(roleARN) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderRoleARN renders the role ARN template of the modifier for a role name
+func (m *Modifier) renderRoleARN(roleName, serviceAccount, namespace string) (string, error) {
+	if m.RoleARNTemplate == nil {
+		return "", fmt.Errorf("role name %q given but no role ARN template is configured", roleName)
+	}
+	var buf bytes.Buffer
+	err := m.RoleARNTemplate.Execute(&buf, roleARNTemplateData{
+		AccountID:      m.AccountID,
+		Namespace:      namespace,
+		ServiceAccount: serviceAccount,
+		RoleName:       roleName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error rendering role ARN template for role name %q: %v", roleName, err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,89 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// configVolumeName is the name of the volume holding the generated AWS
+	// config file of chained roles
+	configVolumeName = "aws-iam-config"
+	// configFileName is the file name of the generated AWS config file
+	configFileName = "config"
+	// webIdentityProfile is the profile of the generated AWS config file
+	// assuming the base role with the injected token
+	webIdentityProfile = "web-identity"
+)
+
+// awsConfig returns a shared AWS config file whose default profile assumes
+// chainedRoleARN with the credentials of baseRoleARN, which is assumed with
+// the web identity token at tokenFilePath
+func awsConfig(baseRoleARN, chainedRoleARN, tokenFilePath string) string {
+	return fmt.Sprintf(`[profile %s]
+role_arn = %s
+web_identity_token_file = %s
+
+[default]
+role_arn = %s
+source_profile = %s
+`, webIdentityProfile, baseRoleARN, tokenFilePath, chainedRoleARN, webIdentityProfile)
+}
+
+// configAnnotation returns the pod annotation the generated AWS config file is
+// stored in
+func (m *Modifier) configAnnotation() string {
+	return m.AnnotationDomain + "/aws-config"
+}
+
+// configMountPath returns the directory the AWS config file is mounted in, next
+// to the token mount path
+func configMountPath(mountPath string) string {
+	return path.Join(path.Dir(mountPath), "aws-config")
+}
+
+// configVolume returns a projected volume exposing the config annotation of the
+// pod as a file. Projected volumes can't hold arbitrary content, so the config
+// is stored on the pod and projected with the downward API.
+func (m *Modifier) configVolume(fileMode *int32) corev1.Volume {
+	return corev1.Volume{
+		Name: configVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				DefaultMode: fileMode,
+				Sources: []corev1.VolumeProjection{
+					corev1.VolumeProjection{
+						DownwardAPI: &corev1.DownwardAPIProjection{
+							Items: []corev1.DownwardAPIVolumeFile{
+								{
+									Path: configFileName,
+									FieldRef: &corev1.ObjectFieldSelector{
+										APIVersion: "v1",
+										FieldPath:  fmt.Sprintf("metadata.annotations['%s']", m.configAnnotation()),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
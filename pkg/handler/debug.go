@@ -0,0 +1,134 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/amazon-eks-pod-identity-webhook/pkg/cache"
+	"k8s.io/klog"
+)
+
+// debugCacheLimit is the maximum number of service accounts listed by
+// /debug/cache, the response is truncated beyond it
+const debugCacheLimit = 1000
+
+// Sources of the service accounts listed by /debug/cache
+const (
+	debugSourceAnnotation = "annotation"
+	debugSourceConfigMap  = "configmap"
+)
+
+// debugCacheEntry is the settings of a service account listed by
+// /debug/cache
+type debugCacheEntry struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	RoleARN   string `json:"roleARN,omitempty"`
+	Audience  string `json:"audience,omitempty"`
+	// TokenExpiration is the token expiration of the service account, or the
+	// default, clamped to the configured bounds
+	TokenExpiration int64  `json:"tokenExpiration"`
+	Source          string `json:"source"`
+}
+
+type debugCacheResponse struct {
+	ServiceAccounts []debugCacheEntry `json:"serviceAccounts"`
+	// Truncated is true if service accounts beyond the limit are missing
+	Truncated bool `json:"truncated"`
+}
+
+// HandleDebugCache lists the cached service accounts and ConfigMap mappings
+// with their settings as JSON, filtered to the namespace query parameter if
+// set. At most the limit query parameter or 1000 service accounts are listed.
+// It is meant for the internal metrics port, it has no authentication.
+func (m *Modifier) HandleDebugCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "invalid method, expect GET", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := debugCacheLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "invalid limit, must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if parsed < limit {
+			limit = parsed
+		}
+	}
+	namespace := r.URL.Query().Get("namespace")
+
+	defaults := m.defaults()
+	resp := debugCacheResponse{ServiceAccounts: []debugCacheEntry{}}
+	add := func(source string, accounts []cache.CachedServiceAccount) {
+		for _, sa := range accounts {
+			if len(resp.ServiceAccounts) == limit {
+				resp.Truncated = true
+				return
+			}
+			audience := sa.Settings.Audience
+			if sa.Settings.DefaultAudience && defaults.TokenAudience != "" {
+				audience = defaults.TokenAudience
+			}
+			resp.ServiceAccounts = append(resp.ServiceAccounts, debugCacheEntry{
+				Namespace:       sa.Namespace,
+				Name:            sa.Name,
+				RoleARN:         sa.Settings.RoleARN,
+				Audience:        audience,
+				TokenExpiration: m.clampedExpiration(sa.Settings.TokenExpiration, defaults.TokenExpiration),
+				Source:          source,
+			})
+		}
+	}
+	if m.Cache != nil {
+		add(debugSourceAnnotation, m.Cache.List(namespace))
+	}
+	if m.ConfigMapCache != nil {
+		add(debugSourceConfigMap, m.ConfigMapCache.List(namespace))
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		klog.Errorf("Can't write response: %v", err)
+	}
+}
+
+// clampedExpiration returns the token expiration for an annotated value, or
+// the default if the annotation is unset, clamped to the configured bounds
+// like tokenExpiration without counting or warning
+func (m *Modifier) clampedExpiration(annotated, defaultExpiration int64) int64 {
+	expiration := annotated
+	if expiration == 0 {
+		expiration = defaultExpiration
+	}
+	if expiration < m.MinExpiration {
+		return m.MinExpiration
+	}
+	if m.MaxExpiration > 0 && expiration > m.MaxExpiration {
+		return m.MaxExpiration
+	}
+	return expiration
+}
@@ -0,0 +1,75 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// Reasons of the admission errors, set on the status of their responses and
+// labeling the admission error metric
+const (
+	// reasonUndecodableReview is the reason of request bodies that are not an
+	// AdmissionReview
+	reasonUndecodableReview metav1.StatusReason = "UndecodableReview"
+	// reasonUnsupportedReviewVersion is the reason of AdmissionReviews of an
+	// unsupported version
+	reasonUnsupportedReviewVersion metav1.StatusReason = "UnsupportedReviewVersion"
+	// reasonMissingRequest is the reason of AdmissionReviews without a request
+	reasonMissingRequest metav1.StatusReason = "MissingRequest"
+	// reasonUndecodablePod is the reason of pods that can't be decoded
+	reasonUndecodablePod metav1.StatusReason = "UndecodablePod"
+	// reasonUndecodableServiceAccount is the reason of Service Accounts that
+	// can't be decoded
+	reasonUndecodableServiceAccount metav1.StatusReason = "UndecodableServiceAccount"
+	// reasonServiceAccountLookupFailed is the reason of pods whose Service
+	// Account can't be looked up
+	reasonServiceAccountLookupFailed metav1.StatusReason = "ServiceAccountLookupFailed"
+	// reasonServiceAccountLookupTimeout is the reason of pods whose Service
+	// Account lookup was abandoned, because the request timed out or the API
+	// server gave up on it
+	reasonServiceAccountLookupTimeout metav1.StatusReason = "ServiceAccountLookupTimeout"
+	// reasonMutationFailed is the reason of pods whose mutation failed
+	reasonMutationFailed metav1.StatusReason = "MutationFailed"
+	// reasonPatchEncodingFailed is the reason of patches that can't be
+	// encoded
+	reasonPatchEncodingFailed metav1.StatusReason = "PatchEncodingFailed"
+)
+
+// validateFailurePolicy is the failurePolicy of the
+// ValidatingWebhookConfiguration of /validate, independent of the mutating
+// --webhook-failure-policy
+const validateFailurePolicy = FailurePolicyIgnore
+
+// admissionError logs and counts an admission error, and returns its response.
+// Like the API server does for webhooks that can't be called, the request is
+// admitted unchanged with the Ignore failure policy of the endpoint and denied
+// with Fail. The status describes the error either way.
+func admissionError(policy string, reason metav1.StatusReason, code int32, message string) *v1beta1.AdmissionResponse {
+	klog.Errorf("Admission error %s: %s", reason, message)
+	admissionErrorCounter.WithLabelValues(string(reason)).Inc()
+	return &v1beta1.AdmissionResponse{
+		Allowed: policy != FailurePolicyFail,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: message,
+			Reason:  reason,
+			Code:    code,
+		},
+	}
+}
@@ -0,0 +1,72 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// FailurePolicyIgnore admits pods without injection if the webhook can't
+	// be called
+	FailurePolicyIgnore = string(admissionregistrationv1.Ignore)
+	// FailurePolicyFail rejects pods if the webhook can't be called, so no pod
+	// runs without credentials
+	FailurePolicyFail = string(admissionregistrationv1.Fail)
+)
+
+// ValidateFailurePolicy returns an error if policy is not a webhook failure
+// policy
+func ValidateFailurePolicy(policy string) error {
+	switch policy {
+	case FailurePolicyIgnore, FailurePolicyFail:
+		return nil
+	}
+	return fmt.Errorf("invalid failure policy %q, must be %s or %s", policy, FailurePolicyIgnore, FailurePolicyFail)
+}
+
+// CheckFailurePolicyDrift compares the failurePolicy of each webhook of the
+// named MutatingWebhookConfiguration with the expected policy. Webhooks with a
+// different live policy are logged and set the failure policy drift gauge.
+// It returns true if any webhook drifted.
+func CheckFailurePolicyDrift(ctx context.Context, clientset kubernetes.Interface, name, policy string) (bool, error) {
+	config, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("error fetching mutating webhook configuration %s: %v", name, err)
+	}
+	drifted := false
+	for _, webhook := range config.Webhooks {
+		// The API server defaults the failure policy of v1 webhooks to Fail
+		live := FailurePolicyFail
+		if webhook.FailurePolicy != nil {
+			live = string(*webhook.FailurePolicy)
+		}
+		if live != policy {
+			klog.Warningf("Webhook %s of mutating webhook configuration %s has failure policy %s, expected %s", webhook.Name, name, live, policy)
+			failurePolicyDriftGauge.WithLabelValues(webhook.Name).Set(1)
+			drifted = true
+			continue
+		}
+		failurePolicyDriftGauge.WithLabelValues(webhook.Name).Set(0)
+	}
+	return drifted, nil
+}
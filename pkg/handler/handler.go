@@ -16,28 +16,37 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
-	"path/filepath"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/aws/amazon-eks-pod-identity-webhook/pkg/cache"
 	"k8s.io/api/admission/v1beta1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
-	"k8s.io/kubernetes/pkg/apis/core/v1"
 )
 
 func init() {
 	_ = corev1.AddToScheme(runtimeScheme)
 	_ = admissionregistrationv1beta1.AddToScheme(runtimeScheme)
-	_ = v1.AddToScheme(runtimeScheme)
 }
 
 var (
@@ -46,6 +55,61 @@ var (
 	deserializer  = codecs.UniversalDeserializer()
 )
 
+// admissionReviewVersions are the supported AdmissionReview versions. Both
+// versions have the same schema, so requests of either are decoded into the
+// v1beta1 types.
+var admissionReviewVersions = []string{admissionReviewV1, "admission.k8s.io/v1beta1"}
+
+// admissionReviewV1 is the AdmissionReview version supporting warnings
+const admissionReviewV1 = "admission.k8s.io/v1"
+
+// admissionReviewVersion returns the version of an AdmissionReview. Reviews
+// without an apiVersion are v1beta1, like the API server used to send.
+func admissionReviewVersion(typeMeta metav1.TypeMeta) string {
+	if typeMeta.APIVersion == "" {
+		return v1beta1.SchemeGroupVersion.String()
+	}
+	return typeMeta.APIVersion
+}
+
+// validateAdmissionReviewVersion returns an error if the AdmissionReview is not
+// of a supported version
+func validateAdmissionReviewVersion(typeMeta metav1.TypeMeta) error {
+	version := admissionReviewVersion(typeMeta)
+	for _, supported := range admissionReviewVersions {
+		if version == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported AdmissionReview version %q, must be one of %s", version, strings.Join(admissionReviewVersions, ", "))
+}
+
+// DefaultMaxRequestBytes is the default size limit of admission request
+// bodies. An AdmissionReview of an update holds the object and the old object,
+// each of up to about 3MiB.
+const DefaultMaxRequestBytes = 7 << 20
+
+// ValidateMaxRequestBytes returns an error if limit is not a positive size
+func ValidateMaxRequestBytes(limit int64) error {
+	if limit <= 0 {
+		return fmt.Errorf("request size limit must be positive, got %d", limit)
+	}
+	return nil
+}
+
+// DefaultInternalTimeout is the default deadline of admission requests, below
+// the 10s default timeoutSeconds of webhooks so the response is sent before
+// the API server abandons the request
+const DefaultInternalTimeout = 9 * time.Second
+
+// ValidateInternalTimeout returns an error if timeout is negative
+func ValidateInternalTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("internal timeout must not be negative, got %s", timeout)
+	}
+	return nil
+}
+
 // ModifierOpt is an option type for setting up a Modifier
 type ModifierOpt func(*Modifier)
 
@@ -54,6 +118,24 @@ func WithServiceAccountCache(c cache.ServiceAccountCache) ModifierOpt {
 	return func(m *Modifier) { m.Cache = c }
 }
 
+// WithNamespaceCache sets the modifiers namespace cache used for namespace
+// level defaults. Namespace defaults are disabled if no cache is set.
+func WithNamespaceCache(c cache.NamespaceCache) ModifierOpt {
+	return func(m *Modifier) { m.NamespaceCache = c }
+}
+
+// WithConfigMapCache sets the modifiers configmap cache used as a fallback for
+// service accounts without a role annotation
+func WithConfigMapCache(c cache.ConfigMapCache) ModifierOpt {
+	return func(m *Modifier) { m.ConfigMapCache = c }
+}
+
+// WithDefaultsCache sets the modifiers defaults cache, which overrides the
+// default audience, expiration, mount path, and regional STS setting at runtime
+func WithDefaultsCache(c cache.DefaultsCache) ModifierOpt {
+	return func(m *Modifier) { m.Defaults = c }
+}
+
 // WithMountPath sets the modifier mountPath
 func WithMountPath(mountpath string) ModifierOpt {
 	return func(m *Modifier) { m.MountPath = mountpath }
@@ -64,250 +146,2017 @@ func WithExpiration(exp int64) ModifierOpt {
 	return func(m *Modifier) { m.Expiration = exp }
 }
 
+// WithMinExpiration sets the modifier minimum token expiration. The bounds must
+// be validated with ValidateExpirationBounds.
+func WithMinExpiration(exp int64) ModifierOpt {
+	return func(m *Modifier) { m.MinExpiration = exp }
+}
+
+// WithMaxExpiration sets the modifier maximum token expiration
+func WithMaxExpiration(exp int64) ModifierOpt {
+	return func(m *Modifier) { m.MaxExpiration = exp }
+}
+
+// WithWindowsMountPath sets the modifier mount path for windows pods. The path
+// must be validated with ValidateWindowsMountPath.
+func WithWindowsMountPath(mountpath string) ModifierOpt {
+	return func(m *Modifier) { m.WindowsMountPath = mountpath }
+}
+
+// WithDefaultFSGroup sets the fsGroup defaulted for pods without one. A nil
+// fsGroup disables defaulting.
+func WithDefaultFSGroup(fsGroup *int64) ModifierOpt {
+	return func(m *Modifier) { m.DefaultFSGroup = fsGroup }
+}
+
+// WithTokenFileMode sets the defaultMode of the token volumes. A nil mode uses
+// the Kubernetes default.
+func WithTokenFileMode(mode *int32) ModifierOpt {
+	return func(m *Modifier) { m.TokenFileMode = mode }
+}
+
+// WithRegionalSTS sets whether regional STS is used by default
+func WithRegionalSTS(regionalSTS bool) ModifierOpt {
+	return func(m *Modifier) { m.RegionalSTS = regionalSTS }
+}
+
+// WithDisableIMDSFallback sets whether AWS_EC2_METADATA_DISABLED is injected by
+// default
+func WithDisableIMDSFallback(disable bool) ModifierOpt {
+	return func(m *Modifier) { m.DisableIMDSFallback = disable }
+}
+
+// WithAnnotatePods sets whether mutated pods are annotated with the injected
+// role ARN and audience
+func WithAnnotatePods(annotate bool) ModifierOpt {
+	return func(m *Modifier) { m.AnnotatePods = annotate }
+}
+
+// WithTokenVolumeName sets the name of the injected token volume
+func WithTokenVolumeName(name string) ModifierOpt {
+	return func(m *Modifier) { m.volName = name }
+}
+
+// WithSkipNamespaces sets the namespaces, or glob patterns of namespaces, whose
+// pods are never mutated. The patterns must be validated with
+// ValidateNamespacePatterns.
+func WithSkipNamespaces(namespaces []string) ModifierOpt {
+	return func(m *Modifier) { m.SkipNamespaces = namespaces }
+}
+
+// WithExcludePodSelector sets the label selector of pods that are never mutated
+func WithExcludePodSelector(selector labels.Selector) ModifierOpt {
+	return func(m *Modifier) { m.ExcludePodSelector = selector }
+}
+
+// WithSkipOwnerKinds sets the owner kinds, eg. DaemonSet, whose pods are never
+// mutated
+func WithSkipOwnerKinds(kinds []string) ModifierOpt {
+	return func(m *Modifier) { m.SkipOwnerKinds = kinds }
+}
+
+// WithRespectAutomountDisabled sets whether pods with automountServiceAccountToken
+// disabled, on the pod or its service account, are injected without a token
+func WithRespectAutomountDisabled(respect bool) ModifierOpt {
+	return func(m *Modifier) { m.RespectAutomountDisabled = respect }
+}
+
+// WithAudienceOnlyInjection sets whether service accounts with an audience but
+// no role get a token without the AWS env vars
+func WithAudienceOnlyInjection(enabled bool) ModifierOpt {
+	return func(m *Modifier) { m.AudienceOnlyInjection = enabled }
+}
+
+// WithTokenEnvName sets the env var pointing at the token of audience only
+// injections
+func WithTokenEnvName(name string) ModifierOpt {
+	return func(m *Modifier) { m.TokenEnvName = name }
+}
+
+// WithNamespaceDefaults sets whether the default-role-arn and default-audience
+// annotations of namespaces in the namespace cache are used
+func WithNamespaceDefaults(enabled bool) ModifierOpt {
+	return func(m *Modifier) { m.NamespaceDefaults = enabled }
+}
+
+// WithDenyOnPolicyViolation sets whether pods with roles not allowed by their
+// namespace are denied instead of admitted without injection
+func WithDenyOnPolicyViolation(deny bool) ModifierOpt {
+	return func(m *Modifier) { m.DenyOnPolicyViolation = deny }
+}
+
+// WithDenyOnDeletedSA sets whether pods whose Service Account doesn't exist,
+// eg. because it was deleted along with its role, are denied instead of
+// admitted without injection
+func WithDenyOnDeletedSA(deny bool) ModifierOpt {
+	return func(m *Modifier) { m.DenyOnDeletedSA = deny }
+}
+
+// WithValidationMode sets whether Service Accounts with invalid annotations are
+// denied or admitted with warnings by the validating webhook
+func WithValidationMode(mode string) ModifierOpt {
+	return func(m *Modifier) { m.ValidationMode = mode }
+}
+
+// WithMutateEphemeralContainers sets whether ephemeral containers added
+// through the pods/ephemeralcontainers subresource are injected
+func WithMutateEphemeralContainers(mutate bool) ModifierOpt {
+	return func(m *Modifier) { m.MutateEphemeralContainers = mutate }
+}
+
+// WithSALookupFailurePolicy sets whether pods are admitted without injection,
+// retried, or denied when their Service Account can't be looked up
+func WithSALookupFailurePolicy(policy string) ModifierOpt {
+	return func(m *Modifier) { m.SALookupFailurePolicy = policy }
+}
+
+// WithFailurePolicy sets whether requests failing with an internal error are
+// admitted unchanged, with Ignore, or denied, with Fail
+func WithFailurePolicy(policy string) ModifierOpt {
+	return func(m *Modifier) { m.FailurePolicy = policy }
+}
+
+// WithMaxRequestBytes sets the size limit of admission request bodies
+func WithMaxRequestBytes(limit int64) ModifierOpt {
+	return func(m *Modifier) { m.MaxRequestBytes = limit }
+}
+
+// WithInternalTimeout sets the deadline of admission requests, including their
+// Service Account lookups, 0 for none. Set it below the timeoutSeconds of the
+// webhook, so pods are handled by the lookup failure policy before the API
+// server applies the failure policy of the webhook.
+func WithInternalTimeout(timeout time.Duration) ModifierOpt {
+	return func(m *Modifier) { m.InternalTimeout = timeout }
+}
+
+// WithTokenAudience sets the token audience of Service Accounts without an
+// audience annotation passed to MutatePod
+func WithTokenAudience(audience string) ModifierOpt {
+	return func(m *Modifier) { m.TokenAudience = audience }
+}
+
 // WithRegion sets the modifier region
 func WithRegion(region string) ModifierOpt {
 	return func(m *Modifier) { m.Region = region }
 }
 
+// WithAnnotationDomain sets the modifier annotation domain used for pod annotations
+func WithAnnotationDomain(domain string) ModifierOpt {
+	return func(m *Modifier) { m.AnnotationDomain = domain }
+}
+
+// WithPodAnnotationOverride allows the role-arn annotation on a pod to override
+// the role of the pod's service account
+func WithPodAnnotationOverride(allow bool) ModifierOpt {
+	return func(m *Modifier) { m.AllowPodAnnotationOverride = allow }
+}
+
+// WithLenientBooleanAnnotations accepts yes, no, on, and off values of boolean
+// pod and Service Account annotations
+func WithLenientBooleanAnnotations(lenient bool) ModifierOpt {
+	return func(m *Modifier) { m.LenientBooleanAnnotations = lenient }
+}
+
+// WithSTSEndpoint sets the modifier STS endpoint URL. The endpoint must be
+// validated with ValidateSTSEndpointURL.
+func WithSTSEndpoint(endpoint string) ModifierOpt {
+	return func(m *Modifier) { m.STSEndpoint = endpoint }
+}
+
+// WithInsecureSTSEndpoint allows http STS endpoint URLs
+func WithInsecureSTSEndpoint(allow bool) ModifierOpt {
+	return func(m *Modifier) { m.AllowInsecureSTSEndpoint = allow }
+}
+
+// WithAllowedPartitions sets the partitions role ARNs are accepted in. The
+// partitions must be validated with ValidatePartitions.
+func WithAllowedPartitions(partitions []string) ModifierOpt {
+	return func(m *Modifier) { m.AllowedPartitions = partitions }
+}
+
+// WithRoleARNTemplate sets the template used to build role ARNs from role
+// names. The template must be parsed with ParseRoleARNTemplate.
+func WithRoleARNTemplate(tmpl *template.Template) ModifierOpt {
+	return func(m *Modifier) { m.RoleARNTemplate = tmpl }
+}
+
+// WithAccountID sets the account ID role ARN templates are rendered with
+func WithAccountID(accountID string) ModifierOpt {
+	return func(m *Modifier) { m.AccountID = accountID }
+}
+
+// WithContainerCredentialsURI sets the credentials agent URI injected into pods
+// using container credentials. An empty URI disables container credentials.
+func WithContainerCredentialsURI(uri string) ModifierOpt {
+	return func(m *Modifier) { m.ContainerCredentialsURI = uri }
+}
+
+// WithContainerCredentialsAudience sets the token audience of pods using
+// container credentials
+func WithContainerCredentialsAudience(audience string) ModifierOpt {
+	return func(m *Modifier) { m.ContainerCredentialsAudience = audience }
+}
+
 // NewModifier returns a Modifier with default values
 func NewModifier(opts ...ModifierOpt) *Modifier {
 
 	mod := &Modifier{
-		MountPath:  "/var/run/secrets/eks.amazonaws.com/serviceaccount",
-		Expiration: 86400,
-		volName:    "aws-iam-token",
-		tokenName:  "token",
+		AnnotationDomain:             "eks.amazonaws.com",
+		MountPath:                    "/var/run/secrets/eks.amazonaws.com/serviceaccount",
+		Expiration:                   86400,
+		MinExpiration:                minTokenExpiration,
+		MaxExpiration:                86400,
+		AllowedPartitions:            DefaultPartitions,
+		ContainerCredentialsURI:      DefaultContainerCredentialsURI,
+		ContainerCredentialsAudience: DefaultContainerCredentialsAudience,
+		TokenEnvName:                 DefaultTokenEnvName,
+		TokenAudience:                "sts.amazonaws.com",
+		ValidationMode:               ValidationModeDeny,
+		MaxRequestBytes:              DefaultMaxRequestBytes,
+		InternalTimeout:              DefaultInternalTimeout,
+		SALookupFailurePolicy:        SALookupFailurePolicyAllow,
+		FailurePolicy:                FailurePolicyIgnore,
+		volName:                      "aws-iam-token",
+		tokenName:                    "token",
 	}
 	for _, opt := range opts {
 		opt(mod)
 	}
+	if mod.SAGetter == nil && mod.clientset != nil {
+		mod.SAGetter = cache.NewAPILookup(mod.TokenAudience, mod.AnnotationDomain, mod.clientset,
+			cache.WithLenientBooleans(mod.LenientBooleanAnnotations))
+	}
 
 	return mod
 }
 
 // Modifier holds configuration values for pod modifications
 type Modifier struct {
-	Expiration int64
-	MountPath  string
-	Region     string
-	Cache      cache.ServiceAccountCache
-	volName    string
-	tokenName  string
+	AnnotationDomain           string
+	AllowPodAnnotationOverride bool
+	LenientBooleanAnnotations  bool
+	Expiration                 int64
+	MinExpiration              int64
+	MaxExpiration              int64
+	MountPath                  string
+	WindowsMountPath           string
+	DefaultFSGroup             *int64
+	TokenFileMode              *int32
+	Region                     string
+	RegionalSTS                bool
+	DisableIMDSFallback        bool
+	AnnotatePods               bool
+	SkipNamespaces             []string
+	SkipOwnerKinds             []string
+	ExcludePodSelector         labels.Selector
+	RespectAutomountDisabled   bool
+	AudienceOnlyInjection      bool
+	TokenEnvName               string
+	TokenAudience              string
+	NamespaceDefaults          bool
+	DenyOnPolicyViolation      bool
+	DenyOnDeletedSA            bool
+	ValidationMode             string
+	MutateEphemeralContainers  bool
+	SALookupFailurePolicy      string
+	FailurePolicy              string
+	MaxRequestBytes            int64
+	STSEndpoint                string
+	AllowInsecureSTSEndpoint   bool
+	AllowedPartitions          []string
+	RoleARNTemplate            *template.Template
+	AccountID                  string
+	ContainerCredentialsURI    string
+	// ContainerCredentialsAudience is the token audience of pods using
+	// container credentials
+	ContainerCredentialsAudience string
+	Cache                        cache.ServiceAccountCache
+	NamespaceCache               cache.NamespaceCache
+	ConfigMapCache               cache.ConfigMapCache
+	Defaults                     cache.DefaultsCache
+	volName                      string
+	tokenName                    string
+	// SAGetter looks up the Service Accounts of admitted pods instead of
+	// Cache if set
+	SAGetter SAGetter
+	// clientset builds the SAGetter fetching Service Accounts from the API
+	// server, set by WithClientset
+	clientset kubernetes.Interface
+	// InternalTimeout is the deadline of admission requests, 0 for none
+	InternalTimeout time.Duration
+}
+
+// ValidateSTSEndpointURL returns an error if endpoint is not a well-formed
+// https URL, or http URL if allowInsecure is set
+func ValidateSTSEndpointURL(endpoint string, allowInsecure bool) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid STS endpoint URL %q: %v", endpoint, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid STS endpoint URL %q: missing host", endpoint)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if allowInsecure {
+			return nil
+		}
+		return fmt.Errorf("invalid STS endpoint URL %q: http endpoints are not allowed", endpoint)
+	}
+	return fmt.Errorf("invalid STS endpoint URL %q: scheme must be https", endpoint)
+}
+
+const (
+	// DefaultContainerCredentialsURI is the URI of the node-local EKS Pod
+	// Identity Agent
+	DefaultContainerCredentialsURI = "http://169.254.170.23/v1/credentials"
+	// DefaultContainerCredentialsAudience is the token audience expected by
+	// the EKS Pod Identity Agent
+	DefaultContainerCredentialsAudience = "pods.eks.amazonaws.com"
+	// DefaultTokenEnvName is the env var pointing at the token of audience
+	// only injections
+	DefaultTokenEnvName = "OIDC_TOKEN_FILE"
+)
+
+// ParseFileMode parses an octal file mode such as "0400" or "0640"
+func ParseFileMode(mode string) (int32, error) {
+	value, err := strconv.ParseInt(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q: must be an octal number", mode)
+	}
+	if value < 0 || value > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q: must be between 0000 and 0777", mode)
+	}
+	return int32(value), nil
+}
+
+// minTokenExpiration is the minimum expiration the kubelet accepts for a
+// projected service account token
+const minTokenExpiration int64 = 600
+
+// ValidateExpirationBounds returns an error if the token expiration bounds are
+// below the kubelet minimum or the minimum exceeds the maximum
+func ValidateExpirationBounds(min, max int64) error {
+	if min < minTokenExpiration {
+		return fmt.Errorf("minimum token expiration %d is below the kubelet minimum of %d seconds", min, minTokenExpiration)
+	}
+	if max < min {
+		return fmt.Errorf("maximum token expiration %d is below the minimum token expiration %d", max, min)
+	}
+	return nil
+}
+
+// podUpdateSettings holds the resolved settings for mutating a single pod
+type podUpdateSettings struct {
+	roleName    string
+	audience    string
+	regionalSTS bool
+	expiration  int64
+	mountPath   string
+	stsEndpoint string
+	// forceEnvOverride replaces container defined role, token file, and
+	// regional STS env vars
+	forceEnvOverride bool
+	// containerRoles maps container names to roles used instead of roleName
+	containerRoles map[string]string
+	// annotatedMountPath is true if mountPath is set by the service account
+	annotatedMountPath bool
+	// tokenFileName overrides the token file name if set
+	tokenFileName string
+	// fsGroup is the fsGroup defaulted for pods without one, if set
+	fsGroup *int64
+	// fileMode is the defaultMode of the token volumes, if set
+	fileMode *int32
+	// containerCredentials injects the container credentials env vars
+	// instead of the web identity env vars
+	containerCredentials bool
+	// disableIMDSFallback injects AWS_EC2_METADATA_DISABLED so SDKs don't fall
+	// back to the node role
+	disableIMDSFallback bool
+	// audienceOnly injects the token with the generic token env var instead of
+	// the AWS env vars
+	audienceOnly bool
+	// skipToken skips the token volume and token file env var, only the role
+	// env vars are injected
+	skipToken bool
+	// extraMountPath is an additional path the token volume is mounted at, if
+	// set
+	extraMountPath string
+	// chainedRoleARN is assumed with the credentials of roleName through a
+	// generated AWS config file, if set
+	chainedRoleARN string
+	// configFilePath is the path of the generated AWS config file
+	configFilePath string
+	// ephemeralContainers are the names of the ephemeral containers added by
+	// a pods/ephemeralcontainers request. If set only they are injected, and
+	// the rest of the pod is left unchanged.
+	ephemeralContainers map[string]bool
+	// dryRun is the dry_run metric label of the admission request
+	dryRun string
+}
+
+// defaults returns the current defaults of the modifier. Without a defaults
+// cache the token audience is empty, the service account cache resolves it.
+func (m *Modifier) defaults() cache.Defaults {
+	if m.Defaults != nil {
+		return m.Defaults.Get()
+	}
+	return cache.Defaults{
+		TokenExpiration: m.Expiration,
+		MountPath:       m.MountPath,
+		RegionalSTS:     m.RegionalSTS,
+	}
+}
+
+// tokenExpiration returns the token expiration for an annotated value, or the
+// default expiration if the annotation is unset, clamped to the configured
+// bounds. A warning is returned if the expiration was clamped.
+func (m *Modifier) tokenExpiration(annotated, defaultExpiration int64) (int64, string) {
+	expiration, source := annotated, "token-expiration annotation"
+	if annotated == 0 {
+		expiration, source = defaultExpiration, "default token expiration"
+	}
+	if expiration < m.MinExpiration {
+		tokenExpirationClampedCounter.WithLabelValues("min").Inc()
+		return m.MinExpiration, fmt.Sprintf("%s of %ds is below the minimum of %ds, using %ds",
+			source, expiration, m.MinExpiration, m.MinExpiration)
+	}
+	if m.MaxExpiration > 0 && expiration > m.MaxExpiration {
+		tokenExpirationClampedCounter.WithLabelValues("max").Inc()
+		return m.MaxExpiration, fmt.Sprintf("%s of %ds is above the maximum of %ds, using %ds",
+			source, expiration, m.MaxExpiration, m.MaxExpiration)
+	}
+	return expiration, ""
 }
 
-type patchOperation struct {
-	Op    string      `json:"op"`
-	Path  string      `json:"path"`
-	Value interface{} `json:"value,omitempty"`
+// podAnnotation returns the trimmed value of a pod annotation with the
+// annotation domain
+func (m *Modifier) podAnnotation(pod *corev1.Pod, name string) (string, bool) {
+	return cache.AnnotationValue(pod.Annotations, m.AnnotationDomain+"/"+name)
 }
 
-func addEnvToContainer(container *corev1.Container, mountPath, tokenFilePath, volName, roleName, region string) {
-	var skipReservedKeys, skipRegionKey bool
-	reservedKeys := map[string]string{
-		"AWS_ROLE_ARN":                "",
-		"AWS_WEB_IDENTITY_TOKEN_FILE": "",
+// podAnnotationBool parses a boolean pod annotation. Missing and invalid
+// values are false.
+func (m *Modifier) podAnnotationBool(pod *corev1.Pod, name string) bool {
+	value, ok := m.podAnnotation(pod, name)
+	if !ok {
+		return false
 	}
-	for _, env := range container.Env {
-		if _, ok := reservedKeys[env.Name]; ok {
-			// Skip if any env vars are already present
-			skipReservedKeys = true
+	parsed, ok := cache.ParseBool(value, m.LenientBooleanAnnotations)
+	if !ok {
+		klog.Warningf("Ignoring invalid %s value %q on pod %s", name, value, podName(pod, ""))
+		invalidPodAnnotationCounter.WithLabelValues(name).Inc()
+	}
+	return parsed
+}
+
+// containerRoles parses the container-roles pod annotation, a JSON object
+// mapping container names to role ARNs. A malformed annotation is ignored and
+// invalid role ARNs are dropped.
+func (m *Modifier) containerRoles(pod *corev1.Pod) map[string]string {
+	value, ok := m.podAnnotation(pod, "container-roles")
+	if !ok {
+		return nil
+	}
+	var roles map[string]string
+	if err := json.Unmarshal([]byte(value), &roles); err != nil {
+		klog.Errorf("Ignoring invalid container-roles annotation on pod %s: %v", podName(pod, ""), err)
+		invalidPodAnnotationCounter.WithLabelValues("container-roles").Inc()
+		return nil
+	}
+	// Sorted so invalid entries are logged in the same order every time
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := validateRoleARN(roles[name], m.AllowedPartitions); err != nil {
+			klog.Errorf("Ignoring container-roles entry %s on pod %s: %v", name, podName(pod, ""), err)
+			invalidPodAnnotationCounter.WithLabelValues("container-roles").Inc()
+			delete(roles, name)
+		}
+	}
+	return roles
+}
+
+// containerNameSet parses a comma separated list of container names
+func containerNameSet(value string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names[name] = true
 		}
 	}
+	return names
+}
 
-	for _, vol := range container.VolumeMounts {
-		if vol.Name == volName {
-			// Skip if volume is already present
-			skipReservedKeys = true
+// parseAudiences parses a comma separated list of audiences, dropping empty and
+// duplicate entries while preserving order
+func parseAudiences(value string) []string {
+	audiences := []string{}
+	seen := map[string]bool{}
+	for _, audience := range strings.Split(value, ",") {
+		audience = strings.TrimSpace(audience)
+		if audience != "" && !seen[audience] {
+			seen[audience] = true
+			audiences = append(audiences, audience)
 		}
 	}
+	return audiences
+}
+
+// tokenVolumeName returns the deterministic volume name for the i-th audience
+func (m *Modifier) tokenVolumeName(i int) string {
+	if i == 0 {
+		return m.volName
+	}
+	return fmt.Sprintf("%s-%d", m.volName, i)
+}
 
-	awsRegionKeys := map[string]string{
-		"AWS_REGION":         "",
-		"AWS_DEFAULT_REGION": "",
+// tokenVolumeIndex returns the audience index of a token volume name returned
+// by tokenVolumeName, with or without the -irsa suffix. ok is false for other
+// names.
+func (m *Modifier) tokenVolumeIndex(name string) (i int, ok bool) {
+	name = strings.TrimSuffix(name, "-irsa")
+	if name == m.volName {
+		return 0, true
+	}
+	suffix := strings.TrimPrefix(name, m.volName+"-")
+	if suffix == name {
+		return 0, false
 	}
-	for _, env := range container.Env {
-		if _, ok := awsRegionKeys[env.Name]; ok {
-			// Don't set AWS_DEFAULT_REGION if any awsRegionKeys is already set
-			skipRegionKey = true
+	i, err := strconv.Atoi(suffix)
+	if err != nil || i < 1 || strconv.Itoa(i) != suffix {
+		return 0, false
+	}
+	return i, true
+}
+
+// resolveVolumeName returns the name to inject volume with. If a volume with
+// the same name and token source already exists it is reused. A token volume
+// with a different token source was injected by an earlier invocation with
+// different settings, and is returned to be replaced. Otherwise the name
+// suffixed with -irsa is used. ok is false if both names are taken by other
+// volumes.
+func resolveVolumeName(existing map[string]corev1.Volume, volume corev1.Volume) (name string, reuse, ok bool) {
+	for _, name := range []string{volume.Name, volume.Name + "-irsa"} {
+		vol, exists := existing[name]
+		if !exists {
+			return name, false, true
+		}
+		if sameTokenSource(vol, volume) {
+			return name, true, true
+		}
+		if isTokenVolume(vol) {
+			return name, false, true
 		}
 	}
+	return "", false, false
+}
 
-	if skipReservedKeys && skipRegionKey {
-		return
+// tokenExpirationTolerance is the percentage the expiration of an existing
+// token source may differ from the injected expiration by to be reused
+const tokenExpirationTolerance = 10
+
+// defaultTokenSourceExpiration is the expiration the API server defaults
+// service account token sources without one to
+const defaultTokenSourceExpiration = 3600
+
+// equivalentTokenVolume returns the name of an existing volume of the pod that
+// projects a service account token with the audience and an expiration within
+// tokenExpirationTolerance of expiration, and the path of the token in the
+// volume. Volumes in skip, volumes without the configured fileMode, and volumes
+// a container mounts at another path than mountPath are not reused.
+func equivalentTokenVolume(pod *corev1.Pod, audience string, expiration int64, fileMode *int32, mountPath string, skip map[string]bool) (name, tokenPath string, ok bool) {
+	if audience == "" {
+		return "", "", false
+	}
+	mountedElsewhere := map[string]bool{}
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			for _, mount := range containers[i].VolumeMounts {
+				if path.Clean(mount.MountPath) != path.Clean(mountPath) {
+					mountedElsewhere[mount.Name] = true
+				}
+			}
+		}
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Projected == nil || skip[volume.Name] || mountedElsewhere[volume.Name] {
+			continue
+		}
+		if fileMode != nil && (volume.Projected.DefaultMode == nil || *volume.Projected.DefaultMode != *fileMode) {
+			continue
+		}
+		for _, source := range volume.Projected.Sources {
+			token := source.ServiceAccountToken
+			if token == nil || token.Audience != audience {
+				continue
+			}
+			existing := int64(defaultTokenSourceExpiration)
+			if token.ExpirationSeconds != nil {
+				existing = *token.ExpirationSeconds
+			}
+			diff := existing - expiration
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff*100 <= expiration*tokenExpirationTolerance {
+				return volume.Name, token.Path, true
+			}
+		}
 	}
+	return "", "", false
+}
 
-	env := container.Env
-	if !skipRegionKey && region != "" {
-		env = append(env,
-			corev1.EnvVar{
-				Name:  "AWS_DEFAULT_REGION",
-				Value: region,
-			},
-			corev1.EnvVar{
-				Name:  "AWS_REGION",
-				Value: region,
-			},
-		)
+// isTokenVolume returns true if volume only projects service account tokens,
+// like the volumes injected by the webhook
+func isTokenVolume(volume corev1.Volume) bool {
+	if volume.Projected == nil || len(volume.Projected.Sources) == 0 {
+		return false
+	}
+	for _, source := range volume.Projected.Sources {
+		if source.ServiceAccountToken == nil {
+			return false
+		}
 	}
+	return true
+}
 
-	if !skipReservedKeys {
-		env = append(env, corev1.EnvVar{
-			Name:  "AWS_ROLE_ARN",
-			Value: roleName,
-		})
+// sameTokenSource returns true if both volumes project the same service
+// account tokens. Other fields, like the defaultMode set by the API server, are
+// ignored.
+func sameTokenSource(a, b corev1.Volume) bool {
+	if a.Projected == nil || b.Projected == nil || len(a.Projected.Sources) != len(b.Projected.Sources) {
+		return false
+	}
+	for i := range a.Projected.Sources {
+		if a.Projected.Sources[i].ServiceAccountToken == nil ||
+			!reflect.DeepEqual(a.Projected.Sources[i].ServiceAccountToken, b.Projected.Sources[i].ServiceAccountToken) {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenMountPath returns the mount path for the i-th of n audiences. A single
+// audience is mounted directly at the mount path, multiple audiences are each
+// mounted in a numbered subdirectory.
+func tokenMountPath(mountPath string, i, n int) string {
+	if n == 1 {
+		return mountPath
+	}
+	return path.Join(mountPath, strconv.Itoa(i))
+}
+
+// isWindowsPod returns true if the pod targets windows nodes, by spec.os or by
+// node selector
+func isWindowsPod(pod *corev1.Pod) bool {
+	if pod.Spec.OS != nil && pod.Spec.OS.Name == corev1.Windows {
+		return true
+	}
+	return pod.Spec.NodeSelector["kubernetes.io/os"] == "windows" ||
+		pod.Spec.NodeSelector["beta.kubernetes.io/os"] == "windows"
+}
+
+// windowsPath converts a volumeMount path to the path a windows container
+// sees, eg. /var/run/secrets/eks.amazonaws.com/serviceaccount/token to
+// C:\var\run\secrets\eks.amazonaws.com\serviceaccount\token. Paths with a
+// drive letter keep their drive.
+func windowsPath(p string) string {
+	p = strings.Replace(p, `/`, `\`, -1)
+	if hasDriveLetter(p) {
+		return p
+	}
+	return "C:" + p
+}
+
+// kubernetesPath converts a windows path to the form used in volumeMounts. The
+// system drive C: is implied, other drives are kept.
+// Eg. C:\var\run\secrets to /var/run/secrets
+func kubernetesPath(p string) string {
+	if hasDriveLetter(p) && strings.EqualFold(p[:2], "C:") {
+		p = p[2:]
+	}
+	return strings.Replace(p, `\`, `/`, -1)
+}
+
+func hasDriveLetter(p string) bool {
+	return len(p) >= 2 && p[1] == ':' &&
+		((p[0] >= 'a' && p[0] <= 'z') || (p[0] >= 'A' && p[0] <= 'Z'))
+}
+
+// ValidateWindowsMountPath returns an error if mountPath is not an absolute
+// windows path, eg. C:\var\run\secrets\eks.amazonaws.com\serviceaccount
+func ValidateWindowsMountPath(mountPath string) error {
+	if !hasDriveLetter(mountPath) || len(mountPath) < 3 || mountPath[2] != '\\' {
+		return fmt.Errorf("invalid windows mount path %q: must be an absolute path with a drive letter", mountPath)
+	}
+	if strings.Contains(mountPath, "..") {
+		return fmt.Errorf("invalid windows mount path %q: must not contain '..'", mountPath)
+	}
+	return nil
+}
+
+// automountDisabled returns where token automounting is explicitly disabled for
+// a pod, pod or service-account, or empty if it isn't. The pod field takes
+// precedence over the service account field.
+func automountDisabled(pod *corev1.Pod, saAutomount *bool) string {
+	if pod.Spec.AutomountServiceAccountToken != nil {
+		if !*pod.Spec.AutomountServiceAccountToken {
+			return "pod"
+		}
+		return ""
+	}
+	if saAutomount != nil && !*saAutomount {
+		return "service-account"
+	}
+	return ""
+}
+
+// ValidateNamespacePatterns returns an error if any of patterns is not a valid
+// glob pattern
+func ValidateNamespacePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// skippedOwnerKind returns the first owner kind of the pod in the
+// skip-owner-kinds list, or empty if there is none. Only the owner references
+// of the pod are checked, not the owners of its owners.
+func (m *Modifier) skippedOwnerKind(pod *corev1.Pod) string {
+	for _, owner := range pod.OwnerReferences {
+		for _, kind := range m.SkipOwnerKinds {
+			if strings.EqualFold(owner.Kind, kind) {
+				return owner.Kind
+			}
+		}
+	}
+	return ""
+}
+
+// namespaceSkipped returns true if namespace matches any of the skip-namespaces
+// patterns
+func (m *Modifier) namespaceSkipped(namespace string) bool {
+	for _, pattern := range m.SkipNamespaces {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTokenEnvName returns an error if name is not a valid env var name
+func ValidateTokenEnvName(name string) error {
+	if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+		return fmt.Errorf("invalid token env var name %q: %s", name, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// ValidateTokenVolumeName returns an error if name, or name with the -irsa
+// suffix used on conflicts, is not a valid volume name
+func ValidateTokenVolumeName(name string) error {
+	if errs := validation.IsDNS1123Label(name + "-irsa"); len(errs) > 0 {
+		return fmt.Errorf("invalid token volume name %q: %s", name, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// podResource returns true if the request is for a pod, or the
+// pods/ephemeralcontainers subresource
+func podResource(req *v1beta1.AdmissionRequest) bool {
+	if req.Resource.Group != "" || req.Resource.Version != "v1" || req.Resource.Resource != "pods" {
+		return false
+	}
+	return req.SubResource == "" || req.SubResource == "ephemeralcontainers"
+}
+
+// resourceLabel returns the group/version/resource of a request, with the
+// subresource if set
+func resourceLabel(req *v1beta1.AdmissionRequest) string {
+	return path.Join(req.Resource.Group, req.Resource.Version, req.Resource.Resource, req.SubResource)
+}
+
+// dryRunLabel returns the dry_run metric label of an admission request. Dry
+// run requests are labeled so they can be excluded from alerts.
+func dryRunLabel(req *v1beta1.AdmissionRequest) string {
+	return strconv.FormatBool(req.DryRun != nil && *req.DryRun)
+}
 
-		env = append(env, corev1.EnvVar{
-			Name:  "AWS_WEB_IDENTITY_TOKEN_FILE",
-			Value: tokenFilePath,
+// podName returns the name a pod is logged with. Pods created by controllers
+// have no name at admission time, they are identified by their generateName
+// and owner instead. The admission request UID is included if set.
+func podName(pod *corev1.Pod, uid string) string {
+	name := pod.Namespace + "/" + pod.Name
+	if pod.Name == "" && pod.GenerateName != "" {
+		name = pod.Namespace + "/" + pod.GenerateName + "*"
+	}
+	var details []string
+	if pod.Name == "" {
+		if owner := podOwner(pod); owner != nil {
+			details = append(details, owner.Kind+" "+owner.Name)
+		}
+	}
+	if uid != "" {
+		details = append(details, "request "+uid)
+	}
+	if len(details) > 0 {
+		name += " (" + strings.Join(details, ", ") + ")"
+	}
+	return name
+}
+
+// podOwner returns the controller of a pod, or its first owner if none of its
+// owners is the controller
+func podOwner(pod *corev1.Pod) *metav1.OwnerReference {
+	for i, owner := range pod.OwnerReferences {
+		if owner.Controller != nil && *owner.Controller {
+			return &pod.OwnerReferences[i]
+		}
+	}
+	if len(pod.OwnerReferences) > 0 {
+		return &pod.OwnerReferences[0]
+	}
+	return nil
+}
+
+// mountPathInUse returns true if any container of the pod already mounts a
+// volume at mountPath. The token volumes injected by an earlier invocation are
+// ignored, so reinvocations keep the annotated mount path.
+func (m *Modifier) mountPathInUse(pod *corev1.Pod, mountPath string) bool {
+	tokenVolumes := map[string]bool{}
+	for _, volume := range pod.Spec.Volumes {
+		if _, ok := m.tokenVolumeIndex(volume.Name); ok && isTokenVolume(volume) {
+			tokenVolumes[volume.Name] = true
+		}
+	}
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for _, mount := range container.VolumeMounts {
+			if path.Clean(mount.MountPath) == mountPath && !tokenVolumes[mount.Name] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addEnvToContainer injects the AWS env vars and token volume mounts into a
+// container. Env vars the container already defines, by value or valueFrom,
+// are not overwritten unless settings.forceEnvOverride is set or the container
+// was injected by an earlier invocation, in which case replace operations for
+// the defined role, token file, and regional STS env vars whose values differ
+// are returned. containerPath is the JSON patch path of the container. The token
+// is not mounted if the container defines its own token file env var or
+// already mounts the token volume, a container mounting it only gets the
+// mounts of the other token volumes. With settings.containerCredentials the
+// container credentials env vars are injected instead of the role, token
+// file, and STS env vars.
+func (m *Modifier) addEnvToContainer(container *corev1.Container, containerPath, tokenFilePath string, volumeMounts []corev1.VolumeMount, settings podUpdateSettings) ([]PatchOperation, []string) {
+	// Defined env vars are looked up in the container env, which is short,
+	// instead of indexing it for every container. The env list is only
+	// appended to, so the indexes remain valid after the container is patched.
+	definedEnv := func(name string) bool {
+		for i := range container.Env {
+			if container.Env[i].Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A container mounting the token volume at the token path is already
+	// configured, by its manifest or an earlier invocation, and only gets the
+	// missing env vars. A container mounting it elsewhere was injected by an
+	// earlier invocation with a different mount path, its mount and env vars
+	// are replaced.
+	var replacements []PatchOperation
+	volumeMounted := false
+	mountedAtPath := false
+	staleMount := -1
+	mountedVolumes := map[string]bool{}
+	for i, vol := range container.VolumeMounts {
+		mountedVolumes[vol.Name] = true
+		if len(volumeMounts) > 0 && vol.Name == volumeMounts[0].Name {
+			volumeMounted = true
+			if vol.MountPath == volumeMounts[0].MountPath {
+				mountedAtPath = true
+			} else if staleMount < 0 && path.Clean(vol.MountPath) != settings.extraMountPath {
+				staleMount = i
+			}
+		}
+	}
+	stale := !mountedAtPath && staleMount >= 0
+
+	tokenFileEnv := "AWS_WEB_IDENTITY_TOKEN_FILE"
+	switch {
+	case settings.audienceOnly:
+		tokenFileEnv = m.TokenEnvName
+	case settings.containerCredentials:
+		tokenFileEnv = "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"
+	case settings.chainedRoleARN != "":
+		tokenFileEnv = "AWS_CONFIG_FILE"
+	}
+	// A container defining the token file env var as well was injected by an
+	// earlier invocation, or copied from an injected pod, and its managed env
+	// vars are replaced when their values changed since, such as the role of
+	// a re-annotated service account
+	reinjected := volumeMounted && definedEnv(tokenFileEnv)
+	if stale {
+		replacements = append(replacements, PatchOperation{
+			Op:    "replace",
+			Path:  containerPath + jsonPointer("volumeMounts", strconv.Itoa(staleMount)),
+			Value: volumeMounts[0],
 		})
 	}
 
-	container.Env = env
-	container.VolumeMounts = append(
-		container.VolumeMounts,
-		corev1.VolumeMount{
-			Name:      volName,
-			ReadOnly:  true,
-			MountPath: mountPath,
-		},
-	)
+	// At most 7 env vars are injected
+	env := make([]corev1.EnvVar, 0, 7)
+	addEnv := func(name, value string) {
+		if !definedEnv(name) {
+			env = append(env, corev1.EnvVar{Name: name, Value: value})
+		}
+	}
+	// Env vars of stale and earlier invocations are replaced like overridden
+	// ones, the replacements are only added for values that differ
+	forceEnv := func(name, value string) {
+		if !settings.forceEnvOverride && !stale && !reinjected {
+			addEnv(name, value)
+			return
+		}
+		for i, defined := range container.Env {
+			if defined.Name != name || (defined.Value == value && defined.ValueFrom == nil) {
+				continue
+			}
+			replacements = append(replacements, PatchOperation{
+				Op:    "replace",
+				Path:  containerPath + jsonPointer("env", strconv.Itoa(i)),
+				Value: corev1.EnvVar{Name: name, Value: value},
+			})
+		}
+		addEnv(name, value)
+	}
+
+	// Don't set AWS_DEFAULT_REGION if any region env var is already set
+	if m.Region != "" && !settings.audienceOnly && !definedEnv("AWS_REGION") && !definedEnv("AWS_DEFAULT_REGION") {
+		addEnv("AWS_DEFAULT_REGION", m.Region)
+		addEnv("AWS_REGION", m.Region)
+	}
+
+	if settings.audienceOnly {
+		// Audience only tokens are for other identity providers, no AWS env
+		// vars are injected
+		forceEnv(tokenFileEnv, tokenFilePath)
+	} else if settings.containerCredentials {
+		forceEnv("AWS_CONTAINER_CREDENTIALS_FULL_URI", m.ContainerCredentialsURI)
+		forceEnv(tokenFileEnv, tokenFilePath)
+	} else if settings.chainedRoleARN != "" {
+		// The generated config file references the token, the web identity
+		// env vars would take precedence over it
+		forceEnv(tokenFileEnv, settings.configFilePath)
+		addEnv("AWS_SDK_LOAD_CONFIG", "1")
+
+		if settings.regionalSTS {
+			forceEnv("AWS_STS_REGIONAL_ENDPOINTS", "regional")
+		}
+
+		if settings.stsEndpoint != "" {
+			addEnv("AWS_ENDPOINT_URL_STS", settings.stsEndpoint)
+		}
+	} else {
+		forceEnv("AWS_ROLE_ARN", settings.roleName)
+		if tokenFilePath != "" {
+			forceEnv(tokenFileEnv, tokenFilePath)
+		}
+
+		if settings.regionalSTS {
+			forceEnv("AWS_STS_REGIONAL_ENDPOINTS", "regional")
+		}
+
+		if settings.stsEndpoint != "" {
+			addEnv("AWS_ENDPOINT_URL_STS", settings.stsEndpoint)
+		}
+	}
+
+	// A container defined AWS_EC2_METADATA_DISABLED is never overridden
+	if settings.disableIMDSFallback && !settings.audienceOnly {
+		addEnv("AWS_EC2_METADATA_DISABLED", "true")
+	}
+
+	tokenFileDefined := definedEnv(tokenFileEnv) && !settings.forceEnvOverride
+	mountToken := len(volumeMounts) > 0 && !volumeMounted && !tokenFileDefined
+	// A container mounting the first token volume was injected by an earlier
+	// invocation, possibly with fewer audiences, and only gets the mounts of
+	// the volumes it doesn't mount yet
+	addMounts := volumeMounts
+	if !mountToken {
+		addMounts = nil
+		if volumeMounted {
+			for _, mount := range volumeMounts[1:] {
+				if !mountedVolumes[mount.Name] {
+					addMounts = append(addMounts, mount)
+				}
+			}
+		}
+	}
+	if len(env) == 0 && len(addMounts) == 0 {
+		return replacements, nil
+	}
+
+	container.Env = append(container.Env, env...)
+	var collisions []string
+	if len(addMounts) > 0 {
+		// The mounts are copied once with room for the token and extra
+		// mounts, instead of growing the slice shared with the pod
+		containerMounts := make([]corev1.VolumeMount, len(container.VolumeMounts), len(container.VolumeMounts)+len(addMounts)+1)
+		copy(containerMounts, container.VolumeMounts)
+		container.VolumeMounts = containerMounts
+		extraMountInUse := false
+		mountedPaths := map[string]bool{}
+		for _, mount := range container.VolumeMounts {
+			extraMountInUse = extraMountInUse || path.Clean(mount.MountPath) == settings.extraMountPath
+			mountedPaths[path.Clean(mount.MountPath)] = true
+		}
+		// A duplicate mount path is rejected by the API server, mounts
+		// colliding with a container defined mount are skipped
+		for _, mount := range addMounts {
+			if mountedPaths[path.Clean(mount.MountPath)] {
+				collisions = append(collisions, mount.MountPath)
+				continue
+			}
+			container.VolumeMounts = append(container.VolumeMounts, mount)
+		}
+		// The extra mount shares the first token volume, it is skipped if the
+		// container already mounts a volume at the path
+		if mountToken && settings.extraMountPath != "" {
+			if extraMountInUse || path.Clean(volumeMounts[0].MountPath) == settings.extraMountPath {
+				klog.Infof("Skipping extra token mount of container %s, a volume is already mounted at %s", container.Name, settings.extraMountPath)
+			} else {
+				container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+					Name:      volumeMounts[0].Name,
+					ReadOnly:  true,
+					MountPath: settings.extraMountPath,
+				})
+			}
+		}
+	}
+	return replacements, collisions
 }
 
-func (m *Modifier) updatePodSpec(pod *corev1.Pod, roleName, audience string) []patchOperation {
-	// return early if volume already exists
-	for _, vol := range pod.Spec.Volumes {
-		if vol.Name == m.volName {
-			return nil
+// removeVolumeMounts removes the mounts of the named volumes from container.
+// The mounts are copied instead of modifying the slice shared with the pod.
+func removeVolumeMounts(container *corev1.Container, names map[string]bool) {
+	var mounts []corev1.VolumeMount
+	removed := false
+	for _, mount := range container.VolumeMounts {
+		if names[mount.Name] {
+			removed = true
+			continue
 		}
+		mounts = append(mounts, mount)
 	}
+	if removed {
+		container.VolumeMounts = mounts
+	}
+}
 
-	tokenFilePath := filepath.Join(m.MountPath, m.tokenName)
+// mountCollisionWarnings logs and returns the admission warnings of the token
+// mounts skipped because the container already mounts a volume at their path
+func mountCollisionWarnings(pod *corev1.Pod, containerName string, collisions []string) []string {
+	if len(collisions) == 0 {
+		return nil
+	}
+	mountCollisionCounter.Inc()
+	var warnings []string
+	for _, mountPath := range collisions {
+		warning := fmt.Sprintf("container %s already mounts a volume at %s, the token is not mounted there", containerName, mountPath)
+		klog.Warningf("Skipping token mount of pod %s: %s", podName(pod, ""), warning)
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
 
-	betaNodeSelector, _ := pod.Spec.NodeSelector["beta.kubernetes.io/os"]
-	nodeSelector, _ := pod.Spec.NodeSelector["kubernetes.io/os"]
-	if (betaNodeSelector == "windows") || nodeSelector == "windows" {
-		// Convert the unix file path to a windows file path
-		// Eg. /var/run/secrets/eks.amazonaws.com/serviceaccount/token to
-		//     C:\var\run\secrets\eks.amazonaws.com\serviceaccount\token
-		tokenFilePath = "C:" + strings.Replace(tokenFilePath, `/`, `\`, -1)
+// containerSelector returns a function reporting whether a container should be
+// injected. If the inject-containers annotation is present only the listed
+// containers are injected and the skip-containers annotation is ignored,
+// otherwise all containers not named in skip-containers are injected. Unknown
+// names are ignored. The inject-container-types annotation further restricts
+// injection to init or regular containers.
+func (m *Modifier) containerSelector(pod *corev1.Pod) func(name string) bool {
+	selectName := m.containerNameSelector(pod)
+	initContainers := map[string]bool{}
+	for _, container := range pod.Spec.InitContainers {
+		initContainers[container.Name] = true
+	}
+	switch types := m.injectContainerTypes(pod); types {
+	case "init":
+		return func(name string) bool { return initContainers[name] && selectName(name) }
+	case "regular":
+		return func(name string) bool { return !initContainers[name] && selectName(name) }
 	}
+	return selectName
+}
 
-	var initContainers = []corev1.Container{}
-	for i := range pod.Spec.InitContainers {
-		container := pod.Spec.InitContainers[i]
-		addEnvToContainer(&container, m.MountPath, tokenFilePath, m.volName, roleName, m.Region)
-		initContainers = append(initContainers, container)
+// injectContainerTypes returns the value of the inject-container-types pod
+// annotation: init, regular, or all. Invalid values are ignored.
+func (m *Modifier) injectContainerTypes(pod *corev1.Pod) string {
+	value, ok := m.podAnnotation(pod, "inject-container-types")
+	if !ok {
+		return "all"
 	}
-	var containers = []corev1.Container{}
-	for i := range pod.Spec.Containers {
-		container := pod.Spec.Containers[i]
-		addEnvToContainer(&container, m.MountPath, tokenFilePath, m.volName, roleName, m.Region)
-		containers = append(containers, container)
-	}
-
-	volume := corev1.Volume{
-		m.volName,
-		corev1.VolumeSource{
-			Projected: &corev1.ProjectedVolumeSource{
-				Sources: []corev1.VolumeProjection{
-					corev1.VolumeProjection{
-						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
-							Audience:          audience,
-							ExpirationSeconds: &m.Expiration,
-							Path:              m.tokenName,
+	switch types := strings.ToLower(value); types {
+	case "init", "regular", "all":
+		return types
+	}
+	klog.Warningf("Ignoring invalid inject-container-types value %q on pod %s, must be init, regular, or all", value, podName(pod, ""))
+	invalidPodAnnotationCounter.WithLabelValues("inject-container-types").Inc()
+	return "all"
+}
+
+// containerNameSelector returns a function reporting whether a container should
+// be injected by the inject-containers and skip-containers annotations
+func (m *Modifier) containerNameSelector(pod *corev1.Pod) func(name string) bool {
+	if value, ok := m.podAnnotation(pod, "inject-containers"); ok {
+		injectContainers := containerNameSet(value)
+		found := false
+		for _, container := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+			found = found || injectContainers[container.Name]
+		}
+		if !found {
+			klog.Warningf("inject-containers annotation %q on pod %s matches no containers, not injecting any container", value, podName(pod, ""))
+		}
+		return func(name string) bool { return injectContainers[name] }
+	}
+	skipContainers := containerNameSet(pod.Annotations[m.AnnotationDomain+"/skip-containers"])
+	return func(name string) bool { return !skipContainers[name] }
+}
+
+// updatePodSpec returns the patch injecting the pod and the admission warnings
+// of the injection. The same pod always produces the same patch, operations
+// are emitted in a fixed order: volume replacements, volume removals, added
+// volumes, init containers, containers, annotations in key order, the fsGroup,
+// and the env var replacements of each container in spec order.
+func (m *Modifier) updatePodSpec(pod *corev1.Pod, settings podUpdateSettings) ([]PatchOperation, []string) {
+	existingVolumes := map[string]corev1.Volume{}
+	volumeIndexes := map[string]int{}
+	for i, vol := range pod.Spec.Volumes {
+		existingVolumes[vol.Name] = vol
+		volumeIndexes[vol.Name] = i
+	}
+
+	// Windows pods use the windows mount path, unless the service account
+	// annotates its own mount path
+	mountPath := settings.mountPath
+	if m.WindowsMountPath != "" && !settings.annotatedMountPath && isWindowsPod(pod) {
+		mountPath = kubernetesPath(m.WindowsMountPath)
+	}
+
+	tokenName := m.tokenName
+	if settings.tokenFileName != "" {
+		tokenName = settings.tokenFileName
+	}
+
+	// Each audience gets its own projected token volume, the first audience
+	// is used for AWS_WEB_IDENTITY_TOKEN_FILE
+	audiences := parseAudiences(settings.audience)
+	if len(audiences) == 0 {
+		audiences = []string{settings.audience}
+	}
+	var volumes []corev1.Volume
+	// staleVolumes replace token volumes of earlier invocations by index
+	var staleVolumes []PatchOperation
+	var volumeMounts []corev1.VolumeMount
+	// Pods with automounting disabled only get the role env vars
+	if settings.skipToken {
+		audiences = nil
+	}
+	// tokenFileName is the token file of the first volume, which differs from
+	// tokenName if an existing volume is reused
+	tokenFileName := tokenName
+	// Volumes of earlier invocations are matched exactly by resolveVolumeName,
+	// so they are replaced when the settings change
+	skipVolumes := map[string]bool{}
+	for i := range audiences {
+		skipVolumes[m.tokenVolumeName(i)] = true
+		skipVolumes[m.tokenVolumeName(i)+"-irsa"] = true
+	}
+	// Token volumes of audiences dropped since an earlier invocation are
+	// removed with their mounts, in reverse order so the indexes remain valid
+	removedVolumes := map[string]bool{}
+	var volumeRemovals []PatchOperation
+	for i := len(pod.Spec.Volumes) - 1; i >= 0 && len(audiences) > 0; i-- {
+		vol := pod.Spec.Volumes[i]
+		if index, ok := m.tokenVolumeIndex(vol.Name); ok && index >= len(audiences) && isTokenVolume(vol) {
+			klog.V(4).Infof("Removing volume %s of pod %s, its audience is no longer injected", vol.Name, podName(pod, ""))
+			removedVolumes[vol.Name] = true
+			skipVolumes[vol.Name] = true
+			volumeRemovals = append(volumeRemovals, PatchOperation{
+				Op:   "remove",
+				Path: jsonPointer("spec", "volumes", strconv.Itoa(i)),
+			})
+		}
+	}
+	for i, audience := range audiences {
+		// A volume projecting an equivalent token, added by the pod's
+		// manifest or another webhook, is mounted instead of a duplicate
+		volumeMountPath := tokenMountPath(mountPath, i, len(audiences))
+		if name, tokenPath, ok := equivalentTokenVolume(pod, audience, settings.expiration, settings.fileMode, volumeMountPath, skipVolumes); ok {
+			klog.V(4).Infof("Mounting existing volume %s of pod %s, it projects an equivalent %s token", name, podName(pod, ""), audience)
+			skipVolumes[name] = true
+			if i == 0 {
+				tokenFileName = tokenPath
+			}
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      name,
+				ReadOnly:  true,
+				MountPath: volumeMountPath,
+			})
+			continue
+		}
+		volume := corev1.Volume{
+			Name: m.tokenVolumeName(i),
+			VolumeSource: corev1.VolumeSource{
+				Projected: &corev1.ProjectedVolumeSource{
+					DefaultMode: settings.fileMode,
+					Sources: []corev1.VolumeProjection{
+						corev1.VolumeProjection{
+							ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+								Audience:          audience,
+								ExpirationSeconds: &settings.expiration,
+								Path:              tokenName,
+							},
 						},
 					},
 				},
 			},
-		},
+		}
+		name, reuse, ok := resolveVolumeName(existingVolumes, volume)
+		if !ok {
+			klog.Warningf("Not injecting pod %s, volumes %s and %s-irsa already exist", podName(pod, ""), volume.Name, volume.Name)
+			skippedCounter.WithLabelValues("volume-name-conflict", settings.dryRun).Inc()
+			return nil, nil
+		}
+		if name != volume.Name {
+			klog.V(4).Infof("Using volume name %s for pod %s, volume %s already exists", name, podName(pod, ""), volume.Name)
+		}
+		volume.Name = name
+		if _, exists := existingVolumes[name]; exists && !reuse {
+			klog.V(4).Infof("Replacing volume %s of pod %s, its token source changed", name, podName(pod, ""))
+			staleVolumes = append(staleVolumes, PatchOperation{
+				Op:    "replace",
+				Path:  jsonPointer("spec", "volumes", strconv.Itoa(volumeIndexes[name])),
+				Value: volume,
+			})
+		} else if !reuse {
+			volumes = append(volumes, volume)
+		}
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      name,
+			ReadOnly:  true,
+			MountPath: volumeMountPath,
+		})
 	}
 
-	patch := []patchOperation{
-		patchOperation{
-			Op:    "add",
-			Path:  "/spec/volumes/0",
-			Value: volume,
-		},
+	var tokenFilePath string
+	if len(volumeMounts) > 0 {
+		tokenFilePath = path.Join(volumeMounts[0].MountPath, tokenFileName)
+		if isWindowsPod(pod) {
+			tokenFilePath = windowsPath(tokenFilePath)
+		}
 	}
 
-	if pod.Spec.Volumes == nil {
-		patch = []patchOperation{
-			patchOperation{
-				Op:   "add",
-				Path: "/spec/volumes",
-				Value: []corev1.Volume{
-					volume,
-				},
-			},
+	// Chained roles get a generated AWS config file assuming the chained role
+	// with the credentials of the base role
+	var configMounts []corev1.VolumeMount
+	if settings.chainedRoleARN != "" {
+		configMount := corev1.VolumeMount{
+			Name:      configVolumeName,
+			ReadOnly:  true,
+			MountPath: configMountPath(mountPath),
+		}
+		settings.configFilePath = path.Join(configMount.MountPath, configFileName)
+		if isWindowsPod(pod) {
+			settings.configFilePath = windowsPath(settings.configFilePath)
 		}
+		if _, exists := existingVolumes[configVolumeName]; !exists {
+			volumes = append(volumes, m.configVolume(settings.fileMode))
+		}
+		configMounts = append(append(configMounts, volumeMounts...), configMount)
 	}
 
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/spec/containers",
-		Value: containers,
-	})
+	selectContainer := m.containerSelector(pod)
+	containerSettings := func(name string) (podUpdateSettings, []corev1.VolumeMount, bool) {
+		containerSettings := settings
+		mounts := volumeMounts
+		if role, ok := settings.containerRoles[name]; ok {
+			// Containers with their own role are not chained
+			containerSettings.roleName = role
+			containerSettings.chainedRoleARN = ""
+		}
+		if containerSettings.chainedRoleARN != "" {
+			mounts = configMounts
+		}
+		return containerSettings, mounts, selectContainer(name) && (containerSettings.roleName != "" || settings.containerCredentials || settings.audienceOnly)
+	}
+
+	// Env replacements are applied after the containers are added. Container
+	// lists are only patched if a container changed, so reinvocations over an
+	// injected pod are a no-op.
+	var replacements []PatchOperation
+	var warnings []string
+	mutated := 0
+	changed := false
+
+	// Ephemeral containers can't add volumes, they mount the volumes the pod
+	// was injected with
+	if settings.ephemeralContainers != nil {
+		if len(volumes) > 0 || len(staleVolumes) > 0 {
+			klog.Warningf("Not injecting ephemeral containers of pod %s, the pod has no matching token volume", podName(pod, ""))
+			skippedCounter.WithLabelValues("ephemeral-volume-missing", settings.dryRun).Inc()
+			return nil, nil
+		}
+		ephemeralContainers := make([]corev1.EphemeralContainer, 0, len(pod.Spec.EphemeralContainers))
+		for i := range pod.Spec.EphemeralContainers {
+			ephemeralContainer := pod.Spec.EphemeralContainers[i]
+			if containerSettings, mounts, ok := containerSettings(ephemeralContainer.Name); ok && settings.ephemeralContainers[ephemeralContainer.Name] {
+				mutated++
+				container := corev1.Container(ephemeralContainer.EphemeralContainerCommon)
+				containerPath := jsonPointer("spec", "ephemeralContainers", strconv.Itoa(i))
+				containerReplacements, collisions := m.addEnvToContainer(&container, containerPath, tokenFilePath, mounts, containerSettings)
+				replacements = append(replacements, containerReplacements...)
+				warnings = append(warnings, mountCollisionWarnings(pod, container.Name, collisions)...)
+				if !reflect.DeepEqual(corev1.Container(ephemeralContainer.EphemeralContainerCommon), container) {
+					changed = true
+				}
+				ephemeralContainer.EphemeralContainerCommon = corev1.EphemeralContainerCommon(container)
+			}
+			ephemeralContainers = append(ephemeralContainers, ephemeralContainer)
+		}
+		if mutated == 0 {
+			klog.V(4).Infof("Not injecting ephemeral containers of pod %s, no new ephemeral containers are selected", podName(pod, ""))
+			return nil, nil
+		}
+		var patch []PatchOperation
+		if changed {
+			patch = append(patch, PatchOperation{
+				Op:    "add",
+				Path:  jsonPointer("spec", "ephemeralContainers"),
+				Value: ephemeralContainers,
+			})
+		}
+		return append(patch, replacements...), warnings
+	}
+
+	// The container lists are built in a single pass, containers that are not
+	// selected are copied as is, except for the mounts of removed volumes
+	initChanged := false
+	initContainers := make([]corev1.Container, 0, len(pod.Spec.InitContainers))
+	for i := range pod.Spec.InitContainers {
+		initContainers = append(initContainers, pod.Spec.InitContainers[i])
+		container := &initContainers[i]
+		removeVolumeMounts(container, removedVolumes)
+		if containerSettings, mounts, ok := containerSettings(container.Name); ok {
+			mutated++
+			containerPath := jsonPointer("spec", "initContainers", strconv.Itoa(i))
+			containerReplacements, collisions := m.addEnvToContainer(container, containerPath, tokenFilePath, mounts, containerSettings)
+			replacements = append(replacements, containerReplacements...)
+			warnings = append(warnings, mountCollisionWarnings(pod, container.Name, collisions)...)
+		}
+		initChanged = initChanged || !reflect.DeepEqual(&pod.Spec.InitContainers[i], container)
+	}
+	containers := make([]corev1.Container, 0, len(pod.Spec.Containers))
+	for i := range pod.Spec.Containers {
+		containers = append(containers, pod.Spec.Containers[i])
+		container := &containers[i]
+		removeVolumeMounts(container, removedVolumes)
+		if containerSettings, mounts, ok := containerSettings(container.Name); ok {
+			mutated++
+			containerPath := jsonPointer("spec", "containers", strconv.Itoa(i))
+			containerReplacements, collisions := m.addEnvToContainer(container, containerPath, tokenFilePath, mounts, containerSettings)
+			replacements = append(replacements, containerReplacements...)
+			warnings = append(warnings, mountCollisionWarnings(pod, container.Name, collisions)...)
+		}
+		changed = changed || !reflect.DeepEqual(&pod.Spec.Containers[i], container)
+	}
+
+	// The token is only added if a container uses it
+	if mutated == 0 {
+		klog.V(4).Infof("Not injecting pod %s, no containers are selected", podName(pod, ""))
+		return nil, nil
+	}
 
-	if len(initContainers) > 0 {
-		patch = append(patch, patchOperation{
+	// Replacements and removals by index are applied before volumes are
+	// inserted
+	patch := append(staleVolumes, volumeRemovals...)
+	// A missing volumes array is added whole, volumes are inserted into an
+	// existing one, even if it is empty. Env vars and mounts need no such
+	// care, containers are patched whole.
+	if pod.Spec.Volumes == nil && len(volumes) > 0 {
+		patch = append(patch, PatchOperation{
 			Op:    "add",
-			Path:  "/spec/initContainers",
+			Path:  jsonPointer("spec", "volumes"),
+			Value: volumes,
+		})
+	} else {
+		for i, volume := range volumes {
+			patch = append(patch, PatchOperation{
+				Op:    "add",
+				Path:  jsonPointer("spec", "volumes", strconv.Itoa(i)),
+				Value: volume,
+			})
+		}
+	}
+
+	if initChanged {
+		patch = append(patch, PatchOperation{
+			Op:    "add",
+			Path:  jsonPointer("spec", "initContainers"),
 			Value: initContainers,
 		})
 	}
+
+	if changed {
+		patch = append(patch, PatchOperation{
+			Op:    "add",
+			Path:  jsonPointer("spec", "containers"),
+			Value: containers,
+		})
+	}
+
+	annotations := map[string]string{}
+	if settings.chainedRoleARN != "" {
+		annotations[m.configAnnotation()] = awsConfig(settings.roleName, settings.chainedRoleARN, tokenFilePath)
+	}
+	// Informational annotations never overwrite annotations set by the user
+	if m.AnnotatePods {
+		injectedAudience := settings.audience
+		if settings.skipToken {
+			injectedAudience = ""
+		}
+		informational := map[string]string{
+			m.AnnotationDomain + "/injected-role-arn": settings.roleName,
+			m.AnnotationDomain + "/injected-audience": injectedAudience,
+		}
+		// The name is generated after admission, the generateName identifies
+		// the pod in audits of the admission
+		if pod.Name == "" {
+			informational[m.AnnotationDomain+"/injected-generate-name"] = pod.GenerateName
+		}
+		for key, value := range informational {
+			if _, ok := pod.Annotations[key]; !ok && value != "" {
+				annotations[key] = value
+			}
+		}
+	}
+	for key, value := range annotations {
+		if existing, ok := pod.Annotations[key]; ok && existing == value {
+			delete(annotations, key)
+		}
+	}
+	patch = append(patch, annotationsPatch(pod, annotations)...)
+
+	patch = append(patch, m.fsGroupPatch(pod, settings.fsGroup)...)
+	return append(patch, replacements...), warnings
+}
+
+// newEphemeralContainers returns the names of the ephemeral containers of pod
+// that are not in the old object of the request
+func newEphemeralContainers(req *v1beta1.AdmissionRequest, pod *corev1.Pod) map[string]bool {
+	var oldPod corev1.Pod
+	if len(req.OldObject.Raw) > 0 {
+		if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err != nil {
+			klog.Errorf("Could not unmarshal raw old object, treating all ephemeral containers as new: %v", err)
+		}
+	}
+	existing := map[string]bool{}
+	for _, container := range oldPod.Spec.EphemeralContainers {
+		existing[container.Name] = true
+	}
+	names := map[string]bool{}
+	for _, container := range pod.Spec.EphemeralContainers {
+		if !existing[container.Name] {
+			names[container.Name] = true
+		}
+	}
+	return names
+}
+
+// annotationsPatch returns the operations adding annotations to the pod. Pods
+// without annotations get the whole annotations map added.
+func annotationsPatch(pod *corev1.Pod, annotations map[string]string) []PatchOperation {
+	if len(annotations) == 0 {
+		return nil
+	}
+	if pod.Annotations == nil {
+		return []PatchOperation{{
+			Op:    "add",
+			Path:  jsonPointer("metadata", "annotations"),
+			Value: annotations,
+		}}
+	}
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var patch []PatchOperation
+	for _, key := range keys {
+		patch = append(patch, PatchOperation{
+			Op:    "add",
+			Path:  jsonPointer("metadata", "annotations", key),
+			Value: annotations[key],
+		})
+	}
 	return patch
 }
 
-// MutatePod takes a AdmissionReview, mutates the pod, and returns an AdmissionResponse
-func (m *Modifier) MutatePod(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	badRequest := &v1beta1.AdmissionResponse{
-		Result: &metav1.Status{
-			Message: "bad content",
+// fsGroupPatch returns the operations defaulting the fsGroup of a pod so non
+// root containers can read the token. An explicitly set fsGroup is never
+// overridden and windows pods, which don't support fsGroup, are skipped.
+func (m *Modifier) fsGroupPatch(pod *corev1.Pod, fsGroup *int64) []PatchOperation {
+	if fsGroup == nil || isWindowsPod(pod) {
+		return nil
+	}
+	if pod.Spec.SecurityContext != nil && pod.Spec.SecurityContext.FSGroup != nil {
+		return nil
+	}
+	fsGroupDefaultedCounter.Inc()
+	if pod.Spec.SecurityContext == nil {
+		return []PatchOperation{{
+			Op:    "add",
+			Path:  jsonPointer("spec", "securityContext"),
+			Value: corev1.PodSecurityContext{FSGroup: fsGroup},
+		}}
+	}
+	return []PatchOperation{{
+		Op:    "add",
+		Path:  jsonPointer("spec", "securityContext", "fsGroup"),
+		Value: *fsGroup,
+	}}
+}
+
+// PodDeniedError is returned by MutatePod for pods that must not be admitted
+type PodDeniedError struct {
+	Status metav1.Status
+}
+
+// Error returns the message of the denial status
+func (e *PodDeniedError) Error() string {
+	return e.Status.Message
+}
+
+// podRequest holds the admission request details of a pod mutation
+type podRequest struct {
+	// uid is the UID of the admission request, if any
+	uid string
+	// dryRun is the dry_run metric label of the admission request
+	dryRun string
+	// ephemeralContainers are the names of the ephemeral containers added by
+	// a pods/ephemeralcontainers request
+	ephemeralContainers map[string]bool
+	// lookup returns the settings of the Service Account of the pod
+	lookup func(ctx context.Context, name, namespace string) (*cache.CacheResponse, error)
+}
+
+// MutatePod returns the patch injecting a pod with the settings of its Service
+// Account, and the admission warnings of the mutation. The namespace of the pod
+// must be set, and a nil Service Account is handled like a missing one. Pods
+// that must not be admitted return a *PodDeniedError.
+func (m *Modifier) MutatePod(ctx context.Context, pod *corev1.Pod, sa *corev1.ServiceAccount) ([]PatchOperation, []string, error) {
+	return m.mutatePod(ctx, pod, podRequest{
+		dryRun: "false",
+		lookup: func(ctx context.Context, name, namespace string) (*cache.CacheResponse, error) {
+			if sa == nil || sa.Name != name || sa.Namespace != namespace {
+				return nil, nil
+			}
+			return cache.ParseServiceAccount(sa, m.AnnotationDomain, m.TokenAudience, cache.WithLenientBooleans(m.LenientBooleanAnnotations)), nil
 		},
+	})
+}
+
+// mutatePod returns the patch and warnings of a pod, shared by MutatePod and
+// AdmitPod
+func (m *Modifier) mutatePod(ctx context.Context, pod *corev1.Pod, req podRequest) ([]PatchOperation, []string, error) {
+	podID := podName(pod, req.uid)
+	var warnings admissionWarnings
+
+	// Mirror pods of static pods are created by the kubelet, and the API
+	// server rejects them if they use service accounts. They are skipped before
+	// their Service Account is looked up.
+	if _, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]; ok {
+		klog.V(4).Infof("Skipping pod %s, it is a mirror pod", podID)
+		skippedCounter.WithLabelValues("mirror-pod", req.dryRun).Inc()
+		return nil, nil, nil
+	}
+
+	if m.namespaceSkipped(pod.Namespace) {
+		klog.V(4).Infof("Skipping pod %s, namespace is in the skip-namespaces list", podID)
+		skippedCounter.WithLabelValues("namespace-denylist", req.dryRun).Inc()
+		return nil, nil, nil
 	}
-	if ar == nil {
-		return badRequest
+
+	if m.ExcludePodSelector != nil && m.ExcludePodSelector.Matches(labels.Set(pod.Labels)) {
+		klog.V(4).Infof("Skipping pod %s, pod matches the exclude-pod-selector %s", podID, m.ExcludePodSelector)
+		skippedCounter.WithLabelValues("pod-selector", req.dryRun).Inc()
+		return nil, nil, nil
+	}
+
+	if kind := m.skippedOwnerKind(pod); kind != "" {
+		klog.V(4).Infof("Skipping pod %s, it is owned by a %s", podID, kind)
+		skippedCounter.WithLabelValues("owner-kind", req.dryRun).Inc()
+		return nil, nil, nil
+	}
+
+	if m.podAnnotationBool(pod, "skip-pod-identity") {
+		klog.V(4).Infof("Skipping pod %s, pod opted out of mutation", podID)
+		skippedCounter.WithLabelValues("pod-opt-out", req.dryRun).Inc()
+		return nil, nil, nil
+	}
+
+	defaults := m.defaults()
+	var saRole string
+	var forceEnvOverride, annotatedMountPath, audienceAnnotated bool
+	var disableIMDSFallback, saAutomount *bool
+	var tokenFileName, chainedRoleARN, extraMountPath string
+	fsGroup := m.DefaultFSGroup
+	fileMode := m.TokenFileMode
+	mountPath := defaults.MountPath
+	stsEndpoint := m.STSEndpoint
+	resp, err := req.lookup(ctx, pod.Spec.ServiceAccountName, pod.Namespace)
+	if err != nil {
+		message := fmt.Sprintf("could not look up service account %s/%s of pod %s: %v", pod.Namespace, pod.Spec.ServiceAccountName, podName(pod, ""), err)
+		reason, code := reasonServiceAccountLookupFailed, int32(http.StatusInternalServerError)
+		if ctx.Err() != nil {
+			// The request timed out or was abandoned during the lookup
+			reason, code = reasonServiceAccountLookupTimeout, http.StatusGatewayTimeout
+		}
+		admissionErrorCounter.WithLabelValues(string(reason)).Inc()
+		if m.SALookupFailurePolicy == SALookupFailurePolicyDeny {
+			klog.Errorf("Denying pod: %s", message)
+			return nil, nil, &PodDeniedError{Status: metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: message,
+				Reason:  reason,
+				Code:    code,
+			}}
+		}
+		klog.Errorf("Not injecting pod: %s", message)
+		warnings.add(fmt.Sprintf("not injecting credentials: %s", message))
+	}
+	if err == nil && resp == nil {
+		// The Service Account was deleted, or not created yet. Its role may
+		// be revoked along with it, so its pods would fail to assume it.
+		if m.DenyOnDeletedSA {
+			message := fmt.Sprintf("service account %s/%s of pod %s not found, it may have been deleted", pod.Namespace, pod.Spec.ServiceAccountName, podName(pod, ""))
+			klog.Warningf("Denying pod: %s", message)
+			saNotFoundCounter.WithLabelValues("denied", req.dryRun).Inc()
+			return nil, nil, &PodDeniedError{Status: metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: message,
+				Reason:  metav1.StatusReasonForbidden,
+				Code:    http.StatusForbidden,
+			}}
+		}
+		klog.V(4).Infof("Service account %s/%s of pod %s not found", pod.Namespace, pod.Spec.ServiceAccountName, podID)
+		saNotFoundCounter.WithLabelValues("allowed", req.dryRun).Inc()
+	}
+	if resp != nil {
+		for _, invalid := range resp.InvalidAnnotations {
+			warnings.add(fmt.Sprintf("ignoring service account %s/%s annotation: %s", pod.Namespace, pod.Spec.ServiceAccountName, invalid))
+		}
+		if resp.DeprecatedAnnotationPrefix != "" {
+			warnings.add(fmt.Sprintf("service account %s/%s uses the deprecated annotation prefix %s, annotate it with %s instead",
+				pod.Namespace, pod.Spec.ServiceAccountName, resp.DeprecatedAnnotationPrefix, m.AnnotationDomain))
+		}
+		if resp.STSEndpoint != "" {
+			if err := ValidateSTSEndpointURL(resp.STSEndpoint, m.AllowInsecureSTSEndpoint); err != nil {
+				klog.Warningf("Ignoring sts-endpoint-url of sa %s/%s: %v", pod.Namespace, pod.Spec.ServiceAccountName, err)
+				warnings.add(fmt.Sprintf("ignoring service account %s/%s annotation %s/sts-endpoint-url: %v",
+					pod.Namespace, pod.Spec.ServiceAccountName, m.AnnotationDomain, err))
+			} else {
+				stsEndpoint = resp.STSEndpoint
+			}
+		}
+		saRole = resp.RoleARN
+		audienceAnnotated = !resp.DefaultAudience
+		// With a role ARN template, a role-arn annotation without an arn:
+		// prefix is a role name. The role-name annotation is only used
+		// without a role-arn annotation.
+		roleName := resp.RoleName
+		if saRole != "" {
+			roleName = ""
+			if m.RoleARNTemplate != nil && !strings.HasPrefix(saRole, "arn:") {
+				roleName = saRole
+			}
+		}
+		if roleName != "" {
+			roleARN, err := m.renderRoleARN(roleName, pod.Spec.ServiceAccountName, pod.Namespace)
+			if err != nil {
+				klog.Warningf("Not injecting role into pod %s with service account %s: %v", podID, pod.Spec.ServiceAccountName, err)
+				skippedCounter.WithLabelValues("role-arn-template", req.dryRun).Inc()
+				warnings.add(fmt.Sprintf("not injecting a role: %v", err))
+				return nil, warnings.list(), nil
+			}
+			saRole = roleARN
+		}
+		forceEnvOverride = resp.ForceEnvOverride
+		tokenFileName = resp.TokenFileName
+		chainedRoleARN = resp.ChainedRoleARN
+		saAutomount = resp.AutomountServiceAccountToken
+		extraMountPath = resp.ExtraMountPath
+		disableIMDSFallback = resp.DisableIMDSFallback
+		if resp.TokenFileMode != nil {
+			fileMode = resp.TokenFileMode
+		}
+		if resp.DefaultFSGroup != nil {
+			fsGroup = resp.DefaultFSGroup
+		}
+		if resp.MountPath != "" {
+			if m.mountPathInUse(pod, resp.MountPath) {
+				klog.Warningf("Ignoring token-mount-path %s of sa %s/%s for pod %s, the path is already mounted",
+					resp.MountPath, pod.Namespace, pod.Spec.ServiceAccountName, podID)
+			} else {
+				mountPath = resp.MountPath
+				annotatedMountPath = true
+			}
+		}
+	}
+
+	var cmResp *cache.CacheResponse
+	if m.ConfigMapCache != nil {
+		cmResp = m.ConfigMapCache.Get(pod.Spec.ServiceAccountName, pod.Namespace)
+	}
+
+	// The allowed roles of a namespace are enforced even without namespace
+	// defaults
+	var nsResp *cache.NamespaceResponse
+	var allowedRoleARNs []string
+	if m.NamespaceCache != nil {
+		if resp := m.NamespaceCache.Get(pod.Namespace); resp != nil {
+			allowedRoleARNs = resp.AllowedRoleARNs
+			if m.NamespaceDefaults {
+				nsResp = resp
+			}
+		}
+	}
+
+	// The role, audience, expiration, regional STS setting, and mode are
+	// taken from the sources in order of precedence
+	cfg, resolveWarnings := m.resolveInjectionConfig(pod, injectionSources{
+		serviceAccount:     resp,
+		serviceAccountRole: saRole,
+		namespace:          nsResp,
+		configMap:          cmResp,
+		defaults:           defaults,
+	})
+	for _, warning := range resolveWarnings {
+		warnings.add(warning)
+	}
+	podRole, audience := cfg.Role, cfg.Audience
+	containerCredentials := cfg.Mode == InjectionModeContainerCredentials
+	source := cfg.RoleSource
+	if source == "" {
+		source = SourceServiceAccount
+	}
+
+	// An invalid role is not injected, but the pod is still admitted
+	if podRole != "" {
+		if err := validateRoleARN(podRole, m.AllowedPartitions); err != nil {
+			klog.Warningf("Not injecting role into pod %s with service account %s: %v", podID, pod.Spec.ServiceAccountName, err)
+			skippedCounter.WithLabelValues("invalid-role-arn", req.dryRun).Inc()
+			warnings.add(fmt.Sprintf("not injecting a role: %v", err))
+			podRole = ""
+		}
+	}
+
+	// A chained role needs a base role to assume it with. Container
+	// credentials don't use the web identity token, so they aren't chained.
+	if chainedRoleARN != "" {
+		if podRole == "" || containerCredentials {
+			klog.V(4).Infof("Ignoring chained-role-arn of sa %s/%s, pod %s has no web identity role", pod.Namespace, pod.Spec.ServiceAccountName, podID)
+			chainedRoleARN = ""
+		} else if err := validateRoleARN(chainedRoleARN, m.AllowedPartitions); err != nil {
+			klog.Warningf("Ignoring chained-role-arn of sa %s/%s: %v", pod.Namespace, pod.Spec.ServiceAccountName, err)
+			warnings.add(fmt.Sprintf("ignoring service account %s/%s annotation %s/chained-role-arn: %v",
+				pod.Namespace, pod.Spec.ServiceAccountName, m.AnnotationDomain, err))
+			chainedRoleARN = ""
+		}
+	}
+
+	// Per container roles share the token of the service account, so they
+	// need the service account's audience
+	var containerRoles map[string]string
+	if audience != "" && !containerCredentials {
+		containerRoles = m.containerRoles(pod)
+	}
+
+	// With automounting disabled the token is not injected. Container
+	// credentials and chained roles need the token, so they are disabled.
+	skipToken := false
+	if m.RespectAutomountDisabled {
+		if source := automountDisabled(pod, saAutomount); source != "" {
+			klog.Infof("Not injecting a token into pod %s, automountServiceAccountToken is disabled on the %s", podID, source)
+			tokenSkippedCounter.WithLabelValues(source).Inc()
+			skipToken = true
+			containerCredentials = false
+			chainedRoleARN = ""
+		}
+	}
+
+	// Roles not allowed by the namespace are not injected, or the pod is
+	// denied
+	if allowedRoleARNs != nil {
+		var violations []string
+		if podRole != "" && !roleARNAllowed(podRole, allowedRoleARNs) {
+			violations = append(violations, podRole)
+		}
+		if chainedRoleARN != "" && !roleARNAllowed(chainedRoleARN, allowedRoleARNs) {
+			violations = append(violations, chainedRoleARN)
+		}
+		for _, role := range containerRoles {
+			if !roleARNAllowed(role, allowedRoleARNs) {
+				violations = append(violations, role)
+			}
+		}
+		if len(violations) > 0 {
+			sort.Strings(violations)
+			message := fmt.Sprintf("role %s of pod %s is not allowed by the allowed-role-arns annotation of namespace %s",
+				strings.Join(violations, ", "), podName(pod, ""), pod.Namespace)
+			rolePolicyViolationCounter.WithLabelValues(pod.Namespace, req.dryRun).Inc()
+			if m.DenyOnPolicyViolation {
+				klog.Warningf("Denying pod: %s", message)
+				return nil, nil, &PodDeniedError{Status: metav1.Status{
+					Status:  metav1.StatusFailure,
+					Message: message,
+					Reason:  metav1.StatusReasonForbidden,
+					Code:    http.StatusForbidden,
+				}}
+			}
+			klog.Warningf("Not injecting pod: %s", message)
+			skippedCounter.WithLabelValues("role-not-allowed", req.dryRun).Inc()
+			warnings.add(fmt.Sprintf("not injecting a role: %s", message))
+			return nil, warnings.list(), nil
+		}
+	}
+
+	// Service accounts with an audience annotation but no role get only the
+	// token, for identity providers other than AWS
+	audienceOnly := false
+	if m.AudienceOnlyInjection && audienceAnnotated && podRole == "" && len(containerRoles) == 0 && !containerCredentials && !skipToken {
+		klog.V(4).Infof("Injecting audience only token into pod %s with service account %s", podID, pod.Spec.ServiceAccountName)
+		audienceOnly = true
+	}
+
+	// determine whether to perform mutation
+	if podRole == "" && len(containerRoles) == 0 && !containerCredentials && !audienceOnly {
+		return nil, warnings.list(), nil
+	}
+
+	klog.V(4).Infof("Resolved regional STS to %t for pod %s (source: %s, default: %t)",
+		cfg.RegionalSTS, podID, cfg.RegionalSTSSource, defaults.RegionalSTS)
+
+	useDisableIMDSFallback := m.DisableIMDSFallback
+	if disableIMDSFallback != nil {
+		useDisableIMDSFallback = *disableIMDSFallback
+	}
+
+	var annotatedExpiration int64
+	if cfg.ExpirationSource == SourceServiceAccount {
+		annotatedExpiration = cfg.Expiration
+	}
+	tokenExpiration, warning := m.tokenExpiration(annotatedExpiration, defaults.TokenExpiration)
+	if warning != "" {
+		klog.V(4).Infof("Clamping token expiration of pod %s: %s", podID, warning)
+		warnings.add(warning)
+	}
+
+	patch, mountWarnings := m.updatePodSpec(pod, podUpdateSettings{
+		roleName:             podRole,
+		audience:             audience,
+		regionalSTS:          cfg.RegionalSTS,
+		expiration:           tokenExpiration,
+		mountPath:            mountPath,
+		stsEndpoint:          stsEndpoint,
+		forceEnvOverride:     forceEnvOverride,
+		containerRoles:       containerRoles,
+		annotatedMountPath:   annotatedMountPath,
+		tokenFileName:        tokenFileName,
+		fsGroup:              fsGroup,
+		fileMode:             fileMode,
+		containerCredentials: containerCredentials,
+		disableIMDSFallback:  useDisableIMDSFallback,
+		chainedRoleARN:       chainedRoleARN,
+		extraMountPath:       extraMountPath,
+		skipToken:            skipToken,
+		audienceOnly:         audienceOnly,
+		ephemeralContainers:  req.ephemeralContainers,
+		dryRun:               req.dryRun,
+	})
+	for _, warning := range mountWarnings {
+		warnings.add(warning)
+	}
+	if len(patch) == 0 {
+		return nil, warnings.list(), nil
+	}
+	injectionCounter.WithLabelValues(source, req.dryRun).Inc()
+	return patch, warnings.list(), nil
+}
+
+// AdmitPod takes a AdmissionReview, mutates the pod, and returns an AdmissionResponse
+func (m *Modifier) AdmitPod(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	if ar == nil || ar.Request == nil {
+		return admissionError(m.FailurePolicy, reasonMissingRequest, http.StatusBadRequest, "bad content")
 	}
 	req := ar.Request
-	if req == nil {
-		return badRequest
+	defer func(start time.Time) {
+		mutationDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	// A misconfigured webhook may send other resources, they are admitted
+	// unchanged
+	if !podResource(req) {
+		resource := resourceLabel(req)
+		klog.Warningf("Not mutating unexpected resource %s of request %s, only pods are mutated", resource, req.UID)
+		unexpectedResourceCounter.WithLabelValues(resource).Inc()
+		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{fmt.Sprintf("pod identity webhook received unexpected resource %s, only pods are mutated", resource)},
+		}
 	}
 
+	// Pods that can't be decoded are admitted unchanged, so a decoding bug
+	// never blocks pod creation
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		klog.Errorf("Could not unmarshal raw object: %v", err)
 		klog.Errorf("Object: %v", string(req.Object.Raw))
+		skippedCounter.WithLabelValues("undecodable-pod", dryRunLabel(req)).Inc()
+		admissionErrorCounter.WithLabelValues(string(reasonUndecodablePod)).Inc()
+		message := fmt.Sprintf("pod identity webhook could not decode the pod, it is not mutated: %v", err)
 		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{truncateWarning(message)},
 			Result: &metav1.Status{
-				Message: err.Error(),
+				Status:  metav1.StatusFailure,
+				Message: message,
+				Reason:  reasonUndecodablePod,
+				Code:    http.StatusBadRequest,
 			},
 		}
 	}
 
 	pod.Namespace = req.Namespace
 
-	podRole, audience := m.Cache.Get(pod.Spec.ServiceAccountName, pod.Namespace)
-
-	// determine whether to perform mutation
-	if podRole == "" {
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
+	// Ephemeral containers are added to running pods through a subresource
+	var ephemeralContainers map[string]bool
+	if req.SubResource == "ephemeralcontainers" {
+		if !m.MutateEphemeralContainers {
+			return &v1beta1.AdmissionResponse{
+				Allowed: true,
+			}
 		}
+		ephemeralContainers = newEphemeralContainers(req, &pod)
 	}
 
-	patchBytes, err := json.Marshal(m.updatePodSpec(&pod, podRole, audience))
+	patch, warnings, err := m.mutatePod(ctx, &pod, podRequest{
+		uid:                 string(req.UID),
+		dryRun:              dryRunLabel(req),
+		ephemeralContainers: ephemeralContainers,
+		lookup:              m.lookupServiceAccount,
+	})
 	if err != nil {
-		klog.Errorf("Error marshaling pod update: %v", err.Error())
+		if denied, ok := err.(*PodDeniedError); ok {
+			return &v1beta1.AdmissionResponse{
+				Allowed: false,
+				Result:  &denied.Status,
+			}
+		}
+		return admissionError(m.FailurePolicy, reasonMutationFailed, http.StatusInternalServerError, err.Error())
+	}
+	if len(patch) == 0 {
 		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+			Allowed:  true,
+			Warnings: warnings,
 		}
 	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return admissionError(m.FailurePolicy, reasonPatchEncodingFailed, http.StatusInternalServerError, fmt.Sprintf("could not encode the patch: %v", err))
+	}
 
 	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
+		Allowed:  true,
+		Warnings: warnings,
+		Patch:    patchBytes,
 		PatchType: func() *v1beta1.PatchType {
 			pt := v1beta1.PatchTypeJSONPatch
 			return &pt
@@ -317,54 +2166,120 @@ func (m *Modifier) MutatePod(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResp
 
 // Handle handles pod modification requests
 func (m *Modifier) Handle(w http.ResponseWriter, r *http.Request) {
+	m.serve(w, r, m.FailurePolicy, m.AdmitPod)
+}
+
+// HandleValidate handles Service Account validation requests
+func (m *Modifier) HandleValidate(w http.ResponseWriter, r *http.Request) {
+	m.serve(w, r, validateFailurePolicy, m.ValidateServiceAccount)
+}
+
+// rejectRequest counts a request that is not an admission request, and writes
+// a Status error
+func rejectRequest(w http.ResponseWriter, reason string, code int, statusReason metav1.StatusReason, message string) {
+	rejectedRequestCounter.WithLabelValues(reason).Inc()
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   statusReason,
+		Code:     int32(code),
+	}
+	body, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(body); err != nil {
+		klog.Errorf("Can't write response: %v", err)
+	}
+}
+
+// serve decodes the AdmissionReview of a request, admits it with admit, and
+// writes the response. Undecodable reviews follow the failure policy of the
+// endpoint.
+func (m *Modifier) serve(w http.ResponseWriter, r *http.Request, policy string, admit func(context.Context, *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse) {
+	if r.Method != http.MethodPost {
+		klog.Errorf("Method=%s, expect POST", r.Method)
+		w.Header().Set("Allow", http.MethodPost)
+		rejectRequest(w, "method", http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "invalid method, expect POST")
+		return
+	}
+
+	// verify the content type is accurate
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+		klog.Errorf("Content-Type=%s, expect application/json", contentType)
+		rejectRequest(w, "content-type", http.StatusUnsupportedMediaType, metav1.StatusReasonUnsupportedMediaType, "invalid Content-Type, expect `application/json`")
+		return
+	}
+
 	var body []byte
 	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, m.MaxRequestBytes))
+		if _, ok := err.(*http.MaxBytesError); ok {
+			klog.Errorf("Request body exceeds %d bytes", m.MaxRequestBytes)
+			rejectRequest(w, "too-large", http.StatusRequestEntityTooLarge, metav1.StatusReasonRequestEntityTooLarge,
+				fmt.Sprintf("request body exceeds %d bytes", m.MaxRequestBytes))
+			return
+		}
+		if err == nil {
 			body = data
 		}
 	}
 	if len(body) == 0 {
 		klog.Errorf("empty body")
-		http.Error(w, "empty body", http.StatusBadRequest)
+		rejectRequest(w, "empty-body", http.StatusBadRequest, metav1.StatusReasonBadRequest, "empty body")
 		return
 	}
 
-	// verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		klog.Errorf("Content-Type=%s, expect application/json", contentType)
-		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
-		return
+	// The lookups of the request are abandoned with the request, or once the
+	// internal timeout expires
+	ctx := r.Context()
+	if m.InternalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.InternalTimeout)
+		defer cancel()
 	}
 
 	var admissionResponse *v1beta1.AdmissionResponse
 	ar := v1beta1.AdmissionReview{}
 	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		klog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		admissionResponse = admissionError(policy, reasonUndecodableReview, http.StatusBadRequest, err.Error())
+	} else if err := validateAdmissionReviewVersion(ar.TypeMeta); err != nil {
+		admissionResponse = admissionError(policy, reasonUnsupportedReviewVersion, http.StatusBadRequest, err.Error())
 	} else {
-		admissionResponse = m.MutatePod(&ar)
+		admissionResponse = admit(ctx, &ar)
 	}
 
+	// The response is encoded with the version of the request
 	admissionReview := v1beta1.AdmissionReview{}
+	admissionReview.APIVersion = admissionReviewVersion(ar.TypeMeta)
+	admissionReview.Kind = "AdmissionReview"
 	if admissionResponse != nil {
 		admissionReview.Response = admissionResponse
 		if ar.Request != nil {
 			admissionReview.Response.UID = ar.Request.UID
 		}
+		// Warnings are only returned in v1 responses
+		if admissionReview.APIVersion != admissionReviewV1 && len(admissionResponse.Warnings) > 0 {
+			klog.V(4).Infof("Dropping warnings of %s response: %s", admissionReview.APIVersion, strings.Join(admissionResponse.Warnings, "; "))
+			admissionReview.Response.Warnings = nil
+		}
 	}
 
+	// An AdmissionReview that can't be encoded is the only admission error
+	// without a response, the API server applies the failure policy
 	resp, err := json.Marshal(admissionReview)
 	if err != nil {
 		klog.Errorf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(resp); err != nil {
 		klog.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 }
@@ -16,16 +16,38 @@
 package handler
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/amazon-eks-pod-identity-webhook/pkg/cache"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"k8s.io/api/admission/v1beta1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	authenticationv1 "k8s.io/api/authentication/v1"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 var rawPodWithoutVolume = []byte(`
@@ -245,6 +267,30 @@ var rawPodWithAWSDefaultRegion = []byte(`
 }
 `)
 
+var rawPodWithAWSRegionAndDefaultRegion = []byte(`
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+	"name": "balajilovesoreos",
+	"uid": "be8695c4-4ad0-4038-8786-c508853aa255"
+  },
+  "spec": {
+	"containers": [
+	  {
+		"image": "amazonlinux",
+		"name": "balajilovesoreos",
+		"env": [
+		  {"name":"AWS_REGION","value":"paris"},
+		  {"name":"AWS_DEFAULT_REGION","value":"paris"}
+		]
+	  }
+	],
+	"serviceAccountName": "default"
+  }
+}
+`)
+
 func getValidReview(pod []byte) *v1beta1.AdmissionReview {
 	return &v1beta1.AdmissionReview{
 		Request: &v1beta1.AdmissionRequest{
@@ -253,6 +299,10 @@ func getValidReview(pod []byte) *v1beta1.AdmissionReview {
 				Version: "v1",
 				Kind:    "Pod",
 			},
+			Resource: metav1.GroupVersionResource{
+				Version:  "v1",
+				Resource: "pods",
+			},
 			Namespace: "default",
 			Operation: "CREATE",
 			UserInfo: authenticationv1.UserInfo{
@@ -277,6 +327,7 @@ var validPatchIfWindowsVolumesPresent = []byte(`[{"op":"add","path":"/spec/volum
 
 var validPatchIfNoRegionPresent = []byte(`[{"op":"add","path":"/spec/volumes","value":[{"name":"aws-iam-token","projected":{"sources":[{"serviceAccountToken":{"audience":"sts.amazonaws.com","expirationSeconds":86400,"path":"token"}}]}}]},{"op":"add","path":"/spec/containers","value":[{"name":"balajilovesoreos","image":"amazonlinux","env":[{"name":"AWS_DEFAULT_REGION","value":"seattle"},{"name":"AWS_REGION","value":"seattle"},{"name":"AWS_ROLE_ARN","value":"arn:aws:iam::111122223333:role/s3-reader"},{"name":"AWS_WEB_IDENTITY_TOKEN_FILE","value":"/var/run/secrets/eks.amazonaws.com/serviceaccount/token"}],"resources":{},"volumeMounts":[{"name":"aws-iam-token","readOnly":true,"mountPath":"/var/run/secrets/eks.amazonaws.com/serviceaccount"}]}]}]`)
 var validPatchIfRegionPresent = []byte(`[{"op":"add","path":"/spec/volumes","value":[{"name":"aws-iam-token","projected":{"sources":[{"serviceAccountToken":{"audience":"sts.amazonaws.com","expirationSeconds":86400,"path":"token"}}]}}]},{"op":"add","path":"/spec/containers","value":[{"name":"balajilovesoreos","image":"amazonlinux","env":[{"name":"AWS_REGION","value":"paris"},{"name":"AWS_ROLE_ARN","value":"arn:aws:iam::111122223333:role/s3-reader"},{"name":"AWS_WEB_IDENTITY_TOKEN_FILE","value":"/var/run/secrets/eks.amazonaws.com/serviceaccount/token"}],"resources":{},"volumeMounts":[{"name":"aws-iam-token","readOnly":true,"mountPath":"/var/run/secrets/eks.amazonaws.com/serviceaccount"}]}]}]`)
+var validPatchIfBothRegionsPresent = []byte(`[{"op":"add","path":"/spec/volumes","value":[{"name":"aws-iam-token","projected":{"sources":[{"serviceAccountToken":{"audience":"sts.amazonaws.com","expirationSeconds":86400,"path":"token"}}]}}]},{"op":"add","path":"/spec/containers","value":[{"name":"balajilovesoreos","image":"amazonlinux","env":[{"name":"AWS_REGION","value":"paris"},{"name":"AWS_DEFAULT_REGION","value":"paris"},{"name":"AWS_ROLE_ARN","value":"arn:aws:iam::111122223333:role/s3-reader"},{"name":"AWS_WEB_IDENTITY_TOKEN_FILE","value":"/var/run/secrets/eks.amazonaws.com/serviceaccount/token"}],"resources":{},"volumeMounts":[{"name":"aws-iam-token","readOnly":true,"mountPath":"/var/run/secrets/eks.amazonaws.com/serviceaccount"}]}]}]`)
 var validPatchIfDefaultRegionPresent = []byte(`[{"op":"add","path":"/spec/volumes","value":[{"name":"aws-iam-token","projected":{"sources":[{"serviceAccountToken":{"audience":"sts.amazonaws.com","expirationSeconds":86400,"path":"token"}}]}}]},{"op":"add","path":"/spec/containers","value":[{"name":"balajilovesoreos","image":"amazonlinux","env":[{"name":"AWS_DEFAULT_REGION","value":"paris"},{"name":"AWS_ROLE_ARN","value":"arn:aws:iam::111122223333:role/s3-reader"},{"name":"AWS_WEB_IDENTITY_TOKEN_FILE","value":"/var/run/secrets/eks.amazonaws.com/serviceaccount/token"}],"resources":{},"volumeMounts":[{"name":"aws-iam-token","readOnly":true,"mountPath":"/var/run/secrets/eks.amazonaws.com/serviceaccount"}]}]}]`)
 
 var jsonPatchType = v1beta1.PatchType("JSONPatch")
@@ -323,6 +374,13 @@ var validResponseIfRegionPresent = &v1beta1.AdmissionResponse{
 	PatchType: &jsonPatchType,
 }
 
+var validResponseIfBothRegionsPresent = &v1beta1.AdmissionResponse{
+	UID:       "",
+	Allowed:   true,
+	Patch:     validPatchIfBothRegionsPresent,
+	PatchType: &jsonPatchType,
+}
+
 var validResponseIfDefaultRegionPresent = &v1beta1.AdmissionResponse{
 	UID:       "",
 	Allowed:   true,
@@ -348,13 +406,13 @@ func TestSecretStore(t *testing.T) {
 			"nilBody",
 			NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount))),
 			nil,
-			&v1beta1.AdmissionResponse{Result: &metav1.Status{Message: "bad content"}},
+			&v1beta1.AdmissionResponse{Allowed: true, Result: &metav1.Status{Status: metav1.StatusFailure, Message: "bad content", Reason: reasonMissingRequest, Code: http.StatusBadRequest}},
 		},
 		{
 			"NoRequest",
 			NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount))),
 			&v1beta1.AdmissionReview{Request: nil},
-			&v1beta1.AdmissionResponse{Result: &metav1.Status{Message: "bad content"}},
+			&v1beta1.AdmissionResponse{Allowed: true, Result: &metav1.Status{Status: metav1.StatusFailure, Message: "bad content", Reason: reasonMissingRequest, Code: http.StatusBadRequest}},
 		},
 		{
 			"ValidRequestSuccessWithoutVolumes",
@@ -396,7 +454,7 @@ func TestSecretStore(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.caseName, func(t *testing.T) {
-			response := c.modifier.MutatePod(c.input)
+			response := c.modifier.AdmitPod(context.Background(), c.input)
 
 			if !reflect.DeepEqual(response, c.response) {
 				got, _ := json.MarshalIndent(response, "", "  ")
@@ -440,11 +498,23 @@ func TestEnvUpdate(t *testing.T) {
 			getValidReview(rawPodWithAWSDefaultRegion),
 			validResponseIfDefaultRegionPresent,
 		},
+		{
+			"ValidRequestSuccessWithBothRegions",
+			NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)), WithRegion("seattle")),
+			getValidReview(rawPodWithAWSRegionAndDefaultRegion),
+			validResponseIfBothRegionsPresent,
+		},
+		{
+			"ValidRequestSuccessWithoutRegionFlag",
+			NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount))),
+			getValidReview(rawPodWithoutRegion),
+			validResponseIfNoVolumesPresent,
+		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.caseName, func(t *testing.T) {
-			response := c.modifier.MutatePod(c.input)
+			response := c.modifier.AdmitPod(context.Background(), c.input)
 
 			if !reflect.DeepEqual(response, c.response) {
 				got, _ := json.MarshalIndent(response, "", "  ")
@@ -455,3 +525,5485 @@ func TestEnvUpdate(t *testing.T) {
 		})
 	}
 }
+
+func getPodWithSkipContainers(skip string) []byte {
+	return []byte(fmt.Sprintf(`
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+	"name": "balajilovesoreos",
+	"uid": "be8695c4-4ad0-4038-8786-c508853aa255",
+	"annotations": {
+	  "eks.amazonaws.com/skip-containers": %q
+	}
+  },
+  "spec": {
+	"initContainers": [
+	  {
+		"image": "vault",
+		"name": "vault-agent"
+	  }
+	],
+	"containers": [
+	  {
+		"image": "amazonlinux",
+		"name": "balajilovesoreos"
+	  },
+	  {
+		"image": "istio/proxyv2",
+		"name": "istio-proxy"
+	  }
+	],
+	"serviceAccountName": "default"
+  }
+}
+`, skip))
+}
+
+// applyPatch applies the JSON patch of a response to a raw pod and returns the
+// resulting pod
+func applyPatch(t *testing.T, rawPod []byte, response *v1beta1.AdmissionResponse) *v1.Pod {
+	t.Helper()
+	patched := rawPod
+	if len(response.Patch) > 0 {
+		patch, err := jsonpatch.DecodePatch(response.Patch)
+		if err != nil {
+			t.Fatalf("Error decoding patch: %v", err)
+		}
+		patched, err = patch.Apply(rawPod)
+		if err != nil {
+			t.Fatalf("Error applying patch %s: %v", string(response.Patch), err)
+		}
+	}
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(patched, pod); err != nil {
+		t.Fatalf("Error unmarshaling patched pod: %v", err)
+	}
+	return pod
+}
+
+// injectedContainers returns the names of all containers and init containers
+// that received the AWS_ROLE_ARN environment variable
+func injectedContainers(pod *v1.Pod) []string {
+	names := []string{}
+	containers := append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for _, env := range container.Env {
+			if env.Name == "AWS_ROLE_ARN" {
+				names = append(names, container.Name)
+			}
+		}
+	}
+	return names
+}
+
+func TestSkipContainers(t *testing.T) {
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+	}
+
+	cases := []struct {
+		caseName string
+		skip     string
+		injected []string
+	}{
+		{"EmptyList", "", []string{"vault-agent", "balajilovesoreos", "istio-proxy"}},
+		{"Sidecars", "istio-proxy, vault-agent", []string{"balajilovesoreos"}},
+		{"AllContainers", "balajilovesoreos,istio-proxy,vault-agent", []string{}},
+		{"UnknownNames", "does-not-exist,istio-proxy", []string{"vault-agent", "balajilovesoreos"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+			rawPod := getPodWithSkipContainers(c.skip)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			pod := applyPatch(t, rawPod, response)
+
+			if got := injectedContainers(pod); !reflect.DeepEqual(got, c.injected) {
+				t.Errorf("Unexpected injected containers. Got %v, wanted %v", got, c.injected)
+			}
+			for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+				if containerNameSet(c.skip)[container.Name] && len(container.VolumeMounts) > 0 {
+					t.Errorf("Expected no volumeMounts on skipped container %s", container.Name)
+				}
+			}
+		})
+	}
+}
+
+var rawPodWithRoleAnnotation = []byte(`
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+	"name": "balajilovesoreos",
+	"uid": "be8695c4-4ad0-4038-8786-c508853aa255",
+	"annotations": {
+	  "eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/pod-role"
+	}
+  },
+  "spec": {
+	"containers": [
+	  {
+		"image": "amazonlinux",
+		"name": "balajilovesoreos"
+	  }
+	],
+	"serviceAccountName": "default"
+  }
+}
+`)
+
+func TestPodAnnotationOverride(t *testing.T) {
+	saRole := "arn:aws:iam::111122223333:role/s3-reader"
+	podRole := "arn:aws:iam::111122223333:role/pod-role"
+
+	cases := []struct {
+		caseName string
+		allow    bool
+		saRole   string
+		audience string
+		wantRole string
+	}{
+		{"OverrideAllowed", true, saRole, "sts.amazonaws.com", podRole},
+		{"OverrideDisabled", false, saRole, "sts.amazonaws.com", saRole},
+		{"OverrideAllowedWithoutServiceAccountRole", true, "", "custom", podRole},
+		{"OverrideDisabledWithoutServiceAccountRole", false, "", "custom", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", c.saRole, c.audience)
+			modifier := NewModifier(
+				WithServiceAccountCache(saCache),
+				WithPodAnnotationOverride(c.allow),
+			)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithRoleAnnotation))
+			pod := applyPatch(t, rawPodWithRoleAnnotation, response)
+
+			var gotRole string
+			for _, env := range pod.Spec.Containers[0].Env {
+				if env.Name == "AWS_ROLE_ARN" {
+					gotRole = env.Value
+				}
+			}
+			if gotRole != c.wantRole {
+				t.Errorf("Expected role %q, got %q", c.wantRole, gotRole)
+			}
+			if c.wantRole == "" {
+				return
+			}
+			if len(pod.Spec.Volumes) != 1 {
+				t.Fatalf("Expected one volume, got %d", len(pod.Spec.Volumes))
+			}
+			gotAudience := pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.Audience
+			if gotAudience != c.audience {
+				t.Errorf("Expected audience %q, got %q", c.audience, gotAudience)
+			}
+		})
+	}
+}
+
+var rawPodWithSTSRegionalEndpoints = []byte(`
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+	"name": "balajilovesoreos",
+	"uid": "be8695c4-4ad0-4038-8786-c508853aa255"
+  },
+  "spec": {
+	"containers": [
+	  {
+		"image": "amazonlinux",
+		"name": "balajilovesoreos",
+		"env": [
+		  {"name":"AWS_STS_REGIONAL_ENDPOINTS","value":"legacy"}
+		]
+	  }
+	],
+	"serviceAccountName": "default"
+  }
+}
+`)
+
+// envValues returns all values of the named environment variable in a container
+func envValues(container v1.Container, name string) []string {
+	values := []string{}
+	for _, env := range container.Env {
+		if env.Name == name {
+			values = append(values, env.Value)
+		}
+	}
+	return values
+}
+
+func TestRegionalSTSEndpoints(t *testing.T) {
+	cases := []struct {
+		caseName    string
+		regionalSTS bool
+		value       string
+		pod         []byte
+		expected    []string
+	}{
+		{"True", false, "true", rawPodWithoutVolume, []string{"regional"}},
+		{"TrueMixedCase", false, "True", rawPodWithoutVolume, []string{"regional"}},
+		{"False", false, "false", rawPodWithoutVolume, []string{}},
+		{"Missing", false, "", rawPodWithoutVolume, []string{}},
+		{"Garbage", false, "regional", rawPodWithoutVolume, []string{}},
+		{"AlreadyDefined", false, "true", rawPodWithSTSRegionalEndpoints, []string{"legacy"}},
+		{"DefaultTrue", true, "true", rawPodWithoutVolume, []string{"regional"}},
+		{"DefaultFalseAnnotation", true, "false", rawPodWithoutVolume, []string{}},
+		{"DefaultFalseAnnotationUpperCase", true, "FALSE", rawPodWithoutVolume, []string{}},
+		{"DefaultMissing", true, "", rawPodWithoutVolume, []string{"regional"}},
+		{"DefaultGarbage", true, "regional", rawPodWithoutVolume, []string{"regional"}},
+		{"DefaultAlreadyDefined", true, "", rawPodWithSTSRegionalEndpoints, []string{"legacy"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			}
+			if c.value != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/sts-regional-endpoints"] = c.value
+			}
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithRegionalSTS(c.regionalSTS),
+			)
+			response := modifier.AdmitPod(context.Background(), getValidReview(c.pod))
+			pod := applyPatch(t, c.pod, response)
+
+			got := envValues(pod.Spec.Containers[0], "AWS_STS_REGIONAL_ENDPOINTS")
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("Expected AWS_STS_REGIONAL_ENDPOINTS %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestTokenExpiration(t *testing.T) {
+	cases := []struct {
+		caseName   string
+		value      string
+		expiration int64
+		expected   int64
+		warning    string
+		direction  string
+	}{
+		{"Annotated", "3600", 7200, 3600, "", ""},
+		{"BelowMinimum", "60", 7200, 900, "token-expiration annotation of 60s is below the minimum of 900s, using 900s", "min"},
+		{"AboveMaximum", "172800", 7200, 43200, "token-expiration annotation of 172800s is above the maximum of 43200s, using 43200s", "max"},
+		{"Invalid", "1h", 7200, 7200, `ignoring service account default/default annotation: invalid eks.amazonaws.com/token-expiration value "1h", must be a positive number of seconds`, ""},
+		{"Missing", "", 7200, 7200, "", ""},
+		{"DefaultBelowMinimum", "", 600, 900, "default token expiration of 600s is below the minimum of 900s, using 900s", "min"},
+		{"DefaultAboveMaximum", "", 86400, 43200, "default token expiration of 86400s is above the maximum of 43200s, using 43200s", "max"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			}
+			if c.value != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/token-expiration"] = c.value
+			}
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithExpiration(c.expiration),
+				WithMinExpiration(900),
+				WithMaxExpiration(43200),
+			)
+			minBefore := testutil.ToFloat64(tokenExpirationClampedCounter.WithLabelValues("min"))
+			maxBefore := testutil.ToFloat64(tokenExpirationClampedCounter.WithLabelValues("max"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			minDelta := testutil.ToFloat64(tokenExpirationClampedCounter.WithLabelValues("min")) - minBefore
+			maxDelta := testutil.ToFloat64(tokenExpirationClampedCounter.WithLabelValues("max")) - maxBefore
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+
+			got := *pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.ExpirationSeconds
+			if got != c.expected {
+				t.Errorf("Expected expirationSeconds %d, got %d", c.expected, got)
+			}
+
+			var warnings []string
+			if c.warning != "" {
+				warnings = []string{c.warning}
+			}
+			if !reflect.DeepEqual(response.Warnings, warnings) {
+				t.Errorf("Expected warnings %q, got %q", warnings, response.Warnings)
+			}
+
+			var wantMin, wantMax float64
+			switch c.direction {
+			case "min":
+				wantMin = 1
+			case "max":
+				wantMax = 1
+			}
+			if minDelta != wantMin || maxDelta != wantMax {
+				t.Errorf("Expected clamped counter increments min=%v max=%v, got min=%v max=%v", wantMin, wantMax, minDelta, maxDelta)
+			}
+		})
+	}
+}
+
+func TestValidateExpirationBounds(t *testing.T) {
+	cases := []struct {
+		min, max int64
+		valid    bool
+	}{
+		{600, 86400, true},
+		{3600, 3600, true},
+		{60, 86400, false},
+		{7200, 3600, false},
+	}
+
+	for _, c := range cases {
+		err := ValidateExpirationBounds(c.min, c.max)
+		if c.valid && err != nil {
+			t.Errorf("Expected bounds %d-%d to be valid, got %v", c.min, c.max, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("Expected bounds %d-%d to be invalid", c.min, c.max)
+		}
+	}
+}
+
+func TestMultipleAudiences(t *testing.T) {
+	mountPath := "/var/run/secrets/eks.amazonaws.com/serviceaccount"
+	cases := []struct {
+		caseName  string
+		audience  string
+		volumes   map[string]string
+		mounts    map[string]string
+		tokenFile string
+	}{
+		{
+			"OneAudience",
+			"sts.amazonaws.com",
+			map[string]string{"aws-iam-token": "sts.amazonaws.com"},
+			map[string]string{"aws-iam-token": mountPath},
+			mountPath + "/token",
+		},
+		{
+			"TwoAudiences",
+			"sts.amazonaws.com, https://api.example.com",
+			map[string]string{"aws-iam-token": "sts.amazonaws.com", "aws-iam-token-1": "https://api.example.com"},
+			map[string]string{"aws-iam-token": mountPath + "/0", "aws-iam-token-1": mountPath + "/1"},
+			mountPath + "/0/token",
+		},
+		{
+			"DuplicateAudiences",
+			"sts.amazonaws.com,sts.amazonaws.com",
+			map[string]string{"aws-iam-token": "sts.amazonaws.com"},
+			map[string]string{"aws-iam-token": mountPath},
+			mountPath + "/token",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+				"eks.amazonaws.com/audience": c.audience,
+			}
+			modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+
+			volumes := map[string]string{}
+			for _, vol := range pod.Spec.Volumes {
+				volumes[vol.Name] = vol.Projected.Sources[0].ServiceAccountToken.Audience
+			}
+			if !reflect.DeepEqual(volumes, c.volumes) {
+				t.Errorf("Expected volumes %v, got %v", c.volumes, volumes)
+			}
+			mounts := map[string]string{}
+			for _, mount := range pod.Spec.Containers[0].VolumeMounts {
+				mounts[mount.Name] = mount.MountPath
+			}
+			if !reflect.DeepEqual(mounts, c.mounts) {
+				t.Errorf("Expected volumeMounts %v, got %v", c.mounts, mounts)
+			}
+			if got := envValues(pod.Spec.Containers[0], "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, []string{c.tokenFile}) {
+				t.Errorf("Expected AWS_WEB_IDENTITY_TOKEN_FILE %s, got %v", c.tokenFile, got)
+			}
+
+			// Mutating the already mutated pod again must not duplicate volumes
+			patchedPod, _ := json.Marshal(pod)
+			response = modifier.AdmitPod(context.Background(), getValidReview(patchedPod))
+			repatched := applyPatch(t, patchedPod, response)
+			if len(repatched.Spec.Volumes) != len(c.volumes) {
+				t.Errorf("Expected %d volumes after reinvocation, got %d", len(c.volumes), len(repatched.Spec.Volumes))
+			}
+		})
+	}
+}
+
+var rawPodWithMountAtPath = []byte(`
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+	"name": "balajilovesoreos",
+	"uid": "be8695c4-4ad0-4038-8786-c508853aa255"
+  },
+  "spec": {
+	"containers": [
+	  {
+		"image": "amazonlinux",
+		"name": "balajilovesoreos",
+		"volumeMounts": [
+		  {"name":"my-volume","mountPath":"/var/run/secrets/aws/"}
+		]
+	  }
+	],
+	"serviceAccountName": "default",
+	"volumes": [
+	  {
+		"name": "my-volume"
+	  }
+	]
+  }
+}
+`)
+
+var rawPodWithTokenMountAtPath = []byte(`
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+	"name": "balajilovesoreos",
+	"uid": "be8695c4-4ad0-4038-8786-c508853aa255"
+  },
+  "spec": {
+	"containers": [
+	  {
+		"image": "amazonlinux",
+		"name": "balajilovesoreos",
+		"env": [
+		  {"name":"AWS_ROLE_ARN","value":"arn:aws:iam::111122223333:role/s3-reader"},
+		  {"name":"AWS_WEB_IDENTITY_TOKEN_FILE","value":"/var/run/secrets/aws/token"}
+		],
+		"volumeMounts": [
+		  {"name":"aws-iam-token","readOnly":true,"mountPath":"/var/run/secrets/aws"}
+		]
+	  }
+	],
+	"serviceAccountName": "default",
+	"volumes": [
+	  {
+		"name": "aws-iam-token",
+		"projected": {
+		  "sources": [
+			{"serviceAccountToken": {"audience":"sts.amazonaws.com","expirationSeconds":86400,"path":"token"}}
+		  ]
+		}
+	  }
+	]
+  }
+}
+`)
+
+func TestTokenMountPathAnnotation(t *testing.T) {
+	defaultMountPath := "/var/run/secrets/eks.amazonaws.com/serviceaccount"
+	cases := []struct {
+		caseName  string
+		value     string
+		pod       []byte
+		mountPath string
+	}{
+		{"Annotated", "/var/run/secrets/aws", rawPodWithoutVolume, "/var/run/secrets/aws"},
+		{"TrailingSlash", "/var/run/secrets/aws/", rawPodWithoutVolume, "/var/run/secrets/aws"},
+		{"Relative", "secrets/aws", rawPodWithoutVolume, defaultMountPath},
+		{"Collision", "/var/run/secrets/aws", rawPodWithMountAtPath, defaultMountPath},
+		{"OwnTokenMount", "/var/run/secrets/aws", rawPodWithTokenMountAtPath, "/var/run/secrets/aws"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn":         "arn:aws:iam::111122223333:role/s3-reader",
+				"eks.amazonaws.com/token-mount-path": c.value,
+			}
+			modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+			response := modifier.AdmitPod(context.Background(), getValidReview(c.pod))
+			pod := applyPatch(t, c.pod, response)
+
+			container := pod.Spec.Containers[0]
+			mount := container.VolumeMounts[len(container.VolumeMounts)-1]
+			if mount.Name != "aws-iam-token" || mount.MountPath != c.mountPath {
+				t.Errorf("Expected aws-iam-token mount at %s, got %s at %s", c.mountPath, mount.Name, mount.MountPath)
+			}
+			tokenFile := []string{c.mountPath + "/token"}
+			if got := envValues(container, "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, tokenFile) {
+				t.Errorf("Expected AWS_WEB_IDENTITY_TOKEN_FILE %v, got %v", tokenFile, got)
+			}
+		})
+	}
+}
+
+func TestNamespaceDefaultRole(t *testing.T) {
+	saRole := "arn:aws:iam::111122223333:role/s3-reader"
+	nsRole := "arn:aws:iam::111122223333:role/namespace-default"
+
+	cases := []struct {
+		caseName string
+		saRole   string
+		enabled  bool
+		wantRole string
+		source   string
+	}{
+		{"ServiceAccountRoleWins", saRole, true, saRole, "service-account"},
+		{"NamespaceDefault", "", true, nsRole, "namespace"},
+		{"NamespaceDefaultsDisabled", "", false, "", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", c.saRole, "sts.amazonaws.com")
+			nsCache := cache.NewFakeNamespaceCache()
+			nsCache.Add("default", &cache.NamespaceResponse{DefaultRoleARN: nsRole})
+			opts := []ModifierOpt{WithServiceAccountCache(saCache)}
+			if c.enabled {
+				opts = append(opts, WithNamespaceCache(nsCache), WithNamespaceDefaults(true))
+			}
+			modifier := NewModifier(opts...)
+
+			var before float64
+			if c.source != "" {
+				before = testutil.ToFloat64(injectionCounter.WithLabelValues(c.source, "false"))
+			}
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+
+			wantRoles := []string{}
+			if c.wantRole != "" {
+				wantRoles = []string{c.wantRole}
+			}
+			if got := envValues(pod.Spec.Containers[0], "AWS_ROLE_ARN"); !reflect.DeepEqual(got, wantRoles) {
+				t.Errorf("Expected AWS_ROLE_ARN %v, got %v", wantRoles, got)
+			}
+			if c.source != "" {
+				if after := testutil.ToFloat64(injectionCounter.WithLabelValues(c.source, "false")); after != before+1 {
+					t.Errorf("Expected %s injection counter to increase, got %v -> %v", c.source, before, after)
+				}
+			}
+		})
+	}
+}
+
+func TestRoleARNAllowed(t *testing.T) {
+	role := "arn:aws:iam::111122223333:role/team-a/s3-reader"
+
+	cases := []struct {
+		caseName string
+		patterns []string
+		want     bool
+	}{
+		{"Exact", []string{role}, true},
+		{"Wildcard", []string{"arn:aws:iam::111122223333:role/*"}, true},
+		{"WildcardPath", []string{"arn:aws:iam::111122223333:role/team-a/*"}, true},
+		{"SingleCharacter", []string{"arn:aws:iam::11112222333?:role/team-a/s3-reader"}, true},
+		{"OtherAccount", []string{"arn:aws:iam::444455556666:role/*"}, false},
+		{"OtherPath", []string{"arn:aws:iam::111122223333:role/team-b/*"}, false},
+		{"Prefix", []string{"arn:aws:iam::111122223333:role/team-a/s3"}, false},
+		{"MultiplePatterns", []string{"arn:aws:iam::444455556666:role/*", "arn:aws:iam::111122223333:role/team-a/*"}, true},
+		{"DotIsLiteral", []string{"arn:aws:iam::111122223333:role/team-a/s3.reader"}, false},
+		{"NoPatterns", []string{}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			if got := roleARNAllowed(role, c.patterns); got != c.want {
+				t.Errorf("Expected %v for patterns %v, got %v", c.want, c.patterns, got)
+			}
+		})
+	}
+}
+
+func TestNamespaceRoleAllowlist(t *testing.T) {
+	saRole := "arn:aws:iam::111122223333:role/s3-reader"
+
+	cases := []struct {
+		caseName    string
+		allowed     []string
+		deny        bool
+		defaults    bool
+		wantAllowed bool
+		wantRole    bool
+		violation   bool
+	}{
+		{"NoAnnotation", nil, false, false, true, true, false},
+		{"Allowed", []string{"arn:aws:iam::111122223333:role/*"}, false, false, true, true, false},
+		{"AllowedDeny", []string{"arn:aws:iam::111122223333:role/*"}, true, false, true, true, false},
+		{"NotAllowedSkipped", []string{"arn:aws:iam::444455556666:role/*"}, false, false, true, false, true},
+		{"NotAllowedDenied", []string{"arn:aws:iam::444455556666:role/*"}, true, false, false, false, true},
+		{"EmptyAnnotation", []string{}, false, false, true, false, true},
+		{"WithNamespaceDefaults", []string{"arn:aws:iam::444455556666:role/*"}, true, true, false, false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", saRole, "sts.amazonaws.com")
+			nsCache := cache.NewFakeNamespaceCache()
+			nsCache.Add("default", &cache.NamespaceResponse{AllowedRoleARNs: c.allowed})
+			modifier := NewModifier(
+				WithServiceAccountCache(saCache),
+				WithNamespaceCache(nsCache),
+				WithNamespaceDefaults(c.defaults),
+				WithDenyOnPolicyViolation(c.deny),
+			)
+
+			before := testutil.ToFloat64(rolePolicyViolationCounter.WithLabelValues("default", "false"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			if response.Allowed != c.wantAllowed {
+				t.Fatalf("Expected allowed %v, got %v", c.wantAllowed, response.Allowed)
+			}
+			if !response.Allowed {
+				if response.Result == nil || !strings.Contains(response.Result.Message, saRole) {
+					t.Errorf("Expected denial message naming %s, got %+v", saRole, response.Result)
+				}
+			} else {
+				pod := applyPatch(t, rawPodWithoutVolume, response)
+				wantRoles := []string{}
+				if c.wantRole {
+					wantRoles = []string{saRole}
+				}
+				if got := envValues(pod.Spec.Containers[0], "AWS_ROLE_ARN"); !reflect.DeepEqual(got, wantRoles) {
+					t.Errorf("Expected AWS_ROLE_ARN %v, got %v", wantRoles, got)
+				}
+			}
+
+			want := before
+			if c.violation {
+				want++
+			}
+			if after := testutil.ToFloat64(rolePolicyViolationCounter.WithLabelValues("default", "false")); after != want {
+				t.Errorf("Expected violation counter %v, got %v", want, after)
+			}
+		})
+	}
+}
+
+func getPodWithSkipPodIdentity(value string) []byte {
+	return []byte(fmt.Sprintf(`
+{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {
+	"name": "balajilovesoreos",
+	"uid": "be8695c4-4ad0-4038-8786-c508853aa255",
+	"annotations": {
+	  "eks.amazonaws.com/skip-pod-identity": %q
+	}
+  },
+  "spec": {
+	"containers": [
+	  {
+		"image": "amazonlinux",
+		"name": "balajilovesoreos"
+	  }
+	],
+	"serviceAccountName": "default"
+  }
+}
+`, value))
+}
+
+func TestSkipPodIdentity(t *testing.T) {
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+	}
+
+	cases := []struct {
+		caseName string
+		value    string
+		lenient  bool
+		skipped  bool
+		invalid  bool
+	}{
+		{"True", "true", false, true, false},
+		{"TrueUpperCase", "TRUE", false, true, false},
+		{"TrueCapitalized", "True", false, true, false},
+		{"TrueLeadingSpace", " true", false, true, false},
+		{"TrueSurroundingSpaces", "  True  ", false, true, false},
+		{"False", "false", false, false, false},
+		{"FalseTrailingSpace", "false ", false, false, false},
+		{"Invalid", "please", false, false, true},
+		{"Yes", "yes", false, false, true},
+		{"YesLenient", "yes", true, true, false},
+		{"OnLenient", " ON", true, true, false},
+		{"NoLenient", "no", true, false, false},
+		{"OffLenient", "Off", true, false, false},
+		{"InvalidLenient", "y", true, false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithLenientBooleanAnnotations(c.lenient),
+			)
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("pod-opt-out", "false"))
+			invalidBefore := testutil.ToFloat64(invalidPodAnnotationCounter.WithLabelValues("skip-pod-identity"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(getPodWithSkipPodIdentity(c.value)))
+			after := testutil.ToFloat64(skippedCounter.WithLabelValues("pod-opt-out", "false"))
+			if invalidAfter := testutil.ToFloat64(invalidPodAnnotationCounter.WithLabelValues("skip-pod-identity")); (invalidAfter > invalidBefore) != c.invalid {
+				t.Errorf("Expected invalid %v, got invalid annotation counter %v -> %v", c.invalid, invalidBefore, invalidAfter)
+			}
+
+			if !response.Allowed {
+				t.Errorf("Expected response to be allowed")
+			}
+			if c.skipped {
+				if response.Patch != nil {
+					t.Errorf("Expected no patch, got %s", string(response.Patch))
+				}
+				if after != before+1 {
+					t.Errorf("Expected skip counter to increase, got %v -> %v", before, after)
+				}
+			} else {
+				if response.Patch == nil {
+					t.Errorf("Expected a patch")
+				}
+				if after != before {
+					t.Errorf("Expected skip counter to be unchanged, got %v -> %v", before, after)
+				}
+			}
+		})
+	}
+}
+
+// getPodWithSidecars returns a pod with an init container and two containers
+// carrying the given annotations
+func getPodWithSidecars(annotations map[string]string) []byte {
+	pod := &v1.Pod{}
+	pod.Name = "balajilovesoreos"
+	pod.Annotations = annotations
+	pod.Spec.ServiceAccountName = "default"
+	pod.Spec.InitContainers = []v1.Container{{Name: "vault-agent", Image: "vault"}}
+	pod.Spec.Containers = []v1.Container{
+		{Name: "balajilovesoreos", Image: "amazonlinux"},
+		{Name: "istio-proxy", Image: "istio/proxyv2"},
+	}
+	raw, _ := json.Marshal(pod)
+	return raw
+}
+
+func TestInjectContainers(t *testing.T) {
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+	}
+
+	cases := []struct {
+		caseName    string
+		annotations map[string]string
+		injected    []string
+	}{
+		{
+			"Allowlist",
+			map[string]string{"eks.amazonaws.com/inject-containers": "balajilovesoreos"},
+			[]string{"balajilovesoreos"},
+		},
+		{
+			"AllowlistInitContainer",
+			map[string]string{"eks.amazonaws.com/inject-containers": "vault-agent, balajilovesoreos"},
+			[]string{"vault-agent", "balajilovesoreos"},
+		},
+		{
+			"AllowlistTakesPrecedenceOverSkipList",
+			map[string]string{
+				"eks.amazonaws.com/inject-containers": "balajilovesoreos,istio-proxy",
+				"eks.amazonaws.com/skip-containers":   "istio-proxy",
+			},
+			[]string{"balajilovesoreos", "istio-proxy"},
+		},
+		{
+			"AllowlistWithoutValidNames",
+			map[string]string{"eks.amazonaws.com/inject-containers": "does-not-exist"},
+			[]string{},
+		},
+		{
+			"EmptyAllowlist",
+			map[string]string{"eks.amazonaws.com/inject-containers": ""},
+			[]string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+			rawPod := getPodWithSidecars(c.annotations)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			pod := applyPatch(t, rawPod, response)
+
+			if got := injectedContainers(pod); !reflect.DeepEqual(got, c.injected) {
+				t.Errorf("Unexpected injected containers. Got %v, wanted %v", got, c.injected)
+			}
+			// The token volume is only added if a container is injected
+			expectedVolumes := 1
+			if len(c.injected) == 0 {
+				expectedVolumes = 0
+			}
+			if len(pod.Spec.Volumes) != expectedVolumes {
+				t.Errorf("Expected %d token volumes, got %d volumes", expectedVolumes, len(pod.Spec.Volumes))
+			}
+		})
+	}
+}
+
+func TestValidateSTSEndpointURL(t *testing.T) {
+	cases := []struct {
+		endpoint      string
+		allowInsecure bool
+		valid         bool
+	}{
+		{"https://sts.us-west-2.amazonaws.com", false, true},
+		{"https://vpce-0123.sts.us-west-2.vpce.amazonaws.com", false, true},
+		{"http://sts.us-west-2.amazonaws.com", false, false},
+		{"http://sts.us-west-2.amazonaws.com", true, true},
+		{"sts.us-west-2.amazonaws.com", false, false},
+		{"https://", false, false},
+		{"ftp://sts.us-west-2.amazonaws.com", true, false},
+		{"https://sts.us-west-2.amazonaws.com/%zz", false, false},
+	}
+
+	for _, c := range cases {
+		err := ValidateSTSEndpointURL(c.endpoint, c.allowInsecure)
+		if c.valid && err != nil {
+			t.Errorf("Expected %q (allowInsecure=%t) to be valid, got %v", c.endpoint, c.allowInsecure, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("Expected %q (allowInsecure=%t) to be invalid", c.endpoint, c.allowInsecure)
+		}
+	}
+}
+
+func TestSTSEndpoint(t *testing.T) {
+	flagEndpoint := "https://sts.us-west-2.amazonaws.com"
+	annotatedEndpoint := "https://vpce-0123.sts.us-west-2.vpce.amazonaws.com"
+
+	cases := []struct {
+		caseName      string
+		flag          string
+		annotation    string
+		allowInsecure bool
+		expected      []string
+	}{
+		{"Unset", "", "", false, []string{}},
+		{"Flag", flagEndpoint, "", false, []string{flagEndpoint}},
+		{"Annotation", "", annotatedEndpoint, false, []string{annotatedEndpoint}},
+		{"AnnotationOverridesFlag", flagEndpoint, annotatedEndpoint, false, []string{annotatedEndpoint}},
+		{"InsecureAnnotationFallsBackToFlag", flagEndpoint, "http://sts.internal", false, []string{flagEndpoint}},
+		{"InsecureAnnotationAllowed", flagEndpoint, "http://sts.internal", true, []string{"http://sts.internal"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			}
+			if c.annotation != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/sts-endpoint-url"] = c.annotation
+			}
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithSTSEndpoint(c.flag),
+				WithInsecureSTSEndpoint(c.allowInsecure),
+			)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+
+			if got := envValues(pod.Spec.Containers[0], "AWS_ENDPOINT_URL_STS"); !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("Expected AWS_ENDPOINT_URL_STS %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestRoleARNValidation(t *testing.T) {
+	cases := []struct {
+		caseName          string
+		roleARN           string
+		allowedPartitions []string
+		injected          bool
+	}{
+		{"Commercial", "arn:aws:iam::111122223333:role/s3-reader", nil, true},
+		{"China", "arn:aws-cn:iam::111122223333:role/s3-reader", nil, true},
+		{"GovCloud", "arn:aws-us-gov:iam::111122223333:role/s3-reader", nil, true},
+		{"RolePath", "arn:aws:iam::111122223333:role/team/s3-reader", nil, true},
+		{"RestrictedPartition", "arn:aws:iam::111122223333:role/s3-reader", []string{"aws-us-gov"}, false},
+		{"UnknownPartition", "arn:aws-iso:iam::111122223333:role/s3-reader", nil, false},
+		{"MissingAccount", "arn:aws:iam:::role/s3-reader", nil, false},
+		{"ShortAccount", "arn:aws:iam::11112222:role/s3-reader", nil, false},
+		{"WrongService", "arn:aws:s3::111122223333:role/s3-reader", nil, false},
+		{"Region", "arn:aws:iam:us-west-2:111122223333:role/s3-reader", nil, false},
+		{"User", "arn:aws:iam::111122223333:user/s3-reader", nil, false},
+		{"MissingRoleName", "arn:aws:iam::111122223333:role/", nil, false},
+		{"NotAnARN", "s3-reader", nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": c.roleARN,
+			}
+			opts := []ModifierOpt{WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount))}
+			if c.allowedPartitions != nil {
+				opts = append(opts, WithAllowedPartitions(c.allowedPartitions))
+			}
+			modifier := NewModifier(opts...)
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("invalid-role-arn", "false"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			after := testutil.ToFloat64(skippedCounter.WithLabelValues("invalid-role-arn", "false"))
+
+			if !response.Allowed {
+				t.Errorf("Expected response to be allowed")
+			}
+			if c.injected {
+				pod := applyPatch(t, rawPodWithoutVolume, response)
+				if got := envValues(pod.Spec.Containers[0], "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{c.roleARN}) {
+					t.Errorf("Expected AWS_ROLE_ARN %v, got %v", c.roleARN, got)
+				}
+				if after != before {
+					t.Errorf("Expected skip counter to be unchanged, got %v -> %v", before, after)
+				}
+			} else {
+				if response.Patch != nil {
+					t.Errorf("Expected no patch, got %s", string(response.Patch))
+				}
+				if after != before+1 {
+					t.Errorf("Expected skip counter to increase, got %v -> %v", before, after)
+				}
+			}
+		})
+	}
+}
+
+func TestValidatePartitions(t *testing.T) {
+	if err := ValidatePartitions(DefaultPartitions); err != nil {
+		t.Errorf("Expected default partitions to be valid, got %v", err)
+	}
+	if err := ValidatePartitions([]string{"aws", "aws-iso"}); err == nil {
+		t.Errorf("Expected aws-iso to be invalid")
+	}
+}
+
+func TestConfigMapRole(t *testing.T) {
+	saRole := "arn:aws:iam::111122223333:role/s3-reader"
+	cmRole := "arn:aws:iam::111122223333:role/configmap"
+	nsRole := "arn:aws:iam::111122223333:role/namespace-default"
+
+	cases := []struct {
+		caseName    string
+		saRole      string
+		cmMapped    bool
+		nsRole      string
+		wantRole    string
+		wantAud     string
+		regionalSTS bool
+		source      string
+	}{
+		{"ServiceAccountRoleWins", saRole, true, nsRole, saRole, "sts.amazonaws.com", false, "service-account"},
+		{"NamespaceWinsOverConfigMap", "", true, nsRole, nsRole, "sts.amazonaws.com", false, "namespace"},
+		{"ConfigMapWithoutNamespaceDefault", "", true, "", cmRole, "custom", true, "configmap"},
+		{"NotMapped", "", false, nsRole, nsRole, "sts.amazonaws.com", false, "namespace"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.AddResponse("default", "default", &cache.CacheResponse{RoleARN: c.saRole, Audience: "sts.amazonaws.com", DefaultAudience: true})
+			cmCache := cache.NewFakeConfigMapCache()
+			if c.cmMapped {
+				regionalSTS := true
+				cmCache.Add("default", "default", &cache.CacheResponse{RoleARN: cmRole, Audience: "custom", UseRegionalSTS: &regionalSTS})
+			}
+			nsCache := cache.NewFakeNamespaceCache()
+			nsCache.Add("default", &cache.NamespaceResponse{DefaultRoleARN: c.nsRole})
+			modifier := NewModifier(
+				WithServiceAccountCache(saCache),
+				WithConfigMapCache(cmCache),
+				WithNamespaceCache(nsCache),
+				WithNamespaceDefaults(true),
+			)
+
+			before := testutil.ToFloat64(injectionCounter.WithLabelValues(c.source, "false"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+
+			if got := envValues(pod.Spec.Containers[0], "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{c.wantRole}) {
+				t.Errorf("Expected AWS_ROLE_ARN %v, got %v", c.wantRole, got)
+			}
+			if got := pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.Audience; got != c.wantAud {
+				t.Errorf("Expected audience %s, got %s", c.wantAud, got)
+			}
+			if got := len(envValues(pod.Spec.Containers[0], "AWS_STS_REGIONAL_ENDPOINTS")) == 1; got != c.regionalSTS {
+				t.Errorf("Expected regional STS %t, got %t", c.regionalSTS, got)
+			}
+			if after := testutil.ToFloat64(injectionCounter.WithLabelValues(c.source, "false")); after != before+1 {
+				t.Errorf("Expected %s injection counter to increase, got %v -> %v", c.source, before, after)
+			}
+		})
+	}
+}
+
+func getPodWithEnv(env []v1.EnvVar) []byte {
+	pod := &v1.Pod{}
+	pod.Name = "balajilovesoreos"
+	pod.Spec.ServiceAccountName = "default"
+	pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux", Env: env}}
+	raw, _ := json.Marshal(pod)
+	return raw
+}
+
+func TestExistingEnv(t *testing.T) {
+	roleARN := "arn:aws:iam::111122223333:role/s3-reader"
+	tokenFile := "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"
+	fromSecret := &v1.EnvVarSource{
+		SecretKeyRef: &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: "aws"},
+			Key:                  "role",
+		},
+	}
+
+	cases := []struct {
+		caseName  string
+		env       []v1.EnvVar
+		expected  []string
+		mountsVol bool
+	}{
+		{
+			"NoEnv",
+			nil,
+			[]string{"AWS_ROLE_ARN=" + roleARN, "AWS_WEB_IDENTITY_TOKEN_FILE=" + tokenFile},
+			true,
+		},
+		{
+			"RoleARNDefined",
+			[]v1.EnvVar{{Name: "AWS_ROLE_ARN", Value: "arn:aws:iam::111122223333:role/stale"}},
+			[]string{"AWS_ROLE_ARN=arn:aws:iam::111122223333:role/stale", "AWS_WEB_IDENTITY_TOKEN_FILE=" + tokenFile},
+			true,
+		},
+		{
+			"RoleARNFromSecret",
+			[]v1.EnvVar{{Name: "AWS_ROLE_ARN", ValueFrom: fromSecret}},
+			[]string{"AWS_ROLE_ARN=", "AWS_WEB_IDENTITY_TOKEN_FILE=" + tokenFile},
+			true,
+		},
+		{
+			"TokenFileDefined",
+			[]v1.EnvVar{{Name: "AWS_WEB_IDENTITY_TOKEN_FILE", Value: "/token"}},
+			[]string{"AWS_WEB_IDENTITY_TOKEN_FILE=/token", "AWS_ROLE_ARN=" + roleARN},
+			false,
+		},
+		{
+			"BothDefined",
+			[]v1.EnvVar{
+				{Name: "AWS_WEB_IDENTITY_TOKEN_FILE", Value: "/token"},
+				{Name: "AWS_ROLE_ARN", ValueFrom: fromSecret},
+			},
+			[]string{"AWS_WEB_IDENTITY_TOKEN_FILE=/token", "AWS_ROLE_ARN="},
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", roleARN, "sts.amazonaws.com")
+			modifier := NewModifier(WithServiceAccountCache(saCache))
+			rawPod := getPodWithEnv(c.env)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			pod := applyPatch(t, rawPod, response)
+
+			container := pod.Spec.Containers[0]
+			env := []string{}
+			for _, e := range container.Env {
+				env = append(env, e.Name+"="+e.Value)
+			}
+			if !reflect.DeepEqual(env, c.expected) {
+				t.Errorf("Expected env %v, got %v", c.expected, env)
+			}
+			if c.env != nil && !reflect.DeepEqual(container.Env[:len(c.env)], c.env) {
+				t.Errorf("Expected existing env %v to be untouched, got %v", c.env, container.Env)
+			}
+			if mounted := len(container.VolumeMounts) == 1; mounted != c.mountsVol {
+				t.Errorf("Expected token mounted to be %t, got mounts %v", c.mountsVol, container.VolumeMounts)
+			}
+		})
+	}
+}
+
+func TestForceEnvOverride(t *testing.T) {
+	roleARN := "arn:aws:iam::111122223333:role/s3-reader"
+	tokenFile := "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"
+
+	pod := &v1.Pod{}
+	pod.Name = "balajilovesoreos"
+	pod.Spec.ServiceAccountName = "default"
+	pod.Spec.InitContainers = []v1.Container{{
+		Name:  "init",
+		Image: "amazonlinux",
+		Env:   []v1.EnvVar{{Name: "AWS_ROLE_ARN", Value: "arn:aws:iam::111122223333:role/stale"}},
+	}}
+	pod.Spec.Containers = []v1.Container{
+		{Name: "sidecar", Image: "amazonlinux"},
+		{
+			Name:  "balajilovesoreos",
+			Image: "amazonlinux",
+			Env: []v1.EnvVar{
+				{Name: "FOO", Value: "foo"},
+				{Name: "AWS_WEB_IDENTITY_TOKEN_FILE", Value: "/token"},
+				{Name: "BAR", Value: "bar"},
+				{Name: "AWS_STS_REGIONAL_ENDPOINTS", Value: "legacy"},
+				{Name: "AWS_ROLE_ARN", ValueFrom: &v1.EnvVarSource{
+					SecretKeyRef: &v1.SecretKeySelector{
+						LocalObjectReference: v1.LocalObjectReference{Name: "aws"},
+						Key:                  "role",
+					},
+				}},
+			},
+		},
+	}
+	rawPod, _ := json.Marshal(pod)
+
+	cases := []struct {
+		caseName     string
+		force        string
+		replacePaths []string
+		env          []string
+	}{
+		{
+			"Force",
+			"true",
+			[]string{
+				"/spec/initContainers/0/env/0",
+				"/spec/containers/1/env/4",
+				"/spec/containers/1/env/1",
+				"/spec/containers/1/env/3",
+			},
+			[]string{
+				"FOO=foo",
+				"AWS_WEB_IDENTITY_TOKEN_FILE=" + tokenFile,
+				"BAR=bar",
+				"AWS_STS_REGIONAL_ENDPOINTS=regional",
+				"AWS_ROLE_ARN=" + roleARN,
+			},
+		},
+		{
+			"NoForce",
+			"false",
+			[]string{},
+			[]string{
+				"FOO=foo",
+				"AWS_WEB_IDENTITY_TOKEN_FILE=/token",
+				"BAR=bar",
+				"AWS_STS_REGIONAL_ENDPOINTS=legacy",
+				"AWS_ROLE_ARN=",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn":               roleARN,
+				"eks.amazonaws.com/sts-regional-endpoints": "true",
+				"eks.amazonaws.com/force-env-override":     c.force,
+			}
+			modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+
+			var patch []PatchOperation
+			if err := json.Unmarshal(response.Patch, &patch); err != nil {
+				t.Fatalf("Error unmarshaling patch: %v", err)
+			}
+			replacePaths := []string{}
+			for _, op := range patch {
+				if op.Op == "replace" {
+					replacePaths = append(replacePaths, op.Path)
+				}
+			}
+			if !reflect.DeepEqual(replacePaths, c.replacePaths) {
+				t.Errorf("Expected replace ops at %v, got %v", c.replacePaths, replacePaths)
+			}
+
+			patched := applyPatch(t, rawPod, response)
+			env := []string{}
+			for _, e := range patched.Spec.Containers[1].Env {
+				env = append(env, e.Name+"="+e.Value)
+			}
+			if !reflect.DeepEqual(env, c.env) {
+				t.Errorf("Expected env %v, got %v", c.env, env)
+			}
+			if c.force == "true" {
+				if got := envValues(patched.Spec.InitContainers[0], "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{roleARN}) {
+					t.Errorf("Expected init container AWS_ROLE_ARN %s, got %v", roleARN, got)
+				}
+				if patched.Spec.Containers[1].Env[4].ValueFrom != nil {
+					t.Errorf("Expected AWS_ROLE_ARN valueFrom to be replaced")
+				}
+				if len(patched.Spec.Containers[1].VolumeMounts) != 1 {
+					t.Errorf("Expected token to be mounted, got %v", patched.Spec.Containers[1].VolumeMounts)
+				}
+			}
+			if got := envValues(patched.Spec.Containers[0], "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{roleARN}) {
+				t.Errorf("Expected sidecar AWS_ROLE_ARN %s, got %v", roleARN, got)
+			}
+		})
+	}
+}
+
+func getPodWithOS(nodeSelector map[string]string, os v1.OSName) []byte {
+	pod := &v1.Pod{}
+	pod.Name = "balajilovesoreos"
+	pod.Spec.ServiceAccountName = "default"
+	pod.Spec.NodeSelector = nodeSelector
+	if os != "" {
+		pod.Spec.OS = &v1.PodOS{Name: os}
+	}
+	pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux"}}
+	raw, _ := json.Marshal(pod)
+	return raw
+}
+
+func TestWindowsTokenPath(t *testing.T) {
+	cases := []struct {
+		caseName         string
+		pod              []byte
+		windowsMountPath string
+		tokenFile        string
+		mountPath        string
+	}{
+		{
+			"NoSignal",
+			getPodWithOS(nil, ""),
+			"",
+			"/var/run/secrets/eks.amazonaws.com/serviceaccount/token",
+			"/var/run/secrets/eks.amazonaws.com/serviceaccount",
+		},
+		{
+			"LinuxOS",
+			getPodWithOS(nil, v1.Linux),
+			`C:\secrets`,
+			"/var/run/secrets/eks.amazonaws.com/serviceaccount/token",
+			"/var/run/secrets/eks.amazonaws.com/serviceaccount",
+		},
+		{
+			"NodeSelector",
+			getPodWithOS(map[string]string{"kubernetes.io/os": "windows"}, ""),
+			"",
+			`C:\var\run\secrets\eks.amazonaws.com\serviceaccount\token`,
+			"/var/run/secrets/eks.amazonaws.com/serviceaccount",
+		},
+		{
+			"SpecOS",
+			getPodWithOS(nil, v1.Windows),
+			"",
+			`C:\var\run\secrets\eks.amazonaws.com\serviceaccount\token`,
+			"/var/run/secrets/eks.amazonaws.com/serviceaccount",
+		},
+		{
+			"CustomPath",
+			getPodWithOS(nil, v1.Windows),
+			`C:\ProgramData\eks\serviceaccount`,
+			`C:\ProgramData\eks\serviceaccount\token`,
+			"/ProgramData/eks/serviceaccount",
+		},
+		{
+			"CustomPathOtherDrive",
+			getPodWithOS(map[string]string{"beta.kubernetes.io/os": "windows"}, ""),
+			`D:\eks\serviceaccount`,
+			`D:\eks\serviceaccount\token`,
+			"D:/eks/serviceaccount",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+			modifier := NewModifier(
+				WithServiceAccountCache(saCache),
+				WithWindowsMountPath(c.windowsMountPath),
+			)
+			response := modifier.AdmitPod(context.Background(), getValidReview(c.pod))
+			pod := applyPatch(t, c.pod, response)
+
+			container := pod.Spec.Containers[0]
+			if got := envValues(container, "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, []string{c.tokenFile}) {
+				t.Errorf("Expected AWS_WEB_IDENTITY_TOKEN_FILE %s, got %v", c.tokenFile, got)
+			}
+			if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != c.mountPath {
+				t.Errorf("Expected mount at %s, got %v", c.mountPath, container.VolumeMounts)
+			}
+		})
+	}
+}
+
+func TestValidateWindowsMountPath(t *testing.T) {
+	cases := []struct {
+		mountPath string
+		valid     bool
+	}{
+		{`C:\var\run\secrets\eks.amazonaws.com\serviceaccount`, true},
+		{`d:\secrets`, true},
+		{`/var/run/secrets`, false},
+		{`C:secrets`, false},
+		{`C:\secrets\..\other`, false},
+		{``, false},
+	}
+
+	for _, c := range cases {
+		err := ValidateWindowsMountPath(c.mountPath)
+		if c.valid && err != nil {
+			t.Errorf("Expected %q to be valid, got %v", c.mountPath, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("Expected %q to be invalid", c.mountPath)
+		}
+	}
+}
+
+func TestContainerRoles(t *testing.T) {
+	saRole := "arn:aws:iam::111122223333:role/s3-reader"
+	appRole := "arn:aws:iam::111122223333:role/app"
+	proxyRole := "arn:aws:iam::111122223333:role/proxy"
+
+	cases := []struct {
+		caseName   string
+		saRole     string
+		annotation string
+		roles      map[string][]string
+		invalid    bool
+	}{
+		{
+			"PerContainerRoles",
+			saRole,
+			fmt.Sprintf(`{"balajilovesoreos": %q, "istio-proxy": %q}`, appRole, proxyRole),
+			map[string][]string{"vault-agent": {saRole}, "balajilovesoreos": {appRole}, "istio-proxy": {proxyRole}},
+			false,
+		},
+		{
+			"UnlistedWithoutServiceAccountRole",
+			"",
+			fmt.Sprintf(`{"balajilovesoreos": %q}`, appRole),
+			map[string][]string{"vault-agent": {}, "balajilovesoreos": {appRole}, "istio-proxy": {}},
+			false,
+		},
+		{
+			"MalformedJSON",
+			saRole,
+			fmt.Sprintf(`{"balajilovesoreos": %q`, appRole),
+			map[string][]string{"vault-agent": {saRole}, "balajilovesoreos": {saRole}, "istio-proxy": {saRole}},
+			true,
+		},
+		{
+			"InvalidRoleARN",
+			saRole,
+			fmt.Sprintf(`{"balajilovesoreos": "app", "istio-proxy": %q}`, proxyRole),
+			map[string][]string{"vault-agent": {saRole}, "balajilovesoreos": {saRole}, "istio-proxy": {proxyRole}},
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", c.saRole, "sts.amazonaws.com")
+			modifier := NewModifier(WithServiceAccountCache(saCache))
+			rawPod := getPodWithSidecars(map[string]string{"eks.amazonaws.com/container-roles": c.annotation})
+
+			before := testutil.ToFloat64(invalidPodAnnotationCounter.WithLabelValues("container-roles"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			after := testutil.ToFloat64(invalidPodAnnotationCounter.WithLabelValues("container-roles"))
+			if !response.Allowed {
+				t.Errorf("Expected response to be allowed")
+			}
+			pod := applyPatch(t, rawPod, response)
+
+			if len(pod.Spec.Volumes) != 1 {
+				t.Errorf("Expected a single shared token volume, got %v", pod.Spec.Volumes)
+			}
+			containers := append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+			for _, container := range containers {
+				if got := envValues(container, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, c.roles[container.Name]) {
+					t.Errorf("Expected %s AWS_ROLE_ARN %v, got %v", container.Name, c.roles[container.Name], got)
+				}
+			}
+			if c.invalid && after != before+1 {
+				t.Errorf("Expected invalid annotation counter to increase, got %v -> %v", before, after)
+			}
+			if !c.invalid && after != before {
+				t.Errorf("Expected invalid annotation counter to be unchanged, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestRoleARNTemplate(t *testing.T) {
+	tmpl, err := ParseRoleARNTemplate("arn:aws:iam::{{.AccountID}}:role/{{.Namespace}}-{{.ServiceAccount}}-{{.RoleName}}")
+	if err != nil {
+		t.Fatalf("Error parsing template: %v", err)
+	}
+	badTmpl := template.Must(template.New("bad").Parse("arn:aws:iam::{{.AccountID}}:role/{{.Missing}}"))
+
+	cases := []struct {
+		caseName    string
+		template    *template.Template
+		annotations map[string]string
+		expected    []string
+		skipped     bool
+	}{
+		{
+			"RoleName",
+			tmpl,
+			map[string]string{"eks.amazonaws.com/role-name": "s3-reader"},
+			[]string{"arn:aws:iam::111122223333:role/default-default-s3-reader"},
+			false,
+		},
+		{
+			"BareRoleARN",
+			tmpl,
+			map[string]string{"eks.amazonaws.com/role-arn": "s3-reader"},
+			[]string{"arn:aws:iam::111122223333:role/default-default-s3-reader"},
+			false,
+		},
+		{
+			"FullARNTakesPrecedence",
+			tmpl,
+			map[string]string{
+				"eks.amazonaws.com/role-arn":  "arn:aws:iam::111122223333:role/s3-reader",
+				"eks.amazonaws.com/role-name": "s3-writer",
+			},
+			[]string{"arn:aws:iam::111122223333:role/s3-reader"},
+			false,
+		},
+		{
+			"NoTemplate",
+			nil,
+			map[string]string{"eks.amazonaws.com/role-name": "s3-reader"},
+			[]string{},
+			true,
+		},
+		{
+			"RenderError",
+			badTmpl,
+			map[string]string{"eks.amazonaws.com/role-name": "s3-reader"},
+			[]string{},
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = c.annotations
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithRoleARNTemplate(c.template),
+				WithAccountID("111122223333"),
+			)
+
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("role-arn-template", "false"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			after := testutil.ToFloat64(skippedCounter.WithLabelValues("role-arn-template", "false"))
+			if !response.Allowed {
+				t.Errorf("Expected response to be allowed")
+			}
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+
+			if got := envValues(pod.Spec.Containers[0], "AWS_ROLE_ARN"); !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("Expected AWS_ROLE_ARN %v, got %v", c.expected, got)
+			}
+			if c.skipped && after != before+1 {
+				t.Errorf("Expected skip counter to increase, got %v -> %v", before, after)
+			}
+			if !c.skipped && after != before {
+				t.Errorf("Expected skip counter to be unchanged, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestParseRoleARNTemplate(t *testing.T) {
+	cases := []struct {
+		text  string
+		valid bool
+	}{
+		{"arn:aws:iam::{{.AccountID}}:role/{{.Namespace}}-{{.ServiceAccount}}", true},
+		{"arn:aws:iam::{{.AccountID}}:role/{{.RoleName}}", true},
+		{"arn:aws:iam::{{.AccountID}}:role/{{.Namespace", false},
+		{"arn:aws:iam::{{.AccountID}}:role/{{.Cluster}}", false},
+	}
+
+	for _, c := range cases {
+		_, err := ParseRoleARNTemplate(c.text)
+		if c.valid && err != nil {
+			t.Errorf("Expected %q to be valid, got %v", c.text, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("Expected %q to be invalid", c.text)
+		}
+	}
+}
+
+func TestDefaultsCache(t *testing.T) {
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+	}
+	annotatedServiceAccount := testServiceAccount.DeepCopy()
+	annotatedServiceAccount.Name = "annotated"
+	annotatedServiceAccount.Annotations["eks.amazonaws.com/audience"] = "annotated"
+
+	defaults := cache.NewFakeDefaultsCache(cache.Defaults{
+		TokenAudience:   "sts.amazonaws.com",
+		TokenExpiration: 86400,
+		MountPath:       "/var/run/secrets/eks.amazonaws.com/serviceaccount",
+	})
+	modifier := NewModifier(
+		WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount, annotatedServiceAccount)),
+		WithDefaultsCache(defaults),
+	)
+
+	mutate := func(serviceAccount string) *v1.Pod {
+		t.Helper()
+		pod := &v1.Pod{}
+		pod.Name = "balajilovesoreos"
+		pod.Spec.ServiceAccountName = serviceAccount
+		pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux"}}
+		rawPod, _ := json.Marshal(pod)
+		return applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+	}
+	token := func(pod *v1.Pod) *v1.ServiceAccountTokenProjection {
+		return pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken
+	}
+
+	pod := mutate("default")
+	if got := token(pod).Audience; got != "sts.amazonaws.com" {
+		t.Errorf("Expected audience sts.amazonaws.com, got %s", got)
+	}
+
+	defaults.Set(cache.Defaults{
+		TokenAudience:   "updated",
+		TokenExpiration: 3600,
+		MountPath:       "/var/run/secrets/updated",
+		RegionalSTS:     true,
+	})
+
+	pod = mutate("default")
+	if got := token(pod).Audience; got != "updated" {
+		t.Errorf("Expected audience updated, got %s", got)
+	}
+	if got := *token(pod).ExpirationSeconds; got != 3600 {
+		t.Errorf("Expected expirationSeconds 3600, got %d", got)
+	}
+	if got := pod.Spec.Containers[0].VolumeMounts[0].MountPath; got != "/var/run/secrets/updated" {
+		t.Errorf("Expected mount path /var/run/secrets/updated, got %s", got)
+	}
+	if got := envValues(pod.Spec.Containers[0], "AWS_STS_REGIONAL_ENDPOINTS"); !reflect.DeepEqual(got, []string{"regional"}) {
+		t.Errorf("Expected AWS_STS_REGIONAL_ENDPOINTS regional, got %v", got)
+	}
+
+	// An annotated audience takes precedence over the default
+	pod = mutate("annotated")
+	if got := token(pod).Audience; got != "annotated" {
+		t.Errorf("Expected audience annotated, got %s", got)
+	}
+}
+
+func TestNamespaceDefaultAudience(t *testing.T) {
+	cases := []struct {
+		caseName   string
+		saAudience string
+		nsAudience string
+		nsCache    bool
+		expected   string
+	}{
+		{"ServiceAccountAnnotationWins", "annotated", "namespace", true, "annotated"},
+		{"NamespaceAnnotation", "", "namespace", true, "namespace"},
+		{"NamespaceWithoutAnnotation", "", "", true, "sts.amazonaws.com"},
+		{"NamespaceDefaultsDisabled", "", "namespace", false, "sts.amazonaws.com"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			}
+			if c.saAudience != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/audience"] = c.saAudience
+			}
+			testNamespace := &v1.Namespace{}
+			testNamespace.Name = "default"
+			if c.nsAudience != "" {
+				testNamespace.Annotations = map[string]string{"eks.amazonaws.com/default-audience": c.nsAudience}
+			}
+			opts := []ModifierOpt{WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount))}
+			if c.nsCache {
+				opts = append(opts, WithNamespaceCache(cache.NewFakeNamespaceCache(testNamespace)), WithNamespaceDefaults(true))
+			}
+			modifier := NewModifier(opts...)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+
+			if got := pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.Audience; got != c.expected {
+				t.Errorf("Expected audience %s, got %s", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestTokenFileName(t *testing.T) {
+	cases := []struct {
+		caseName  string
+		value     string
+		audience  string
+		tokenFile string
+	}{
+		{"Default", "", "", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"},
+		{"Custom", "oidc-token", "", "/var/run/secrets/eks.amazonaws.com/serviceaccount/oidc-token"},
+		{"Invalid", "../oidc-token", "", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"},
+		{"MultipleAudiences", "oidc-token", "sts.amazonaws.com,vault", "/var/run/secrets/eks.amazonaws.com/serviceaccount/0/oidc-token"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			}
+			if c.value != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/token-file-name"] = c.value
+			}
+			if c.audience != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/audience"] = c.audience
+			}
+			modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+
+			container := pod.Spec.Containers[0]
+			if got := envValues(container, "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, []string{c.tokenFile}) {
+				t.Errorf("Expected AWS_WEB_IDENTITY_TOKEN_FILE %s, got %v", c.tokenFile, got)
+			}
+			// The env var must point at the projected token of the first volume
+			sourcePath := pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.Path
+			if got := path.Join(container.VolumeMounts[0].MountPath, sourcePath); got != c.tokenFile {
+				t.Errorf("Expected projected token at %s, got %s", c.tokenFile, got)
+			}
+		})
+	}
+}
+
+func TestDefaultFSGroup(t *testing.T) {
+	int64Ptr := func(i int64) *int64 { return &i }
+
+	cases := []struct {
+		caseName        string
+		flag            *int64
+		annotation      string
+		securityContext *v1.PodSecurityContext
+		os              v1.OSName
+		expected        *v1.PodSecurityContext
+	}{
+		{"Disabled", nil, "", nil, "", nil},
+		{"NoSecurityContext", int64Ptr(1000), "", nil, "", &v1.PodSecurityContext{FSGroup: int64Ptr(1000)}},
+		{
+			"SecurityContextWithoutFSGroup",
+			int64Ptr(1000),
+			"",
+			&v1.PodSecurityContext{RunAsUser: int64Ptr(1001)},
+			"",
+			&v1.PodSecurityContext{RunAsUser: int64Ptr(1001), FSGroup: int64Ptr(1000)},
+		},
+		{
+			"ExplicitFSGroup",
+			int64Ptr(1000),
+			"",
+			&v1.PodSecurityContext{FSGroup: int64Ptr(2000)},
+			"",
+			&v1.PodSecurityContext{FSGroup: int64Ptr(2000)},
+		},
+		{"Annotation", nil, "3000", nil, "", &v1.PodSecurityContext{FSGroup: int64Ptr(3000)}},
+		{"AnnotationOverridesFlag", int64Ptr(1000), "3000", nil, "", &v1.PodSecurityContext{FSGroup: int64Ptr(3000)}},
+		{"InvalidAnnotation", int64Ptr(1000), "wheel", nil, "", &v1.PodSecurityContext{FSGroup: int64Ptr(1000)}},
+		{"Windows", int64Ptr(1000), "", nil, v1.Windows, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			}
+			if c.annotation != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/default-fs-group"] = c.annotation
+			}
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithDefaultFSGroup(c.flag),
+			)
+
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			pod.Spec.ServiceAccountName = "default"
+			pod.Spec.SecurityContext = c.securityContext
+			if c.os != "" {
+				pod.Spec.OS = &v1.PodOS{Name: c.os}
+			}
+			pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux"}}
+			rawPod, _ := json.Marshal(pod)
+
+			before := testutil.ToFloat64(fsGroupDefaultedCounter)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			after := testutil.ToFloat64(fsGroupDefaultedCounter)
+			patched := applyPatch(t, rawPod, response)
+
+			if !reflect.DeepEqual(patched.Spec.SecurityContext, c.expected) {
+				t.Errorf("Expected securityContext %+v, got %+v", c.expected, patched.Spec.SecurityContext)
+			}
+			defaulted := !reflect.DeepEqual(c.securityContext, c.expected)
+			if defaulted && after != before+1 {
+				t.Errorf("Expected fsGroup counter to increase, got %v -> %v", before, after)
+			}
+			if !defaulted && after != before {
+				t.Errorf("Expected fsGroup counter to be unchanged, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	cases := []struct {
+		mode     string
+		expected int32
+		valid    bool
+	}{
+		{"0400", 256, true},
+		{"0440", 288, true},
+		{"0640", 416, true},
+		{"644", 420, true},
+		{"0", 0, true},
+		{"0777", 511, true},
+		{"01000", 0, false},
+		{"-1", 0, false},
+		{"0800", 0, false},
+		{"rw-r-----", 0, false},
+		{"", 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.mode, func(t *testing.T) {
+			mode, err := ParseFileMode(c.mode)
+			if c.valid && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if !c.valid && err == nil {
+				t.Errorf("Expected an error for %q", c.mode)
+			}
+			if mode != c.expected {
+				t.Errorf("Expected mode %d, got %d", c.expected, mode)
+			}
+		})
+	}
+}
+
+func TestTokenFileMode(t *testing.T) {
+	int32Ptr := func(i int32) *int32 { return &i }
+
+	cases := []struct {
+		caseName   string
+		flag       *int32
+		annotation string
+		expected   *int32
+	}{
+		{"Unset", nil, "", nil},
+		{"Flag", int32Ptr(0400), "", int32Ptr(256)},
+		{"Annotation", nil, "0440", int32Ptr(288)},
+		{"AnnotationOverridesFlag", int32Ptr(0400), "0640", int32Ptr(416)},
+		{"InvalidAnnotation", int32Ptr(0400), "0999", int32Ptr(256)},
+		{"InvalidAnnotationWithoutFlag", nil, "rw", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			}
+			if c.annotation != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/token-file-mode"] = c.annotation
+			}
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithTokenFileMode(c.flag),
+			)
+
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			pod.Spec.ServiceAccountName = "default"
+			pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux"}}
+			rawPod, _ := json.Marshal(pod)
+
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			if c.expected != nil {
+				expected := fmt.Sprintf(`"defaultMode":%d`, *c.expected)
+				if !strings.Contains(string(response.Patch), expected) {
+					t.Errorf("Expected patch to contain %s, got %s", expected, string(response.Patch))
+				}
+			} else if strings.Contains(string(response.Patch), "defaultMode") {
+				t.Errorf("Expected patch without defaultMode, got %s", string(response.Patch))
+			}
+
+			patched := applyPatch(t, rawPod, response)
+			var volume *v1.Volume
+			for i := range patched.Spec.Volumes {
+				if patched.Spec.Volumes[i].Name == "aws-iam-token" {
+					volume = &patched.Spec.Volumes[i]
+				}
+			}
+			if volume == nil || volume.Projected == nil {
+				t.Fatalf("Expected projected token volume, got %+v", patched.Spec.Volumes)
+			}
+			if !reflect.DeepEqual(volume.Projected.DefaultMode, c.expected) {
+				t.Errorf("Expected defaultMode %v, got %v", c.expected, volume.Projected.DefaultMode)
+			}
+		})
+	}
+}
+
+func TestContainerCredentials(t *testing.T) {
+	const roleARN = "arn:aws:iam::111122223333:role/s3-reader"
+	tokenFile := "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"
+
+	cases := []struct {
+		caseName         string
+		annotations      map[string]string
+		uri              string
+		container        bool
+		mutated          bool
+		expectedAudience string
+	}{
+		{"Container", map[string]string{"eks.amazonaws.com/role-arn": roleARN, "eks.amazonaws.com/credential-mode": "container"}, DefaultContainerCredentialsURI, true, true, "pods.eks.amazonaws.com"},
+		{"ContainerWithoutRole", map[string]string{"eks.amazonaws.com/credential-mode": "Container"}, DefaultContainerCredentialsURI, true, true, "pods.eks.amazonaws.com"},
+		{"ContainerWithRegionalSTS", map[string]string{"eks.amazonaws.com/credential-mode": "container", "eks.amazonaws.com/sts-regional-endpoints": "true"}, DefaultContainerCredentialsURI, true, true, "pods.eks.amazonaws.com"},
+		{"ContainerCustomURI", map[string]string{"eks.amazonaws.com/credential-mode": "container"}, "http://[fd00:ec2::23]/v1/credentials", true, true, "pods.eks.amazonaws.com"},
+		{"Missing", map[string]string{"eks.amazonaws.com/role-arn": roleARN}, DefaultContainerCredentialsURI, false, true, "sts.amazonaws.com"},
+		{"IRSA", map[string]string{"eks.amazonaws.com/role-arn": roleARN, "eks.amazonaws.com/credential-mode": "irsa"}, DefaultContainerCredentialsURI, false, true, "sts.amazonaws.com"},
+		{"Invalid", map[string]string{"eks.amazonaws.com/role-arn": roleARN, "eks.amazonaws.com/credential-mode": "agent"}, DefaultContainerCredentialsURI, false, true, "sts.amazonaws.com"},
+		{"Disabled", map[string]string{"eks.amazonaws.com/role-arn": roleARN, "eks.amazonaws.com/credential-mode": "container"}, "", false, true, "sts.amazonaws.com"},
+		{"DisabledWithoutRole", map[string]string{"eks.amazonaws.com/credential-mode": "container"}, "", false, false, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = c.annotations
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithContainerCredentialsURI(c.uri),
+			)
+
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+			if !c.mutated {
+				if response.Patch != nil {
+					t.Errorf("Expected no patch, got %s", string(response.Patch))
+				}
+				return
+			}
+
+			container := pod.Spec.Containers[0]
+			expected := map[string][]string{
+				"AWS_CONTAINER_CREDENTIALS_FULL_URI":     {},
+				"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE": {},
+				"AWS_ROLE_ARN":                           {roleARN},
+				"AWS_WEB_IDENTITY_TOKEN_FILE":            {tokenFile},
+			}
+			if c.container {
+				expected = map[string][]string{
+					"AWS_CONTAINER_CREDENTIALS_FULL_URI":     {c.uri},
+					"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE": {tokenFile},
+					"AWS_ROLE_ARN":                           {},
+					"AWS_WEB_IDENTITY_TOKEN_FILE":            {},
+					"AWS_STS_REGIONAL_ENDPOINTS":             {},
+				}
+			}
+			for name, values := range expected {
+				if got := envValues(container, name); !reflect.DeepEqual(got, values) {
+					t.Errorf("Expected %s %v, got %v", name, values, got)
+				}
+			}
+			if got := pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.Audience; got != c.expectedAudience {
+				t.Errorf("Expected audience %s, got %s", c.expectedAudience, got)
+			}
+		})
+	}
+}
+
+func TestContainerCredentialsForceEnvOverride(t *testing.T) {
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/credential-mode":    "container",
+		"eks.amazonaws.com/force-env-override": "true",
+	}
+	modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+
+	rawPod := getPodWithEnv([]v1.EnvVar{
+		{Name: "AWS_CONTAINER_CREDENTIALS_FULL_URI", Value: "http://localhost/credentials"},
+		{Name: "AWS_ROLE_ARN", Value: "arn:aws:iam::111122223333:role/legacy"},
+	})
+	pod := applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+
+	container := pod.Spec.Containers[0]
+	if got := envValues(container, "AWS_CONTAINER_CREDENTIALS_FULL_URI"); !reflect.DeepEqual(got, []string{DefaultContainerCredentialsURI}) {
+		t.Errorf("Expected AWS_CONTAINER_CREDENTIALS_FULL_URI to be replaced, got %v", got)
+	}
+	// Unrelated env vars the container defines are left untouched
+	if got := envValues(container, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{"arn:aws:iam::111122223333:role/legacy"}) {
+		t.Errorf("Expected AWS_ROLE_ARN to be unchanged, got %v", got)
+	}
+}
+
+func TestDisableIMDSFallback(t *testing.T) {
+	cases := []struct {
+		caseName   string
+		flag       bool
+		annotation string
+		expected   []string
+	}{
+		{"Disabled", false, "", []string{}},
+		{"Flag", true, "", []string{"true"}},
+		{"Annotation", false, "true", []string{"true"}},
+		{"AnnotationDisablesFlag", true, "false", []string{}},
+		{"InvalidAnnotation", true, "yes", []string{"true"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			}
+			if c.annotation != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/disable-imds-fallback"] = c.annotation
+			}
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithDisableIMDSFallback(c.flag),
+			)
+
+			rawPod := getPodWithSidecars(map[string]string{"eks.amazonaws.com/skip-containers": "istio-proxy"})
+			pod := applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+
+			for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers[0]) {
+				if got := envValues(container, "AWS_EC2_METADATA_DISABLED"); !reflect.DeepEqual(got, c.expected) {
+					t.Errorf("Expected AWS_EC2_METADATA_DISABLED %v in container %s, got %v", c.expected, container.Name, got)
+				}
+			}
+			// Skipped containers never get the env var
+			if got := envValues(pod.Spec.Containers[1], "AWS_EC2_METADATA_DISABLED"); len(got) != 0 {
+				t.Errorf("Expected no AWS_EC2_METADATA_DISABLED in skipped container, got %v", got)
+			}
+		})
+	}
+}
+
+func TestDisableIMDSFallbackForceEnvOverride(t *testing.T) {
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn":           "arn:aws:iam::111122223333:role/s3-reader",
+		"eks.amazonaws.com/force-env-override": "true",
+	}
+	modifier := NewModifier(
+		WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+		WithDisableIMDSFallback(true),
+	)
+
+	rawPod := getPodWithEnv([]v1.EnvVar{
+		{Name: "AWS_ROLE_ARN", Value: "arn:aws:iam::111122223333:role/legacy"},
+		{Name: "AWS_EC2_METADATA_DISABLED", Value: "false"},
+	})
+	pod := applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+
+	container := pod.Spec.Containers[0]
+	if got := envValues(container, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{"arn:aws:iam::111122223333:role/s3-reader"}) {
+		t.Errorf("Expected AWS_ROLE_ARN to be replaced, got %v", got)
+	}
+	if got := envValues(container, "AWS_EC2_METADATA_DISABLED"); !reflect.DeepEqual(got, []string{"false"}) {
+		t.Errorf("Expected container defined AWS_EC2_METADATA_DISABLED to be kept, got %v", got)
+	}
+}
+
+func TestAWSConfig(t *testing.T) {
+	expected := `[profile web-identity]
+role_arn = arn:aws:iam::111122223333:role/base
+web_identity_token_file = /var/run/secrets/eks.amazonaws.com/serviceaccount/token
+
+[default]
+role_arn = arn:aws:iam::444455556666:role/chained
+source_profile = web-identity
+`
+	got := awsConfig("arn:aws:iam::111122223333:role/base", "arn:aws:iam::444455556666:role/chained", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token")
+	if got != expected {
+		t.Errorf("Expected config:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestChainedRole(t *testing.T) {
+	const baseRole = "arn:aws:iam::111122223333:role/base"
+	const chainedRole = "arn:aws:iam::444455556666:role/chained"
+
+	cases := []struct {
+		caseName       string
+		chainedRole    string
+		podAnnotations map[string]string
+		chained        bool
+	}{
+		{"Chained", chainedRole, nil, true},
+		{"ChainedWithPodAnnotations", chainedRole, map[string]string{"team": "storage"}, true},
+		{"InvalidChainedRole", "chained", nil, false},
+		{"NotChained", "", nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": baseRole,
+			}
+			if c.chainedRole != "" {
+				testServiceAccount.Annotations["eks.amazonaws.com/chained-role-arn"] = c.chainedRole
+			}
+			modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			pod.Annotations = c.podAnnotations
+			pod.Spec.ServiceAccountName = "default"
+			pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux"}}
+			rawPod, _ := json.Marshal(pod)
+			patched := applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+
+			container := patched.Spec.Containers[0]
+			config, annotated := patched.Annotations["eks.amazonaws.com/aws-config"]
+			if !c.chained {
+				if annotated || len(patched.Spec.Volumes) != 1 {
+					t.Errorf("Expected no config, got annotation %q and volumes %+v", config, patched.Spec.Volumes)
+				}
+				if got := envValues(container, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{baseRole}) {
+					t.Errorf("Expected AWS_ROLE_ARN %s, got %v", baseRole, got)
+				}
+				return
+			}
+
+			expectedConfig := awsConfig(baseRole, chainedRole, "/var/run/secrets/eks.amazonaws.com/serviceaccount/token")
+			if config != expectedConfig {
+				t.Errorf("Expected config annotation:\n%s\ngot:\n%s", expectedConfig, config)
+			}
+			for key, value := range c.podAnnotations {
+				if patched.Annotations[key] != value {
+					t.Errorf("Expected pod annotation %s=%s to be kept, got %q", key, value, patched.Annotations[key])
+				}
+			}
+
+			if len(patched.Spec.Volumes) != 2 || patched.Spec.Volumes[1].Name != "aws-iam-config" {
+				t.Fatalf("Expected token and config volumes, got %+v", patched.Spec.Volumes)
+			}
+			item := patched.Spec.Volumes[1].Projected.Sources[0].DownwardAPI.Items[0]
+			if item.Path != "config" || item.FieldRef.FieldPath != "metadata.annotations['eks.amazonaws.com/aws-config']" {
+				t.Errorf("Unexpected config projection %+v", item)
+			}
+
+			expectedMounts := []v1.VolumeMount{
+				{Name: "aws-iam-token", ReadOnly: true, MountPath: "/var/run/secrets/eks.amazonaws.com/serviceaccount"},
+				{Name: "aws-iam-config", ReadOnly: true, MountPath: "/var/run/secrets/eks.amazonaws.com/aws-config"},
+			}
+			if !reflect.DeepEqual(container.VolumeMounts, expectedMounts) {
+				t.Errorf("Expected volume mounts %+v, got %+v", expectedMounts, container.VolumeMounts)
+			}
+			expectedEnv := map[string][]string{
+				"AWS_CONFIG_FILE":             {"/var/run/secrets/eks.amazonaws.com/aws-config/config"},
+				"AWS_SDK_LOAD_CONFIG":         {"1"},
+				"AWS_ROLE_ARN":                {},
+				"AWS_WEB_IDENTITY_TOKEN_FILE": {},
+			}
+			for name, values := range expectedEnv {
+				if got := envValues(container, name); !reflect.DeepEqual(got, values) {
+					t.Errorf("Expected %s %v, got %v", name, values, got)
+				}
+			}
+		})
+	}
+}
+
+func TestExtraTokenMountPath(t *testing.T) {
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn":               "arn:aws:iam::111122223333:role/s3-reader",
+		"eks.amazonaws.com/extra-token-mount-path": "/var/run/secrets/legacy/",
+	}
+	modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+
+	existingMount := v1.VolumeMount{Name: "legacy", MountPath: "/var/run/secrets/legacy"}
+	pod := &v1.Pod{}
+	pod.Name = "balajilovesoreos"
+	pod.Spec.ServiceAccountName = "default"
+	pod.Spec.Volumes = []v1.Volume{{Name: "legacy"}}
+	pod.Spec.Containers = []v1.Container{
+		{Name: "balajilovesoreos", Image: "amazonlinux"},
+		{Name: "vendor", Image: "vendor", VolumeMounts: []v1.VolumeMount{existingMount}},
+	}
+	rawPod, _ := json.Marshal(pod)
+	patched := applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+
+	tokenVolumes := 0
+	for _, volume := range patched.Spec.Volumes {
+		if volume.Projected != nil {
+			tokenVolumes++
+		}
+	}
+	if tokenVolumes != 1 {
+		t.Errorf("Expected a single token volume, got %+v", patched.Spec.Volumes)
+	}
+
+	tokenMount := v1.VolumeMount{Name: "aws-iam-token", ReadOnly: true, MountPath: "/var/run/secrets/eks.amazonaws.com/serviceaccount"}
+	expectedMounts := [][]v1.VolumeMount{
+		{tokenMount, {Name: "aws-iam-token", ReadOnly: true, MountPath: "/var/run/secrets/legacy"}},
+		// The conflicting container only skips the extra mount
+		{existingMount, tokenMount},
+	}
+	for i, expected := range expectedMounts {
+		if got := patched.Spec.Containers[i].VolumeMounts; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected volume mounts %+v for container %s, got %+v", expected, patched.Spec.Containers[i].Name, got)
+		}
+	}
+	if got := envValues(patched.Spec.Containers[1], "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, []string{"/var/run/secrets/eks.amazonaws.com/serviceaccount/token"}) {
+		t.Errorf("Expected AWS_WEB_IDENTITY_TOKEN_FILE at the token mount path, got %v", got)
+	}
+}
+
+func TestAnnotatePods(t *testing.T) {
+	const roleARN = "arn:aws:iam::111122223333:role/s3-reader"
+
+	cases := []struct {
+		caseName     string
+		annotate     bool
+		generateName string
+		annotations  map[string]string
+		expected     map[string]string
+	}{
+		{"Disabled", false, "", nil, nil},
+		{
+			"NilAnnotations",
+			true,
+			"",
+			nil,
+			map[string]string{
+				"eks.amazonaws.com/injected-role-arn": roleARN,
+				"eks.amazonaws.com/injected-audience": "sts.amazonaws.com",
+			},
+		},
+		{
+			"ExistingAnnotations",
+			true,
+			"",
+			map[string]string{"team": "storage"},
+			map[string]string{
+				"team":                                "storage",
+				"eks.amazonaws.com/injected-role-arn": roleARN,
+				"eks.amazonaws.com/injected-audience": "sts.amazonaws.com",
+			},
+		},
+		{
+			"UserProvidedKey",
+			true,
+			"",
+			map[string]string{"eks.amazonaws.com/injected-role-arn": "user"},
+			map[string]string{
+				"eks.amazonaws.com/injected-role-arn": "user",
+				"eks.amazonaws.com/injected-audience": "sts.amazonaws.com",
+			},
+		},
+		{
+			"GenerateName",
+			true,
+			"web-6d4cf56db6-",
+			nil,
+			map[string]string{
+				"eks.amazonaws.com/injected-role-arn":      roleARN,
+				"eks.amazonaws.com/injected-audience":      "sts.amazonaws.com",
+				"eks.amazonaws.com/injected-generate-name": "web-6d4cf56db6-",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{"eks.amazonaws.com/role-arn": roleARN}
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithAnnotatePods(c.annotate),
+			)
+
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			if c.generateName != "" {
+				pod.Name = ""
+				pod.GenerateName = c.generateName
+			}
+			pod.Annotations = c.annotations
+			pod.Spec.ServiceAccountName = "default"
+			pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux"}}
+			rawPod, _ := json.Marshal(pod)
+			patched := applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+
+			if !reflect.DeepEqual(patched.Annotations, c.expected) {
+				t.Errorf("Expected annotations %v, got %v", c.expected, patched.Annotations)
+			}
+		})
+	}
+}
+
+func TestAnnotationsPatch(t *testing.T) {
+	annotations := map[string]string{"eks.amazonaws.com/injected-role-arn": "arn:aws:iam::111122223333:role/s3-reader"}
+
+	pod := &v1.Pod{}
+	patch := annotationsPatch(pod, annotations)
+	expected := []PatchOperation{{Op: "add", Path: "/metadata/annotations", Value: annotations}}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("Expected patch %+v for nil annotations, got %+v", expected, patch)
+	}
+
+	pod.Annotations = map[string]string{}
+	patch = annotationsPatch(pod, annotations)
+	expected = []PatchOperation{{
+		Op:    "add",
+		Path:  "/metadata/annotations/eks.amazonaws.com~1injected-role-arn",
+		Value: "arn:aws:iam::111122223333:role/s3-reader",
+	}}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("Expected patch %+v for existing annotations, got %+v", expected, patch)
+	}
+}
+
+func TestTokenVolumeName(t *testing.T) {
+	expiration := int64(86400)
+	defaultMode := int32(420)
+	tokenVolume := func(name string) v1.Volume {
+		return v1.Volume{
+			Name: name,
+			VolumeSource: v1.VolumeSource{
+				Projected: &v1.ProjectedVolumeSource{
+					// Set by the API server, ignored when comparing volumes
+					DefaultMode: &defaultMode,
+					Sources: []v1.VolumeProjection{{
+						ServiceAccountToken: &v1.ServiceAccountTokenProjection{
+							Audience:          "sts.amazonaws.com",
+							ExpirationSeconds: &expiration,
+							Path:              "token",
+						},
+					}},
+				},
+			},
+		}
+	}
+	emptyDir := func(name string) v1.Volume {
+		return v1.Volume{Name: name, VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}
+	}
+
+	cases := []struct {
+		caseName     string
+		volumeName   string
+		volumes      []v1.Volume
+		expectedName string
+		added        bool
+	}{
+		{"Default", "", nil, "aws-iam-token", true},
+		{"Custom", "irsa-token", nil, "irsa-token", true},
+		{"Conflict", "", []v1.Volume{emptyDir("aws-iam-token")}, "aws-iam-token-irsa", true},
+		{"CustomConflict", "irsa-token", []v1.Volume{emptyDir("irsa-token")}, "irsa-token-irsa", true},
+		{"Reuse", "", []v1.Volume{tokenVolume("aws-iam-token")}, "aws-iam-token", false},
+		{"ReuseSuffixed", "", []v1.Volume{emptyDir("aws-iam-token"), tokenVolume("aws-iam-token-irsa")}, "aws-iam-token-irsa", false},
+		{"BothTaken", "", []v1.Volume{emptyDir("aws-iam-token"), emptyDir("aws-iam-token-irsa")}, "", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			}
+			opts := []ModifierOpt{WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount))}
+			if c.volumeName != "" {
+				opts = append(opts, WithTokenVolumeName(c.volumeName))
+			}
+			modifier := NewModifier(opts...)
+
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			pod.Spec.ServiceAccountName = "default"
+			pod.Spec.Volumes = c.volumes
+			pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux"}}
+			rawPod, _ := json.Marshal(pod)
+
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("volume-name-conflict", "false"))
+			patched := applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+			after := testutil.ToFloat64(skippedCounter.WithLabelValues("volume-name-conflict", "false"))
+
+			if c.expectedName == "" {
+				if len(patched.Spec.Containers[0].VolumeMounts) != 0 || !reflect.DeepEqual(patched.Spec.Volumes, c.volumes) {
+					t.Errorf("Expected pod to be unchanged, got %+v", patched.Spec)
+				}
+				if after != before+1 {
+					t.Errorf("Expected volume-name-conflict counter to increase, got %v -> %v", before, after)
+				}
+				return
+			}
+
+			expectedVolumes := len(c.volumes)
+			if c.added {
+				expectedVolumes++
+			}
+			if len(patched.Spec.Volumes) != expectedVolumes {
+				t.Errorf("Expected %d volumes, got %+v", expectedVolumes, patched.Spec.Volumes)
+			}
+			found := false
+			for _, volume := range patched.Spec.Volumes {
+				found = found || (volume.Name == c.expectedName && volume.Projected != nil)
+			}
+			if !found {
+				t.Errorf("Expected token volume %s, got %+v", c.expectedName, patched.Spec.Volumes)
+			}
+			mounts := patched.Spec.Containers[0].VolumeMounts
+			if len(mounts) != 1 || mounts[0].Name != c.expectedName {
+				t.Errorf("Expected a mount of volume %s, got %+v", c.expectedName, mounts)
+			}
+		})
+	}
+}
+
+func TestValidateTokenVolumeName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"aws-iam-token":         true,
+		"irsa":                  true,
+		"":                      false,
+		"AWS-IAM-Token":         false,
+		"aws_iam_token":         false,
+		strings.Repeat("a", 59): false,
+	} {
+		if err := ValidateTokenVolumeName(name); (err == nil) != valid {
+			t.Errorf("Expected valid %t for %q, got %v", valid, name, err)
+		}
+	}
+}
+
+func TestTokenVolumeIndex(t *testing.T) {
+	modifier := NewModifier()
+	for name, want := range map[string]int{
+		"aws-iam-token":        0,
+		"aws-iam-token-irsa":   0,
+		"aws-iam-token-2":      2,
+		"aws-iam-token-2-irsa": 2,
+		"aws-iam-token-0":      -1,
+		"aws-iam-token-02":     -1,
+		"aws-iam-token-x":      -1,
+		"my-volume":            -1,
+	} {
+		i, ok := modifier.tokenVolumeIndex(name)
+		if !ok {
+			i = -1
+		}
+		if i != want {
+			t.Errorf("Expected index %d for %q, got %d", want, name, i)
+		}
+	}
+}
+
+func TestSkipNamespaces(t *testing.T) {
+	cases := []struct {
+		caseName       string
+		skipNamespaces []string
+		namespace      string
+		skipped        bool
+	}{
+		{"ExactMatch", []string{"kube-system", "kube-public"}, "kube-system", true},
+		{"NoMatch", []string{"kube-system", "kube-public"}, "default", false},
+		{"GlobMatch", []string{"kube-*"}, "kube-node-lease", true},
+		{"GlobNoMatch", []string{"kube-*"}, "my-kube", false},
+		{"CharacterClass", []string{"team-[ab]"}, "team-b", true},
+		{"EmptyList", []string{}, "kube-system", false},
+		{"Nil", nil, "kube-system", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", c.namespace, "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+			modifier := NewModifier(
+				WithServiceAccountCache(saCache),
+				WithSkipNamespaces(c.skipNamespaces),
+			)
+
+			review := getValidReview(rawPodWithoutVolume)
+			review.Request.Namespace = c.namespace
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("namespace-denylist", "false"))
+			response := modifier.AdmitPod(context.Background(), review)
+			after := testutil.ToFloat64(skippedCounter.WithLabelValues("namespace-denylist", "false"))
+
+			if !response.Allowed {
+				t.Errorf("Expected pod to be allowed")
+			}
+			if c.skipped {
+				if response.Patch != nil {
+					t.Errorf("Expected no patch, got %s", string(response.Patch))
+				}
+				if after != before+1 {
+					t.Errorf("Expected namespace-denylist counter to increase, got %v -> %v", before, after)
+				}
+				return
+			}
+			if response.Patch == nil {
+				t.Errorf("Expected pod to be mutated")
+			}
+			if after != before {
+				t.Errorf("Expected namespace-denylist counter to be unchanged, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestValidateNamespacePatterns(t *testing.T) {
+	if err := ValidateNamespacePatterns([]string{"kube-system", "kube-*", "team-[ab]"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := ValidateNamespacePatterns([]string{"kube-["}); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
+
+func TestRespectAutomountDisabled(t *testing.T) {
+	boolPtr := func(b bool) *bool { return &b }
+	const roleARN = "arn:aws:iam::111122223333:role/s3-reader"
+
+	cases := []struct {
+		caseName     string
+		respect      bool
+		podAutomount *bool
+		saAutomount  *bool
+		skipped      string
+	}{
+		{"PodDisabled", true, boolPtr(false), nil, "pod"},
+		{"ServiceAccountDisabled", true, nil, boolPtr(false), "service-account"},
+		{"PodEnabledOverridesServiceAccount", true, boolPtr(true), boolPtr(false), ""},
+		{"PodDisabledOverridesServiceAccount", true, boolPtr(false), boolPtr(true), "pod"},
+		{"Unset", true, nil, nil, ""},
+		{"NotRespected", false, boolPtr(false), boolPtr(false), ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = map[string]string{"eks.amazonaws.com/role-arn": roleARN}
+			testServiceAccount.AutomountServiceAccountToken = c.saAutomount
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithRespectAutomountDisabled(c.respect),
+			)
+
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			pod.Spec.ServiceAccountName = "default"
+			pod.Spec.AutomountServiceAccountToken = c.podAutomount
+			pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux"}}
+			rawPod, _ := json.Marshal(pod)
+
+			counters := map[string]float64{}
+			for _, source := range []string{"pod", "service-account"} {
+				counters[source] = testutil.ToFloat64(tokenSkippedCounter.WithLabelValues(source))
+			}
+			patched := applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+
+			container := patched.Spec.Containers[0]
+			if got := envValues(container, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{roleARN}) {
+				t.Errorf("Expected AWS_ROLE_ARN %s, got %v", roleARN, got)
+			}
+			tokenFile := envValues(container, "AWS_WEB_IDENTITY_TOKEN_FILE")
+			if c.skipped != "" {
+				if len(tokenFile) != 0 || len(patched.Spec.Volumes) != 0 || len(container.VolumeMounts) != 0 {
+					t.Errorf("Expected no token, got env %v, volumes %+v, and mounts %+v", tokenFile, patched.Spec.Volumes, container.VolumeMounts)
+				}
+			} else if len(tokenFile) != 1 || len(patched.Spec.Volumes) != 1 {
+				t.Errorf("Expected a token, got env %v and volumes %+v", tokenFile, patched.Spec.Volumes)
+			}
+
+			for source, before := range counters {
+				want := before
+				if source == c.skipped {
+					want++
+				}
+				if after := testutil.ToFloat64(tokenSkippedCounter.WithLabelValues(source)); after != want {
+					t.Errorf("Expected %s token skipped counter %v, got %v", source, want, after)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectContainerTypes(t *testing.T) {
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+	}
+	podWithoutInitContainers := func(annotations map[string]string) []byte {
+		pod := &v1.Pod{}
+		pod.Name = "balajilovesoreos"
+		pod.Annotations = annotations
+		pod.Spec.ServiceAccountName = "default"
+		pod.Spec.Containers = []v1.Container{{Name: "balajilovesoreos", Image: "amazonlinux"}}
+		raw, _ := json.Marshal(pod)
+		return raw
+	}
+
+	cases := []struct {
+		caseName string
+		value    string
+		pod      func(map[string]string) []byte
+		injected []string
+		invalid  bool
+	}{
+		{"Init", "init", getPodWithSidecars, []string{"vault-agent"}, false},
+		{"Regular", "regular", getPodWithSidecars, []string{"balajilovesoreos", "istio-proxy"}, false},
+		{"All", "all", getPodWithSidecars, []string{"vault-agent", "balajilovesoreos", "istio-proxy"}, false},
+		{"Missing", "", getPodWithSidecars, []string{"vault-agent", "balajilovesoreos", "istio-proxy"}, false},
+		{"UpperCase", "INIT", getPodWithSidecars, []string{"vault-agent"}, false},
+		{"Invalid", "sidecar", getPodWithSidecars, []string{"vault-agent", "balajilovesoreos", "istio-proxy"}, true},
+		{"InitWithoutInitContainers", "init", podWithoutInitContainers, []string{}, false},
+		{"RegularWithoutInitContainers", "regular", podWithoutInitContainers, []string{"balajilovesoreos"}, false},
+		{"AllWithoutInitContainers", "all", podWithoutInitContainers, []string{"balajilovesoreos"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+			annotations := map[string]string{}
+			if c.value != "" {
+				annotations["eks.amazonaws.com/inject-container-types"] = c.value
+			}
+			rawPod := c.pod(annotations)
+
+			before := testutil.ToFloat64(invalidPodAnnotationCounter.WithLabelValues("inject-container-types"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			after := testutil.ToFloat64(invalidPodAnnotationCounter.WithLabelValues("inject-container-types"))
+			pod := applyPatch(t, rawPod, response)
+
+			if got := injectedContainers(pod); !reflect.DeepEqual(got, c.injected) {
+				t.Errorf("Unexpected injected containers. Got %v, wanted %v", got, c.injected)
+			}
+			for _, container := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+				injected := len(envValues(container, "AWS_ROLE_ARN")) > 0
+				if mounted := len(container.VolumeMounts) > 0; mounted != injected {
+					t.Errorf("Expected container %s to be mounted %t, got %t", container.Name, injected, mounted)
+				}
+			}
+			// The token volume is only added if a container is injected
+			if len(c.injected) == 0 && response.Patch != nil {
+				t.Errorf("Expected no patch, got %s", string(response.Patch))
+			}
+			if len(c.injected) > 0 && len(pod.Spec.Volumes) != 1 {
+				t.Errorf("Expected the token volume to be added once, got %d volumes", len(pod.Spec.Volumes))
+			}
+			if c.invalid && after != before+1 {
+				t.Errorf("Expected invalid pod annotation counter to increase, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestAudienceOnlyInjection(t *testing.T) {
+	cases := []struct {
+		caseName    string
+		enabled     bool
+		envName     string
+		annotations map[string]string
+		expected    map[string][]string
+		audience    string
+	}{
+		{
+			"AudienceOnly",
+			true,
+			"",
+			map[string]string{"eks.amazonaws.com/audience": "vault"},
+			map[string][]string{"OIDC_TOKEN_FILE": {"/var/run/secrets/eks.amazonaws.com/serviceaccount/token"}},
+			"vault",
+		},
+		{
+			"CustomEnvName",
+			true,
+			"VAULT_TOKEN_FILE",
+			map[string]string{"eks.amazonaws.com/audience": "vault"},
+			map[string][]string{"VAULT_TOKEN_FILE": {"/var/run/secrets/eks.amazonaws.com/serviceaccount/token"}},
+			"vault",
+		},
+		{"Disabled", false, "", map[string]string{"eks.amazonaws.com/audience": "vault"}, nil, ""},
+		{"DefaultAudience", true, "", map[string]string{}, nil, ""},
+		{
+			"WithRole",
+			true,
+			"",
+			map[string]string{"eks.amazonaws.com/audience": "vault", "eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader"},
+			map[string][]string{
+				"AWS_ROLE_ARN":                {"arn:aws:iam::111122223333:role/s3-reader"},
+				"AWS_WEB_IDENTITY_TOKEN_FILE": {"/var/run/secrets/eks.amazonaws.com/serviceaccount/token"},
+				"AWS_DEFAULT_REGION":          {"us-west-2"},
+				"AWS_REGION":                  {"us-west-2"},
+				"AWS_STS_REGIONAL_ENDPOINTS":  {"regional"},
+				"AWS_EC2_METADATA_DISABLED":   {"true"},
+			},
+			"vault",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = c.annotations
+			opts := []ModifierOpt{
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithAudienceOnlyInjection(c.enabled),
+				WithRegion("us-west-2"),
+				WithRegionalSTS(true),
+				WithDisableIMDSFallback(true),
+			}
+			if c.envName != "" {
+				opts = append(opts, WithTokenEnvName(c.envName))
+			}
+			modifier := NewModifier(opts...)
+
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			if c.expected == nil {
+				if response.Patch != nil {
+					t.Errorf("Expected no patch, got %s", string(response.Patch))
+				}
+				return
+			}
+			pod := applyPatch(t, rawPodWithoutVolume, response)
+
+			env := map[string][]string{}
+			for _, e := range pod.Spec.Containers[0].Env {
+				env[e.Name] = append(env[e.Name], e.Value)
+			}
+			if !reflect.DeepEqual(env, c.expected) {
+				t.Errorf("Expected env %v, got %v", c.expected, env)
+			}
+			if c.expected["AWS_ROLE_ARN"] == nil && strings.Contains(string(response.Patch), "AWS_") {
+				t.Errorf("Expected no AWS env vars in patch, got %s", string(response.Patch))
+			}
+			if got := pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.Audience; got != c.audience {
+				t.Errorf("Expected audience %s, got %s", c.audience, got)
+			}
+		})
+	}
+}
+
+func TestValidateTokenEnvName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"OIDC_TOKEN_FILE": true,
+		"vault.token":     true,
+		"":                false,
+		"1TOKEN":          false,
+		"TOKEN FILE":      false,
+	} {
+		if err := ValidateTokenEnvName(name); (err == nil) != valid {
+			t.Errorf("Expected valid %t for %q, got %v", valid, name, err)
+		}
+	}
+}
+
+func getServiceAccountReview(annotations map[string]string) *v1beta1.AdmissionReview {
+	sa := &v1.ServiceAccount{}
+	sa.Name = "default"
+	sa.Annotations = annotations
+	raw, _ := json.Marshal(sa)
+	review := getValidReview(raw)
+	review.Request.Kind.Kind = "ServiceAccount"
+	return review
+}
+
+func TestValidateServiceAccount(t *testing.T) {
+	cases := []struct {
+		caseName    string
+		annotations map[string]string
+		mode        string
+		wantAllowed bool
+		wantFields  []string
+	}{
+		{"NoAnnotations", nil, ValidationModeDeny, true, nil},
+		{
+			"Valid",
+			map[string]string{
+				"eks.amazonaws.com/role-arn":               "arn:aws:iam::111122223333:role/s3-reader",
+				"eks.amazonaws.com/audience":               "sts.amazonaws.com",
+				"eks.amazonaws.com/token-expiration":       "3600",
+				"eks.amazonaws.com/sts-regional-endpoints": "True",
+			},
+			ValidationModeDeny, true, nil,
+		},
+		{
+			"InvalidRoleARN",
+			map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:user/s3-reader"},
+			ValidationModeDeny, false,
+			[]string{"metadata.annotations[eks.amazonaws.com/role-arn]"},
+		},
+		{
+			"EmptyAudience",
+			map[string]string{"eks.amazonaws.com/audience": " "},
+			ValidationModeDeny, false,
+			[]string{"metadata.annotations[eks.amazonaws.com/audience]"},
+		},
+		{
+			"NonIntegerExpiration",
+			map[string]string{"eks.amazonaws.com/token-expiration": "1h"},
+			ValidationModeDeny, false,
+			[]string{"metadata.annotations[eks.amazonaws.com/token-expiration]"},
+		},
+		{
+			"ExpirationOutOfBounds",
+			map[string]string{"eks.amazonaws.com/token-expiration": "60"},
+			ValidationModeDeny, false,
+			[]string{"metadata.annotations[eks.amazonaws.com/token-expiration]"},
+		},
+		{
+			"InvalidRegionalSTS",
+			map[string]string{"eks.amazonaws.com/sts-regional-endpoints": "yes"},
+			ValidationModeDeny, false,
+			[]string{"metadata.annotations[eks.amazonaws.com/sts-regional-endpoints]"},
+		},
+		{
+			"MultipleInvalid",
+			map[string]string{
+				"eks.amazonaws.com/role-arn":               "s3-reader",
+				"eks.amazonaws.com/sts-regional-endpoints": "yes",
+			},
+			ValidationModeDeny, false,
+			[]string{
+				"metadata.annotations[eks.amazonaws.com/role-arn]",
+				"metadata.annotations[eks.amazonaws.com/sts-regional-endpoints]",
+			},
+		},
+		{
+			"WarnMode",
+			map[string]string{
+				"eks.amazonaws.com/role-arn":               "s3-reader",
+				"eks.amazonaws.com/sts-regional-endpoints": "yes",
+			},
+			ValidationModeWarn, true,
+			[]string{
+				"metadata.annotations[eks.amazonaws.com/role-arn]",
+				"metadata.annotations[eks.amazonaws.com/sts-regional-endpoints]",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			modifier := NewModifier(WithValidationMode(c.mode))
+
+			before := testutil.ToFloat64(invalidServiceAccountCounter.WithLabelValues(c.mode, "false"))
+			response := modifier.ValidateServiceAccount(context.Background(), getServiceAccountReview(c.annotations))
+			if response.Allowed != c.wantAllowed {
+				t.Fatalf("Expected allowed %v, got %v: %+v", c.wantAllowed, response.Allowed, response.Result)
+			}
+
+			var gotFields []string
+			if c.mode == ValidationModeWarn {
+				for _, warning := range response.Warnings {
+					gotFields = append(gotFields, strings.SplitN(warning, ":", 2)[0])
+				}
+			} else if response.Result != nil && response.Result.Details != nil {
+				for _, cause := range response.Result.Details.Causes {
+					gotFields = append(gotFields, cause.Field)
+				}
+			}
+			sort.Strings(gotFields)
+			if !reflect.DeepEqual(gotFields, c.wantFields) {
+				t.Errorf("Expected invalid fields %v, got %v", c.wantFields, gotFields)
+			}
+
+			want := before
+			if len(c.wantFields) > 0 {
+				want++
+			}
+			if after := testutil.ToFloat64(invalidServiceAccountCounter.WithLabelValues(c.mode, "false")); after != want {
+				t.Errorf("Expected invalid service account counter %v, got %v", want, after)
+			}
+		})
+	}
+}
+
+func TestValidateValidationMode(t *testing.T) {
+	for _, mode := range []string{ValidationModeDeny, ValidationModeWarn} {
+		if err := ValidateValidationMode(mode); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", mode, err)
+		}
+	}
+	if err := ValidateValidationMode("audit"); err == nil {
+		t.Errorf("Expected audit to be invalid")
+	}
+}
+
+func getEphemeralContainersReview(t *testing.T, pod *v1.Pod, existing ...string) (*v1beta1.AdmissionReview, []byte) {
+	t.Helper()
+	oldPod := pod.DeepCopy()
+	for _, name := range existing {
+		oldPod.Spec.EphemeralContainers = append(oldPod.Spec.EphemeralContainers, v1.EphemeralContainer{
+			EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: name, Image: "busybox"},
+		})
+	}
+	newPod := oldPod.DeepCopy()
+	newPod.Spec.EphemeralContainers = append(newPod.Spec.EphemeralContainers, v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: "debugger", Image: "amazon/aws-cli"},
+		TargetContainerName:      "balajilovesoreos",
+	})
+	oldRaw, err := json.Marshal(oldPod)
+	if err != nil {
+		t.Fatalf("Error marshaling pod: %v", err)
+	}
+	raw, err := json.Marshal(newPod)
+	if err != nil {
+		t.Fatalf("Error marshaling pod: %v", err)
+	}
+	review := getValidReview(raw)
+	review.Request.Operation = "UPDATE"
+	review.Request.SubResource = "ephemeralcontainers"
+	review.Request.OldObject = runtime.RawExtension{Raw: oldRaw}
+	return review, raw
+}
+
+func TestEphemeralContainers(t *testing.T) {
+	roleARN := "arn:aws:iam::111122223333:role/s3-reader"
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.Add("default", "default", roleARN, "sts.amazonaws.com")
+
+	// The pod as it was injected at creation
+	injectedPod := applyPatch(t, rawPodWithoutVolume, NewModifier(WithServiceAccountCache(saCache)).AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume)))
+	uninjectedPod := applyPatch(t, rawPodWithoutVolume, &v1beta1.AdmissionResponse{})
+
+	cases := []struct {
+		caseName  string
+		pod       *v1.Pod
+		existing  []string
+		enabled   bool
+		wantRoles map[string][]string
+		skipped   bool
+	}{
+		{"Disabled", injectedPod, nil, false, map[string][]string{"debugger": {}}, false},
+		{"WithVolume", injectedPod, nil, true, map[string][]string{"debugger": {roleARN}}, false},
+		{"ExistingEphemeralContainer", injectedPod, []string{"old-debugger"}, true, map[string][]string{"old-debugger": {}, "debugger": {roleARN}}, false},
+		{"WithoutVolume", uninjectedPod, nil, true, map[string][]string{"debugger": {}}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			modifier := NewModifier(
+				WithServiceAccountCache(saCache),
+				WithMutateEphemeralContainers(c.enabled),
+			)
+			review, raw := getEphemeralContainersReview(t, c.pod, c.existing...)
+
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("ephemeral-volume-missing", "false"))
+			response := modifier.AdmitPod(context.Background(), review)
+			if !response.Allowed {
+				t.Fatalf("Expected pod to be allowed, got %+v", response.Result)
+			}
+			if len(response.Patch) > 0 {
+				var patch []PatchOperation
+				if err := json.Unmarshal(response.Patch, &patch); err != nil {
+					t.Fatalf("Error unmarshaling patch: %v", err)
+				}
+				for _, op := range patch {
+					if !strings.HasPrefix(op.Path, "/spec/ephemeralContainers") {
+						t.Errorf("Expected only ephemeral containers to be patched, got %s", op.Path)
+					}
+				}
+			}
+			pod := applyPatch(t, raw, response)
+
+			for _, container := range pod.Spec.EphemeralContainers {
+				wantRoles, ok := c.wantRoles[container.Name]
+				if !ok {
+					t.Fatalf("Unexpected ephemeral container %s", container.Name)
+				}
+				if got := envValues(v1.Container(container.EphemeralContainerCommon), "AWS_ROLE_ARN"); !reflect.DeepEqual(got, wantRoles) {
+					t.Errorf("Expected AWS_ROLE_ARN %v on %s, got %v", wantRoles, container.Name, got)
+				}
+				mounted := false
+				for _, mount := range container.VolumeMounts {
+					mounted = mounted || mount.Name == "aws-iam-token"
+				}
+				if mounted != (len(wantRoles) > 0) {
+					t.Errorf("Expected token mounted %v on %s, got %v", len(wantRoles) > 0, container.Name, mounted)
+				}
+			}
+			if len(pod.Spec.Volumes) != len(c.pod.Spec.Volumes) {
+				t.Errorf("Expected volumes to be unchanged, got %v", pod.Spec.Volumes)
+			}
+
+			want := before
+			if c.skipped {
+				want++
+			}
+			if after := testutil.ToFloat64(skippedCounter.WithLabelValues("ephemeral-volume-missing", "false")); after != want {
+				t.Errorf("Expected skipped counter %v, got %v", want, after)
+			}
+		})
+	}
+}
+
+func TestReinvocation(t *testing.T) {
+	roleARN := "arn:aws:iam::111122223333:role/s3-reader"
+	fsGroup := int64(65534)
+
+	cases := []struct {
+		caseName    string
+		annotations map[string]string
+		opts        []ModifierOpt
+	}{
+		{"Default", nil, nil},
+		{"Region", nil, []ModifierOpt{WithRegion("us-west-2"), WithRegionalSTS(true), WithDisableIMDSFallback(true)}},
+		{"MultipleAudiences", map[string]string{"eks.amazonaws.com/audience": "sts.amazonaws.com,vault"}, nil},
+		{"ForceEnvOverride", map[string]string{"eks.amazonaws.com/force-env-override": "true"}, nil},
+		{"ExtraMountPath", map[string]string{"eks.amazonaws.com/extra-token-mount-path": "/var/run/secrets/token"}, nil},
+		{"TokenMountPath", map[string]string{"eks.amazonaws.com/token-mount-path": "/var/run/secrets/aws"}, nil},
+		{"ChainedRole", map[string]string{"eks.amazonaws.com/chained-role-arn": "arn:aws:iam::444455556666:role/chained"}, nil},
+		{"ContainerCredentials", map[string]string{"eks.amazonaws.com/credential-mode": "container"}, nil},
+		{"AnnotatePodsAndFSGroup", nil, []ModifierOpt{WithAnnotatePods(true), WithDefaultFSGroup(&fsGroup)}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			sa := &v1.ServiceAccount{}
+			sa.Name = "default"
+			sa.Namespace = "default"
+			sa.Annotations = map[string]string{"eks.amazonaws.com/role-arn": roleARN}
+			for key, value := range c.annotations {
+				sa.Annotations[key] = value
+			}
+			modifier := NewModifier(append([]ModifierOpt{WithServiceAccountCache(cache.NewFakeServiceAccountCache(sa))}, c.opts...)...)
+
+			rawPod := getPodWithSidecars(nil)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			if len(response.Patch) == 0 {
+				t.Fatalf("Expected the first invocation to patch the pod")
+			}
+			injected, err := json.Marshal(applyPatch(t, rawPod, response))
+			if err != nil {
+				t.Fatalf("Error marshaling pod: %v", err)
+			}
+
+			response = modifier.AdmitPod(context.Background(), getValidReview(injected))
+			if !response.Allowed || len(response.Patch) != 0 {
+				t.Errorf("Expected the second invocation to be a no-op, got patch %s", string(response.Patch))
+			}
+		})
+	}
+}
+
+func TestReinvocationChangedSettings(t *testing.T) {
+	roleARN := "arn:aws:iam::111122223333:role/s3-reader"
+	changedRoleARN := "arn:aws:iam::111122223333:role/s3-writer"
+
+	injectPod := func(t *testing.T, rawPod []byte, annotations map[string]string) *v1.Pod {
+		sa := &v1.ServiceAccount{}
+		sa.Name = "default"
+		sa.Namespace = "default"
+		sa.Annotations = annotations
+		modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(sa)))
+		return applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+	}
+
+	cases := []struct {
+		caseName  string
+		changed   map[string]string
+		wantRole  string
+		wantAud   string
+		wantMount string
+	}{
+		{
+			"RoleReplaced",
+			map[string]string{"eks.amazonaws.com/role-arn": changedRoleARN},
+			changedRoleARN, "sts.amazonaws.com", "/var/run/secrets/eks.amazonaws.com/serviceaccount",
+		},
+		{
+			"RoleOverridden",
+			map[string]string{"eks.amazonaws.com/role-arn": changedRoleARN, "eks.amazonaws.com/force-env-override": "true"},
+			changedRoleARN, "sts.amazonaws.com", "/var/run/secrets/eks.amazonaws.com/serviceaccount",
+		},
+		{
+			"Audience",
+			map[string]string{"eks.amazonaws.com/role-arn": roleARN, "eks.amazonaws.com/audience": "custom"},
+			roleARN, "custom", "/var/run/secrets/eks.amazonaws.com/serviceaccount",
+		},
+		{
+			"MountPath",
+			map[string]string{"eks.amazonaws.com/role-arn": roleARN, "eks.amazonaws.com/token-mount-path": "/var/run/secrets/aws"},
+			roleARN, "sts.amazonaws.com", "/var/run/secrets/aws",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			first := injectPod(t, rawPodWithoutVolume, map[string]string{"eks.amazonaws.com/role-arn": roleARN})
+			injected, err := json.Marshal(first)
+			if err != nil {
+				t.Fatalf("Error marshaling pod: %v", err)
+			}
+			pod := injectPod(t, injected, c.changed)
+
+			if len(pod.Spec.Volumes) != 1 {
+				t.Fatalf("Expected the token volume to be replaced, got %+v", pod.Spec.Volumes)
+			}
+			if got := pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.Audience; got != c.wantAud {
+				t.Errorf("Expected audience %s, got %s", c.wantAud, got)
+			}
+			container := pod.Spec.Containers[0]
+			if got := envValues(container, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{c.wantRole}) {
+				t.Errorf("Expected AWS_ROLE_ARN %s, got %v", c.wantRole, got)
+			}
+			wantTokenFile := []string{path.Join(c.wantMount, "token")}
+			if got := envValues(container, "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, wantTokenFile) {
+				t.Errorf("Expected AWS_WEB_IDENTITY_TOKEN_FILE %v, got %v", wantTokenFile, got)
+			}
+			if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != c.wantMount {
+				t.Errorf("Expected a single mount at %s, got %+v", c.wantMount, container.VolumeMounts)
+			}
+		})
+	}
+}
+
+func TestReinvocationChangedAudiences(t *testing.T) {
+	mountPath := "/var/run/secrets/eks.amazonaws.com/serviceaccount"
+	cases := []struct {
+		caseName  string
+		first     string
+		second    string
+		volumes   map[string]string
+		mounts    map[string]string
+		tokenFile string
+	}{
+		{
+			"AudienceAdded",
+			"sts.amazonaws.com",
+			"sts.amazonaws.com,vault",
+			map[string]string{"aws-iam-token": "sts.amazonaws.com", "aws-iam-token-1": "vault"},
+			map[string]string{"aws-iam-token": mountPath + "/0", "aws-iam-token-1": mountPath + "/1"},
+			mountPath + "/0/token",
+		},
+		{
+			"AudienceRemoved",
+			"sts.amazonaws.com,vault",
+			"sts.amazonaws.com",
+			map[string]string{"aws-iam-token": "sts.amazonaws.com"},
+			map[string]string{"aws-iam-token": mountPath},
+			mountPath + "/token",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			modifier := func(audience string) *Modifier {
+				sa := &v1.ServiceAccount{}
+				sa.Name = "default"
+				sa.Namespace = "default"
+				sa.Annotations = map[string]string{
+					"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+					"eks.amazonaws.com/audience": audience,
+				}
+				return NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(sa)))
+			}
+			first := applyPatch(t, rawPodWithoutVolume, modifier(c.first).AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume)))
+			injected, err := json.Marshal(first)
+			if err != nil {
+				t.Fatalf("Error marshaling pod: %v", err)
+			}
+			second := modifier(c.second)
+			pod := applyPatch(t, injected, second.AdmitPod(context.Background(), getValidReview(injected)))
+
+			volumes := map[string]string{}
+			for _, vol := range pod.Spec.Volumes {
+				volumes[vol.Name] = vol.Projected.Sources[0].ServiceAccountToken.Audience
+			}
+			if !reflect.DeepEqual(volumes, c.volumes) {
+				t.Errorf("Expected volumes %v, got %v", c.volumes, volumes)
+			}
+			mounts := map[string]string{}
+			for _, mount := range pod.Spec.Containers[0].VolumeMounts {
+				mounts[mount.Name] = mount.MountPath
+			}
+			if !reflect.DeepEqual(mounts, c.mounts) {
+				t.Errorf("Expected volumeMounts %v, got %v", c.mounts, mounts)
+			}
+			if got := envValues(pod.Spec.Containers[0], "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, []string{c.tokenFile}) {
+				t.Errorf("Expected AWS_WEB_IDENTITY_TOKEN_FILE %s, got %v", c.tokenFile, got)
+			}
+
+			reinjected, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatalf("Error marshaling pod: %v", err)
+			}
+			response := second.AdmitPod(context.Background(), getValidReview(reinjected))
+			if !response.Allowed || len(response.Patch) != 0 {
+				t.Errorf("Expected the third invocation to be a no-op, got patch %s", string(response.Patch))
+			}
+		})
+	}
+}
+
+func TestInitContainers(t *testing.T) {
+	roleARN := "arn:aws:iam::111122223333:role/s3-reader"
+	container := func(name string) v1.Container {
+		return v1.Container{Name: name, Image: "amazonlinux"}
+	}
+
+	cases := []struct {
+		caseName       string
+		initContainers []v1.Container
+		containers     []v1.Container
+		annotations    map[string]string
+		wantInjected   []string
+	}{
+		{"OnlyInitContainers", []v1.Container{container("fetch-artifacts")}, nil, nil, []string{"fetch-artifacts"}},
+		{"OnlyContainers", nil, []v1.Container{container("app")}, nil, []string{"app"}},
+		{"Both", []v1.Container{container("fetch-artifacts")}, []v1.Container{container("app"), container("sidecar")}, nil, []string{"fetch-artifacts", "app", "sidecar"}},
+		{
+			"SkipInitContainer",
+			[]v1.Container{container("fetch-artifacts")},
+			[]v1.Container{container("app")},
+			map[string]string{"eks.amazonaws.com/skip-containers": "fetch-artifacts"},
+			[]string{"app"},
+		},
+		{
+			"InjectOnlyInitContainer",
+			[]v1.Container{container("fetch-artifacts")},
+			[]v1.Container{container("app")},
+			map[string]string{"eks.amazonaws.com/inject-containers": "fetch-artifacts"},
+			[]string{"fetch-artifacts"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", roleARN, "sts.amazonaws.com")
+			modifier := NewModifier(WithServiceAccountCache(saCache))
+
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			pod.Annotations = c.annotations
+			pod.Spec.ServiceAccountName = "default"
+			pod.Spec.InitContainers = c.initContainers
+			pod.Spec.Containers = c.containers
+			rawPod, _ := json.Marshal(pod)
+
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			var patch []PatchOperation
+			if err := json.Unmarshal(response.Patch, &patch); err != nil {
+				t.Fatalf("Error unmarshaling patch: %v", err)
+			}
+			for _, op := range patch {
+				if op.Path == "/spec/initContainers" && len(c.initContainers) == 0 {
+					t.Errorf("Expected no initContainers patch for a pod without init containers")
+				}
+			}
+			patched := applyPatch(t, rawPod, response)
+
+			if got := injectedContainers(patched); !reflect.DeepEqual(got, c.wantInjected) {
+				t.Errorf("Expected injected containers %v, got %v", c.wantInjected, got)
+			}
+			if len(patched.Spec.Volumes) != 1 {
+				t.Errorf("Expected the token volume to be added once, got %+v", patched.Spec.Volumes)
+			}
+			for _, container := range append(append([]v1.Container{}, patched.Spec.InitContainers...), patched.Spec.Containers...) {
+				injected := len(envValues(container, "AWS_ROLE_ARN")) > 0
+				mounted := len(container.VolumeMounts) == 1 && container.VolumeMounts[0].Name == "aws-iam-token"
+				if injected != mounted {
+					t.Errorf("Expected container %s to mount the token only if injected, got %+v", container.Name, container.VolumeMounts)
+				}
+			}
+		})
+	}
+}
+
+func TestMountPathCollision(t *testing.T) {
+	roleARN := "arn:aws:iam::111122223333:role/s3-reader"
+	tokenDir := "/var/run/secrets/eks.amazonaws.com/serviceaccount"
+
+	cases := []struct {
+		caseName    string
+		mounts      []v1.VolumeMount
+		wantMounted bool
+	}{
+		{"NoMounts", nil, true},
+		{"OtherPath", []v1.VolumeMount{{Name: "secrets", MountPath: "/etc/secrets"}}, true},
+		{"ExactPath", []v1.VolumeMount{{Name: "my-token", MountPath: tokenDir}}, false},
+		{"TrailingSlash", []v1.VolumeMount{{Name: "my-token", MountPath: tokenDir + "/"}}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", roleARN, "sts.amazonaws.com")
+			modifier := NewModifier(WithServiceAccountCache(saCache))
+
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			pod.Spec.ServiceAccountName = "default"
+			pod.Spec.Containers = []v1.Container{
+				{Name: "app", Image: "amazonlinux", VolumeMounts: c.mounts},
+				{Name: "sidecar", Image: "amazonlinux"},
+			}
+			rawPod, _ := json.Marshal(pod)
+
+			before := testutil.ToFloat64(mountCollisionCounter)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			if !response.Allowed {
+				t.Fatalf("Expected pod to be allowed, got %+v", response.Result)
+			}
+			patched := applyPatch(t, rawPod, response)
+
+			app := patched.Spec.Containers[0]
+			mounted := false
+			for _, mount := range app.VolumeMounts {
+				mounted = mounted || mount.Name == "aws-iam-token"
+			}
+			if mounted != c.wantMounted {
+				t.Errorf("Expected token mounted %v, got %+v", c.wantMounted, app.VolumeMounts)
+			}
+			wantMounts := len(c.mounts)
+			if c.wantMounted {
+				wantMounts++
+			}
+			if len(app.VolumeMounts) != wantMounts {
+				t.Errorf("Expected container defined mounts to be kept, got %+v", app.VolumeMounts)
+			}
+			// The env vars are still injected, the token may be provided by
+			// the container defined mount
+			if got := envValues(app, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{roleARN}) {
+				t.Errorf("Expected AWS_ROLE_ARN %s, got %v", roleARN, got)
+			}
+			if sidecar := patched.Spec.Containers[1]; len(sidecar.VolumeMounts) != 1 {
+				t.Errorf("Expected the sidecar to mount the token, got %+v", sidecar.VolumeMounts)
+			}
+
+			after := testutil.ToFloat64(mountCollisionCounter)
+			if c.wantMounted {
+				if len(response.Warnings) != 0 || after != before {
+					t.Errorf("Expected no collision, got warnings %v and counter %v -> %v", response.Warnings, before, after)
+				}
+				return
+			}
+			if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "container app") {
+				t.Errorf("Expected a warning naming container app, got %v", response.Warnings)
+			}
+			if after != before+1 {
+				t.Errorf("Expected collision counter to increase, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestDeterministicPatch(t *testing.T) {
+	fsGroup := int64(65534)
+	sa := &v1.ServiceAccount{}
+	sa.Name = "default"
+	sa.Namespace = "default"
+	sa.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn":               "arn:aws:iam::111122223333:role/s3-reader",
+		"eks.amazonaws.com/audience":               "sts.amazonaws.com,vault",
+		"eks.amazonaws.com/sts-regional-endpoints": "true",
+		"eks.amazonaws.com/force-env-override":     "true",
+	}
+	modifier := NewModifier(
+		WithServiceAccountCache(cache.NewFakeServiceAccountCache(sa)),
+		WithRegion("us-west-2"),
+		WithDisableIMDSFallback(true),
+		WithAnnotatePods(true),
+		WithDefaultFSGroup(&fsGroup),
+	)
+
+	pod := &v1.Pod{}
+	pod.Name = "balajilovesoreos"
+	pod.Annotations = map[string]string{
+		"eks.amazonaws.com/container-roles": `{"worker": "arn:aws:iam::111122223333:role/worker", "app": "arn:aws:iam::111122223333:role/app"}`,
+	}
+	pod.Spec.ServiceAccountName = "default"
+	pod.Spec.Volumes = []v1.Volume{{Name: "config", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+	pod.Spec.InitContainers = []v1.Container{{Name: "vault-agent", Image: "vault"}}
+	pod.Spec.Containers = []v1.Container{
+		{Name: "app", Image: "amazonlinux", Env: []v1.EnvVar{{Name: "AWS_ROLE_ARN", Value: "arn:aws:iam::111122223333:role/old"}}},
+		{Name: "worker", Image: "amazonlinux"},
+		{Name: "istio-proxy", Image: "istio/proxyv2", Env: []v1.EnvVar{{Name: "AWS_STS_REGIONAL_ENDPOINTS", Value: "legacy"}}},
+	}
+	rawPod, _ := json.Marshal(pod)
+
+	first := modifier.AdmitPod(context.Background(), getValidReview(rawPod)).Patch
+	for i := 0; i < 20; i++ {
+		if patch := modifier.AdmitPod(context.Background(), getValidReview(rawPod)).Patch; !bytes.Equal(patch, first) {
+			t.Fatalf("Expected identical patches, run %d got\n%s\nwant\n%s", i, string(patch), string(first))
+		}
+	}
+
+	golden := filepath.Join("testdata", "deterministic-patch.json")
+	if *update {
+		if err := ioutil.WriteFile(golden, append(first, '\n'), 0644); err != nil {
+			t.Fatalf("Error writing golden file: %v", err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Error reading golden file: %v", err)
+	}
+	if !bytes.Equal(append(first, '\n'), want) {
+		t.Errorf("Patch differs from %s, rerun with -update if the change is intended\ngot\n%s\nwant\n%s", golden, string(first), string(want))
+	}
+}
+
+func TestPreDeclaredTokenVolume(t *testing.T) {
+	roleARN := "arn:aws:iam::111122223333:role/s3-reader"
+	declaredRoleARN := "arn:aws:iam::111122223333:role/declared"
+	tokenDir := "/var/run/secrets/eks.amazonaws.com/serviceaccount"
+	tokenVolume := func(expiration int64) v1.Volume {
+		return v1.Volume{
+			Name: "aws-iam-token",
+			VolumeSource: v1.VolumeSource{
+				Projected: &v1.ProjectedVolumeSource{
+					Sources: []v1.VolumeProjection{{
+						ServiceAccountToken: &v1.ServiceAccountTokenProjection{
+							Audience:          "sts.amazonaws.com",
+							ExpirationSeconds: &expiration,
+							Path:              "token",
+						},
+					}},
+				},
+			},
+		}
+	}
+
+	cases := []struct {
+		caseName       string
+		volume         v1.Volume
+		wantReplaced   bool
+		wantExpiration int64
+	}{
+		{"MatchingSource", tokenVolume(86400), false, 86400},
+		{"MismatchedSource", tokenVolume(3600), true, 86400},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", roleARN, "sts.amazonaws.com")
+			modifier := NewModifier(WithServiceAccountCache(saCache))
+
+			// Copied from the docs, without the token file env var
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			pod.Spec.ServiceAccountName = "default"
+			pod.Spec.Volumes = []v1.Volume{c.volume}
+			pod.Spec.Containers = []v1.Container{{
+				Name:         "balajilovesoreos",
+				Image:        "amazonlinux",
+				Env:          []v1.EnvVar{{Name: "AWS_ROLE_ARN", Value: declaredRoleARN}},
+				VolumeMounts: []v1.VolumeMount{{Name: "aws-iam-token", ReadOnly: true, MountPath: tokenDir}},
+			}}
+			rawPod, _ := json.Marshal(pod)
+
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			var patch []PatchOperation
+			if err := json.Unmarshal(response.Patch, &patch); err != nil {
+				t.Fatalf("Error unmarshaling patch: %v", err)
+			}
+			replaced := false
+			for _, op := range patch {
+				replaced = replaced || (op.Op == "replace" && op.Path == "/spec/volumes/0")
+				if op.Op == "add" && strings.HasPrefix(op.Path, "/spec/volumes") {
+					t.Errorf("Expected the token volume not to be added again, got %s", op.Path)
+				}
+			}
+			if replaced != c.wantReplaced {
+				t.Errorf("Expected volume replaced %v, got patch %s", c.wantReplaced, string(response.Patch))
+			}
+			patched := applyPatch(t, rawPod, response)
+
+			if len(patched.Spec.Volumes) != 1 || *patched.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.ExpirationSeconds != c.wantExpiration {
+				t.Errorf("Expected a single token volume expiring in %d, got %+v", c.wantExpiration, patched.Spec.Volumes)
+			}
+			container := patched.Spec.Containers[0]
+			if len(container.VolumeMounts) != 1 {
+				t.Errorf("Expected the declared mount only, got %+v", container.VolumeMounts)
+			}
+			if got := envValues(container, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{declaredRoleARN}) {
+				t.Errorf("Expected the declared AWS_ROLE_ARN to be kept, got %v", got)
+			}
+			if got := envValues(container, "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, []string{path.Join(tokenDir, "token")}) {
+				t.Errorf("Expected the missing AWS_WEB_IDENTITY_TOKEN_FILE to be added, got %v", got)
+			}
+		})
+	}
+}
+
+func TestPodName(t *testing.T) {
+	controller := true
+	replicaSet := metav1.OwnerReference{Kind: "ReplicaSet", Name: "web-6d4cf56db6", Controller: &controller}
+	job := metav1.OwnerReference{Kind: "Job", Name: "backup"}
+
+	cases := []struct {
+		caseName     string
+		name         string
+		generateName string
+		owners       []metav1.OwnerReference
+		uid          string
+		expected     string
+	}{
+		{"Name", "web", "", nil, "", "default/web"},
+		{"NameWithOwner", "web", "", []metav1.OwnerReference{replicaSet}, "", "default/web"},
+		{"NameAndGenerateName", "web", "web-", nil, "", "default/web"},
+		{"GenerateName", "", "web-6d4cf56db6-", nil, "", "default/web-6d4cf56db6-*"},
+		{"GenerateNameWithOwner", "", "web-6d4cf56db6-", []metav1.OwnerReference{replicaSet}, "", "default/web-6d4cf56db6-* (ReplicaSet web-6d4cf56db6)"},
+		{"ControllerOwner", "", "web-6d4cf56db6-", []metav1.OwnerReference{job, replicaSet}, "", "default/web-6d4cf56db6-* (ReplicaSet web-6d4cf56db6)"},
+		{"FirstOwner", "", "backup-", []metav1.OwnerReference{job}, "", "default/backup-* (Job backup)"},
+		{"NoName", "", "", nil, "", "default/"},
+		{"NoNameWithOwner", "", "", []metav1.OwnerReference{job}, "", "default/ (Job backup)"},
+		{"NameWithUID", "web", "", nil, "918ef1dc", "default/web (request 918ef1dc)"},
+		{"GenerateNameWithOwnerAndUID", "", "web-6d4cf56db6-", []metav1.OwnerReference{replicaSet}, "918ef1dc", "default/web-6d4cf56db6-* (ReplicaSet web-6d4cf56db6, request 918ef1dc)"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			pod := &v1.Pod{}
+			pod.Namespace = "default"
+			pod.Name = c.name
+			pod.GenerateName = c.generateName
+			pod.OwnerReferences = c.owners
+			if got := podName(pod, c.uid); got != c.expected {
+				t.Errorf("Expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestHandleAdmissionReviewVersions(t *testing.T) {
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn":         "arn:aws:iam::111122223333:role/s3-reader",
+		"eks.amazonaws.com/token-expiration": "1h",
+	}
+	modifier := NewModifier(
+		WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+		WithFailurePolicy(FailurePolicyFail),
+	)
+
+	review := func(apiVersion string) []byte {
+		return []byte(fmt.Sprintf(`{
+  "apiVersion": %q,
+  "kind": "AdmissionReview",
+  "request": {
+	"uid": "918ef1dc-928f-4525-99ef-988389f263c3",
+	"kind": {"group": "", "version": "v1", "kind": "Pod"},
+	"resource": {"group": "", "version": "v1", "resource": "pods"},
+	"namespace": "default",
+	"operation": "CREATE",
+	"object": %s
+  }
+}`, apiVersion, rawPodWithoutVolume))
+	}
+
+	cases := []struct {
+		caseName         string
+		body             []byte
+		expectedVersion  string
+		expectedAllowed  bool
+		expectedWarnings int
+	}{
+		{"V1", review("admission.k8s.io/v1"), "admission.k8s.io/v1", true, 1},
+		{"V1beta1", review("admission.k8s.io/v1beta1"), "admission.k8s.io/v1beta1", true, 0},
+		{"Unsupported", review("admission.k8s.io/v2"), "admission.k8s.io/v2", false, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(c.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			modifier.Handle(w, r)
+
+			var resp struct {
+				APIVersion string                     `json:"apiVersion"`
+				Kind       string                     `json:"kind"`
+				Response   *v1beta1.AdmissionResponse `json:"response"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Can't decode response %s: %v", w.Body.String(), err)
+			}
+			if resp.APIVersion != c.expectedVersion || resp.Kind != "AdmissionReview" {
+				t.Errorf("Expected %s AdmissionReview, got %s %s", c.expectedVersion, resp.APIVersion, resp.Kind)
+			}
+			if resp.Response == nil {
+				t.Fatalf("Expected a response, got none")
+			}
+			if resp.Response.UID != "918ef1dc-928f-4525-99ef-988389f263c3" {
+				t.Errorf("Expected the request UID to be echoed, got %q", resp.Response.UID)
+			}
+			if resp.Response.Allowed != c.expectedAllowed {
+				t.Errorf("Expected allowed %v, got %v: %v", c.expectedAllowed, resp.Response.Allowed, resp.Response.Result)
+			}
+			if len(resp.Response.Warnings) != c.expectedWarnings {
+				t.Errorf("Expected %d warnings, got %q", c.expectedWarnings, resp.Response.Warnings)
+			}
+			if !c.expectedAllowed {
+				return
+			}
+			if resp.Response.PatchType == nil || *resp.Response.PatchType != v1beta1.PatchTypeJSONPatch {
+				t.Errorf("Expected a JSONPatch patch type, got %v", resp.Response.PatchType)
+			}
+			if !bytes.Equal(resp.Response.Patch, validPatchIfNoVolumesPresent) {
+				t.Errorf("Expected patch %s, got %s", validPatchIfNoVolumesPresent, resp.Response.Patch)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+	modifier := NewModifier(WithServiceAccountCache(saCache))
+
+	dryRun, notDryRun := true, false
+	cases := []struct {
+		caseName string
+		dryRun   *bool
+		label    string
+	}{
+		{"Unset", nil, "false"},
+		{"NotDryRun", &notDryRun, "false"},
+		{"DryRun", &dryRun, "true"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			review := getValidReview(rawPodWithoutVolume)
+			review.Request.DryRun = c.dryRun
+
+			before := map[string]float64{}
+			for _, label := range []string{"true", "false"} {
+				before[label] = testutil.ToFloat64(injectionCounter.WithLabelValues("service-account", label))
+			}
+			response := modifier.AdmitPod(context.Background(), review)
+			if !bytes.Equal(response.Patch, validPatchIfNoVolumesPresent) {
+				t.Errorf("Expected patch %s, got %s", validPatchIfNoVolumesPresent, response.Patch)
+			}
+			for _, label := range []string{"true", "false"} {
+				want := before[label]
+				if label == c.label {
+					want++
+				}
+				if got := testutil.ToFloat64(injectionCounter.WithLabelValues("service-account", label)); got != want {
+					t.Errorf("Expected %v injections with dry_run=%s, got %v", want, label, got)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmissionWarnings(t *testing.T) {
+	cases := []struct {
+		caseName      string
+		saAnnotations map[string]string
+		podOverride   bool
+		expected      []string
+	}{
+		{
+			"Clean",
+			map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader"},
+			true,
+			nil,
+		},
+		{
+			"OverflowingTokenExpiration",
+			map[string]string{
+				"eks.amazonaws.com/role-arn":         "arn:aws:iam::111122223333:role/s3-reader",
+				"eks.amazonaws.com/token-expiration": "99999999999999999999",
+			},
+			true,
+			[]string{`ignoring service account default/default annotation: invalid eks.amazonaws.com/token-expiration value "99999999999999999999", out of range`},
+		},
+		{
+			"InvalidBooleanAnnotation",
+			map[string]string{
+				"eks.amazonaws.com/role-arn":           "arn:aws:iam::111122223333:role/s3-reader",
+				"eks.amazonaws.com/force-env-override": "always",
+			},
+			true,
+			[]string{`ignoring service account default/default annotation: invalid eks.amazonaws.com/force-env-override value "always", must be true or false`},
+		},
+		{
+			"DisallowedPartition",
+			map[string]string{"eks.amazonaws.com/role-arn": "arn:example:iam::111122223333:role/s3-reader"},
+			true,
+			[]string{`not injecting a role: partition "example" of ARN "arn:example:iam::111122223333:role/s3-reader" is not allowed`},
+		},
+		{
+			"IgnoredPodRoleAnnotation",
+			map[string]string{"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader"},
+			false,
+			[]string{"ignoring pod annotation eks.amazonaws.com/role-arn, pod annotation override is disabled"},
+		},
+		{
+			"InvalidChainedRole",
+			map[string]string{
+				"eks.amazonaws.com/role-arn":         "arn:aws:iam::111122223333:role/s3-reader",
+				"eks.amazonaws.com/chained-role-arn": "s3-writer",
+			},
+			true,
+			[]string{`ignoring service account default/default annotation eks.amazonaws.com/chained-role-arn: malformed ARN "s3-writer"`},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			testServiceAccount := &v1.ServiceAccount{}
+			testServiceAccount.Name = "default"
+			testServiceAccount.Namespace = "default"
+			testServiceAccount.Annotations = c.saAnnotations
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)),
+				WithPodAnnotationOverride(c.podOverride),
+			)
+
+			pod := rawPodWithoutVolume
+			if !c.podOverride {
+				pod = []byte(strings.Replace(string(rawPodWithoutVolume), `"metadata": {`,
+					`"metadata": {"annotations": {"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-writer"},`, 1))
+			}
+			response := modifier.AdmitPod(context.Background(), getValidReview(pod))
+			if !response.Allowed {
+				t.Fatalf("Expected the pod to be allowed, got %v", response.Result)
+			}
+			if !reflect.DeepEqual(response.Warnings, c.expected) {
+				t.Errorf("Expected warnings %q, got %q", c.expected, response.Warnings)
+			}
+		})
+	}
+}
+
+func TestAdmissionWarningsCollector(t *testing.T) {
+	var warnings admissionWarnings
+	if got := warnings.list(); got != nil {
+		t.Errorf("Expected no warnings, got %q", got)
+	}
+
+	warnings.add("first")
+	warnings.add("second")
+	warnings.add("first")
+	if got, want := warnings.list(), []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected deduplicated warnings %q, got %q", want, got)
+	}
+
+	long := strings.Repeat("é", maxWarningLength)
+	warnings.add(long)
+	warnings.add(long)
+	got := warnings.list()
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 warnings, got %d", len(got))
+	}
+	truncated := got[2]
+	if len(truncated) > maxWarningLength || !strings.HasSuffix(truncated, "...") || !utf8.ValidString(truncated) {
+		t.Errorf("Expected a valid warning of at most %d bytes ending with ..., got %d bytes %q", maxWarningLength, len(truncated), truncated)
+	}
+}
+
+func TestSALookupFailurePolicy(t *testing.T) {
+	backoff := saLookupBackoff
+	saLookupBackoff.Duration = time.Millisecond
+	defer func() { saLookupBackoff = backoff }()
+
+	cases := []struct {
+		caseName         string
+		policy           string
+		failures         int
+		expectedAttempts int
+		expectedAllowed  bool
+		expectedInjected bool
+		expectedOutcome  string
+	}{
+		{"AllowSucceeds", SALookupFailurePolicyAllow, 0, 1, true, true, ""},
+		{"AllowFails", SALookupFailurePolicyAllow, 5, 1, true, false, "allowed"},
+		{"RetryRecovers", SALookupFailurePolicyRetry, 1, 2, true, true, "recovered"},
+		{"RetryFails", SALookupFailurePolicyRetry, 5, 3, true, false, "allowed"},
+		{"DenyFails", SALookupFailurePolicyDeny, 5, 1, false, false, "denied"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			getter := newFakeSAGetter()
+			getter.add("default", "default", "arn:aws:iam::111122223333:role/s3-reader")
+			getter.failures = c.failures
+			modifier := NewModifier(
+				WithSAGetter(getter),
+				WithSALookupFailurePolicy(c.policy),
+			)
+
+			outcomes := []string{"recovered", "allowed", "denied"}
+			before := map[string]float64{}
+			for _, outcome := range outcomes {
+				before[outcome] = testutil.ToFloat64(saLookupFailureCounter.WithLabelValues(c.policy, outcome))
+			}
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+
+			if getter.lookups != c.expectedAttempts {
+				t.Errorf("Expected %d lookups, got %d", c.expectedAttempts, getter.lookups)
+			}
+			if response.Allowed != c.expectedAllowed {
+				t.Errorf("Expected allowed %v, got %v: %v", c.expectedAllowed, response.Allowed, response.Result)
+			}
+			if injected := len(response.Patch) > 0; injected != c.expectedInjected {
+				t.Errorf("Expected injected %v, got patch %s", c.expectedInjected, response.Patch)
+			}
+			if !c.expectedAllowed && (response.Result == nil || !strings.Contains(response.Result.Message, "could not look up service account default/default")) {
+				t.Errorf("Expected a lookup failure message, got %v", response.Result)
+			}
+			for _, outcome := range outcomes {
+				want := before[outcome]
+				if outcome == c.expectedOutcome {
+					want++
+				}
+				if got := testutil.ToFloat64(saLookupFailureCounter.WithLabelValues(c.policy, outcome)); got != want {
+					t.Errorf("Expected %v %s lookup failures, got %v", want, outcome, got)
+				}
+			}
+		})
+	}
+}
+
+// fakeSAGetter is an in-memory SAGetter, failing the first lookups
+type fakeSAGetter struct {
+	accounts map[string]*cache.CacheResponse
+	failures int
+	lookups  int
+}
+
+func newFakeSAGetter() *fakeSAGetter {
+	return &fakeSAGetter{accounts: map[string]*cache.CacheResponse{}}
+}
+
+func (f *fakeSAGetter) add(name, namespace, role string) {
+	f.accounts[namespace+"/"+name] = &cache.CacheResponse{RoleARN: role, Audience: "sts.amazonaws.com", DefaultAudience: true}
+}
+
+func (f *fakeSAGetter) Lookup(ctx context.Context, name, namespace string) (*cache.CacheResponse, error) {
+	f.lookups++
+	if f.lookups <= f.failures {
+		return nil, errors.New("connection refused")
+	}
+	resp, ok := f.accounts[namespace+"/"+name]
+	if !ok {
+		return nil, nil
+	}
+	respCopy := *resp
+	return &respCopy, nil
+}
+
+func TestSAGetter(t *testing.T) {
+	sa := &v1.ServiceAccount{}
+	sa.Name = "default"
+	sa.Namespace = "default"
+	sa.Annotations = map[string]string{"irsa.example.com/role-arn": "arn:aws:iam::111122223333:role/api"}
+	getter := newFakeSAGetter()
+	getter.add("default", "default", "arn:aws:iam::111122223333:role/getter")
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.Add("default", "default", "arn:aws:iam::111122223333:role/cache", "sts.amazonaws.com")
+
+	cases := []struct {
+		caseName string
+		opts     []ModifierOpt
+		expected string
+	}{
+		{"Cache", []ModifierOpt{WithServiceAccountCache(saCache)}, "arn:aws:iam::111122223333:role/cache"},
+		{"Getter", []ModifierOpt{WithServiceAccountCache(saCache), WithSAGetter(getter)}, "arn:aws:iam::111122223333:role/getter"},
+		// The API server lookup uses the annotation domain set after it
+		{"Clientset", []ModifierOpt{WithClientset(fake.NewSimpleClientset(sa)), WithAnnotationDomain("irsa.example.com")}, "arn:aws:iam::111122223333:role/api"},
+		{"GetterOverClientset", []ModifierOpt{WithClientset(fake.NewSimpleClientset(sa)), WithSAGetter(getter)}, "arn:aws:iam::111122223333:role/getter"},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			modifier := NewModifier(c.opts...)
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			if !response.Allowed || !strings.Contains(string(response.Patch), c.expected) {
+				t.Errorf("Expected role %s to be injected, got patch %s: %v", c.expected, response.Patch, response.Result)
+			}
+		})
+	}
+}
+
+func TestDeprecatedAnnotationPrefixWarning(t *testing.T) {
+	sa := &v1.ServiceAccount{}
+	sa.Name = "default"
+	sa.Namespace = "default"
+	sa.Annotations = map[string]string{"irsa.mycorp.io/role-arn": "arn:aws:iam::111122223333:role/s3-reader"}
+	modifier := NewModifier(WithServiceAccountCache(cache.New("sts.amazonaws.com", "eks.amazonaws.com", fake.NewSimpleClientset(sa),
+		cache.WithSecondaryAnnotationPrefixes("irsa.mycorp.io"))))
+
+	response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+	if !response.Allowed || len(response.Patch) == 0 {
+		t.Fatalf("Expected the role of the secondary prefix to be injected, got %v", response.Result)
+	}
+	expected := "service account default/default uses the deprecated annotation prefix irsa.mycorp.io, annotate it with eks.amazonaws.com instead"
+	if !reflect.DeepEqual(response.Warnings, []string{expected}) {
+		t.Errorf("Expected warnings %q, got %q", []string{expected}, response.Warnings)
+	}
+}
+
+func TestDenyOnDeletedSA(t *testing.T) {
+	cases := []struct {
+		caseName         string
+		deny             bool
+		deleted          bool
+		expectedAllowed  bool
+		expectedInjected bool
+		expectedAction   string
+	}{
+		{"Exists", true, false, true, true, ""},
+		{"DeletedAllowed", false, true, true, false, "allowed"},
+		{"DeletedDenied", true, true, false, false, "denied"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			fakeCache := cache.NewFakeServiceAccountCache()
+			fakeCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+			if c.deleted {
+				fakeCache.Pop("default", "default")
+			}
+			modifier := NewModifier(
+				WithServiceAccountCache(fakeCache),
+				WithDenyOnDeletedSA(c.deny),
+			)
+
+			before := map[string]float64{}
+			for _, action := range []string{"allowed", "denied"} {
+				before[action] = testutil.ToFloat64(saNotFoundCounter.WithLabelValues(action, "false"))
+			}
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+
+			if response.Allowed != c.expectedAllowed {
+				t.Errorf("Expected allowed %v, got %v: %v", c.expectedAllowed, response.Allowed, response.Result)
+			}
+			if injected := len(response.Patch) > 0; injected != c.expectedInjected {
+				t.Errorf("Expected injected %v, got patch %s", c.expectedInjected, response.Patch)
+			}
+			if !c.expectedAllowed && (response.Result == nil || !strings.Contains(response.Result.Message, "service account default/default of pod") ||
+				response.Result.Code != http.StatusForbidden) {
+				t.Errorf("Expected a forbidden not found message, got %v", response.Result)
+			}
+			for action, count := range before {
+				if action == c.expectedAction {
+					count++
+				}
+				if got := testutil.ToFloat64(saNotFoundCounter.WithLabelValues(action, "false")); got != count {
+					t.Errorf("Expected %v %s pods without service account, got %v", count, action, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteNamespaceMetrics(t *testing.T) {
+	roleOverrideCounter.WithLabelValues("ci-1234").Inc()
+	roleOverrideCounter.WithLabelValues("kept").Inc()
+	rolePolicyViolationCounter.WithLabelValues("ci-1234", "true").Inc()
+	rolePolicyViolationCounter.WithLabelValues("ci-1234", "false").Inc()
+	DeleteNamespaceMetrics("ci-1234")
+
+	if roleOverrideCounter.DeleteLabelValues("ci-1234") {
+		t.Error("Expected the role override series of ci-1234 to be deleted")
+	}
+	for _, dryRun := range []string{"true", "false"} {
+		if rolePolicyViolationCounter.DeleteLabelValues("ci-1234", dryRun) {
+			t.Errorf("Expected the dry_run=%s role policy violation series of ci-1234 to be deleted", dryRun)
+		}
+	}
+	if !roleOverrideCounter.DeleteLabelValues("kept") {
+		t.Error("Expected the role override series of other namespaces to be kept")
+	}
+}
+
+// blockingSAGetter is an SAGetter whose lookups wait for their context, like
+// lookups of an unresponsive API server. cancel is called on the first lookup.
+type blockingSAGetter struct {
+	cancel  context.CancelFunc
+	lookups int
+}
+
+func (g *blockingSAGetter) Lookup(ctx context.Context, name, namespace string) (*cache.CacheResponse, error) {
+	g.lookups++
+	if g.cancel != nil {
+		g.cancel()
+	}
+	<-ctx.Done()
+	return nil, fmt.Errorf("error fetching sa %s/%s: %v", namespace, name, ctx.Err())
+}
+
+func TestSALookupContext(t *testing.T) {
+	cases := []struct {
+		caseName        string
+		policy          string
+		timeout         time.Duration
+		cancel          bool
+		expectedAllowed bool
+		expectedCode    int32
+	}{
+		{"AllowTimeout", SALookupFailurePolicyAllow, 50 * time.Millisecond, false, true, 0},
+		{"DenyTimeout", SALookupFailurePolicyDeny, 50 * time.Millisecond, false, false, http.StatusGatewayTimeout},
+		{"AllowCanceled", SALookupFailurePolicyAllow, 0, true, true, 0},
+		{"DenyCanceled", SALookupFailurePolicyDeny, 0, true, false, http.StatusGatewayTimeout},
+		// The lookup isn't retried once the request is canceled
+		{"RetryCanceled", SALookupFailurePolicyRetry, 0, true, true, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			getter := &blockingSAGetter{}
+			if c.cancel {
+				getter.cancel = cancel
+			}
+			modifier := NewModifier(
+				WithSAGetter(getter),
+				WithSALookupFailurePolicy(c.policy),
+				WithInternalTimeout(c.timeout),
+			)
+			body, err := json.Marshal(getValidReview(rawPodWithoutVolume))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)).WithContext(ctx)
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			reason := string(reasonServiceAccountLookupTimeout)
+			before := testutil.ToFloat64(admissionErrorCounter.WithLabelValues(reason))
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				modifier.Handle(w, r)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected the request to be abandoned")
+			}
+
+			var resp v1beta1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Response == nil {
+				t.Fatalf("Can't decode response %s: %v", w.Body.String(), err)
+			}
+			if resp.Response.Allowed != c.expectedAllowed {
+				t.Errorf("Expected allowed %v, got %v", c.expectedAllowed, resp.Response.Allowed)
+			}
+			if len(resp.Response.Patch) > 0 {
+				t.Errorf("Expected no patch, got %s", resp.Response.Patch)
+			}
+			if c.expectedCode != 0 && (resp.Response.Result == nil || resp.Response.Result.Code != c.expectedCode || resp.Response.Result.Reason != reasonServiceAccountLookupTimeout) {
+				t.Errorf("Expected reason %s and code %d, got %v", reasonServiceAccountLookupTimeout, c.expectedCode, resp.Response.Result)
+			}
+			if getter.lookups != 1 {
+				t.Errorf("Expected 1 lookup, got %d", getter.lookups)
+			}
+			if after := testutil.ToFloat64(admissionErrorCounter.WithLabelValues(reason)); after != before+1 {
+				t.Errorf("Expected %v %s admission errors, got %v", before+1, reason, after)
+			}
+		})
+	}
+}
+
+func TestValidateSALookupFailurePolicy(t *testing.T) {
+	for _, policy := range []string{SALookupFailurePolicyAllow, SALookupFailurePolicyRetry, SALookupFailurePolicyDeny} {
+		if err := ValidateSALookupFailurePolicy(policy); err != nil {
+			t.Errorf("Expected policy %q to be valid, got %v", policy, err)
+		}
+	}
+	for _, policy := range []string{"", "ignore", "Deny"} {
+		if err := ValidateSALookupFailurePolicy(policy); err == nil {
+			t.Errorf("Expected policy %q to be invalid", policy)
+		}
+	}
+}
+
+var rawDeployment = []byte(`
+{
+  "apiVersion": "apps/v1",
+  "kind": "Deployment",
+  "metadata": {
+	"name": "balajilovesoreos"
+  },
+  "spec": {
+	"template": {
+	  "spec": {
+		"containers": [
+		  {
+			"image": "amazonlinux",
+			"name": "balajilovesoreos"
+		  }
+		],
+		"serviceAccountName": "default"
+	  }
+	}
+  }
+}
+`)
+
+func TestUnexpectedResources(t *testing.T) {
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+	modifier := NewModifier(WithServiceAccountCache(saCache))
+
+	cases := []struct {
+		caseName    string
+		resource    metav1.GroupVersionResource
+		subResource string
+		object      []byte
+		label       string
+	}{
+		{"Deployment", metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, "", rawDeployment, "apps/v1/deployments"},
+		{"PodStatus", metav1.GroupVersionResource{Version: "v1", Resource: "pods"}, "status", rawPodWithoutVolume, "v1/pods/status"},
+		{"OtherPodVersion", metav1.GroupVersionResource{Version: "v2", Resource: "pods"}, "", rawPodWithoutVolume, "v2/pods"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			review := getValidReview(c.object)
+			review.Request.Resource = c.resource
+			review.Request.SubResource = c.subResource
+
+			before := testutil.ToFloat64(unexpectedResourceCounter.WithLabelValues(c.label))
+			response := modifier.AdmitPod(context.Background(), review)
+			after := testutil.ToFloat64(unexpectedResourceCounter.WithLabelValues(c.label))
+
+			if !response.Allowed {
+				t.Errorf("Expected the request to be allowed, got %v", response.Result)
+			}
+			if len(response.Patch) != 0 {
+				t.Errorf("Expected no patch, got %s", response.Patch)
+			}
+			if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], c.label) {
+				t.Errorf("Expected a warning naming %s, got %q", c.label, response.Warnings)
+			}
+			if after != before+1 {
+				t.Errorf("Expected unexpected resource counter to increase, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestUndecodablePod(t *testing.T) {
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+	modifier := NewModifier(WithServiceAccountCache(saCache))
+
+	cases := []struct {
+		caseName string
+		object   []byte
+	}{
+		{"Truncated", rawPodWithoutVolume[:len(rawPodWithoutVolume)/2]},
+		{"WrongType", []byte(`{"apiVersion": "v1", "kind": "Pod", "spec": {"containers": "balajilovesoreos"}}`)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("undecodable-pod", "false"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(c.object))
+			after := testutil.ToFloat64(skippedCounter.WithLabelValues("undecodable-pod", "false"))
+
+			if !response.Allowed {
+				t.Errorf("Expected the pod to be allowed, got %v", response.Result)
+			}
+			if len(response.Patch) != 0 {
+				t.Errorf("Expected no patch, got %s", response.Patch)
+			}
+			if response.Result == nil || !strings.Contains(response.Result.Message, "could not decode the pod") {
+				t.Errorf("Expected a decoding status message, got %v", response.Result)
+			}
+			if after != before+1 {
+				t.Errorf("Expected skipped counter to increase, got %v -> %v", before, after)
+			}
+		})
+	}
+}
+
+func TestServeRejections(t *testing.T) {
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+
+	review, err := json.Marshal(getValidReview(rawPodWithoutVolume))
+	if err != nil {
+		t.Fatalf("Can't encode review: %v", err)
+	}
+	limit := int64(len(review)) + 16
+	atLimit := append(append([]byte{}, review...), bytes.Repeat([]byte(" "), 16)...)
+	overLimit := append(append([]byte{}, atLimit...), ' ')
+
+	cases := []struct {
+		caseName     string
+		method       string
+		contentType  string
+		body         []byte
+		expectedCode int
+		reason       string
+	}{
+		{"Valid", http.MethodPost, "application/json", review, http.StatusOK, ""},
+		{"ContentTypeParameters", http.MethodPost, "application/json; charset=utf-8", review, http.StatusOK, ""},
+		{"AtLimit", http.MethodPost, "application/json", atLimit, http.StatusOK, ""},
+		{"Get", http.MethodGet, "application/json", review, http.StatusMethodNotAllowed, "method"},
+		{"Put", http.MethodPut, "application/json", review, http.StatusMethodNotAllowed, "method"},
+		{"NoContentType", http.MethodPost, "", review, http.StatusUnsupportedMediaType, "content-type"},
+		{"Yaml", http.MethodPost, "application/yaml", review, http.StatusUnsupportedMediaType, "content-type"},
+		{"EmptyBody", http.MethodPost, "application/json", nil, http.StatusBadRequest, "empty-body"},
+		{"OverLimit", http.MethodPost, "application/json", overLimit, http.StatusRequestEntityTooLarge, "too-large"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			modifier := NewModifier(WithServiceAccountCache(saCache), WithMaxRequestBytes(limit))
+			r := httptest.NewRequest(c.method, "/mutate", bytes.NewReader(c.body))
+			if c.contentType != "" {
+				r.Header.Set("Content-Type", c.contentType)
+			}
+			w := httptest.NewRecorder()
+
+			var before float64
+			if c.reason != "" {
+				before = testutil.ToFloat64(rejectedRequestCounter.WithLabelValues(c.reason))
+			}
+			modifier.Handle(w, r)
+
+			if w.Code != c.expectedCode {
+				t.Fatalf("Expected code %d, got %d: %s", c.expectedCode, w.Code, w.Body.String())
+			}
+			if c.reason == "" {
+				var resp v1beta1.AdmissionReview
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Response == nil || !resp.Response.Allowed {
+					t.Errorf("Expected an allowed AdmissionReview, got %s", w.Body.String())
+				}
+				return
+			}
+
+			var status metav1.Status
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatalf("Expected a JSON Status, got %s: %v", w.Body.String(), err)
+			}
+			if status.Kind != "Status" || status.Code != int32(c.expectedCode) || status.Message == "" {
+				t.Errorf("Expected a %d Status with a message, got %+v", c.expectedCode, status)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Expected Content-Type application/json, got %q", got)
+			}
+			if after := testutil.ToFloat64(rejectedRequestCounter.WithLabelValues(c.reason)); after != before+1 {
+				t.Errorf("Expected %s rejection counter to increase, got %v -> %v", c.reason, before, after)
+			}
+		})
+	}
+}
+
+func TestValidateMaxRequestBytes(t *testing.T) {
+	if err := ValidateMaxRequestBytes(DefaultMaxRequestBytes); err != nil {
+		t.Errorf("Expected the default limit to be valid, got %v", err)
+	}
+	for _, limit := range []int64{0, -1} {
+		if err := ValidateMaxRequestBytes(limit); err == nil {
+			t.Errorf("Expected limit %d to be invalid", limit)
+		}
+	}
+}
+
+func TestJSONPointer(t *testing.T) {
+	cases := []struct {
+		caseName string
+		tokens   []string
+		expected string
+	}{
+		{"Root", nil, ""},
+		{"Plain", []string{"spec", "containers", "0"}, "/spec/containers/0"},
+		{"Empty", []string{""}, "/"},
+		{"Slash", []string{"metadata", "annotations", "eks.amazonaws.com/injected-role-arn"}, "/metadata/annotations/eks.amazonaws.com~1injected-role-arn"},
+		{"Tilde", []string{"a~b"}, "/a~0b"},
+		{"TildeSlash", []string{"~/"}, "/~0~1"},
+		{"SlashTilde", []string{"/~"}, "/~1~0"},
+		{"EscapedLookingToken", []string{"~1"}, "/~01"},
+		{"Repeated", []string{"//~~"}, "/~1~1~0~0"},
+		{"MultipleTokens", []string{"a/b", "c~d"}, "/a~1b/c~0d"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			if got := jsonPointer(c.tokens...); got != c.expected {
+				t.Errorf("Expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestAnnotationsPatchEscaping(t *testing.T) {
+	keys := []string{
+		"eks.amazonaws.com/injected-role-arn",
+		"example.com/a~b",
+		"example.com/~1",
+		"plain",
+	}
+	annotations := map[string]string{}
+	for _, key := range keys {
+		annotations[key] = "value of " + key
+	}
+
+	for _, existing := range []map[string]string{nil, {"existing": "annotation"}} {
+		pod := &v1.Pod{}
+		pod.Name = "balajilovesoreos"
+		pod.Annotations = existing
+		raw, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatalf("Can't encode pod: %v", err)
+		}
+		patch, err := json.Marshal(annotationsPatch(pod, annotations))
+		if err != nil {
+			t.Fatalf("Can't encode patch: %v", err)
+		}
+
+		patched := applyPatch(t, raw, &v1beta1.AdmissionResponse{Patch: patch})
+		for _, key := range keys {
+			if got := patched.Annotations[key]; got != annotations[key] {
+				t.Errorf("Expected annotation %q to be %q, got %q (patch %s)", key, annotations[key], got, patch)
+			}
+		}
+		for key, value := range existing {
+			if got := patched.Annotations[key]; got != value {
+				t.Errorf("Expected existing annotation %q to be kept, got %q", key, got)
+			}
+		}
+	}
+}
+
+func TestMissingAndEmptyArrays(t *testing.T) {
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+	modifier := NewModifier(WithServiceAccountCache(saCache))
+
+	populated := map[string]interface{}{
+		"env":          []interface{}{map[string]interface{}{"name": "APP_ENV", "value": "prod"}},
+		"volumeMounts": []interface{}{map[string]interface{}{"name": "data", "mountPath": "/data"}},
+		"volumes":      []interface{}{map[string]interface{}{"name": "data", "emptyDir": map[string]interface{}{}}},
+	}
+
+	for _, field := range []string{"env", "volumeMounts", "volumes"} {
+		for _, presence := range []string{"missing", "empty", "populated"} {
+			t.Run(field+"/"+presence, func(t *testing.T) {
+				container := map[string]interface{}{"name": "balajilovesoreos", "image": "amazonlinux"}
+				spec := map[string]interface{}{
+					"containers":         []interface{}{container},
+					"initContainers":     []interface{}{map[string]interface{}{"name": "init", "image": "amazonlinux"}},
+					"serviceAccountName": "default",
+				}
+				target := container
+				if field == "volumes" {
+					target = spec
+				}
+				switch presence {
+				case "empty":
+					target[field] = []interface{}{}
+				case "populated":
+					target[field] = populated[field]
+				}
+				rawPod, err := json.Marshal(map[string]interface{}{
+					"apiVersion": "v1",
+					"kind":       "Pod",
+					"metadata":   map[string]interface{}{"name": "balajilovesoreos"},
+					"spec":       spec,
+				})
+				if err != nil {
+					t.Fatalf("Can't encode pod: %v", err)
+				}
+
+				response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+				pod := applyPatch(t, rawPod, response)
+
+				for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+					if got := envValues(c, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{"arn:aws:iam::111122223333:role/s3-reader"}) {
+						t.Errorf("Expected AWS_ROLE_ARN in container %s, got %v", c.Name, got)
+					}
+					mounted := false
+					for _, mount := range c.VolumeMounts {
+						mounted = mounted || mount.Name == "aws-iam-token"
+					}
+					if !mounted {
+						t.Errorf("Expected the token to be mounted in container %s, got %+v", c.Name, c.VolumeMounts)
+					}
+				}
+				if len(pod.Spec.Volumes) == 0 || pod.Spec.Volumes[0].Name != "aws-iam-token" {
+					t.Errorf("Expected the token volume to be added, got %+v", pod.Spec.Volumes)
+				}
+
+				if presence != "populated" {
+					return
+				}
+				c := pod.Spec.Containers[0]
+				switch field {
+				case "env":
+					if got := envValues(c, "APP_ENV"); !reflect.DeepEqual(got, []string{"prod"}) {
+						t.Errorf("Expected APP_ENV to be kept, got %v", got)
+					}
+				case "volumeMounts":
+					if c.VolumeMounts[0].Name != "data" {
+						t.Errorf("Expected the data mount to be kept first, got %+v", c.VolumeMounts)
+					}
+				case "volumes":
+					if len(pod.Spec.Volumes) != 2 || pod.Spec.Volumes[1].Name != "data" {
+						t.Errorf("Expected the data volume to be kept, got %+v", pod.Spec.Volumes)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSkipOwnerKinds(t *testing.T) {
+	controller := true
+	daemonSet := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "node-agent", Controller: &controller}
+	replicaSet := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-6d4cf56db6", Controller: &controller}
+	job := metav1.OwnerReference{APIVersion: "batch/v1", Kind: "Job", Name: "backup"}
+	custom := metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Agent", Name: "agent"}
+
+	cases := []struct {
+		caseName string
+		kinds    []string
+		owners   []metav1.OwnerReference
+		skipped  bool
+	}{
+		{"NoOwners", []string{"DaemonSet"}, nil, false},
+		{"NoKinds", nil, []metav1.OwnerReference{daemonSet}, false},
+		{"DaemonSet", []string{"DaemonSet"}, []metav1.OwnerReference{daemonSet}, true},
+		{"OtherOwner", []string{"DaemonSet", "Job"}, []metav1.OwnerReference{replicaSet}, false},
+		{"SecondOwner", []string{"Job"}, []metav1.OwnerReference{custom, job}, true},
+		{"MultipleOwnersNoneListed", []string{"DaemonSet"}, []metav1.OwnerReference{custom, job}, false},
+		{"CaseInsensitive", []string{"daemonset"}, []metav1.OwnerReference{daemonSet}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+			modifier := NewModifier(WithServiceAccountCache(saCache), WithSkipOwnerKinds(c.kinds))
+
+			pod := &v1.Pod{}
+			if err := json.Unmarshal(rawPodWithoutVolume, pod); err != nil {
+				t.Fatalf("Can't decode pod: %v", err)
+			}
+			pod.OwnerReferences = c.owners
+			rawPod, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatalf("Can't encode pod: %v", err)
+			}
+
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("owner-kind", "false"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			after := testutil.ToFloat64(skippedCounter.WithLabelValues("owner-kind", "false"))
+
+			if !response.Allowed {
+				t.Errorf("Expected the pod to be allowed, got %v", response.Result)
+			}
+			if skipped := len(response.Patch) == 0; skipped != c.skipped {
+				t.Errorf("Expected skipped %v, got patch %s", c.skipped, response.Patch)
+			}
+			want := before
+			if c.skipped {
+				want++
+			}
+			if after != want {
+				t.Errorf("Expected skipped counter %v, got %v", want, after)
+			}
+		})
+	}
+}
+
+func TestExcludePodSelector(t *testing.T) {
+	cases := []struct {
+		caseName string
+		selector string
+		labels   map[string]string
+		skipped  bool
+	}{
+		{"NoSelector", "", map[string]string{"irsa.example.com/inject": "false"}, false},
+		{"EqualityMatch", "irsa.example.com/inject=false", map[string]string{"irsa.example.com/inject": "false"}, true},
+		{"EqualityOtherValue", "irsa.example.com/inject=false", map[string]string{"irsa.example.com/inject": "true"}, false},
+		{"EqualityNoLabels", "irsa.example.com/inject=false", nil, false},
+		{"InequalityNoLabels", "irsa.example.com/inject!=true", nil, true},
+		{"InMatch", "tier in (node-agent, system)", map[string]string{"tier": "system"}, true},
+		{"InNoMatch", "tier in (node-agent, system)", map[string]string{"tier": "web"}, false},
+		{"NotInMatch", "tier notin (web)", map[string]string{"tier": "system"}, true},
+		{"NotInNoMatch", "tier notin (web)", map[string]string{"tier": "web"}, false},
+		{"Exists", "node-agent", map[string]string{"node-agent": ""}, true},
+		{"DoesNotExist", "!team", map[string]string{"app": "web"}, true},
+		{"DoesNotExistNoMatch", "!team", map[string]string{"team": "payments"}, false},
+		{"AllRequirements", "tier in (system),!team", map[string]string{"tier": "system", "team": "payments"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+			opts := []ModifierOpt{WithServiceAccountCache(saCache)}
+			if c.selector != "" {
+				selector, err := labels.Parse(c.selector)
+				if err != nil {
+					t.Fatalf("Can't parse selector %q: %v", c.selector, err)
+				}
+				opts = append(opts, WithExcludePodSelector(selector))
+			}
+			modifier := NewModifier(opts...)
+
+			pod := &v1.Pod{}
+			if err := json.Unmarshal(rawPodWithoutVolume, pod); err != nil {
+				t.Fatalf("Can't decode pod: %v", err)
+			}
+			pod.Labels = c.labels
+			rawPod, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatalf("Can't encode pod: %v", err)
+			}
+
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("pod-selector", "false"))
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			after := testutil.ToFloat64(skippedCounter.WithLabelValues("pod-selector", "false"))
+
+			if !response.Allowed {
+				t.Errorf("Expected the pod to be allowed, got %v", response.Result)
+			}
+			if skipped := len(response.Patch) == 0; skipped != c.skipped {
+				t.Errorf("Expected skipped %v, got patch %s", c.skipped, response.Patch)
+			}
+			want := before
+			if c.skipped {
+				want++
+			}
+			if after != want {
+				t.Errorf("Expected skipped counter %v, got %v", want, after)
+			}
+		})
+	}
+}
+
+func TestMutatePodLibrary(t *testing.T) {
+	annotatedSA := &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "default",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+			},
+		},
+	}
+	otherSA := annotatedSA.DeepCopy()
+	otherSA.Name = "other"
+
+	cases := []struct {
+		caseName string
+		sa       *v1.ServiceAccount
+		injected bool
+	}{
+		{"NilServiceAccount", nil, false},
+		{"AnnotatedServiceAccount", annotatedSA, true},
+		{"OtherServiceAccount", otherSA, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			if c.sa != nil && c.sa.Name == "default" {
+				saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+			}
+			modifier := NewModifier(WithServiceAccountCache(saCache))
+
+			pod := &v1.Pod{}
+			if err := json.Unmarshal(rawPodWithoutVolume, pod); err != nil {
+				t.Fatalf("Can't decode pod: %v", err)
+			}
+			pod.Namespace = "default"
+
+			patch, _, err := modifier.MutatePod(context.Background(), pod, c.sa)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if injected := len(patch) > 0; injected != c.injected {
+				t.Fatalf("Expected injected %v, got patch %v", c.injected, patch)
+			}
+
+			if !c.injected {
+				return
+			}
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume))
+			rawPatch, err := json.Marshal(patch)
+			if err != nil {
+				t.Fatalf("Can't encode patch: %v", err)
+			}
+			if string(rawPatch) != string(response.Patch) {
+				t.Errorf("Expected the AdmitPod patch\n%s\ngot\n%s", response.Patch, rawPatch)
+			}
+		})
+	}
+}
+
+func TestPodDeniedError(t *testing.T) {
+	saCache := cache.NewFakeServiceAccountCache()
+	modifier := NewModifier(
+		WithServiceAccountCache(saCache),
+		WithSALookupFailurePolicy(SALookupFailurePolicyDeny),
+	)
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(rawPodWithoutVolume, pod); err != nil {
+		t.Fatalf("Can't decode pod: %v", err)
+	}
+	pod.Namespace = "default"
+
+	_, _, err := modifier.mutatePod(context.Background(), pod, podRequest{
+		dryRun: "false",
+		lookup: func(context.Context, string, string) (*cache.CacheResponse, error) {
+			return nil, fmt.Errorf("connection refused")
+		},
+	})
+	denied, ok := err.(*PodDeniedError)
+	if !ok {
+		t.Fatalf("Expected a *PodDeniedError, got %v", err)
+	}
+	if denied.Status.Code != http.StatusInternalServerError {
+		t.Errorf("Expected code %d, got %d", http.StatusInternalServerError, denied.Status.Code)
+	}
+	if denied.Error() != denied.Status.Message {
+		t.Errorf("Expected error %q, got %q", denied.Status.Message, denied.Error())
+	}
+}
+
+func TestReinjectedEnvValues(t *testing.T) {
+	roleARN := "arn:aws:iam::111122223333:role/s3-reader"
+	oldRoleARN := "arn:aws:iam::111122223333:role/s3-writer"
+	tokenFile := "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"
+
+	cases := []struct {
+		caseName    string
+		roleARN     string
+		wantReplace bool
+	}{
+		{"IdenticalValues", roleARN, false},
+		{"ChangedRole", oldRoleARN, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", roleARN, "sts.amazonaws.com")
+			modifier := NewModifier(WithServiceAccountCache(saCache))
+
+			// Copied from an injected pod template, with an earlier role
+			first := applyPatch(t, rawPodWithoutVolume, modifier.AdmitPod(context.Background(), getValidReview(rawPodWithoutVolume)))
+			first.Spec.Containers[0].Env = append([]v1.EnvVar{{Name: "APP_MODE", Value: "batch"}}, first.Spec.Containers[0].Env...)
+			for i, env := range first.Spec.Containers[0].Env {
+				if env.Name == "AWS_ROLE_ARN" {
+					first.Spec.Containers[0].Env[i].Value = c.roleARN
+				}
+			}
+			rawPod, err := json.Marshal(first)
+			if err != nil {
+				t.Fatalf("Can't encode pod: %v", err)
+			}
+
+			response := modifier.AdmitPod(context.Background(), getValidReview(rawPod))
+			var patch []PatchOperation
+			if len(response.Patch) > 0 {
+				if err := json.Unmarshal(response.Patch, &patch); err != nil {
+					t.Fatalf("Error unmarshaling patch: %v", err)
+				}
+			}
+			var replaced []string
+			for _, op := range patch {
+				if op.Op == "replace" {
+					replaced = append(replaced, op.Path)
+				}
+			}
+			if !c.wantReplace {
+				if len(patch) != 0 {
+					t.Errorf("Expected no patch, got %s", response.Patch)
+				}
+				return
+			}
+			if !reflect.DeepEqual(replaced, []string{"/spec/containers/0/env/1"}) {
+				t.Errorf("Expected the AWS_ROLE_ARN env var to be replaced, got patch %s", response.Patch)
+			}
+
+			container := applyPatch(t, rawPod, response).Spec.Containers[0]
+			if got := envValues(container, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{roleARN}) {
+				t.Errorf("Expected AWS_ROLE_ARN %s, got %v", roleARN, got)
+			}
+			if got := envValues(container, "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, []string{tokenFile}) {
+				t.Errorf("Expected AWS_WEB_IDENTITY_TOKEN_FILE %s, got %v", tokenFile, got)
+			}
+			if got := envValues(container, "APP_MODE"); !reflect.DeepEqual(got, []string{"batch"}) {
+				t.Errorf("Expected the unrelated APP_MODE to be untouched, got %v", got)
+			}
+		})
+	}
+}
+
+func TestVersionedMutatePaths(t *testing.T) {
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+	opts := []ModifierOpt{WithServiceAccountCache(saCache), WithRegion("us-west-2")}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", NewModifier(opts...).Handle)
+	mux.HandleFunc("/mutate/v2", NewModifier(append(opts[:len(opts):len(opts)],
+		WithRegionalSTS(true),
+		WithDisableIMDSFallback(true),
+	)...).Handle)
+
+	review, err := json.Marshal(getValidReview(rawPodWithoutVolume))
+	if err != nil {
+		t.Fatalf("Can't encode review: %v", err)
+	}
+
+	cases := []struct {
+		path         string
+		regionalSTS  []string
+		imdsDisabled []string
+	}{
+		{"/mutate", []string{}, []string{}},
+		{"/mutate/v2", []string{"regional"}, []string{"true"}},
+	}
+
+	// Both routes are served concurrently by the same mux
+	var wg sync.WaitGroup
+	for _, c := range cases {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(review))
+				r.Header.Set("Content-Type", "application/json")
+				mux.ServeHTTP(httptest.NewRecorder(), r)
+			}(c.path)
+		}
+	}
+	wg.Wait()
+
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, c.path, bytes.NewReader(review))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var resp v1beta1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Can't decode response: %v", err)
+			}
+
+			container := applyPatch(t, rawPodWithoutVolume, resp.Response).Spec.Containers[0]
+			if got := envValues(container, "AWS_ROLE_ARN"); !reflect.DeepEqual(got, []string{"arn:aws:iam::111122223333:role/s3-reader"}) {
+				t.Errorf("Expected the shared role to be injected, got %v", got)
+			}
+			if got := envValues(container, "AWS_STS_REGIONAL_ENDPOINTS"); !reflect.DeepEqual(got, c.regionalSTS) {
+				t.Errorf("Expected AWS_STS_REGIONAL_ENDPOINTS %v, got %v", c.regionalSTS, got)
+			}
+			if got := envValues(container, "AWS_EC2_METADATA_DISABLED"); !reflect.DeepEqual(got, c.imdsDisabled) {
+				t.Errorf("Expected AWS_EC2_METADATA_DISABLED %v, got %v", c.imdsDisabled, got)
+			}
+		})
+	}
+}
+
+func TestEquivalentTokenVolume(t *testing.T) {
+	mountPath := "/var/run/secrets/eks.amazonaws.com/serviceaccount"
+	boundToken := func(audience string, expiration int64) v1.Volume {
+		return v1.Volume{
+			Name: "bound-token",
+			VolumeSource: v1.VolumeSource{
+				Projected: &v1.ProjectedVolumeSource{
+					Sources: []v1.VolumeProjection{
+						{ServiceAccountToken: &v1.ServiceAccountTokenProjection{
+							Audience:          audience,
+							ExpirationSeconds: &expiration,
+							Path:              "sts-token",
+						}},
+						{DownwardAPI: &v1.DownwardAPIProjection{}},
+					},
+				},
+			},
+		}
+	}
+
+	cases := []struct {
+		caseName      string
+		volumes       []v1.Volume
+		mountedAt     string
+		wantVolume    string
+		wantTokenFile string
+		wantVolumes   int
+	}{
+		{"Matching", []v1.Volume{boundToken("sts.amazonaws.com", 86400)}, "", "bound-token", mountPath + "/sts-token", 1},
+		{"WithinTolerance", []v1.Volume{boundToken("sts.amazonaws.com", 80000)}, "", "bound-token", mountPath + "/sts-token", 1},
+		{"OutsideTolerance", []v1.Volume{boundToken("sts.amazonaws.com", 3600)}, "", "aws-iam-token", mountPath + "/token", 2},
+		{"DifferentAudience", []v1.Volume{boundToken("vault", 86400)}, "", "aws-iam-token", mountPath + "/token", 2},
+		{"MountedElsewhere", []v1.Volume{boundToken("sts.amazonaws.com", 86400)}, "/var/run/secrets/tokens", "aws-iam-token", mountPath + "/token", 2},
+		{"MountedAtTokenPath", []v1.Volume{boundToken("sts.amazonaws.com", 86400)}, mountPath, "bound-token", mountPath + "/sts-token", 1},
+		{"NoVolume", nil, "", "aws-iam-token", mountPath + "/token", 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saCache := cache.NewFakeServiceAccountCache()
+			saCache.Add("default", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+			modifier := NewModifier(WithServiceAccountCache(saCache))
+
+			pod := &v1.Pod{}
+			if err := json.Unmarshal(rawPodWithoutVolume, pod); err != nil {
+				t.Fatalf("Can't decode pod: %v", err)
+			}
+			pod.Spec.Volumes = c.volumes
+			if c.mountedAt != "" {
+				pod.Spec.Containers[0].VolumeMounts = []v1.VolumeMount{{Name: "bound-token", ReadOnly: true, MountPath: c.mountedAt}}
+			}
+			rawPod, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatalf("Can't encode pod: %v", err)
+			}
+
+			patched := applyPatch(t, rawPod, modifier.AdmitPod(context.Background(), getValidReview(rawPod)))
+
+			if len(patched.Spec.Volumes) != c.wantVolumes {
+				t.Errorf("Expected %d volumes, got %+v", c.wantVolumes, patched.Spec.Volumes)
+			}
+			container := patched.Spec.Containers[0]
+			mounted := false
+			for _, mount := range container.VolumeMounts {
+				mounted = mounted || (mount.Name == c.wantVolume && mount.MountPath == mountPath)
+			}
+			if !mounted {
+				t.Errorf("Expected volume %s to be mounted at %s, got %+v", c.wantVolume, mountPath, container.VolumeMounts)
+			}
+			if got := envValues(container, "AWS_WEB_IDENTITY_TOKEN_FILE"); !reflect.DeepEqual(got, []string{c.wantTokenFile}) {
+				t.Errorf("Expected AWS_WEB_IDENTITY_TOKEN_FILE %s, got %v", c.wantTokenFile, got)
+			}
+		})
+	}
+}
+
+func TestValidateFailurePolicy(t *testing.T) {
+	for _, policy := range []string{FailurePolicyIgnore, FailurePolicyFail} {
+		if err := ValidateFailurePolicy(policy); err != nil {
+			t.Errorf("Expected policy %q to be valid, got %v", policy, err)
+		}
+	}
+	for _, policy := range []string{"", "ignore", "fail", "Deny"} {
+		if err := ValidateFailurePolicy(policy); err == nil {
+			t.Errorf("Expected policy %q to be invalid", policy)
+		}
+	}
+}
+
+func TestCheckFailurePolicyDrift(t *testing.T) {
+	ignore := admissionregistrationv1.Ignore
+	fail := admissionregistrationv1.Fail
+
+	cases := []struct {
+		caseName    string
+		live        *admissionregistrationv1.FailurePolicyType
+		policy      string
+		wantDrift   bool
+		wantMissing bool
+	}{
+		{"IgnoreMatches", &ignore, FailurePolicyIgnore, false, false},
+		{"FailMatches", &fail, FailurePolicyFail, false, false},
+		{"IgnoreDrifted", &ignore, FailurePolicyFail, true, false},
+		{"FailDrifted", &fail, FailurePolicyIgnore, true, false},
+		{"UnsetDefaultsToFail", nil, FailurePolicyIgnore, true, false},
+		{"MissingConfiguration", nil, FailurePolicyIgnore, false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if !c.wantMissing {
+				clientset = fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+					ObjectMeta: metav1.ObjectMeta{Name: "pod-identity-webhook"},
+					Webhooks: []admissionregistrationv1.MutatingWebhook{{
+						Name:          "pod-identity-webhook.amazonaws.com",
+						FailurePolicy: c.live,
+					}},
+				})
+			}
+
+			drifted, err := CheckFailurePolicyDrift(context.Background(), clientset, "pod-identity-webhook", c.policy)
+			if (err != nil) != c.wantMissing {
+				t.Fatalf("Expected error %v, got %v", c.wantMissing, err)
+			}
+			if drifted != c.wantDrift {
+				t.Errorf("Expected drift %v, got %v", c.wantDrift, drifted)
+			}
+			if c.wantMissing {
+				return
+			}
+			want := 0.0
+			if c.wantDrift {
+				want = 1
+			}
+			if got := testutil.ToFloat64(failurePolicyDriftGauge.WithLabelValues("pod-identity-webhook.amazonaws.com")); got != want {
+				t.Errorf("Expected drift gauge %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestAdmissionErrors(t *testing.T) {
+	const uid = "918ef1dc-928f-4525-99ef-988389f263c3"
+	review := func(apiVersion, request string) []byte {
+		return []byte(fmt.Sprintf(`{"apiVersion": %q, "kind": "AdmissionReview"%s}`, apiVersion, request))
+	}
+	request := func(object []byte) string {
+		return fmt.Sprintf(`, "request": {"uid": %q, "kind": {"version": "v1", "kind": "Pod"}, "resource": {"version": "v1", "resource": "pods"}, "namespace": "default", "operation": "CREATE", "object": %s}`, uid, object)
+	}
+	podRequest := request(rawPodWithoutVolume)
+	lookupFailure := func() SAGetter {
+		getter := newFakeSAGetter()
+		getter.failures = 1
+		return getter
+	}
+
+	cases := []struct {
+		caseName        string
+		body            []byte
+		saGetter        SAGetter
+		opts            []ModifierOpt
+		expectedUID     string
+		expectedReason  metav1.StatusReason
+		expectedCode    int32
+		expectedAllowed bool
+		// validate sends the review to /validate instead of /mutate
+		validate bool
+	}{
+		{"UndecodableReview", []byte(`{"apiVersion": `), nil, nil, "", reasonUndecodableReview, http.StatusBadRequest, true, false},
+		{"UndecodableReviewFail", []byte(`{"apiVersion": `), nil, []ModifierOpt{WithFailurePolicy(FailurePolicyFail)}, "", reasonUndecodableReview, http.StatusBadRequest, false, false},
+		{"UnsupportedVersion", review("admission.k8s.io/v2", podRequest), nil, nil, uid, reasonUnsupportedReviewVersion, http.StatusBadRequest, true, false},
+		{"UnsupportedVersionFail", review("admission.k8s.io/v2", podRequest), nil, []ModifierOpt{WithFailurePolicy(FailurePolicyFail)}, uid, reasonUnsupportedReviewVersion, http.StatusBadRequest, false, false},
+		{"MissingRequest", review("admission.k8s.io/v1", ""), nil, nil, "", reasonMissingRequest, http.StatusBadRequest, true, false},
+		{"UndecodablePod", review("admission.k8s.io/v1", request([]byte(`{"spec": "containers"}`))), nil, nil, uid, reasonUndecodablePod, http.StatusBadRequest, true, false},
+		{"ServiceAccountLookupFailed", review("admission.k8s.io/v1", podRequest), lookupFailure(), []ModifierOpt{WithSALookupFailurePolicy(SALookupFailurePolicyDeny)}, uid, reasonServiceAccountLookupFailed, http.StatusInternalServerError, false, false},
+		// The validating webhook configuration ignores failures whatever the
+		// mutating failure policy
+		{"ValidateUndecodableReview", []byte(`{"apiVersion": `), nil, []ModifierOpt{WithFailurePolicy(FailurePolicyFail)}, "", reasonUndecodableReview, http.StatusBadRequest, true, true},
+		{"ValidateMissingRequest", review("admission.k8s.io/v1", ""), nil, []ModifierOpt{WithFailurePolicy(FailurePolicyFail)}, "", reasonMissingRequest, http.StatusBadRequest, true, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			saGetter := c.saGetter
+			if saGetter == nil {
+				saGetter = newFakeSAGetter()
+			}
+			modifier := NewModifier(append([]ModifierOpt{WithSAGetter(saGetter)}, c.opts...)...)
+
+			before := testutil.ToFloat64(admissionErrorCounter.WithLabelValues(string(c.expectedReason)))
+			handle, path := modifier.Handle, "/mutate"
+			if c.validate {
+				handle, path = modifier.HandleValidate, "/validate"
+			}
+			r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(c.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handle(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected HTTP %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			var resp v1beta1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Can't decode response %s: %v", w.Body.String(), err)
+			}
+			if resp.Response == nil {
+				t.Fatalf("Expected a response, got none")
+			}
+			if string(resp.Response.UID) != c.expectedUID {
+				t.Errorf("Expected UID %q, got %q", c.expectedUID, resp.Response.UID)
+			}
+			if resp.Response.Allowed != c.expectedAllowed {
+				t.Errorf("Expected allowed %v, got %v", c.expectedAllowed, resp.Response.Allowed)
+			}
+			if len(resp.Response.Patch) > 0 {
+				t.Errorf("Expected no patch, got %s", resp.Response.Patch)
+			}
+			result := resp.Response.Result
+			if result == nil || result.Reason != c.expectedReason || result.Code != c.expectedCode || result.Message == "" {
+				t.Errorf("Expected reason %s and code %d with a message, got %v", c.expectedReason, c.expectedCode, result)
+			}
+			if after := testutil.ToFloat64(admissionErrorCounter.WithLabelValues(string(c.expectedReason))); after != before+1 {
+				t.Errorf("Expected %v %s admission errors, got %v", before+1, c.expectedReason, after)
+			}
+		})
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.SetSynced(false)
+	certificateIssued := false
+	readiness := NewReadiness()
+	readiness.AddCheck("service-account-cache", func() error {
+		if !saCache.HasSynced() {
+			return fmt.Errorf("not synced")
+		}
+		return nil
+	})
+	readiness.AddCheck("serving-certificate", func() error {
+		if !certificateIssued {
+			return fmt.Errorf("no serving certificate")
+		}
+		return nil
+	})
+
+	probe := func(expectedCode int, expectedBody string, expectedGauge float64) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		readiness.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != expectedCode {
+			t.Errorf("Expected code %d, got %d", expectedCode, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), expectedBody) {
+			t.Errorf("Expected body to contain %q, got %q", expectedBody, w.Body.String())
+		}
+		if got := testutil.ToFloat64(readyGauge); got != expectedGauge {
+			t.Errorf("Expected ready gauge %v, got %v", expectedGauge, got)
+		}
+	}
+
+	probe(http.StatusServiceUnavailable, "service-account-cache: not synced, serving-certificate: no serving certificate", 0)
+	saCache.SetSynced(true)
+	probe(http.StatusServiceUnavailable, "serving-certificate: no serving certificate", 0)
+	certificateIssued = true
+	probe(http.StatusOK, "ok", 1)
+	saCache.SetSynced(false)
+	probe(http.StatusServiceUnavailable, "service-account-cache: not synced", 0)
+}
+
+func TestHandleDebugCache(t *testing.T) {
+	saCache := cache.NewFakeServiceAccountCache()
+	saCache.Add("s3-reader", "default", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com")
+	saCache.AddResponse("short-lived", "default", &cache.CacheResponse{
+		RoleARN:         "arn:aws:iam::111122223333:role/short-lived",
+		Audience:        "custom",
+		TokenExpiration: 3600,
+	})
+	saCache.Add("builder", "ci", "arn:aws:iam::111122223333:role/builder", "sts.amazonaws.com")
+	cmCache := cache.NewFakeConfigMapCache()
+	cmCache.Add("mapped", "ci", &cache.CacheResponse{RoleARN: "arn:aws:iam::111122223333:role/mapped", Audience: "sts.amazonaws.com"})
+	modifier := NewModifier(
+		WithServiceAccountCache(saCache),
+		WithConfigMapCache(cmCache),
+	)
+
+	entry := func(namespace, name, role, audience string, expiration int64, source string) debugCacheEntry {
+		return debugCacheEntry{Namespace: namespace, Name: name, RoleARN: role, Audience: audience, TokenExpiration: expiration, Source: source}
+	}
+	builder := entry("ci", "builder", "arn:aws:iam::111122223333:role/builder", "sts.amazonaws.com", 86400, "annotation")
+	s3Reader := entry("default", "s3-reader", "arn:aws:iam::111122223333:role/s3-reader", "sts.amazonaws.com", 86400, "annotation")
+	shortLived := entry("default", "short-lived", "arn:aws:iam::111122223333:role/short-lived", "custom", 3600, "annotation")
+	mapped := entry("ci", "mapped", "arn:aws:iam::111122223333:role/mapped", "sts.amazonaws.com", 86400, "configmap")
+
+	cases := []struct {
+		caseName     string
+		method       string
+		query        string
+		expectedCode int
+		expected     debugCacheResponse
+	}{
+		{"All", http.MethodGet, "", http.StatusOK, debugCacheResponse{ServiceAccounts: []debugCacheEntry{builder, s3Reader, shortLived, mapped}}},
+		{"Namespace", http.MethodGet, "?namespace=ci", http.StatusOK, debugCacheResponse{ServiceAccounts: []debugCacheEntry{builder, mapped}}},
+		{"EmptyNamespace", http.MethodGet, "?namespace=missing", http.StatusOK, debugCacheResponse{ServiceAccounts: []debugCacheEntry{}}},
+		{"Truncated", http.MethodGet, "?limit=2", http.StatusOK, debugCacheResponse{ServiceAccounts: []debugCacheEntry{builder, s3Reader}, Truncated: true}},
+		{"AtLimit", http.MethodGet, "?namespace=ci&limit=2", http.StatusOK, debugCacheResponse{ServiceAccounts: []debugCacheEntry{builder, mapped}}},
+		{"InvalidLimit", http.MethodGet, "?limit=none", http.StatusBadRequest, debugCacheResponse{}},
+		{"Post", http.MethodPost, "", http.StatusMethodNotAllowed, debugCacheResponse{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			modifier.HandleDebugCache(w, httptest.NewRequest(c.method, "/debug/cache"+c.query, nil))
+			if w.Code != c.expectedCode {
+				t.Fatalf("Expected code %d, got %d: %s", c.expectedCode, w.Code, w.Body.String())
+			}
+			if c.expectedCode != http.StatusOK {
+				return
+			}
+			var resp debugCacheResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Error decoding response: %v", err)
+			}
+			if !reflect.DeepEqual(resp, c.expected) {
+				t.Errorf("Expected %+v, got %+v", c.expected, resp)
+			}
+		})
+	}
+}
+
+func BenchmarkAdmitPodManyContainers(b *testing.B) {
+	pod := &v1.Pod{}
+	pod.Name = "pipeline"
+	pod.Spec.ServiceAccountName = "default"
+	for i := 0; i < 50; i++ {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+			Name:  fmt.Sprintf("step-%d", i),
+			Image: "amazonlinux",
+			Env:   []v1.EnvVar{{Name: "STEP", Value: strconv.Itoa(i)}},
+			VolumeMounts: []v1.VolumeMount{
+				{Name: "data", MountPath: "/data"},
+			},
+		})
+	}
+	pod.Spec.Volumes = []v1.Volume{{Name: "data", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+	rawPod, err := json.Marshal(pod)
+	if err != nil {
+		b.Fatalf("Can't encode pod: %v", err)
+	}
+	testServiceAccount := &v1.ServiceAccount{}
+	testServiceAccount.Name = "default"
+	testServiceAccount.Namespace = "default"
+	testServiceAccount.Annotations = map[string]string{
+		"eks.amazonaws.com/role-arn": "arn:aws:iam::111122223333:role/s3-reader",
+	}
+	modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache(testServiceAccount)))
+	review := getValidReview(rawPod)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if response := modifier.AdmitPod(context.Background(), review); len(response.Patch) == 0 {
+			b.Fatalf("Expected a patch, got %v", response.Result)
+		}
+	}
+}
+
+func TestMirrorPodsSkipped(t *testing.T) {
+	cases := []struct {
+		caseName        string
+		annotations     map[string]string
+		expectedSkipped bool
+	}{
+		{"MirrorPod", map[string]string{v1.MirrorPodAnnotationKey: "3b1e8a4e0f6a5b7c9d2e4f6a8b0c1d3e"}, true},
+		{"NormalPod", nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			pod := &v1.Pod{}
+			if err := json.Unmarshal(rawPodWithoutVolume, pod); err != nil {
+				t.Fatalf("Can't decode pod: %v", err)
+			}
+			pod.Namespace = "kube-system"
+			pod.Annotations = c.annotations
+			lookups := 0
+			modifier := NewModifier(WithServiceAccountCache(cache.NewFakeServiceAccountCache()))
+
+			before := testutil.ToFloat64(skippedCounter.WithLabelValues("mirror-pod", "false"))
+			patch, _, err := modifier.mutatePod(context.Background(), pod, podRequest{
+				dryRun: "false",
+				lookup: func(context.Context, string, string) (*cache.CacheResponse, error) {
+					lookups++
+					return &cache.CacheResponse{RoleARN: "arn:aws:iam::111122223333:role/s3-reader", Audience: "sts.amazonaws.com"}, nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			after := testutil.ToFloat64(skippedCounter.WithLabelValues("mirror-pod", "false"))
+
+			if skipped := after == before+1; skipped != c.expectedSkipped {
+				t.Errorf("Expected skipped %v, got %v mirror pod skips", c.expectedSkipped, after-before)
+			}
+			if c.expectedSkipped && (len(patch) > 0 || lookups > 0) {
+				t.Errorf("Expected no patch and no lookup, got %d lookups and patch %v", lookups, patch)
+			}
+			if !c.expectedSkipped && (len(patch) == 0 || lookups != 1) {
+				t.Errorf("Expected a patch after a lookup, got %d lookups and patch %v", lookups, patch)
+			}
+		})
+	}
+}
+
+func TestResolveInjectionConfig(t *testing.T) {
+	const (
+		podRole = "arn:aws:iam::111122223333:role/pod"
+		saRole  = "arn:aws:iam::111122223333:role/service-account"
+		nsRole  = "arn:aws:iam::111122223333:role/namespace"
+		cmRole  = "arn:aws:iam::111122223333:role/configmap"
+	)
+	enabled, disabled := true, false
+	sa := func(role, audience string, annotated bool) *cache.CacheResponse {
+		return &cache.CacheResponse{RoleARN: role, Audience: audience, DefaultAudience: !annotated}
+	}
+	defaults := cache.Defaults{TokenExpiration: 86400, RegionalSTS: true}
+
+	cases := []struct {
+		caseName          string
+		podRole           string
+		allowOverride     bool
+		sources           injectionSources
+		expected          InjectionConfig
+		expectedConflicts []string
+		expectedWarnings  int
+	}{
+		{
+			caseName: "Defaults",
+			sources:  injectionSources{serviceAccount: sa("", "sts.amazonaws.com", false), defaults: defaults},
+			expected: InjectionConfig{Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+		},
+		{
+			caseName: "ServiceAccountMissing",
+			sources:  injectionSources{defaults: defaults},
+			expected: InjectionConfig{},
+		},
+		{
+			caseName: "ServiceAccountRole",
+			sources:  injectionSources{serviceAccount: sa(saRole, "sts.amazonaws.com", false), serviceAccountRole: saRole, defaults: defaults},
+			expected: InjectionConfig{Role: saRole, RoleSource: SourceServiceAccount, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+		},
+		{
+			caseName: "ServiceAccountOverNamespace",
+			sources: injectionSources{
+				serviceAccount:     sa(saRole, "sts.amazonaws.com", false),
+				serviceAccountRole: saRole,
+				namespace:          &cache.NamespaceResponse{DefaultRoleARN: nsRole},
+				defaults:           defaults,
+			},
+			expected: InjectionConfig{Role: saRole, RoleSource: SourceServiceAccount, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+		},
+		{
+			caseName: "ServiceAccountOverConfigMap",
+			sources: injectionSources{
+				serviceAccount:     sa(saRole, "sts.amazonaws.com", false),
+				serviceAccountRole: saRole,
+				configMap:          &cache.CacheResponse{RoleARN: cmRole, Audience: "custom", UseRegionalSTS: &disabled},
+				defaults:           defaults,
+			},
+			expected:          InjectionConfig{Role: saRole, RoleSource: SourceServiceAccount, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+			expectedConflicts: []string{"role/service-account/configmap"},
+		},
+		{
+			caseName: "NamespaceOverConfigMap",
+			sources: injectionSources{
+				serviceAccount: sa("", "sts.amazonaws.com", false),
+				namespace:      &cache.NamespaceResponse{DefaultRoleARN: nsRole},
+				configMap:      &cache.CacheResponse{RoleARN: cmRole, Audience: "custom", UseRegionalSTS: &disabled},
+				defaults:       defaults,
+			},
+			expected: InjectionConfig{Role: nsRole, RoleSource: SourceNamespace, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+		},
+		{
+			caseName: "NamespaceRoleNeedsServiceAccount",
+			sources: injectionSources{
+				namespace: &cache.NamespaceResponse{DefaultRoleARN: nsRole},
+				defaults:  defaults,
+			},
+			expected: InjectionConfig{},
+		},
+		{
+			caseName: "ConfigMap",
+			sources: injectionSources{
+				serviceAccount: sa("", "sts.amazonaws.com", false),
+				configMap:      &cache.CacheResponse{RoleARN: cmRole, Audience: "custom", UseRegionalSTS: &disabled},
+				defaults:       defaults,
+			},
+			expected: InjectionConfig{Role: cmRole, RoleSource: SourceConfigMap, Audience: "custom", AudienceSource: SourceConfigMap, RegionalSTS: false, RegionalSTSSource: SourceConfigMap},
+		},
+		{
+			caseName: "ConfigMapWithoutServiceAccount",
+			sources: injectionSources{
+				configMap: &cache.CacheResponse{RoleARN: cmRole, Audience: "sts.amazonaws.com", DefaultAudience: true},
+				defaults:  defaults,
+			},
+			expected: InjectionConfig{Role: cmRole, RoleSource: SourceConfigMap, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+		},
+		{
+			caseName: "ServiceAccountAudienceOverConfigMap",
+			sources: injectionSources{
+				serviceAccount: sa("", "my-idp", true),
+				configMap:      &cache.CacheResponse{RoleARN: cmRole, Audience: "custom"},
+				defaults:       defaults,
+			},
+			expected:          InjectionConfig{Role: cmRole, RoleSource: SourceConfigMap, Audience: "my-idp", AudienceSource: SourceServiceAccount},
+			expectedConflicts: []string{"audience/service-account/configmap"},
+		},
+		{
+			caseName: "NamespaceAudienceOverConfigMap",
+			sources: injectionSources{
+				serviceAccount: sa("", "sts.amazonaws.com", false),
+				namespace:      &cache.NamespaceResponse{DefaultAudience: "namespace-idp"},
+				configMap:      &cache.CacheResponse{RoleARN: cmRole, Audience: "custom"},
+				defaults:       defaults,
+			},
+			expected: InjectionConfig{Role: cmRole, RoleSource: SourceConfigMap, Audience: "namespace-idp", AudienceSource: SourceNamespace},
+		},
+		{
+			caseName: "ServiceAccountAudienceOverNamespace",
+			sources: injectionSources{
+				serviceAccount:     sa(saRole, "my-idp", true),
+				serviceAccountRole: saRole,
+				namespace:          &cache.NamespaceResponse{DefaultAudience: "namespace-idp"},
+				defaults:           defaults,
+			},
+			expected: InjectionConfig{Role: saRole, RoleSource: SourceServiceAccount, Audience: "my-idp", AudienceSource: SourceServiceAccount},
+		},
+		{
+			caseName: "RuntimeDefaultAudience",
+			sources: injectionSources{
+				serviceAccount:     sa(saRole, "sts.amazonaws.com", false),
+				serviceAccountRole: saRole,
+				defaults:           cache.Defaults{TokenAudience: "runtime", TokenExpiration: 86400, RegionalSTS: true},
+			},
+			expected: InjectionConfig{Role: saRole, RoleSource: SourceServiceAccount, Audience: "runtime", AudienceSource: SourceDefaults},
+		},
+		{
+			caseName:          "PodOverServiceAccount",
+			podRole:           podRole,
+			allowOverride:     true,
+			sources:           injectionSources{serviceAccount: sa(saRole, "sts.amazonaws.com", false), serviceAccountRole: saRole, defaults: defaults},
+			expected:          InjectionConfig{Role: podRole, RoleSource: SourcePodAnnotation, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+			expectedConflicts: []string{"role/pod-annotation/service-account"},
+		},
+		{
+			caseName:      "PodOverNamespace",
+			podRole:       podRole,
+			allowOverride: true,
+			sources: injectionSources{
+				serviceAccount: sa("", "sts.amazonaws.com", false),
+				namespace:      &cache.NamespaceResponse{DefaultRoleARN: nsRole},
+				defaults:       defaults,
+			},
+			expected: InjectionConfig{Role: podRole, RoleSource: SourcePodAnnotation, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+		},
+		{
+			caseName:      "PodOverConfigMap",
+			podRole:       podRole,
+			allowOverride: true,
+			sources: injectionSources{
+				serviceAccount: sa("", "sts.amazonaws.com", false),
+				configMap:      &cache.CacheResponse{RoleARN: cmRole, Audience: "custom"},
+				defaults:       defaults,
+			},
+			expected:          InjectionConfig{Role: podRole, RoleSource: SourcePodAnnotation, Audience: "custom", AudienceSource: SourceConfigMap},
+			expectedConflicts: []string{"role/pod-annotation/configmap"},
+		},
+		{
+			caseName:      "PodSameAsServiceAccount",
+			podRole:       saRole,
+			allowOverride: true,
+			sources:       injectionSources{serviceAccount: sa(saRole, "sts.amazonaws.com", false), serviceAccountRole: saRole, defaults: defaults},
+			expected:      InjectionConfig{Role: saRole, RoleSource: SourceServiceAccount, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+		},
+		{
+			caseName:         "PodOverrideDisabled",
+			podRole:          podRole,
+			sources:          injectionSources{serviceAccount: sa(saRole, "sts.amazonaws.com", false), serviceAccountRole: saRole, defaults: defaults},
+			expected:         InjectionConfig{Role: saRole, RoleSource: SourceServiceAccount, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults},
+			expectedWarnings: 1,
+		},
+		{
+			caseName:         "PodWithoutServiceAccount",
+			podRole:          podRole,
+			allowOverride:    true,
+			sources:          injectionSources{defaults: defaults},
+			expected:         InjectionConfig{},
+			expectedWarnings: 1,
+		},
+		{
+			caseName: "ServiceAccountExpiration",
+			sources: injectionSources{
+				serviceAccount:     &cache.CacheResponse{RoleARN: saRole, Audience: "sts.amazonaws.com", DefaultAudience: true, TokenExpiration: 3600},
+				serviceAccountRole: saRole,
+				defaults:           defaults,
+			},
+			expected: InjectionConfig{Role: saRole, RoleSource: SourceServiceAccount, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults, Expiration: 3600, ExpirationSource: SourceServiceAccount},
+		},
+		{
+			caseName: "ServiceAccountRegionalSTSOverConfigMap",
+			sources: injectionSources{
+				serviceAccount: &cache.CacheResponse{Audience: "sts.amazonaws.com", DefaultAudience: true, UseRegionalSTS: &enabled},
+				configMap:      &cache.CacheResponse{RoleARN: cmRole, Audience: "sts.amazonaws.com", DefaultAudience: true, UseRegionalSTS: &disabled},
+				defaults:       cache.Defaults{TokenExpiration: 86400},
+			},
+			expected:          InjectionConfig{Role: cmRole, RoleSource: SourceConfigMap, Audience: "sts.amazonaws.com", AudienceSource: SourceDefaults, RegionalSTS: true, RegionalSTSSource: SourceServiceAccount},
+			expectedConflicts: []string{"regional-sts/service-account/configmap"},
+		},
+		{
+			caseName:      "ContainerCredentials",
+			podRole:       podRole,
+			allowOverride: true,
+			sources: injectionSources{
+				serviceAccount: &cache.CacheResponse{Audience: "sts.amazonaws.com", DefaultAudience: true, ContainerCredentials: true},
+				namespace:      &cache.NamespaceResponse{DefaultRoleARN: nsRole},
+				configMap:      &cache.CacheResponse{RoleARN: cmRole, Audience: "custom"},
+				defaults:       defaults,
+			},
+			expected: InjectionConfig{Audience: DefaultContainerCredentialsAudience, AudienceSource: SourceDefaults, Mode: InjectionModeContainerCredentials},
+		},
+	}
+
+	settings := []string{"role", "audience", "regional-sts"}
+	sources := []string{SourcePodAnnotation, SourceServiceAccount, SourceConfigMap}
+	conflicts := func() map[string]float64 {
+		values := map[string]float64{}
+		for _, setting := range settings {
+			for _, source := range sources {
+				for _, overridden := range sources {
+					values[setting+"/"+source+"/"+overridden] = testutil.ToFloat64(configConflictCounter.WithLabelValues(setting, source, overridden))
+				}
+			}
+		}
+		return values
+	}
+
+	for _, c := range cases {
+		t.Run(c.caseName, func(t *testing.T) {
+			pod := &v1.Pod{}
+			pod.Name = "balajilovesoreos"
+			pod.Namespace = "default"
+			pod.Spec.ServiceAccountName = "default"
+			if c.podRole != "" {
+				pod.Annotations = map[string]string{"eks.amazonaws.com/role-arn": c.podRole}
+			}
+			modifier := NewModifier(
+				WithServiceAccountCache(cache.NewFakeServiceAccountCache()),
+				WithPodAnnotationOverride(c.allowOverride),
+				WithContainerCredentialsURI("http://169.254.170.23/v1/credentials"),
+			)
+
+			// Unset expected settings are the defaults
+			expected := c.expected
+			if expected.ExpirationSource == "" {
+				expected.Expiration, expected.ExpirationSource = c.sources.defaults.TokenExpiration, SourceDefaults
+			}
+			if expected.RegionalSTSSource == "" {
+				expected.RegionalSTS, expected.RegionalSTSSource = c.sources.defaults.RegionalSTS, SourceDefaults
+			}
+			if expected.Mode == "" {
+				expected.Mode = InjectionModeWebIdentity
+			}
+
+			before := conflicts()
+			cfg, warnings := modifier.resolveInjectionConfig(pod, c.sources)
+			after := conflicts()
+
+			if !reflect.DeepEqual(cfg, expected) {
+				t.Errorf("Expected config\n%+v\ngot\n%+v", expected, cfg)
+			}
+			if len(warnings) != c.expectedWarnings {
+				t.Errorf("Expected %d warnings, got %q", c.expectedWarnings, warnings)
+			}
+			var got []string
+			for key, value := range after {
+				if value != before[key] {
+					got = append(got, key)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, c.expectedConflicts) {
+				t.Errorf("Expected conflicts %q, got %q", c.expectedConflicts, got)
+			}
+		})
+	}
+}
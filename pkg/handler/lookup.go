@@ -0,0 +1,123 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/amazon-eks-pod-identity-webhook/pkg/cache"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// SAGetter looks up the settings of the Service Accounts of admitted pods. The
+// Service Account caches of the cache package implement it, and so do
+// cache.NewAPILookup, fetching Service Accounts from the API server, and the
+// mapping file cache.
+type SAGetter = cache.ServiceAccountLookup
+
+// WithSAGetter sets the lookup of the Service Accounts of admitted pods, used
+// instead of the Service Account cache
+func WithSAGetter(getter SAGetter) ModifierOpt {
+	return func(m *Modifier) { m.SAGetter = getter }
+}
+
+// WithClientset looks up the Service Accounts of admitted pods from the API
+// server for each pod, with the annotation domain, token audience, and lenient
+// booleans of the modifier, unless WithSAGetter sets another lookup
+func WithClientset(clientset kubernetes.Interface) ModifierOpt {
+	return func(m *Modifier) { m.clientset = clientset }
+}
+
+// saGetter returns the lookup of the Service Accounts of admitted pods, the
+// Service Account cache unless another lookup is set
+func (m *Modifier) saGetter() SAGetter {
+	if m.SAGetter != nil {
+		return m.SAGetter
+	}
+	return m.Cache
+}
+
+const (
+	// SALookupFailurePolicyAllow admits pods without injection if their
+	// Service Account can't be looked up
+	SALookupFailurePolicyAllow = "allow"
+	// SALookupFailurePolicyRetry retries failed Service Account lookups, and
+	// admits pods without injection if the retries fail too
+	SALookupFailurePolicyRetry = "retry"
+	// SALookupFailurePolicyDeny rejects pods whose Service Account can't be
+	// looked up
+	SALookupFailurePolicyDeny = "deny"
+)
+
+// saLookupBackoff is the backoff of Service Account lookups with the retry
+// policy, 3 attempts within a second
+var saLookupBackoff = wait.Backoff{
+	Duration: 250 * time.Millisecond,
+	Factor:   2,
+	Steps:    3,
+}
+
+// ValidateSALookupFailurePolicy returns an error if policy is not a Service
+// Account lookup failure policy
+func ValidateSALookupFailurePolicy(policy string) error {
+	switch policy {
+	case SALookupFailurePolicyAllow, SALookupFailurePolicyRetry, SALookupFailurePolicyDeny:
+		return nil
+	}
+	return fmt.Errorf("invalid Service Account lookup failure policy %q, must be %s, %s or %s",
+		policy, SALookupFailurePolicyAllow, SALookupFailurePolicyRetry, SALookupFailurePolicyDeny)
+}
+
+// lookupServiceAccount returns the settings of a Service Account, or nil if it
+// doesn't exist. Failed lookups are retried with the retry policy until ctx is
+// done, and counted with the outcome of the admission: recovered, allowed, or
+// denied.
+func (m *Modifier) lookupServiceAccount(ctx context.Context, name, namespace string) (*cache.CacheResponse, error) {
+	backoff := wait.Backoff{Steps: 1}
+	if m.SALookupFailurePolicy == SALookupFailurePolicyRetry {
+		backoff = saLookupBackoff
+	}
+
+	var resp *cache.CacheResponse
+	var lookupErr error
+	attempts := 0
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(ctx context.Context) (bool, error) {
+		attempts++
+		resp, lookupErr = m.saGetter().Lookup(ctx, name, namespace)
+		if lookupErr != nil {
+			klog.Warningf("Service Account lookup attempt %d of %d failed: %v", attempts, backoff.Steps, lookupErr)
+		}
+		return lookupErr == nil, nil
+	})
+	if lookupErr == nil && err != nil {
+		// The request was done before the first attempt
+		lookupErr = fmt.Errorf("error looking up sa %s/%s: %w", namespace, name, err)
+	}
+
+	switch {
+	case lookupErr == nil && attempts > 1:
+		saLookupFailureCounter.WithLabelValues(m.SALookupFailurePolicy, "recovered").Inc()
+	case lookupErr != nil && m.SALookupFailurePolicy == SALookupFailurePolicyDeny:
+		saLookupFailureCounter.WithLabelValues(m.SALookupFailurePolicy, "denied").Inc()
+	case lookupErr != nil:
+		saLookupFailureCounter.WithLabelValues(m.SALookupFailurePolicy, "allowed").Inc()
+	}
+	return resp, lookupErr
+}
@@ -0,0 +1,187 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	roleOverrideCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_role_override_total",
+			Help: "Counter of pods whose service account role was overridden by a pod annotation, broken out for each namespace.",
+		},
+		[]string{"namespace"},
+	)
+	injectionCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_injections_total",
+			Help: "Counter of mutated pods broken out for the source of the injected role: service-account, configmap, namespace, or pod-annotation. Dry run requests are labeled dry_run=\"true\".",
+		},
+		[]string{"source", "dry_run"},
+	)
+	invalidPodAnnotationCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "invalid_pod_annotation_total",
+			Help: "Counter of ignored pod annotations with invalid values, broken out for each annotation.",
+		},
+		[]string{"annotation"},
+	)
+	tokenExpirationClampedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "token_expiration_clamped_total",
+			Help: "Counter of token expirations clamped to the configured bounds, broken out for each direction: min or max.",
+		},
+		[]string{"direction"},
+	)
+	fsGroupDefaultedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pod_identity_fs_group_defaulted_total",
+			Help: "Counter of mutated pods whose fsGroup was defaulted.",
+		},
+	)
+	mountCollisionCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pod_identity_mount_path_collisions_total",
+			Help: "Counter of containers whose token mount was skipped because the container already mounts a volume at the path.",
+		},
+	)
+	tokenSkippedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_token_skipped_total",
+			Help: "Counter of pods not injected with a token because automountServiceAccountToken is disabled, broken out for where it is disabled: pod or service-account.",
+		},
+		[]string{"source"},
+	)
+	rolePolicyViolationCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_role_policy_violations_total",
+			Help: "Counter of pods whose role is not allowed by the allowed-role-arns annotation of their namespace, broken out for each namespace. Dry run requests are labeled dry_run=\"true\".",
+		},
+		[]string{"namespace", "dry_run"},
+	)
+	saNotFoundCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_sa_not_found_total",
+			Help: "Counter of pods whose Service Account doesn't exist, broken out for the action: denied or allowed. Dry run requests are labeled dry_run=\"true\".",
+		},
+		[]string{"action", "dry_run"},
+	)
+	invalidServiceAccountCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_invalid_service_accounts_total",
+			Help: "Counter of Service Accounts with invalid annotations seen by the validating webhook, broken out for each validation mode. Dry run requests are labeled dry_run=\"true\".",
+		},
+		[]string{"mode", "dry_run"},
+	)
+	saLookupFailureCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_sa_lookup_failures_total",
+			Help: "Counter of failed Service Account lookups, broken out for the lookup failure policy and the outcome: recovered, allowed, or denied.",
+		},
+		[]string{"policy", "outcome"},
+	)
+	unexpectedResourceCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_unexpected_resources_total",
+			Help: "Counter of admitted requests for resources other than pods, broken out for the group/version/resource received.",
+		},
+		[]string{"resource"},
+	)
+	rejectedRequestCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_rejected_requests_total",
+			Help: "Counter of requests rejected before decoding, broken out for each reason: method, content-type, empty-body, or too-large.",
+		},
+		[]string{"reason"},
+	)
+	admissionErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_admission_errors_total",
+			Help: "Counter of admission requests that failed with an error, broken out for the reason set on the response status.",
+		},
+		[]string{"reason"},
+	)
+	failurePolicyDriftGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pod_identity_failure_policy_drift",
+			Help: "Whether the live failurePolicy of a webhook differs from the webhook-failure-policy flag at startup, 1 if it does, broken out for each webhook.",
+		},
+		[]string{"webhook"},
+	)
+	readyGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pod_identity_ready",
+			Help: "Whether the webhook passed its last readiness check, 1 if it did.",
+		},
+	)
+	configConflictCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_config_conflicts_total",
+			Help: "Counter of settings of a pod configured differently by its pod annotations, Service Account, and ConfigMap mapping, broken out for each setting: role, audience, or regional-sts, the source that was used, and the source that was overridden.",
+		},
+		[]string{"setting", "source", "overridden"},
+	)
+	mutationDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "pod_identity_mutation_duration_seconds",
+			Help: "Histogram of the time taken to admit pods, from decoding the pod to encoding the patch, in seconds.",
+			// Use buckets ranging from 50 µs to 400 ms, finer than the request
+			// latencies, which start at 125 ms.
+			Buckets: prometheus.ExponentialBuckets(0.00005, 2, 14),
+		},
+	)
+	skippedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pod_identity_skipped_total",
+			Help: "Counter of pods that were not mutated, broken out for each reason. Dry run requests are labeled dry_run=\"true\".",
+		},
+		[]string{"reason", "dry_run"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(roleOverrideCounter)
+	prometheus.MustRegister(injectionCounter)
+	prometheus.MustRegister(invalidPodAnnotationCounter)
+	prometheus.MustRegister(tokenExpirationClampedCounter)
+	prometheus.MustRegister(fsGroupDefaultedCounter)
+	prometheus.MustRegister(mountCollisionCounter)
+	prometheus.MustRegister(tokenSkippedCounter)
+	prometheus.MustRegister(rolePolicyViolationCounter)
+	prometheus.MustRegister(saNotFoundCounter)
+	prometheus.MustRegister(invalidServiceAccountCounter)
+	prometheus.MustRegister(saLookupFailureCounter)
+	prometheus.MustRegister(unexpectedResourceCounter)
+	prometheus.MustRegister(rejectedRequestCounter)
+	prometheus.MustRegister(admissionErrorCounter)
+	prometheus.MustRegister(failurePolicyDriftGauge)
+	prometheus.MustRegister(configConflictCounter)
+	prometheus.MustRegister(mutationDuration)
+	prometheus.MustRegister(skippedCounter)
+	prometheus.MustRegister(readyGauge)
+}
+
+// DeleteNamespaceMetrics deletes the metric series of a namespace, eg. once
+// the namespace is deleted, so namespaces created and deleted by CI don't
+// leave series behind
+func DeleteNamespaceMetrics(namespace string) {
+	roleOverrideCounter.DeleteLabelValues(namespace)
+	for _, dryRun := range []string{"true", "false"} {
+		rolePolicyViolationCounter.DeleteLabelValues(namespace, dryRun)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"strings"
+)
+
+// PatchOperation is a JSON patch operation of a pod mutation
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// jsonPointer returns the JSON pointer of a path of reference tokens, with the
+// tokens escaped as described in RFC 6901
+func jsonPointer(tokens ...string) string {
+	var b strings.Builder
+	n := len(tokens)
+	for _, token := range tokens {
+		n += len(token)
+	}
+	b.Grow(n)
+	for _, token := range tokens {
+		b.WriteString("/")
+		b.WriteString(escapeJSONPointer(token))
+	}
+	return b.String()
+}
+
+// escapeJSONPointer escapes a JSON pointer reference token as described in
+// RFC 6901
+func escapeJSONPointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,93 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// Readiness reports whether the webhook is ready to serve admissions, which it
+// is once all of its checks pass. It serves /readyz, so the Service only
+// routes admissions to ready replicas, and sets the pod_identity_ready gauge.
+type Readiness struct {
+	checks []readinessCheck
+	mu     sync.Mutex // guards ready
+	ready  bool
+}
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// NewReadiness returns a Readiness with no checks, it is ready until checks
+// are added
+func NewReadiness() *Readiness {
+	return &Readiness{}
+}
+
+// AddCheck adds a named check, returning an error while the webhook isn't
+// ready
+func (r *Readiness) AddCheck(name string, check func() error) {
+	r.checks = append(r.checks, readinessCheck{name: name, check: check})
+}
+
+// Check runs the checks and returns the failures, none if the webhook is
+// ready. Transitions are logged and update the readiness gauge.
+func (r *Readiness) Check() []string {
+	var failures []string
+	for _, c := range r.checks {
+		if err := c.check(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", c.name, err))
+		}
+	}
+	ready := len(failures) == 0
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ready != r.ready {
+		if ready {
+			klog.Info("Webhook is ready")
+		} else {
+			klog.Warningf("Webhook is not ready: %s", strings.Join(failures, ", "))
+		}
+		r.ready = ready
+	}
+	if ready {
+		readyGauge.Set(1)
+	} else {
+		readyGauge.Set(0)
+	}
+	return failures
+}
+
+// ServeHTTP responds 200 if the webhook is ready, and 503 with the failed
+// checks if it isn't
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	failures := r.Check()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: %s\n", strings.Join(failures, ", "))
+		return
+	}
+	fmt.Fprintf(w, "ok")
+}
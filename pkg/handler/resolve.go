@@ -0,0 +1,201 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+
+	"github.com/aws/amazon-eks-pod-identity-webhook/pkg/cache"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// Sources of the injection settings of a pod, in decreasing precedence. The
+// role sources label the injection metric.
+const (
+	SourcePodAnnotation  = "pod-annotation"
+	SourceServiceAccount = "service-account"
+	SourceNamespace      = "namespace"
+	SourceConfigMap      = "configmap"
+	// SourceDefaults is the flags, or the defaults ConfigMap overriding them
+	SourceDefaults = "defaults"
+)
+
+// Injection modes of a pod
+const (
+	// InjectionModeWebIdentity injects the role and web identity token env
+	// vars
+	InjectionModeWebIdentity = "web-identity"
+	// InjectionModeContainerCredentials injects the container credentials env
+	// vars, the role is associated with the Service Account by the agent
+	InjectionModeContainerCredentials = "container-credentials"
+)
+
+// InjectionConfig is the configuration of a pod resolved from all of its
+// sources. Each setting records the source it was taken from, one of the
+// Source constants, empty if no source sets it.
+type InjectionConfig struct {
+	Role           string
+	RoleSource     string
+	Audience       string
+	AudienceSource string
+	// Expiration is the token expiration before it is clamped to the
+	// configured bounds
+	Expiration        int64
+	ExpirationSource  string
+	RegionalSTS       bool
+	RegionalSTSSource string
+	// Mode is one of the InjectionMode constants
+	Mode string
+}
+
+// injectionSources holds the settings of a pod that are not pod annotations.
+// Missing sources are nil.
+type injectionSources struct {
+	// serviceAccount is the Service Account of the pod, nil if it doesn't
+	// exist or can't be looked up
+	serviceAccount *cache.CacheResponse
+	// serviceAccountRole is the role of the Service Account, rendered from
+	// the role ARN template for role names
+	serviceAccountRole string
+	// namespace holds the defaults of the namespace, nil unless namespace
+	// defaults are enabled
+	namespace *cache.NamespaceResponse
+	// configMap is the ConfigMap mapping of the Service Account, if any
+	configMap *cache.CacheResponse
+	defaults  cache.Defaults
+}
+
+// resolveInjectionConfig merges the settings of a pod from all of its sources,
+// each setting is taken from the first source setting it in this order: pod
+// annotations, the Service Account, the namespace defaults, the ConfigMap
+// mapping, then the defaults of the flags.
+//
+// The role of a ConfigMap mapping comes with its audience and regional STS
+// setting, they only apply if the role does. The namespace default role and
+// the pod role-arn annotation need an audience, from an existing Service
+// Account or a ConfigMap mapping, and neither applies to container
+// credentials. Differing roles, audiences, and regional STS settings of the
+// pod, its Service Account, and the ConfigMap are counted as conflicts, the
+// namespace and flag defaults are meant to be overridden.
+func (m *Modifier) resolveInjectionConfig(pod *corev1.Pod, sources injectionSources) (InjectionConfig, []string) {
+	var warnings admissionWarnings
+	podID := podName(pod, "")
+	sa, ns, cm := sources.serviceAccount, sources.namespace, sources.configMap
+	cfg := InjectionConfig{
+		Expiration:        sources.defaults.TokenExpiration,
+		ExpirationSource:  SourceDefaults,
+		RegionalSTS:       sources.defaults.RegionalSTS,
+		RegionalSTSSource: SourceDefaults,
+		Mode:              InjectionModeWebIdentity,
+	}
+	if sa != nil && sa.ContainerCredentials {
+		if m.ContainerCredentialsURI == "" {
+			klog.Warningf("Using web identity for sa %s/%s, container credentials are disabled", pod.Namespace, pod.Spec.ServiceAccountName)
+		} else {
+			cfg.Mode = InjectionModeContainerCredentials
+		}
+	}
+	webIdentity := cfg.Mode == InjectionModeWebIdentity
+
+	// The role of the Service Account, the namespace, or the ConfigMap
+	switch {
+	case sources.serviceAccountRole != "":
+		cfg.Role, cfg.RoleSource = sources.serviceAccountRole, SourceServiceAccount
+	case webIdentity && sa != nil && ns != nil && ns.DefaultRoleARN != "":
+		klog.V(4).Infof("Using default role %q of namespace %s for pod %s", ns.DefaultRoleARN, pod.Namespace, podID)
+		cfg.Role, cfg.RoleSource = ns.DefaultRoleARN, SourceNamespace
+	case webIdentity && cm != nil && cm.RoleARN != "":
+		klog.V(4).Infof("Using configmap role %q for sa %s/%s", cm.RoleARN, pod.Namespace, pod.Spec.ServiceAccountName)
+		cfg.Role, cfg.RoleSource = cm.RoleARN, SourceConfigMap
+	}
+	if cfg.RoleSource != SourceConfigMap {
+		if cm != nil && webIdentity && cm.RoleARN != "" && cfg.RoleSource == SourceServiceAccount && cm.RoleARN != cfg.Role {
+			configConflictCounter.WithLabelValues("role", cfg.RoleSource, SourceConfigMap).Inc()
+		}
+		cm = nil
+	}
+
+	// The audience of the Service Account, or a default audience if it is
+	// not annotated
+	switch {
+	case sa != nil && !sa.DefaultAudience:
+		cfg.Audience, cfg.AudienceSource = sa.Audience, SourceServiceAccount
+	case (sa != nil || cm != nil) && ns != nil && ns.DefaultAudience != "":
+		klog.V(4).Infof("Using default audience %q of namespace %s for pod %s", ns.DefaultAudience, pod.Namespace, podID)
+		cfg.Audience, cfg.AudienceSource = ns.DefaultAudience, SourceNamespace
+	case cm != nil && !cm.DefaultAudience:
+		cfg.Audience, cfg.AudienceSource = cm.Audience, SourceConfigMap
+	case (sa != nil || cm != nil) && sources.defaults.TokenAudience != "":
+		cfg.Audience, cfg.AudienceSource = sources.defaults.TokenAudience, SourceDefaults
+	case sa != nil:
+		cfg.Audience, cfg.AudienceSource = sa.Audience, SourceDefaults
+	case cm != nil:
+		cfg.Audience, cfg.AudienceSource = cm.Audience, SourceDefaults
+	}
+	if cm != nil && !cm.DefaultAudience && cfg.AudienceSource == SourceServiceAccount && cm.Audience != cfg.Audience {
+		configConflictCounter.WithLabelValues("audience", cfg.AudienceSource, SourceConfigMap).Inc()
+	}
+
+	// A role-arn annotation on the pod takes precedence over the other
+	// sources, the token audience is still taken from them
+	if podRole, ok := m.podAnnotation(pod, "role-arn"); ok && webIdentity {
+		if !m.AllowPodAnnotationOverride {
+			klog.V(4).Infof("Ignoring role-arn annotation on pod %s, pod annotation override is disabled", podID)
+			warnings.add(fmt.Sprintf("ignoring pod annotation %s/role-arn, pod annotation override is disabled", m.AnnotationDomain))
+		} else if cfg.Audience == "" {
+			klog.Warningf("Ignoring role-arn annotation on pod %s, service account %s not found", podID, pod.Spec.ServiceAccountName)
+			warnings.add(fmt.Sprintf("ignoring pod annotation %s/role-arn, service account %s not found", m.AnnotationDomain, pod.Spec.ServiceAccountName))
+		} else if podRole != cfg.Role {
+			klog.Warningf("Overriding role %q of service account %s/%s with pod annotation role %q for pod %s",
+				cfg.Role, pod.Namespace, pod.Spec.ServiceAccountName, podRole, podID)
+			roleOverrideCounter.WithLabelValues(pod.Namespace).Inc()
+			if cfg.RoleSource == SourceServiceAccount || cfg.RoleSource == SourceConfigMap {
+				configConflictCounter.WithLabelValues("role", SourcePodAnnotation, cfg.RoleSource).Inc()
+			}
+			cfg.Role, cfg.RoleSource = podRole, SourcePodAnnotation
+		}
+	}
+
+	// Container credentials replace the web identity env vars, the role is
+	// associated with the service account by the credentials agent
+	if !webIdentity {
+		klog.V(4).Infof("Using container credentials for pod %s with service account %s", podID, pod.Spec.ServiceAccountName)
+		cfg.Role, cfg.RoleSource = "", ""
+		cfg.Audience, cfg.AudienceSource = m.ContainerCredentialsAudience, SourceDefaults
+	}
+
+	if sa != nil && sa.TokenExpiration != 0 {
+		cfg.Expiration, cfg.ExpirationSource = sa.TokenExpiration, SourceServiceAccount
+	}
+
+	// An sts-regional-endpoints annotation takes precedence over the default,
+	// so "false" disables regional STS even when it is enabled by default
+	switch {
+	case sa != nil && sa.UseRegionalSTS != nil:
+		cfg.RegionalSTS, cfg.RegionalSTSSource = *sa.UseRegionalSTS, SourceServiceAccount
+		if cm != nil && cm.UseRegionalSTS != nil && *cm.UseRegionalSTS != cfg.RegionalSTS {
+			configConflictCounter.WithLabelValues("regional-sts", SourceServiceAccount, SourceConfigMap).Inc()
+		}
+	case cm != nil && cm.UseRegionalSTS != nil:
+		cfg.RegionalSTS, cfg.RegionalSTSSource = *cm.UseRegionalSTS, SourceConfigMap
+	}
+
+	klog.V(5).Infof("Resolved injection config of pod %s: role %q from %s, audience %q from %s, expiration %ds from %s, regional STS %t from %s, mode %s",
+		podID, cfg.Role, cfg.RoleSource, cfg.Audience, cfg.AudienceSource, cfg.Expiration, cfg.ExpirationSource,
+		cfg.RegionalSTS, cfg.RegionalSTSSource, cfg.Mode)
+	return cfg, warnings.list()
+}
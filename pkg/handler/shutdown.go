@@ -31,7 +31,7 @@ var term = syscall.SIGTERM
 // ShutdownOnTerm will wait for SIGTERM or SIGINT and gracefully shuts down the
 // http server or kill it after the specified timeout
 func ShutdownOnTerm(server *http.Server, timeout time.Duration) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, term)
 
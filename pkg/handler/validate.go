@@ -0,0 +1,126 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/amazon-eks-pod-identity-webhook/pkg/cache"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/klog"
+)
+
+const (
+	// ValidationModeDeny rejects Service Accounts with invalid annotations
+	ValidationModeDeny = "deny"
+	// ValidationModeWarn admits Service Accounts with invalid annotations
+	// with a warning for each
+	ValidationModeWarn = "warn"
+)
+
+// ValidateValidationMode returns an error if mode is not a validation mode
+func ValidateValidationMode(mode string) error {
+	switch mode {
+	case ValidationModeDeny, ValidationModeWarn:
+		return nil
+	}
+	return fmt.Errorf("invalid validation mode %q, must be %s or %s", mode, ValidationModeDeny, ValidationModeWarn)
+}
+
+// validateServiceAccount returns the errors of the annotations of sa
+func (m *Modifier) validateServiceAccount(sa *corev1.ServiceAccount) field.ErrorList {
+	var errs field.ErrorList
+	annotationsPath := field.NewPath("metadata", "annotations")
+
+	if arn, ok := cache.AnnotationValue(sa.Annotations, m.AnnotationDomain+"/role-arn"); ok {
+		if err := validateRoleARN(arn, m.AllowedPartitions); err != nil {
+			errs = append(errs, field.Invalid(annotationsPath.Key(m.AnnotationDomain+"/role-arn"), arn, err.Error()))
+		}
+	}
+	if audience, ok := cache.AnnotationValue(sa.Annotations, m.AnnotationDomain+"/audience"); ok && strings.TrimSpace(audience) == "" {
+		errs = append(errs, field.Invalid(annotationsPath.Key(m.AnnotationDomain+"/audience"), audience, "must not be empty"))
+	}
+	if expiration, ok := cache.AnnotationValue(sa.Annotations, m.AnnotationDomain+"/token-expiration"); ok {
+		if value, err := strconv.ParseInt(expiration, 10, 64); err != nil {
+			errs = append(errs, field.Invalid(annotationsPath.Key(m.AnnotationDomain+"/token-expiration"), expiration, "must be an integer number of seconds"))
+		} else if value < m.MinExpiration || value > m.MaxExpiration {
+			errs = append(errs, field.Invalid(annotationsPath.Key(m.AnnotationDomain+"/token-expiration"), expiration,
+				fmt.Sprintf("must be between %d and %d seconds", m.MinExpiration, m.MaxExpiration)))
+		}
+	}
+	if regionalSTS, ok := cache.AnnotationValue(sa.Annotations, m.AnnotationDomain+"/sts-regional-endpoints"); ok {
+		if _, ok := cache.ParseBool(regionalSTS, m.LenientBooleanAnnotations); !ok {
+			reason := "must be true or false"
+			if m.LenientBooleanAnnotations {
+				reason = "must be true, false, yes, no, on, or off"
+			}
+			errs = append(errs, field.Invalid(annotationsPath.Key(m.AnnotationDomain+"/sts-regional-endpoints"), regionalSTS, reason))
+		}
+	}
+	return errs
+}
+
+// ValidateServiceAccount takes a AdmissionReview of a Service Account,
+// validates its annotations, and returns an AdmissionResponse
+func (m *Modifier) ValidateServiceAccount(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	if ar == nil || ar.Request == nil {
+		return admissionError(validateFailurePolicy, reasonMissingRequest, http.StatusBadRequest, "bad content")
+	}
+	req := ar.Request
+
+	var sa corev1.ServiceAccount
+	if err := json.Unmarshal(req.Object.Raw, &sa); err != nil {
+		klog.Errorf("Object: %v", string(req.Object.Raw))
+		return admissionError(validateFailurePolicy, reasonUndecodableServiceAccount, http.StatusBadRequest, fmt.Sprintf("could not decode the service account: %v", err))
+	}
+	sa.Namespace = req.Namespace
+
+	errs := m.validateServiceAccount(&sa)
+	if len(errs) == 0 {
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	invalidServiceAccountCounter.WithLabelValues(m.ValidationMode, dryRunLabel(req)).Inc()
+	for _, err := range errs {
+		klog.Warningf("Invalid annotation on sa %s/%s: %v", sa.Namespace, sa.Name, err)
+	}
+
+	if m.ValidationMode == ValidationModeWarn {
+		warnings := make([]string, 0, len(errs))
+		for _, err := range errs {
+			warnings = append(warnings, err.Error())
+		}
+		return &v1beta1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: warnings,
+		}
+	}
+	status := apierrors.NewInvalid(schema.GroupKind{Kind: "ServiceAccount"}, sa.Name, errs).ErrStatus
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result:  &status,
+	}
+}
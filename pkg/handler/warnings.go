@@ -0,0 +1,64 @@
+/*
+  Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+
+  Licensed under the Apache License, Version 2.0 (the "License").
+  You may not use this file except in compliance with the License.
+  A copy of the License is located at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+  or in the "license" file accompanying this file. This file is distributed
+  on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+  express or implied. See the License for the specific language governing
+  permissions and limitations under the License.
+*/
+
+package handler
+
+import (
+	"unicode/utf8"
+)
+
+// maxWarningLength is the length the API server recommends admission warnings
+// stay under
+const maxWarningLength = 256
+
+// admissionWarnings collects the admission warnings of a request. Repeated
+// warnings are only returned once, and long warnings are truncated.
+type admissionWarnings struct {
+	seen     map[string]bool
+	warnings []string
+}
+
+// add adds a warning
+func (w *admissionWarnings) add(warning string) {
+	warning = truncateWarning(warning)
+	if w.seen[warning] {
+		return
+	}
+	if w.seen == nil {
+		w.seen = map[string]bool{}
+	}
+	w.seen[warning] = true
+	w.warnings = append(w.warnings, warning)
+}
+
+// list returns the warnings in the order they were added, or nil if there are
+// none
+func (w *admissionWarnings) list() []string {
+	return w.warnings
+}
+
+// truncateWarning shortens a warning to maxWarningLength bytes, without
+// splitting a character
+func truncateWarning(warning string) string {
+	if len(warning) <= maxWarningLength {
+		return warning
+	}
+	const ellipsis = "..."
+	cut := maxWarningLength - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(warning[cut]) {
+		cut--
+	}
+	return warning[:cut] + ellipsis
+}